@@ -6,8 +6,11 @@
 package boot
 
 import (
+	"log"
+
 	"ActivedRouter/boot/cmdline"
 	"ActivedRouter/boot/config"
+	"ActivedRouter/global"
 	"ActivedRouter/netservice"
 )
 
@@ -16,6 +19,18 @@ func init() {
 	if cmdline.ParseCmdline() {
 		//parse config file
 		config.ParseConfigfile()
+		if global.RunMode == global.ReportMode {
+			//print the daily report and exit
+			netservice.PrintReport()
+			return
+		}
+		if global.RunMode == global.CAMode {
+			//run the command of the internal CA and exit
+			if err := netservice.RunCACommand(); err != nil {
+				log.Fatalln("CA:", err)
+			}
+			return
+		}
 		//	start network
 		netservice.StartNetworkService()
 	}
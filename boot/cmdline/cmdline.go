@@ -11,6 +11,14 @@ import (
 
 func ParseCmdline() bool {
 	runmode := flag.String("runmode", "", UsageTemplate)
+	reportDate := flag.String("date", "", "date of the report,2006-01-02,yesterday if empty")
+	reportFormat := flag.String("format", ReportPlain, "format of the report,plain html or json")
+	caCommand := flag.String("cmd", "", "command of the internal CA,issue list or revoke")
+	caName := flag.String("name", "", "name of the issued certificate")
+	caType := flag.String("type", CAServer, "type of the issued certificate,server or client")
+	caSANs := flag.String("san", "", "dns names,ip addresses or emails of the issued certificate,comma separated")
+	caDays := flag.Int("days", DefaultCADays, "days the issued certificate is valid")
+	caSerial := flag.String("serial", "", "serial of the certificate to revoke")
 	flag.Parse()
 	//if not set run mode
 	if *runmode == "" {
@@ -21,12 +29,22 @@ func ParseCmdline() bool {
 	} else {
 		if strings.ToLower(*runmode) != ServerMode &&
 			strings.ToLower(*runmode) != ClientMode &&
-			strings.ToLower(*runmode) != ReverseProxyMode {
+			strings.ToLower(*runmode) != ReverseProxyMode &&
+			strings.ToLower(*runmode) != ReportMode &&
+			strings.ToLower(*runmode) != CAMode {
 			log.Println(UsageRunmodeError)
 			return false
 		} else {
 			//set run mode
 			RunMode = strings.ToLower(*runmode)
+			ReportDate = *reportDate
+			ReportFormat = *reportFormat
+			CACommand = *caCommand
+			CAName = *caName
+			CAType = *caType
+			CASANs = *caSANs
+			CADays = *caDays
+			CASerial = *caSerial
 			return true
 		}
 	}
@@ -29,6 +29,15 @@ func ParseConfigfile() {
 			netservice.DefaultHttpReverseProxy.LoadCertificateConfig(CertificateData)
 			//proxy config
 			netservice.DefaultHttpReverseProxy.LoadProxyConfig(HttpProxyConfig)
+			//tcp proxy config
+			netservice.DefaultTCPProxy.LoadTCPProxyConfig(TCPProxyConfig)
+			//hook script,certificate alerts
+			hook.ParseHookScript(HookConfig)
+		}
+	case ReportMode:
+		{
+			//statistics history
+			netservice.LoadServerJsonConfig(ServerJsonConfig)
 		}
 	case InitMode:
 		{
@@ -15,6 +15,7 @@ type Containerer interface {
 	ResetOrAddKVPair(k string, v interface{}) Containerer
 	ResetKVPairs(kvMaps map[string]interface{}) Containerer
 	ResetOrAddKVPairs(kvMaps map[string]interface{}) Containerer
+	GetValue(k string) (interface{}, bool)
 	Exist(k interface{}) bool
 	GetData() *map[string]interface{}
 }
@@ -40,9 +41,7 @@ func (self *CacheImpl) Set(k string, v interface{}) {
 
 //get
 func (self *CacheImpl) Get(k string) (interface{}, bool) {
-	mapData := *self.Driver.GetData()
-	val, ok := mapData[k]
-	return val, ok
+	return self.Driver.GetValue(k)
 }
 
 //erase
@@ -52,7 +51,6 @@ func (self *CacheImpl) Del(k string) {
 
 //has
 func (self *CacheImpl) Has(k string) bool {
-	mapData := *self.Driver.GetData()
-	_, ok := mapData[k]
+	_, ok := self.Driver.GetValue(k)
 	return ok
 }
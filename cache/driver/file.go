@@ -35,6 +35,10 @@ func (this *FileContainer) ResetOrAddKVPairs(kvMaps map[string]interface{}) Cont
 	return nil
 }
 
+func (this *FileContainer) GetValue(k string) (interface{}, bool) {
+	return nil, false
+}
+
 func (this *FileContainer) GetData() *map[string]interface{} {
 	return nil
 }
@@ -1,8 +1,14 @@
 package driver
 
+import (
+	"sync"
+)
+
 //Memory Driven Based on Map Type
+//It's safe for concurrent use,GetData returns a copy of the data
 type MapContainer struct {
-	data map[string]interface{}
+	data  map[string]interface{}
+	mutex sync.RWMutex
 }
 
 //create new map container
@@ -14,7 +20,9 @@ func (this *MapContainer) PushKVPair(k, v interface{}) Containerer {
 	if key, ok := k.(string); !ok {
 		panic("key must be string type!")
 	} else {
+		this.mutex.Lock()
 		this.data[key] = v
+		this.mutex.Unlock()
 	}
 	return this
 }
@@ -27,7 +35,9 @@ func (this *MapContainer) EraseKVPair(k interface{}) Containerer {
 	if key, ok := k.(string); !ok {
 		panic("key must be string type!")
 	} else {
+		this.mutex.Lock()
 		delete(this.data, key)
+		this.mutex.Unlock()
 	}
 	return this
 }
@@ -40,17 +50,23 @@ func (this *MapContainer) PushKVMaps(maps ...map[string]interface{}) Containerer
 	return this
 }
 func (this *MapContainer) ResetKVPair(k string, v interface{}) Containerer {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
 	if _, ok := this.data[k]; ok {
 		this.data[k] = v
 	}
 	return this
 }
 func (this *MapContainer) ResetOrAddKVPair(k string, v interface{}) Containerer {
+	this.mutex.Lock()
 	this.data[k] = v
+	this.mutex.Unlock()
 	return this
 }
 
 func (this *MapContainer) ResetKVPairs(kvMaps map[string]interface{}) Containerer {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
 	for k, v := range kvMaps {
 		if _, ok := this.data[k]; ok {
 			this.data[k] = v
@@ -60,12 +76,28 @@ func (this *MapContainer) ResetKVPairs(kvMaps map[string]interface{}) Containere
 }
 
 func (this *MapContainer) ResetOrAddKVPairs(kvMaps map[string]interface{}) Containerer {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
 	for k, v := range kvMaps {
 		this.data[k] = v
 	}
 	return this
 }
 
+func (this *MapContainer) GetValue(k string) (interface{}, bool) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	v, ok := this.data[k]
+	return v, ok
+}
+
+//snapshot of the data,changes to the returned map don't affect the container
 func (this *MapContainer) GetData() *map[string]interface{} {
-	return &this.data
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	data := make(map[string]interface{}, len(this.data))
+	for k, v := range this.data {
+		data[k] = v
+	}
+	return &data
 }
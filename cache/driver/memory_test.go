@@ -0,0 +1,32 @@
+package driver
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMapContainerConcurrent(t *testing.T) {
+	container := NewMapContainer()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := strconv.Itoa(i*100 + j)
+				container.PushKVPair(key, j)
+				container.GetValue(key)
+				container.GetData()
+				container.ResetKVPair(key, j+1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if data := *container.GetData(); len(data) != 800 {
+		t.Fatal("unexpected length", len(data))
+	}
+	if v, ok := container.GetValue("1"); !ok || v.(int) != 2 {
+		t.Fatal("unexpected value", v)
+	}
+}
@@ -34,6 +34,10 @@ func (this *MongoContainer) ResetOrAddKVPairs(kvMaps map[string]interface{}) Con
 	return nil
 }
 
+func (this *MongoContainer) GetValue(k string) (interface{}, bool) {
+	return nil, false
+}
+
 func (this *MongoContainer) GetData() *map[string]interface{} {
 	return nil
 }
@@ -34,6 +34,10 @@ func (this *MysqlContainer) ResetOrAddKVPairs(kvMaps map[string]interface{}) Con
 	return nil
 }
 
+func (this *MysqlContainer) GetValue(k string) (interface{}, bool) {
+	return nil, false
+}
+
 func (this *MysqlContainer) GetData() *map[string]interface{} {
 	return nil
 }
@@ -34,6 +34,10 @@ func (this *RedisContainer) ResetOrAddKVPairs(kvMaps map[string]interface{}) Con
 	return nil
 }
 
+func (this *RedisContainer) GetValue(k string) (interface{}, bool) {
+	return nil, false
+}
+
 func (this *RedisContainer) GetData() *map[string]interface{} {
 	return nil
 }
@@ -9,8 +9,15 @@ const (
 	HttpsProxyConfig = "config/https_proxy.json"
 	TCPProxyConfig   = "config/tcp_proxy.json"
 	CertificateData  = "config/crtdata"
+	//versions are kept beside the config file
+	ConfigVersionDir = "versions"
+	//statistics history
+	DefaultStatisticsDir = "data/statistics"
 )
 
+//number of saved versions of each config file
+const DefaultConfigVersions = 20
+
 const (
 	//http statistics interval 5min
 	Http_Statistics_Interval = 60
@@ -18,6 +25,38 @@ const (
 	HTTP_PPROF_Default_Addr = ":6060"
 	DefaultHttpAddr         = "127.0.0.1:80"
 	DefaultHttsAddr         = "127.0.0.1:443"
+	//seconds between two checks of the proxy config file
+	DefaultConfigWatchInterval = 5
+)
+
+//graceful shutdown and upgrade
+const (
+	//seconds to drain in-flight requests and connections
+	DefaultShutdownTimeout = 30
+	//listening sockets passed to the upgraded process,addresses separated by ;
+	InheritListenersEnv = "ACTIVEDROUTER_LISTENERS"
+	//fd of the pipe the upgraded process writes to once it serves the inherited sockets
+	UpgradeReadyEnv = "ACTIVEDROUTER_READY"
+	//seconds the old process waits for the upgraded one,it keeps serving if the new one isn't ready
+	DefaultUpgradeTimeout = 30
+)
+
+//reverse proxy listener timeouts(seconds) and size limits(bytes), 0 means unlimited
+//read_timeout and write_timeout are unlimited unless configured,long uploads and downloads keep working
+const (
+	DefaultProxyReadHeaderTimeout = 10
+	DefaultProxyIdleTimeout       = 120
+	DefaultProxyMaxHeaderBytes    = 1 << 20
+	DefaultProxyMaxBodyBytes      = 0
+	DefaultProxyMaxResponseBytes  = 0
+)
+
+//reasons of rejected reverse proxy requests
+const (
+	RejectHeaderTooLarge   = "header_too_large"
+	RejectBodyTooLarge     = "body_too_large"
+	RejectResponseTooLarge = "response_too_large"
+	RejectTimeout          = "timeout"
 )
 
 const (
@@ -38,18 +77,127 @@ const (
 	DefaultKey         = "server.key"
 )
 
+//access log
+const (
+	AccessLogCombined   = "combined"
+	AccessLogJson       = "json"
+	AccessLogTemplate   = "template"
+	DefaultAccessLogDir = "logs/access"
+	RequestIDHeader     = "X-Request-Id"
+)
+
+//tracing
+const (
+	DefaultTracingServiceName   = "ActivedRouter"
+	DefaultTracingBatchSize     = 512
+	DefaultTracingFlushInterval = 5
+	SpanKindServer              = 2
+	SpanStatusError             = 2
+)
+
+//top-k traffic analytics
+const (
+	TopKCapacity      = 100
+	TopKWindowMinutes = 60
+	DefaultTopKItems  = 10
+)
+
 //run mode
 const (
 	ServerMode       = "server"       //server mode
 	ClientMode       = "client"       //client mode
 	ReverseProxyMode = "reverseproxy" //reverseproxy mode
 	InitMode         = "init"         //初始化
+	ReportMode       = "report"       //print a daily report
+	CAMode           = "ca"           //issue,list and revoke certificates of the internal CA
+)
+
+//daily report
+const (
+	ReportHtml         = "html"
+	ReportPlain        = "plain"
+	ReportJson         = "json"
+	DefaultReportTime  = "08:00"
+	ReportSlowBackends = 5
 )
 
 //load balance method
 const (
-	Alived = "alived"
-	Random = "random"
+	Alived     = "alived"
+	Random     = "random"
+	RoundRobin = "roundrobin"
+	LeastConn  = "leastconn"
+)
+
+//seconds to connect a tcp proxy node
+const DefaultTCPConnectTimeout = 5
+
+//seconds to wait for the ClientHello of a connection routed by server name
+const DefaultClientHelloTimeout = 5
+
+//tcp node health check,seconds and successive results
+const (
+	DefaultTCPHealthInterval = 5
+	DefaultTCPHealthTimeout  = 3
+	DefaultTCPHealthRise     = 2
+	DefaultTCPHealthFall     = 3
+)
+
+//tcp node status
+const (
+	NodeUp        = "up"
+	NodeDown      = "down"
+	NodeUnchecked = "unchecked"
+)
+
+//udp proxy
+const (
+	DefaultUDPSessionTimeout = 60
+	DefaultUDPBufferSize     = 65535
+	MaxUDPBufferSize         = 65535
+	//sessions of a udp listener,packets of new clients are dropped above it
+	DefaultUDPMaxSessions = 4096
+)
+
+//PROXY protocol versions and the seconds to wait for the header
+const (
+	ProxyProtocolV1             = "v1"
+	ProxyProtocolV2             = "v2"
+	DefaultProxyProtocolTimeout = 5
+)
+
+//acme,days before the expiry to renew and seconds between two checks
+const (
+	DefaultACMEDirectory     = "https://acme-v02.api.letsencrypt.org/directory"
+	ACMEAccountKey           = "config/acme/account.key"
+	ACMEHttp01               = "http-01"
+	ACMETLSALPN01            = "tls-alpn-01"
+	DefaultACMERenewBefore   = 30
+	DefaultACMECheckInterval = 3600
+)
+
+//client certificate modes
+const (
+	ClientAuthRequire  = "require"
+	ClientAuthOptional = "optional"
+)
+
+//session ticket keys,seconds between two rotations and keys kept to resume the older tickets
+const (
+	DefaultTicketKeyRotation = 86400
+	MinTicketKeyRotation     = 60
+	TicketKeyCount           = 3
+)
+
+//OCSP stapling,seconds between two checks,to refresh a stapled response,to retry a failed one
+//and to wait for the responder
+const (
+	OCSPSourceResponder      = "responder"
+	OCSPSourceFile           = "file"
+	DefaultOCSPCheckInterval = 60
+	DefaultOCSPRefresh       = 3600
+	DefaultOCSPRetry         = 300
+	OCSPTimeout              = 10
 )
 
 const (
@@ -76,7 +224,43 @@ const (
 	ActiveRouter --runmode=Server  Running In Server Mode 
 	ActiveRouter --runmode=Client  Running In Client Mode
 	ActiveRouter --runmode=ReverseProxy   Running In ReserveProxy Mode
+	ActiveRouter --runmode=Report [--date=2006-01-02] [--format=plain|html|json]  Print The Daily Report
+	ActiveRouter --runmode=CA --cmd=issue --name=api [--type=server|client] [--san=api.local,10.0.0.1] [--days=365]  Issue A Certificate
+	ActiveRouter --runmode=CA --cmd=list|revoke [--serial=]  List Or Revoke The Certificates Of The Internal CA
 `
 	TheHelpTemplate   = "\033[35;1mThe Help:\033[0m\n\033[1mActiveRouter --help or  -h or -help\033[0m"
 	UsageRunmodeError = "runmode parameters error ,please reference  ActiveRouter --runmode=Client/ReverseProxy/Server"
 )
+
+//certificate check,days before the expiry to alert,seconds between two checks and two alerts of a certificate
+const (
+	DefaultCertWarnDays      = 30
+	DefaultCertCheckInterval = 43200
+	DefaultCertAlertRepeat   = 86400
+)
+
+//certificate events
+const (
+	CertExpiring = "expiring"
+	CertExpired  = "expired"
+	CertMismatch = "mismatch"
+)
+
+//internal CA,files relative to CADir
+const (
+	CADir            = "config/ca"
+	CACertificate    = "ca/ca.crt"
+	CAKey            = "ca/ca.key"
+	CAIndex          = "index.json"
+	CACRL            = "ca.crl"
+	CAIssuedDir      = "issued"
+	CAServer         = "server"
+	CAClient         = "client"
+	CAIssue          = "issue"
+	CAList           = "list"
+	CARevoke         = "revoke"
+	DefaultCADays    = 365
+	DefaultCACRLDays = 7
+	//days before the next update the CRL is signed again
+	CACRLRefreshDays = 1
+)
@@ -28,12 +28,27 @@ var RouterSysInfo string = ""
 //Run Mode
 var RunMode = ""
 
+//Date and format of the report printed in report mode
+var ReportDate = ""
+var ReportFormat = ""
+
+//Command and options of the internal CA in ca mode
+var CACommand = ""
+var CAName = ""
+var CAType = ""
+var CASANs = ""
+var CADays = 0
+var CASerial = ""
+
 //SRVMODE
 var SrvMode = "monitor"
 
 //Global http reverse proxy statistics
 var GProxyHttpStatistics = system.NewSysHttpStatistics()
 
+//Busiest clients,paths,user agents and referers of the domains
+var GProxyTopK = system.NewTrafficTopK(TopKCapacity, TopKWindowMinutes)
+
 //Read-Write Mutex
 var rwMutexRouterInfo = &sync.RWMutex{}
 
@@ -0,0 +1,86 @@
+package hook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//证书过期检查配置,hook.json 的 cert_check 项
+type CertCheckConfig struct {
+	Switch   string `json:"switch"`   //on off
+	Days     int    `json:"days"`     //距离过期少于该天数时报警
+	Interval int    `json:"interval"` //检查间隔,秒
+}
+
+//证书过期检查配置
+var GCertCheckConfig = &CertCheckConfig{Switch: global.SwitchOff, Days: global.DefaultCertWarnDays, Interval: global.DefaultCertCheckInterval}
+
+func parseCertCheckConfig(v interface{}) error {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	cfg := &CertCheckConfig{}
+	if err := json.Unmarshal(bts, cfg); err != nil {
+		return err
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	GCertCheckConfig = cfg
+	return nil
+}
+
+func (self *CertCheckConfig) validate() error {
+	if self.Switch == "" {
+		self.Switch = global.SwitchOff
+	}
+	if self.Switch != global.SwitchOn && self.Switch != global.SwitchOff {
+		return errors.New("switch must be on or off")
+	}
+	if self.Days < 0 || self.Interval < 0 {
+		return errors.New("days and interval can't be negative")
+	}
+	if self.Days == 0 {
+		self.Days = global.DefaultCertWarnDays
+	}
+	if self.Interval == 0 {
+		self.Interval = global.DefaultCertCheckInterval
+	}
+	return nil
+}
+
+//证书事件,快要过期 已经过期 或者不包含映射的域名
+type CertEvent struct {
+	Domain   string    `json:"domain"`
+	Kind     string    `json:"kind"`
+	Sources  []string  `json:"sources"` //https 服务中的证书 或者 config/crtdata 中的文件
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	SANs     []string  `json:"sans"`
+	NotAfter time.Time `json:"not_after"`
+	DaysLeft int       `json:"days_left"`
+}
+
+//处理证书事件,和 disk mem 报警一样记录并发送邮件
+func ProcessCertEvent(hostip string, event *CertEvent) {
+	var tipinfo string
+	notAfter := event.NotAfter.Format("2006-01-02 15:04:05")
+	switch event.Kind {
+	case global.CertExpiring:
+		tipinfo = fmt.Sprintf("域名 %s 的证书将在 %d 天后过期(%s)", event.Domain, event.DaysLeft, notAfter)
+	case global.CertExpired:
+		tipinfo = fmt.Sprintf("域名 %s 的证书已于 %s 过期", event.Domain, notAfter)
+	case global.CertMismatch:
+		tipinfo = fmt.Sprintf("域名 %s 的证书不包含该域名,证书域名:%s", event.Domain, strings.Join(event.SANs, ","))
+	default:
+		return
+	}
+	bts, _ := json.MarshalIndent(event, "", " ")
+	sendNotifyContent("ActivedRouter 证书警报", hostip, tipinfo, string(bts))
+}
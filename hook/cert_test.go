@@ -0,0 +1,25 @@
+package hook
+
+import (
+	"testing"
+
+	"ActivedRouter/global"
+)
+
+func TestCertCheckConfig(t *testing.T) {
+	for _, cfg := range []map[string]interface{}{
+		{"switch": "yes"},
+		{"days": -1},
+		{"interval": "1h"},
+	} {
+		if parseCertCheckConfig(cfg) == nil {
+			t.Fatal("invalid config accepted", cfg)
+		}
+	}
+	if err := parseCertCheckConfig(map[string]interface{}{"switch": "on", "days": 14}); err != nil {
+		t.Fatal(err)
+	}
+	if GCertCheckConfig.Days != 14 || GCertCheckConfig.Interval != global.DefaultCertCheckInterval {
+		t.Fatalf("unexpected config %+v", GCertCheckConfig)
+	}
+}
@@ -7,7 +7,7 @@ package hook
 
 import (
 	"ActivedRouter/global"
-	_ "ActivedRouter/system"
+	"ActivedRouter/system"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -17,6 +17,7 @@ import (
 	"net/smtp"
 	"os"
 	"strings"
+	"time"
 )
 
 //钩子脚本
@@ -28,6 +29,9 @@ var GEventQueue = NewEventQueue()
 //syntax
 var GScriptSyntax = NewDefaultSyntax()
 
+//报警记录,设置后每次触发的报警都会保存,用于每日报告
+var AlertRecorder func(alert *system.AlertRecord)
+
 //load HOOK script
 func loadHookScript(routerFile string) {
 	file, err := os.Open(routerFile)
@@ -85,6 +89,18 @@ func ParseHookScript(configfile string) {
 			}
 		}
 	}
+	//每日报告
+	if v, ok := _hookScript["report"]; ok {
+		if err := parseReportConfig(v); err != nil {
+			log.Fatalln("Report Config Error :", err.Error())
+		}
+	}
+	//证书过期检查
+	if v, ok := _hookScript["cert_check"]; ok {
+		if err := parseCertCheckConfig(v); err != nil {
+			log.Fatalln("Cert Check Config Error :", err.Error())
+		}
+	}
 	scriptList := _hookScript["script"]
 	eventList := scriptList.([]interface{})
 	for _, event := range eventList {
@@ -169,6 +185,9 @@ func sendNotifyContent(subject, hostip, info, sysinfo string) {
 	data.INFO = info
 	data.SYSINFO = sysinfo
 	template.Execute(buffer, &data)
+	if AlertRecorder != nil {
+		AlertRecorder(&system.AlertRecord{Timestamp: time.Now().Unix(), Host: hostip, Subject: subject, Info: info})
+	}
 	//发送通知邮件到管理员邮箱
 	SendEmailTo(GEventQueue.EmailUser, GEventQueue.EmailPwd, GEventQueue.SmtpHost, GEventQueue.EmailTo, subject, string(buffer.Bytes()), "html")
 }
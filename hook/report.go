@@ -0,0 +1,97 @@
+package hook
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//每日报告配置,hook.json 的 report 项
+type ReportConfig struct {
+	Switch     string `json:"switch"`     //on off
+	Time       string `json:"time"`       //每天发送的时间 15:04,本地时间
+	Recipients string `json:"recipients"` //收件人,分号分隔,为空时发送给 emailto
+	Format     string `json:"format"`     //html plain json
+	Webhook    string `json:"webhook"`    //json 格式报告的接收地址
+}
+
+//每日报告配置
+var GReportConfig = &ReportConfig{Switch: global.SwitchOff, Time: global.DefaultReportTime, Format: global.ReportHtml}
+
+func parseReportConfig(v interface{}) error {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	cfg := &ReportConfig{}
+	if err := json.Unmarshal(bts, cfg); err != nil {
+		return err
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	GReportConfig = cfg
+	return nil
+}
+
+func (self *ReportConfig) validate() error {
+	if self.Switch == "" {
+		self.Switch = global.SwitchOff
+	}
+	if self.Switch != global.SwitchOn && self.Switch != global.SwitchOff {
+		return errors.New("switch must be on or off")
+	}
+	if self.Time == "" {
+		self.Time = global.DefaultReportTime
+	}
+	if _, err := time.Parse("15:04", self.Time); err != nil {
+		return errors.New("time must be like 08:00")
+	}
+	if self.Format == "" {
+		self.Format = global.ReportHtml
+	}
+	switch self.Format {
+	case global.ReportHtml, global.ReportPlain:
+	case global.ReportJson:
+		if u, err := url.Parse(self.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("json report needs a http webhook")
+		}
+	default:
+		return errors.New("unknown report format " + self.Format)
+	}
+	return nil
+}
+
+//下一次发送报告的时间
+func (self *ReportConfig) NextRun(now time.Time) time.Time {
+	at, _ := time.Parse("15:04", self.Time)
+	next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+//报告的收件人
+func (self *ReportConfig) recipients() string {
+	if strings.TrimSpace(self.Recipients) != "" {
+		return self.Recipients
+	}
+	return GEventQueue.EmailTo
+}
+
+//通过钩子脚本的smtp配置发送报告邮件
+func SendReportEmail(subject, body, mailtype string) error {
+	if !GEventQueue.EmailOpen {
+		return errors.New("email is not open in hook config")
+	}
+	to := GReportConfig.recipients()
+	if to == "" {
+		return errors.New("no report recipients")
+	}
+	return SendEmailTo(GEventQueue.EmailUser, GEventQueue.EmailPwd, GEventQueue.SmtpHost, to, subject, body, mailtype)
+}
@@ -0,0 +1,34 @@
+package hook
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReportConfig(t *testing.T) {
+	for _, cfg := range []map[string]interface{}{
+		{"switch": "yes"},
+		{"time": "8"},
+		{"format": "pdf"},
+		{"format": "json"},
+		{"format": "json", "webhook": "ftp://example.com"},
+	} {
+		if parseReportConfig(cfg) == nil {
+			t.Fatal("invalid config accepted", cfg)
+		}
+	}
+	if err := parseReportConfig(map[string]interface{}{"switch": "on", "format": "json", "webhook": "http://127.0.0.1/report"}); err != nil {
+		t.Fatal(err)
+	}
+	if GReportConfig.Time != "08:00" {
+		t.Fatal("default time not set")
+	}
+	now := time.Date(2026, 10, 19, 9, 0, 0, 0, time.Local)
+	if next := GReportConfig.NextRun(now); !next.Equal(time.Date(2026, 10, 20, 8, 0, 0, 0, time.Local)) {
+		t.Fatal("unexpected next run", next)
+	}
+	GReportConfig.Time = "23:30"
+	if next := GReportConfig.NextRun(now); !next.Equal(time.Date(2026, 10, 19, 23, 30, 0, 0, time.Local)) {
+		t.Fatal("unexpected next run", next)
+	}
+}
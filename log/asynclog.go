@@ -0,0 +1,157 @@
+package log
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Default number of lines waiting to be written
+const DefaultAsyncBufferLines = 4096
+
+//Asynchronous line logger with size and daily rotation
+//Write never blocks the caller,lines are dropped when the buffer is full
+type AsyncLogger struct {
+	filename string
+	//rotate when the file is larger than maxSize bytes,0 means never
+	maxSize int64
+	//rotate when the day changes
+	daily bool
+	lines chan []byte
+	done  chan struct{}
+	//guards closed
+	mutex   sync.RWMutex
+	closed  bool
+	dropped int64
+	//only used by the writer goroutine
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	day    string
+}
+
+//Create the logger and start the writer goroutine
+func NewAsyncLogger(filename string, maxSize int64, daily bool, bufferLines int) (*AsyncLogger, error) {
+	if bufferLines <= 0 {
+		bufferLines = DefaultAsyncBufferLines
+	}
+	self := &AsyncLogger{
+		filename: filename,
+		maxSize:  maxSize,
+		daily:    daily,
+		lines:    make(chan []byte, bufferLines),
+		done:     make(chan struct{}),
+	}
+	if err := self.openFile(); err != nil {
+		return nil, err
+	}
+	go self.run()
+	return self, nil
+}
+
+//Queue a line,the line must end with a newline
+func (self *AsyncLogger) Write(line []byte) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if self.closed {
+		return
+	}
+	select {
+	case self.lines <- line:
+	default:
+		atomic.AddInt64(&self.dropped, 1)
+	}
+}
+
+//Number of lines dropped because the buffer was full
+func (self *AsyncLogger) Dropped() int64 {
+	return atomic.LoadInt64(&self.dropped)
+}
+
+//Write the queued lines and close the file
+func (self *AsyncLogger) Close() {
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return
+	}
+	self.closed = true
+	close(self.lines)
+	self.mutex.Unlock()
+	<-self.done
+}
+
+func (self *AsyncLogger) run() {
+	defer close(self.done)
+	for line := range self.lines {
+		self.rotate(int64(len(line)))
+		if n, err := self.writer.Write(line); err == nil {
+			self.size += int64(n)
+		}
+		//flush when idle
+		if len(self.lines) == 0 {
+			self.writer.Flush()
+		}
+	}
+	self.writer.Flush()
+	self.file.Close()
+}
+
+func (self *AsyncLogger) openFile() error {
+	if err := os.MkdirAll(filepath.Dir(self.filename), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(self.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	self.file = file
+	self.writer = bufio.NewWriter(file)
+	self.size = info.Size()
+	self.day = info.ModTime().Format("2006-01-02")
+	if info.Size() == 0 {
+		self.day = time.Now().Format("2006-01-02")
+	}
+	return nil
+}
+
+//Rename the current file and open a new one
+//access.log is renamed to access.log.2006-01-02 on a new day,
+//to access.log.20060102-150405 when it is too large
+func (self *AsyncLogger) rotate(next int64) {
+	now := time.Now()
+	var suffix string
+	if self.daily && now.Format("2006-01-02") != self.day {
+		suffix = self.day
+	} else if self.maxSize > 0 && self.size > 0 && self.size+next > self.maxSize {
+		suffix = now.Format("20060102-150405")
+	} else {
+		return
+	}
+	self.writer.Flush()
+	self.file.Close()
+	rotated := self.filename + "." + suffix
+	//several rotations in the same second
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = self.filename + "." + suffix + "." + strconv.Itoa(i)
+	}
+	os.Rename(self.filename, rotated)
+	if err := self.openFile(); err != nil {
+		//keep writing to a discarded file rather than crash the writer
+		self.file, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		self.writer = bufio.NewWriter(self.file)
+	}
+	self.day = now.Format("2006-01-02")
+}
@@ -0,0 +1,40 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAsyncLoggerRotate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "asynclog")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "access.log")
+	logger, err := NewAsyncLogger(file, 100, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		logger.Write([]byte(strings.Repeat("x", 39) + "\n"))
+	}
+	logger.Close()
+	//Write after Close is ignored
+	logger.Write([]byte("x\n"))
+	infos, _ := ioutil.ReadDir(dir)
+	//two lines per file
+	if len(infos) != 5 {
+		t.Fatal("unexpected file count", len(infos))
+	}
+	total := int64(0)
+	for _, info := range infos {
+		if info.Size() > 100 {
+			t.Fatal("file too large", info.Name(), info.Size())
+		}
+		total += info.Size()
+	}
+	if total != 400 {
+		t.Fatal("lines lost", total)
+	}
+}
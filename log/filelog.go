@@ -18,13 +18,13 @@ type MyLogger struct {
 
 //正常日志输出
 func (this *MyLogger) LogOut(msg ...interface{}) {
-	this.loger.Println(msg)
+	this.loger.Println(msg...)
 
 }
 
 //打印错误
 func (this *MyLogger) LogErr(msg ...interface{}) {
-	this.loger.Fatalln(msg)
+	this.loger.Fatalln(msg...)
 }
 
 //创建日志
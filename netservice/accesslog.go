@@ -0,0 +1,343 @@
+package netservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"ActivedRouter/global"
+	routerlog "ActivedRouter/log"
+)
+
+//Access log config,the global one is the default of every domain
+//Dir,MaxSize,DailyRotate and BufferLines are global only
+type AccessLogConfig struct {
+	//on off
+	Switch string `json:"switch,omitempty"`
+	//logs are written to dir/<domain>.log
+	Dir string `json:"dir,omitempty"`
+	//combined json template
+	Format   string `json:"format,omitempty"`
+	Template string `json:"template,omitempty"`
+	//rotate size in MB,0 means no size rotation
+	MaxSize int64 `json:"max_size,omitempty"`
+	//on off
+	DailyRotate string `json:"daily_rotate,omitempty"`
+	//fraction of the requests logged,server errors are always logged
+	SampleRate  float64 `json:"sample_rate,omitempty"`
+	BufferLines int     `json:"buffer_lines,omitempty"`
+}
+
+//A logged request
+type accessRecord struct {
+	Time           time.Time `json:"time"`
+	RemoteAddr     string    `json:"remote_addr"`
+	Host           string    `json:"host"`
+	Method         string    `json:"method"`
+	URI            string    `json:"uri"`
+	Proto          string    `json:"proto"`
+	Status         int       `json:"status"`
+	BytesIn        int64     `json:"bytes_in"`
+	BytesOut       int64     `json:"bytes_out"`
+	Referer        string    `json:"referer"`
+	UserAgent      string    `json:"user_agent"`
+	Latency        float64   `json:"latency"`
+	Upstream       string    `json:"upstream"`
+	UpstreamStatus int       `json:"upstream_status"`
+	RequestID      string    `json:"request_id"`
+	//request body read by the transport goroutine
+	body *countBody
+}
+
+//Access log of a domain in the routing table
+type domainAccessLog struct {
+	format     string
+	template   *template.Template
+	sampleRate float64
+	logger     *routerlog.AsyncLogger
+}
+
+//Open loggers by file name and rotation settings,kept across routing table swaps
+var (
+	accessLoggers     = make(map[string]*routerlog.AsyncLogger)
+	accessLoggerMutex sync.Mutex
+)
+
+//Check the access log settings
+func (self *AccessLogConfig) validate() error {
+	if self == nil {
+		return nil
+	}
+	if !validSwitch(self.Switch) || !validSwitch(self.DailyRotate) {
+		return errors.New("access_log: switch must be on or off")
+	}
+	switch self.Format {
+	case "", global.AccessLogCombined, global.AccessLogJson:
+	case global.AccessLogTemplate:
+		if _, err := template.New("access_log").Parse(self.Template); err != nil {
+			return fmt.Errorf("access_log: %s", err.Error())
+		}
+	default:
+		return fmt.Errorf("access_log: unknown format %s", self.Format)
+	}
+	if self.SampleRate < 0 || self.SampleRate > 1 {
+		return errors.New("access_log: sample_rate must be between 0 and 1")
+	}
+	if self.MaxSize < 0 || self.BufferLines < 0 {
+		return errors.New("access_log: max_size and buffer_lines can't be negative")
+	}
+	return nil
+}
+
+//Merge the domain settings with the global ones,return nil if the log is off
+func newDomainAccessLog(cfg *ReverseProxyConfigData, node *LbNode) *domainAccessLog {
+	defaults := cfg.AccessLog
+	if defaults == nil {
+		defaults = &AccessLogConfig{}
+	}
+	merged := *defaults
+	if node.AccessLog != nil {
+		if node.AccessLog.Switch != "" {
+			merged.Switch = node.AccessLog.Switch
+		}
+		if node.AccessLog.Format != "" {
+			merged.Format = node.AccessLog.Format
+			merged.Template = node.AccessLog.Template
+		}
+		if node.AccessLog.SampleRate > 0 {
+			merged.SampleRate = node.AccessLog.SampleRate
+		}
+	}
+	if merged.Switch != global.SwitchOn {
+		return nil
+	}
+	accessLog := &domainAccessLog{format: merged.Format, sampleRate: merged.SampleRate}
+	if accessLog.format == "" {
+		accessLog.format = global.AccessLogCombined
+	}
+	if accessLog.sampleRate == 0 {
+		accessLog.sampleRate = 1
+	}
+	if accessLog.format == global.AccessLogTemplate {
+		//validated before
+		accessLog.template = template.Must(template.New(node.Domain).Parse(merged.Template))
+	}
+	dir := merged.Dir
+	if dir == "" {
+		dir = global.DefaultAccessLogDir
+	}
+	logger, err := openAccessLogger(filepath.Join(dir, node.Domain+".log"), &merged)
+	if err != nil {
+		log.Println("Open access log error:", err)
+		return nil
+	}
+	accessLog.logger = logger
+	return accessLog
+}
+
+//Get the logger of the file,open it on first use or when the settings changed,
+//the logger of the old settings is closed with the old routing table
+func openAccessLogger(filename string, cfg *AccessLogConfig) (*routerlog.AsyncLogger, error) {
+	key := fmt.Sprintf("%s|%d|%s|%d", filename, cfg.MaxSize, cfg.DailyRotate, cfg.BufferLines)
+	accessLoggerMutex.Lock()
+	defer accessLoggerMutex.Unlock()
+	if logger, ok := accessLoggers[key]; ok {
+		return logger, nil
+	}
+	logger, err := routerlog.NewAsyncLogger(filename, cfg.MaxSize*1024*1024, cfg.DailyRotate == global.SwitchOn, cfg.BufferLines)
+	if err != nil {
+		return nil, err
+	}
+	accessLoggers[key] = logger
+	return logger, nil
+}
+
+//Close the loggers no longer used by the routing table
+func closeUnusedAccessLoggers(table *routingTable) {
+	used := make(map[*routerlog.AsyncLogger]bool)
+	for _, route := range table.Domains {
+		if route.AccessLog != nil {
+			used[route.AccessLog.logger] = true
+		}
+	}
+	accessLoggerMutex.Lock()
+	defer accessLoggerMutex.Unlock()
+	for key, logger := range accessLoggers {
+		if !used[logger] {
+			delete(accessLoggers, key)
+			//requests still holding the old table drop their lines
+			go logger.Close()
+		}
+	}
+}
+
+//Flush and close all access logs
+func CloseAccessLoggers() {
+	accessLoggerMutex.Lock()
+	loggers := accessLoggers
+	accessLoggers = make(map[string]*routerlog.AsyncLogger)
+	accessLoggerMutex.Unlock()
+	for _, logger := range loggers {
+		logger.Close()
+	}
+}
+
+//Decide whether the request is logged
+func (self *domainAccessLog) sampled(record *accessRecord) bool {
+	if self.sampleRate >= 1 || record.Status >= http.StatusInternalServerError {
+		return true
+	}
+	return rand.Float64() < self.sampleRate
+}
+
+//Format and queue the record
+func (self *domainAccessLog) log(record *accessRecord) {
+	if !self.sampled(record) {
+		return
+	}
+	var buf bytes.Buffer
+	switch self.format {
+	case global.AccessLogJson:
+		json.NewEncoder(&buf).Encode(record)
+	case global.AccessLogTemplate:
+		if err := self.template.Execute(&buf, record); err != nil {
+			return
+		}
+		if buf.Len() == 0 || buf.Bytes()[buf.Len()-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	default:
+		writeCombined(&buf, record)
+	}
+	self.logger.Write(buf.Bytes())
+}
+
+//Client address without the port
+func (self *accessRecord) clientIP() string {
+	host, _, err := net.SplitHostPort(self.RemoteAddr)
+	if err != nil {
+		return self.RemoteAddr
+	}
+	return host
+}
+
+//NCSA combined format followed by the proxy fields
+func writeCombined(buf *bytes.Buffer, record *accessRecord) {
+	host := record.clientIP()
+	upstreamStatus := "-"
+	if record.UpstreamStatus > 0 {
+		upstreamStatus = strconv.Itoa(record.UpstreamStatus)
+	}
+	fmt.Fprintf(buf, "%s - - [%s] %q %d %d %q %q rt=%.3f upstream=%s upstream_status=%s bytes_in=%d request_id=%s\n",
+		host,
+		record.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		record.Method+" "+record.URI+" "+record.Proto,
+		record.Status,
+		record.BytesOut,
+		orDash(record.Referer),
+		orDash(record.UserAgent),
+		record.Latency,
+		orDash(record.Upstream),
+		upstreamStatus,
+		record.BytesIn,
+		orDash(record.RequestID))
+}
+
+func orDash(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "-"
+	}
+	return value
+}
+
+//Response writer recording the status and the bytes sent to the client
+type accessResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (self *accessResponseWriter) WriteHeader(status int) {
+	if self.status == 0 {
+		self.status = status
+	}
+	self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *accessResponseWriter) Write(p []byte) (int, error) {
+	if self.status == 0 {
+		self.status = http.StatusOK
+	}
+	n, err := self.ResponseWriter.Write(p)
+	self.bytes += int64(n)
+	return n, err
+}
+
+func (self *accessResponseWriter) Flush() {
+	if flusher, ok := self.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//Used by http.ResponseController to reach the hijacker of upgraded connections
+func (self *accessResponseWriter) Unwrap() http.ResponseWriter {
+	return self.ResponseWriter
+}
+
+//Request body wrapper counting the bytes received from the client
+type countBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (self *countBody) Read(p []byte) (int, error) {
+	n, err := self.ReadCloser.Read(p)
+	atomic.AddInt64(&self.bytes, int64(n))
+	return n, err
+}
+
+//Start recording the request,the returned writer must be used for the response
+func startAccessRecord(w http.ResponseWriter, r *http.Request) (*accessRecord, *accessResponseWriter) {
+	record := &accessRecord{
+		Time:       time.Now(),
+		RemoteAddr: r.RemoteAddr,
+		Host:       r.Host,
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		Proto:      r.Proto,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		RequestID:  requestID(r),
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		record.body = &countBody{ReadCloser: r.Body}
+		r.Body = record.body
+	}
+	return record, &accessResponseWriter{ResponseWriter: w}
+}
+
+//Complete the record when the response has been written
+func (self *accessRecord) finish(w *accessResponseWriter) {
+	self.Status = w.status
+	if self.Status == 0 {
+		self.Status = http.StatusOK
+	}
+	self.BytesOut = w.bytes
+	if self.body != nil {
+		self.BytesIn = atomic.LoadInt64(&self.body.bytes)
+	}
+	self.Latency = time.Since(self.Time).Seconds()
+}
@@ -0,0 +1,103 @@
+package netservice
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	backendUrl, _ := url.Parse(backend.URL)
+
+	dir, _ := ioutil.TempDir("", "accesslog")
+	defer os.RemoveAll(dir)
+	cfg := &ReverseProxyConfigData{
+		GlobalHttpSwitch: "on",
+		AccessLog:        &AccessLogConfig{Switch: "on", Dir: dir},
+		ReverseProxy: []*LbNode{
+			{Domain: "www.abc.com", HttpSwitch: "on", Clients: []*HostInfo{{Host: backendUrl.Hostname(), Port: backendUrl.Port()}}},
+			{Domain: "www.abcd.com", HttpSwitch: "on", Clients: []*HostInfo{{Host: backendUrl.Hostname(), Port: backendUrl.Port()}},
+				AccessLog: &AccessLogConfig{Format: "json"}},
+			{Domain: "www.abcde.com", HttpSwitch: "on", Clients: []*HostInfo{{Host: backendUrl.Hostname(), Port: backendUrl.Port()}},
+				AccessLog: &AccessLogConfig{Format: "template", Template: "{{.Host}} {{.Status}} {{.UpstreamStatus}}"}},
+		},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.setDefaults()
+	proxy := NewReverseProxy()
+	proxy.applyProxyConfig(cfg, "")
+	for _, domain := range []string{"www.abc.com", "www.abcd.com", "www.abcde.com"} {
+		r := httptest.NewRequest("POST", "http://"+domain+"/path?q=1", strings.NewReader("body"))
+		r.RequestURI = "/path?q=1"
+		r.Header.Set("X-Request-Id", "req-1")
+		proxy.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	CloseAccessLoggers()
+
+	combined, _ := ioutil.ReadFile(filepath.Join(dir, "www.abc.com.log"))
+	if !strings.Contains(string(combined), `"POST /path?q=1 HTTP/1.1" 201 5`) ||
+		!strings.Contains(string(combined), "upstream="+backendUrl.Host+" upstream_status=201 bytes_in=4 request_id=req-1") {
+		t.Fatal("unexpected combined log", string(combined))
+	}
+	bts, _ := ioutil.ReadFile(filepath.Join(dir, "www.abcd.com.log"))
+	record := &accessRecord{}
+	if err := json.Unmarshal(bts, record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != 201 || record.BytesIn != 4 || record.BytesOut != 5 || record.Upstream != backendUrl.Host {
+		t.Fatal("unexpected json log", string(bts))
+	}
+	bts, _ = ioutil.ReadFile(filepath.Join(dir, "www.abcde.com.log"))
+	if string(bts) != "www.abcde.com 201 201\n" {
+		t.Fatal("unexpected template log", string(bts))
+	}
+}
+
+func TestAccessLogValidate(t *testing.T) {
+	for _, cfg := range []*AccessLogConfig{
+		{Format: "xml"},
+		{Format: "template", Template: "{{.Host"},
+		{SampleRate: 2},
+		{Switch: "yes"},
+	} {
+		if cfg.validate() == nil {
+			t.Fatal("invalid config accepted", *cfg)
+		}
+	}
+}
+
+func TestAccessLoggerSettings(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "accesslog")
+	defer os.RemoveAll(dir)
+	defer CloseAccessLoggers()
+	proxy := NewReverseProxy()
+	logger := func(maxSize int64) interface{} {
+		cfg := &ReverseProxyConfigData{
+			AccessLog:    &AccessLogConfig{Switch: "on", Dir: dir, MaxSize: maxSize},
+			ReverseProxy: []*LbNode{{Domain: "www.abc.com"}},
+		}
+		proxy.applyProxyConfig(cfg, "")
+		return proxy.table().Domains["www.abc.com"].AccessLog.logger
+	}
+	first := logger(1)
+	if logger(1) != first {
+		t.Fatal("logger reopened with the same settings")
+	}
+	if logger(2) == first {
+		t.Fatal("logger kept after max_size changed")
+	}
+}
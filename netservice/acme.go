@@ -0,0 +1,472 @@
+package netservice
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"ActivedRouter/tools"
+)
+
+//ALPN protocol and certificate extension of the tls-alpn-01 challenge
+const acmeALPNProto = "acme-tls/1"
+
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+//RFC 8555 directory
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+//RFC 7807 error returned by the server
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (self *acmeProblem) Error() string {
+	return fmt.Sprintf("acme: %s %s", self.Type, self.Detail)
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	url            string
+	Status         string           `json:"status"`
+	Identifiers    []acmeIdentifier `json:"identifiers"`
+	Authorizations []string         `json:"authorizations"`
+	Finalize       string           `json:"finalize"`
+	Certificate    string           `json:"certificate"`
+	Error          *acmeProblem     `json:"error"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string           `json:"status"`
+	Identifier acmeIdentifier   `json:"identifier"`
+	Challenges []*acmeChallenge `json:"challenges"`
+}
+
+//Answers the challenges of an order,cleanup is called when the authorization is done
+type acmeSolver interface {
+	present(domain, token, keyAuth string) error
+	cleanup(domain, token string)
+}
+
+//ACME client of one account
+type acmeClient struct {
+	directoryURL string
+	httpClient   *http.Client
+	key          *ecdsa.PrivateKey
+	//account url,sent as kid after the account is registered
+	kid        string
+	dir        *acmeDirectory
+	nonceMutex sync.Mutex
+	nonces     []string
+	//seconds between two polls of an order or authorization and the limit of the wait
+	pollInterval time.Duration
+	pollTimeout  time.Duration
+}
+
+func newACMEClient(directoryURL string, key *ecdsa.PrivateKey, httpClient *http.Client) *acmeClient {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &acmeClient{
+		directoryURL: directoryURL,
+		httpClient:   httpClient,
+		key:          key,
+		pollInterval: time.Second,
+		pollTimeout:  2 * time.Minute,
+	}
+}
+
+func (self *acmeClient) discover() error {
+	if self.dir != nil {
+		return nil
+	}
+	resp, err := self.httpClient.Get(self.directoryURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("acme directory %s: %s", self.directoryURL, resp.Status)
+	}
+	dir := &acmeDirectory{}
+	if err := json.NewDecoder(resp.Body).Decode(dir); err != nil {
+		return err
+	}
+	if dir.NewNonce == "" || dir.NewAccount == "" || dir.NewOrder == "" {
+		return fmt.Errorf("acme directory %s is incomplete", self.directoryURL)
+	}
+	self.dir = dir
+	return nil
+}
+
+//A nonce saved from an earlier response or a new one
+func (self *acmeClient) nonce() (string, error) {
+	self.nonceMutex.Lock()
+	if n := len(self.nonces); n > 0 {
+		nonce := self.nonces[n-1]
+		self.nonces = self.nonces[:n-1]
+		self.nonceMutex.Unlock()
+		return nonce, nil
+	}
+	self.nonceMutex.Unlock()
+	resp, err := self.httpClient.Head(self.dir.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("acme: no nonce returned")
+	}
+	return nonce, nil
+}
+
+func (self *acmeClient) saveNonce(resp *http.Response) {
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		self.nonceMutex.Lock()
+		self.nonces = append(self.nonces, nonce)
+		self.nonceMutex.Unlock()
+	}
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+//Public key of the account as a JWK,the members in lexical order for the thumbprint
+func (self *acmeClient) jwk() string {
+	size := (self.key.Curve.Params().BitSize + 7) / 8
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+		b64(self.key.X.FillBytes(make([]byte, size))), b64(self.key.Y.FillBytes(make([]byte, size))))
+}
+
+//RFC 7638 thumbprint of the account key
+func (self *acmeClient) thumbprint() string {
+	sum := sha256.Sum256([]byte(self.jwk()))
+	return b64(sum[:])
+}
+
+func (self *acmeClient) keyAuthorization(token string) string {
+	return token + "." + self.thumbprint()
+}
+
+//Flattened JWS signed with ES256,payload nil for POST-as-GET
+func (self *acmeClient) signJWS(url, nonce string, payload interface{}) ([]byte, error) {
+	protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+	if self.kid != "" {
+		protected["kid"] = self.kid
+	} else {
+		protected["jwk"] = json.RawMessage(self.jwk())
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	body := ""
+	if payload != nil {
+		bts, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = b64(bts)
+	}
+	signingInput := b64(header) + "." + body
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, self.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return json.Marshal(map[string]string{"protected": b64(header), "payload": body, "signature": b64(signature)})
+}
+
+//Signed POST,retried once with a new nonce when the server rejects the nonce
+func (self *acmeClient) post(url string, payload interface{}, result interface{}) (*http.Response, []byte, error) {
+	for retry := 0; ; retry++ {
+		nonce, err := self.nonce()
+		if err != nil {
+			return nil, nil, err
+		}
+		jws, err := self.signJWS(url, nonce, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := self.httpClient.Post(url, "application/jose+json", bytes.NewReader(jws))
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		self.saveNonce(resp)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode >= 400 {
+			problem := &acmeProblem{Status: resp.StatusCode}
+			if json.Unmarshal(body, problem) != nil || problem.Type == "" {
+				problem.Type = resp.Status
+				problem.Detail = string(body)
+			}
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && retry == 0 {
+				continue
+			}
+			return resp, body, problem
+		}
+		if result != nil {
+			if err := json.Unmarshal(body, result); err != nil {
+				return resp, body, err
+			}
+		}
+		return resp, body, nil
+	}
+}
+
+//Create the account or look up the existing one of the key
+func (self *acmeClient) register(email string) error {
+	if err := self.discover(); err != nil {
+		return err
+	}
+	if self.kid != "" {
+		return nil
+	}
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	resp, _, err := self.post(self.dir.NewAccount, account, nil)
+	if err != nil {
+		return err
+	}
+	if self.kid = resp.Header.Get("Location"); self.kid == "" {
+		return errors.New("acme: no account url returned")
+	}
+	return nil
+}
+
+//Seconds from the Retry-After header or the default interval
+func (self *acmeClient) retryAfter(resp *http.Response) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		if wait := time.Duration(seconds) * time.Second; wait < self.pollTimeout {
+			return wait
+		}
+	}
+	return self.pollInterval
+}
+
+//Poll the url until the status is not one of pending
+func (self *acmeClient) poll(url string, result interface{}, status func() string, pending ...string) error {
+	deadline := time.Now().Add(self.pollTimeout)
+	for {
+		resp, _, err := self.post(url, nil, result)
+		if err != nil {
+			return err
+		}
+		current := status()
+		waiting := false
+		for _, v := range pending {
+			waiting = waiting || current == v
+		}
+		if !waiting {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("acme: %s still %s", url, current)
+		}
+		time.Sleep(self.retryAfter(resp))
+	}
+}
+
+//Authorize the domains of a new order with the challenge type,
+//returns the certificate chain and the key in PEM
+func (self *acmeClient) obtain(domains []string, challengeType string, solver acmeSolver) ([]byte, []byte, error) {
+	identifiers := make([]acmeIdentifier, 0, len(domains))
+	for _, domain := range domains {
+		identifiers = append(identifiers, acmeIdentifier{Type: "dns", Value: domain})
+	}
+	order := &acmeOrder{}
+	resp, _, err := self.post(self.dir.NewOrder, map[string]interface{}{"identifiers": identifiers}, order)
+	if err != nil {
+		return nil, nil, err
+	}
+	if order.url = resp.Header.Get("Location"); order.url == "" {
+		return nil, nil, errors.New("acme: no order url returned")
+	}
+	for _, url := range order.Authorizations {
+		if err := self.authorize(url, challengeType, solver); err != nil {
+			return nil, nil, err
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := self.poll(order.url, order, func() string { return order.Status }, "pending"); err != nil {
+		return nil, nil, err
+	}
+	if order.Status == "ready" {
+		if _, _, err := self.post(order.Finalize, map[string]string{"csr": b64(csr)}, order); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := self.poll(order.url, order, func() string { return order.Status }, "ready", "processing"); err != nil {
+		return nil, nil, err
+	}
+	if order.Status != "valid" {
+		if order.Error != nil {
+			return nil, nil, order.Error
+		}
+		return nil, nil, fmt.Errorf("acme: order %s is %s", order.url, order.Status)
+	}
+	_, chain, err := self.post(order.Certificate, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+//Answer the challenge of the type and wait until the authorization is valid
+func (self *acmeClient) authorize(url, challengeType string, solver acmeSolver) error {
+	authz := &acmeAuthorization{}
+	if _, _, err := self.post(url, nil, authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	var challenge *acmeChallenge
+	for _, v := range authz.Challenges {
+		if v.Type == challengeType {
+			challenge = v
+		}
+	}
+	domain := authz.Identifier.Value
+	if challenge == nil {
+		return fmt.Errorf("acme: no %s challenge for %s", challengeType, domain)
+	}
+	if err := solver.present(domain, challenge.Token, self.keyAuthorization(challenge.Token)); err != nil {
+		return err
+	}
+	defer solver.cleanup(domain, challenge.Token)
+	if _, _, err := self.post(challenge.URL, map[string]interface{}{}, nil); err != nil {
+		return err
+	}
+	if err := self.poll(url, authz, func() string { return authz.Status }, "pending"); err != nil {
+		return err
+	}
+	if authz.Status != "valid" {
+		for _, v := range authz.Challenges {
+			if v.Error != nil {
+				return fmt.Errorf("acme: %s of %s: %s", v.Type, domain, v.Error.Detail)
+			}
+		}
+		return fmt.Errorf("acme: authorization of %s is %s", domain, authz.Status)
+	}
+	return nil
+}
+
+//Self signed certificate answering the tls-alpn-01 challenge of the domain
+func tlsALPNCertificate(domain, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	value, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: domain},
+		DNSNames:        []string{domain},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: idPeACMEIdentifier, Critical: true, Value: value}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: crypto.Signer(key)}, nil
+}
+
+//Load the account key in PEM,a new key is generated and saved when the file doesn't exist
+func loadACMEAccountKey(file string) (*ecdsa.PrivateKey, error) {
+	if bts, err := ioutil.ReadFile(file); err == nil {
+		block, _ := pem.Decode(bts)
+		if block == nil {
+			return nil, fmt.Errorf("no key in %s", file)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	if err := tools.WriteFileAtomic(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,358 @@
+package netservice
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//Minimal RFC 8555 server,validates the challenges on the given addresses like Pebble
+type fakeACME struct {
+	t        *testing.T
+	server   *httptest.Server
+	httpAddr string
+	tlsAddr  string
+	caKey    *ecdsa.PrivateKey
+	caCert   *x509.Certificate
+	mutex    sync.Mutex
+	serial   int
+	nonces   map[string]bool
+	accounts map[string]*ecdsa.PublicKey
+	orders   map[string]*acmeOrder
+	authz    map[string]*acmeAuthorization
+	certs    map[string][]byte
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	self := &fakeACME{t: t, nonces: map[string]bool{}, accounts: map[string]*ecdsa.PublicKey{},
+		orders: map[string]*acmeOrder{}, authz: map[string]*acmeAuthorization{}, certs: map[string][]byte{}}
+	self.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "fake acme ca"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), IsCA: true,
+		BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, self.caKey.Public(), self.caKey)
+	self.caCert, _ = x509.ParseCertificate(der)
+	self.server = httptest.NewTLSServer(http.HandlerFunc(self.serve))
+	return self
+}
+
+func (self *fakeACME) url(path string) string {
+	return self.server.URL + path
+}
+
+func (self *fakeACME) next() string {
+	self.serial++
+	return fmt.Sprint(self.serial)
+}
+
+func (self *fakeACME) newNonce(w http.ResponseWriter) {
+	nonce := "n" + self.next()
+	self.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+func (self *fakeACME) problem(w http.ResponseWriter, status int, kind, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&acmeProblem{Type: "urn:ietf:params:acme:error:" + kind, Detail: detail, Status: status})
+}
+
+//Verify the JWS,returns the account url and the payload
+func (self *fakeACME) verify(r *http.Request) (string, []byte, error) {
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return "", nil, err
+	}
+	header, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		Jwk                  *struct{ Crv, Kty, X, Y string }
+	}
+	if err := json.Unmarshal(header, &protected); err != nil {
+		return "", nil, err
+	}
+	if !self.nonces[protected.Nonce] {
+		return "", nil, errors.New("badNonce")
+	}
+	delete(self.nonces, protected.Nonce)
+	if protected.Alg != "ES256" || protected.URL != self.url(r.URL.Path) {
+		return "", nil, errors.New("unexpected protected header " + string(header))
+	}
+	key, kid := self.accounts[protected.Kid], protected.Kid
+	if protected.Jwk != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.Jwk.X)
+		y, _ := base64.RawURLEncoding.DecodeString(protected.Jwk.Y)
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		kid = self.url("/account/" + protected.Jwk.X)
+	}
+	if key == nil {
+		return "", nil, errors.New("unknown account " + protected.Kid)
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(signature) != 64 || !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return "", nil, errors.New("bad signature")
+	}
+	self.accounts[kid] = key
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return kid, payload, nil
+}
+
+func (self *fakeACME) serve(w http.ResponseWriter, r *http.Request) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if r.URL.Path == "/dir" {
+		json.NewEncoder(w).Encode(&acmeDirectory{NewNonce: self.url("/nonce"), NewAccount: self.url("/account"), NewOrder: self.url("/order")})
+		return
+	}
+	self.newNonce(w)
+	if r.URL.Path == "/nonce" {
+		return
+	}
+	kid, payload, err := self.verify(r)
+	if err != nil {
+		if err.Error() == "badNonce" {
+			self.problem(w, http.StatusBadRequest, "badNonce", "")
+		} else {
+			self.problem(w, http.StatusUnauthorized, "malformed", err.Error())
+		}
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch parts[0] {
+	case "account":
+		w.Header().Set("Location", kid)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status":"valid"}`))
+	case "order":
+		if len(parts) == 1 {
+			var request acmeOrder
+			json.Unmarshal(payload, &request)
+			id := self.next()
+			order := &acmeOrder{Status: "pending", Identifiers: request.Identifiers, Finalize: self.url("/finalize/" + id)}
+			for _, identifier := range request.Identifiers {
+				authzID := self.next()
+				self.authz[authzID] = &acmeAuthorization{Status: "pending", Identifier: identifier, Challenges: []*acmeChallenge{
+					{Type: "http-01", URL: self.url("/chal/" + authzID + "/http-01"), Token: "token" + authzID, Status: "pending"},
+					{Type: "tls-alpn-01", URL: self.url("/chal/" + authzID + "/tls-alpn-01"), Token: "token" + authzID, Status: "pending"},
+				}}
+				order.Authorizations = append(order.Authorizations, self.url("/authz/"+authzID))
+			}
+			self.orders[id] = order
+			w.Header().Set("Location", self.url("/order/"+id))
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(order)
+			return
+		}
+		json.NewEncoder(w).Encode(self.orders[parts[1]])
+	case "authz":
+		json.NewEncoder(w).Encode(self.authz[parts[1]])
+	case "chal":
+		authz := self.authz[parts[1]]
+		for _, challenge := range authz.Challenges {
+			if challenge.Type == parts[2] {
+				challenge.Status = "valid"
+				if err := self.validate(authz.Identifier.Value, challenge.Type, challenge.Token+"."+thumbprintOf(self.accounts[kid])); err != nil {
+					challenge.Status = "invalid"
+					challenge.Error = &acmeProblem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: err.Error()}
+				}
+				authz.Status = challenge.Status
+				json.NewEncoder(w).Encode(challenge)
+			}
+		}
+		for _, order := range self.orders {
+			ready := order.Status == "pending"
+			for _, url := range order.Authorizations {
+				ready = ready && self.authz[url[strings.LastIndex(url, "/")+1:]].Status == "valid"
+			}
+			if ready {
+				order.Status = "ready"
+			}
+		}
+	case "finalize":
+		var request struct{ CSR string }
+		json.Unmarshal(payload, &request)
+		der, _ := base64.RawURLEncoding.DecodeString(request.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || csr.CheckSignature() != nil {
+			self.problem(w, http.StatusBadRequest, "badCSR", "invalid csr")
+			return
+		}
+		template := &x509.Certificate{SerialNumber: big.NewInt(int64(self.serial + 100)), Subject: csr.Subject, DNSNames: csr.DNSNames,
+			NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(90 * 24 * time.Hour), ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+		leaf, _ := x509.CreateCertificate(rand.Reader, template, self.caCert, csr.PublicKey, self.caKey)
+		order := self.orders[parts[1]]
+		order.Status = "valid"
+		order.Certificate = self.url("/cert/" + parts[1])
+		self.certs[parts[1]] = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: self.caCert.Raw})...)
+		json.NewEncoder(w).Encode(order)
+	case "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(self.certs[parts[1]])
+	}
+}
+
+//Validate the challenge like a CA,through the http and https listeners of the proxy
+func (self *fakeACME) validate(domain, challengeType, keyAuth string) error {
+	if challengeType == "http-01" {
+		r, _ := http.NewRequest("GET", "http://"+self.httpAddr+"/.well-known/acme-challenge/"+keyAuth[:strings.Index(keyAuth, ".")], nil)
+		r.Host = domain
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != keyAuth {
+			return fmt.Errorf("got key authorization %q", body)
+		}
+		return nil
+	}
+	conn, err := tls.Dial("tcp", self.tlsAddr, &tls.Config{ServerName: domain, NextProtos: []string{acmeALPNProto}, InsecureSkipVerify: true})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != acmeALPNProto {
+		return fmt.Errorf("negotiated %q", state.NegotiatedProtocol)
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	want, _ := asn1.Marshal(sum[:])
+	for _, ext := range state.PeerCertificates[0].Extensions {
+		if ext.Id.Equal(idPeACMEIdentifier) && ext.Critical && string(ext.Value) == string(want) {
+			return nil
+		}
+	}
+	return errors.New("no acmeIdentifier extension")
+}
+
+func thumbprintOf(key *ecdsa.PublicKey) string {
+	return (&acmeClient{key: &ecdsa.PrivateKey{PublicKey: *key}}).thumbprint()
+}
+
+func TestACMEAutoTLS(t *testing.T) {
+	ca := newFakeACME(t)
+	defer ca.server.Close()
+	dir, _ := ioutil.TempDir("", "acme")
+	defer os.RemoveAll(dir)
+	certificateDir = dir
+	defer func() { certificateDir = global.CertificateData }()
+	caFile := filepath.Join(dir, "acme-ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.server.Certificate().Raw}), 0644)
+	configFile := filepath.Join(dir, "http_proxy.json")
+	ioutil.WriteFile(configFile, []byte(`{"http_switch":"on","https_switch":"on",
+		"acme":{"switch":"on","directory_url":"`+ca.url("/dir")+`","email":"admin@abc.com","ca_file":"`+caFile+`"},
+		"reserve_proxy":[{"domain":"www.abc.com","http_switch":"on","https_switch":"on","auto_tls":"on","clients":[]},
+		{"domain":"api.abc.com","http_switch":"on","https_switch":"on","auto_tls":"on","clients":[]},
+		{"domain":"static.abc.com","http_switch":"on","https_switch":"on","clients":[]}]}`), 0644)
+	proxy := NewReverseProxy()
+	proxy.LoadProxyConfig(configFile)
+	proxy.acme = NewACMEManager()
+	proxy.acme.AccountKeyFile = filepath.Join(dir, "acme", "account.key")
+
+	//http-01 through the proxy handler,tls-alpn-01 through the https server
+	httpServer := httptest.NewServer(proxy)
+	defer httpServer.Close()
+	ca.httpAddr = httpServer.Listener.Addr().String()
+	proxy.httpsServer = NewHttpsServer()
+	proxy.httpsServer.Handler = proxy
+	proxy.httpsServer.TLSConfig = &tls.Config{NextProtos: []string{acmeALPNProto}}
+	proxy.httpsServer.TLSConfig.GetCertificate = proxy.httpsServer.defaultGetCertificate
+	proxy.httpsServer.ChallengeCertificate = proxy.acme.challengeCertificate
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.httpsServer.ServeTLS(l, "", "")
+	defer proxy.httpsServer.Close()
+	ca.tlsAddr = l.Addr().String()
+
+	cfg := proxy.Config()
+	proxy.acme.renew(cfg, proxy.installCertificate)
+	for _, domain := range []string{"www.abc.com", "api.abc.com"} {
+		if proxy.acme.needRenew(domain, cfg.ACME.renewBefore()) {
+			t.Fatal("no certificate saved for", domain)
+		}
+		if proxy.httpsServer.DomainCertificate(domain) == nil {
+			t.Fatal("certificate not installed for", domain)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(certificateDir, "static.abc.com")); err == nil {
+		t.Fatal("certificate obtained without auto_tls")
+	}
+	//the new certificate is served at once
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.caCert)
+	conn, err := tls.Dial("tcp", ca.tlsAddr, &tls.Config{ServerName: "www.abc.com", RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	//tls-alpn-01 with the same account
+	cfg.ACME.Challenge = "tls-alpn-01"
+	os.RemoveAll(filepath.Join(certificateDir, "api.abc.com"))
+	proxy.acme.renew(cfg, proxy.installCertificate)
+	if proxy.acme.needRenew("api.abc.com", cfg.ACME.renewBefore()) {
+		t.Fatal("no certificate obtained with tls-alpn-01")
+	}
+	if len(ca.accounts) != 1 {
+		t.Fatal("unexpected accounts", len(ca.accounts))
+	}
+	//due within renew_before
+	if !proxy.acme.needRenew("www.abc.com", 100*24*time.Hour) {
+		t.Fatal("certificate not due for renewal")
+	}
+
+	//a challenge the proxy can't answer leaves the old certificate
+	ca.httpAddr = deadNode(t).Addr()
+	cfg.ACME.Challenge = "http-01"
+	cfg.ACME.RenewBefore = 100
+	old := proxy.httpsServer.DomainCertificate("www.abc.com")
+	proxy.acme.renew(cfg, proxy.installCertificate)
+	if proxy.httpsServer.DomainCertificate("www.abc.com") != old {
+		t.Fatal("certificate replaced after a failed challenge")
+	}
+}
+
+func TestACMEConfigValidate(t *testing.T) {
+	for _, cfg := range []string{
+		`{"http_switch":"on","reserve_proxy":[{"domain":"a.com","auto_tls":"on"}]}`,
+		`{"http_switch":"on","acme":{"switch":"on"},"reserve_proxy":[{"domain":"*.a.com","auto_tls":"on"}]}`,
+		`{"http_switch":"on","acme":{"switch":"on","challenge":"dns-01"}}`,
+		`{"http_switch":"on","acme":{"switch":"yes"}}`,
+	} {
+		var data ReverseProxyConfigData
+		if err := json.Unmarshal([]byte(cfg), &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.validate() == nil {
+			t.Fatal("invalid config accepted", cfg)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package netservice
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"ActivedRouter/global"
+	"ActivedRouter/tools"
+)
+
+//ACME account,the certificates of the domains with auto_tls on are obtained and renewed with it
+type ACMEConfig struct {
+	Switch string `json:"switch"`
+	//directory of the CA,Let's Encrypt by default,a Pebble directory for testing
+	DirectoryURL string `json:"directory_url,omitempty"`
+	Email        string `json:"email,omitempty"`
+	//http-01 answered on the http listener or tls-alpn-01 on the https listener
+	Challenge string `json:"challenge,omitempty"`
+	//PEM file of the roots trusted for the directory,for test CAs
+	CAFile string `json:"ca_file,omitempty"`
+	//days before the expiry to renew,seconds between two checks
+	RenewBefore   int `json:"renew_before,omitempty"`
+	CheckInterval int `json:"check_interval,omitempty"`
+}
+
+func (self *ACMEConfig) validate() error {
+	if self == nil {
+		return nil
+	}
+	if !validSwitch(self.Switch) {
+		return errors.New("acme switch must be on or off")
+	}
+	if self.Challenge != "" && self.Challenge != global.ACMEHttp01 && self.Challenge != global.ACMETLSALPN01 {
+		return fmt.Errorf("unknown acme challenge %s", self.Challenge)
+	}
+	if self.RenewBefore < 0 || self.CheckInterval < 0 {
+		return errors.New("acme renew_before and check_interval can't be negative")
+	}
+	return nil
+}
+
+func (self *ACMEConfig) enabled() bool {
+	return self != nil && self.Switch == global.SwitchOn
+}
+
+func (self *ACMEConfig) directoryURL() string {
+	if self.DirectoryURL == "" {
+		return global.DefaultACMEDirectory
+	}
+	return self.DirectoryURL
+}
+
+func (self *ACMEConfig) challenge() string {
+	if self.Challenge == "" {
+		return global.ACMEHttp01
+	}
+	return self.Challenge
+}
+
+func (self *ACMEConfig) renewBefore() time.Duration {
+	if self.RenewBefore == 0 {
+		return global.DefaultACMERenewBefore * 24 * time.Hour
+	}
+	return time.Duration(self.RenewBefore) * 24 * time.Hour
+}
+
+func (self *ACMEConfig) checkInterval() time.Duration {
+	if self == nil || self.CheckInterval == 0 {
+		return global.DefaultACMECheckInterval * time.Second
+	}
+	return time.Duration(self.CheckInterval) * time.Second
+}
+
+func (self *ACMEConfig) httpClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if self.CAFile != "" {
+		bts, err := ioutil.ReadFile(self.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bts) {
+			return nil, fmt.Errorf("no certificate in %s", self.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+//Obtains and renews the certificates,answers the challenges of the CA
+type ACMEManager struct {
+	AccountKeyFile string
+	mutex          sync.Mutex
+	//http-01 key authorizations by token,tls-alpn-01 certificates by domain
+	tokens   map[string]string
+	alpnCert map[string]*tls.Certificate
+	//client of the directory last used
+	client    *acmeClient
+	clientKey string
+	trigger   chan struct{}
+}
+
+func NewACMEManager() *ACMEManager {
+	return &ACMEManager{
+		AccountKeyFile: global.ACMEAccountKey,
+		tokens:         make(map[string]string),
+		alpnCert:       make(map[string]*tls.Certificate),
+		trigger:        make(chan struct{}, 1),
+	}
+}
+
+//Check the domains at once instead of waiting for the interval
+func (self *ACMEManager) notify() {
+	select {
+	case self.trigger <- struct{}{}:
+	default:
+	}
+}
+
+//Answer the http-01 challenge,false if the request is not one
+func (self *ACMEManager) serveHTTPChallenge(w http.ResponseWriter, r *http.Request) bool {
+	const prefix = "/.well-known/acme-challenge/"
+	if r.TLS != nil || !strings.HasPrefix(r.URL.Path, prefix) {
+		return false
+	}
+	self.mutex.Lock()
+	keyAuth, ok := self.tokens[r.URL.Path[len(prefix):]]
+	self.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+	return true
+}
+
+//Certificate answering the tls-alpn-01 challenge,nil for the other handshakes
+func (self *ACMEManager) challengeCertificate(hello *tls.ClientHelloInfo) *tls.Certificate {
+	for _, proto := range hello.SupportedProtos {
+		if proto == acmeALPNProto {
+			self.mutex.Lock()
+			defer self.mutex.Unlock()
+			return self.alpnCert[strings.ToLower(hello.ServerName)]
+		}
+	}
+	return nil
+}
+
+//acmeSolver of one challenge type
+type acmeChallengeSolver struct {
+	manager   *ACMEManager
+	challenge string
+}
+
+func (self *acmeChallengeSolver) present(domain, token, keyAuth string) error {
+	self.manager.mutex.Lock()
+	defer self.manager.mutex.Unlock()
+	if self.challenge == global.ACMETLSALPN01 {
+		cert, err := tlsALPNCertificate(domain, keyAuth)
+		if err != nil {
+			return err
+		}
+		self.manager.alpnCert[domain] = cert
+		return nil
+	}
+	self.manager.tokens[token] = keyAuth
+	return nil
+}
+
+func (self *acmeChallengeSolver) cleanup(domain, token string) {
+	self.manager.mutex.Lock()
+	defer self.manager.mutex.Unlock()
+	delete(self.manager.tokens, token)
+	delete(self.manager.alpnCert, domain)
+}
+
+//Registered client of the configured directory,a new one when the directory changes
+func (self *ACMEManager) accountClient(cfg *ACMEConfig) (*acmeClient, error) {
+	clientKey := cfg.directoryURL() + "|" + cfg.CAFile + "|" + cfg.Email
+	if self.client == nil || self.clientKey != clientKey {
+		key, err := loadACMEAccountKey(self.AccountKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		httpClient, err := cfg.httpClient()
+		if err != nil {
+			return nil, err
+		}
+		self.client = newACMEClient(cfg.directoryURL(), key, httpClient)
+		self.clientKey = clientKey
+	}
+	if err := self.client.register(cfg.Email); err != nil {
+		return nil, err
+	}
+	return self.client, nil
+}
+
+//The certificate of the domain is missing,unreadable or expires within renewBefore
+func (self *ACMEManager) needRenew(domain string, renewBefore time.Duration) bool {
+	certFile, _ := certificateFiles(domain)
+	bts, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return true
+	}
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return true
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true
+	}
+	return time.Now().Add(renewBefore).After(cert.NotAfter)
+}
+
+//Obtain a certificate of the domain and save it in the certificate dir
+func (self *ACMEManager) obtain(cfg *ACMEConfig, domain string) (*tls.Certificate, error) {
+	client, err := self.accountClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	chain, key, err := client.obtain([]string{domain}, cfg.challenge(), &acmeChallengeSolver{manager: self, challenge: cfg.challenge()})
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(chain, key)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	certFile, keyFile := certificateFiles(domain)
+	if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+		return nil, err
+	}
+	if err := tools.WriteFileAtomic(keyFile, key, 0600); err != nil {
+		return nil, err
+	}
+	if err := tools.WriteFileAtomic(certFile, chain, 0644); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+//One round of renewals,install is called with every new certificate
+func (self *ACMEManager) renew(cfg *ReverseProxyConfigData, install func(domain string, cert *tls.Certificate)) {
+	if !cfg.ACME.enabled() {
+		return
+	}
+	for _, node := range cfg.ReverseProxy {
+		if node.AutoTLS != global.SwitchOn || !self.needRenew(node.Domain, cfg.ACME.renewBefore()) {
+			continue
+		}
+		cert, err := self.obtain(cfg.ACME, node.Domain)
+		if err != nil {
+			log.Println("ACME certificate of", node.Domain, "error:", err)
+			continue
+		}
+		log.Println("ACME certificate of", node.Domain, "obtained")
+		install(node.Domain, cert)
+	}
+}
+
+//Renew the certificates of the running config until the process exits
+func (self *HttpReverseProxy) runACME() {
+	for {
+		cfg := self.Config()
+		self.acme.renew(cfg, self.installCertificate)
+		timer := time.NewTimer(cfg.ACME.checkInterval())
+		select {
+		case <-timer.C:
+		case <-self.acme.trigger:
+			timer.Stop()
+		}
+	}
+}
+
+//Activate the certificate saved for the domain
+func (self *HttpReverseProxy) installCertificate(domain string, cert *tls.Certificate) {
+	stamp, _ := certificateStamp(domain)
+	self.setCertificate(domain, cert, stamp)
+}
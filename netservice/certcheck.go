@@ -0,0 +1,147 @@
+package netservice
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"ActivedRouter/global"
+	"ActivedRouter/hook"
+)
+
+//sources of the checked certificates
+const (
+	certSourceHttps = "https server"
+	certSourceFile  = "config/crtdata"
+)
+
+//Problems of the certificate mapped to the domain
+func checkCertificate(domain string, leaf *x509.Certificate, days int, now time.Time) []string {
+	var kinds []string
+	if now.After(leaf.NotAfter) {
+		kinds = append(kinds, global.CertExpired)
+	} else if now.AddDate(0, 0, days).After(leaf.NotAfter) {
+		kinds = append(kinds, global.CertExpiring)
+	}
+	name := domain
+	//a wildcard domain is covered by a wildcard certificate only
+	if strings.HasPrefix(domain, "*.") {
+		name = "wildcard-check" + domain[1:]
+	}
+	if leaf.VerifyHostname(name) != nil {
+		kinds = append(kinds, global.CertMismatch)
+	}
+	return kinds
+}
+
+//Leaf certificates of the https server and the certificate files by domain
+func (self *HttpReverseProxy) certificateLeaves() map[string]map[string]*x509.Certificate {
+	leaves := map[string]map[string]*x509.Certificate{certSourceHttps: {}, certSourceFile: {}}
+	if self.httpsServer != nil {
+		for domain, cert := range self.httpsServer.DomainCertificates() {
+			leaf := cert.Leaf
+			if leaf == nil {
+				var err error
+				if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+					continue
+				}
+			}
+			leaves[certSourceHttps][domain] = leaf
+		}
+	}
+	fileInfos, _ := ioutil.ReadDir(certificateDir)
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.IsDir() || !validCertificateDomain(fileInfo.Name()) {
+			continue
+		}
+		certFile, _ := certificateFiles(fileInfo.Name())
+		bts, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			continue
+		}
+		if block, _ := pem.Decode(bts); block != nil {
+			if leaf, err := x509.ParseCertificate(block.Bytes); err == nil {
+				leaves[certSourceFile][fileInfo.Name()] = leaf
+			}
+		}
+	}
+	return leaves
+}
+
+//Events of all certificates,a certificate served and stored in the files is reported once
+func (self *HttpReverseProxy) certificateEvents(days int, now time.Time) []*hook.CertEvent {
+	events := make(map[string]*hook.CertEvent)
+	leaves := self.certificateLeaves()
+	for _, source := range []string{certSourceHttps, certSourceFile} {
+		for domain, leaf := range leaves[source] {
+			for _, kind := range checkCertificate(domain, leaf, days, now) {
+				sum := sha256.Sum256(leaf.Raw)
+				key := domain + "|" + kind + "|" + string(sum[:])
+				if event, ok := events[key]; ok {
+					event.Sources = append(event.Sources, source)
+					continue
+				}
+				sans := append([]string{}, leaf.DNSNames...)
+				for _, ip := range leaf.IPAddresses {
+					sans = append(sans, ip.String())
+				}
+				events[key] = &hook.CertEvent{
+					Domain:   domain,
+					Kind:     kind,
+					Sources:  []string{source},
+					Subject:  leaf.Subject.String(),
+					Issuer:   leaf.Issuer.String(),
+					SANs:     sans,
+					NotAfter: leaf.NotAfter,
+					DaysLeft: int(leaf.NotAfter.Sub(now).Hours() / 24),
+				}
+			}
+		}
+	}
+	list := make([]*hook.CertEvent, 0, len(events))
+	for _, event := range events {
+		list = append(list, event)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Domain < list[j].Domain || (list[i].Domain == list[j].Domain && list[i].Kind < list[j].Kind)
+	})
+	return list
+}
+
+//Raise the events of the certificates,the same problem is raised again after a day
+func (self *HttpReverseProxy) checkCertificates(days int, now time.Time) {
+	host, _, err := net.SplitHostPort(self.Config().HttpsProxyAddr)
+	if err != nil || host == "" {
+		host = ServerConfigData.Host
+	}
+	raised := make(map[string]time.Time)
+	for _, event := range self.certificateEvents(days, now) {
+		key := event.Domain + "|" + event.Kind + "|" + event.NotAfter.String()
+		if last, ok := self.certAlerts[key]; ok && now.Sub(last) < global.DefaultCertAlertRepeat*time.Second {
+			raised[key] = last
+			continue
+		}
+		log.Println("Certificate of", event.Domain, event.Kind, event.Sources)
+		hook.ProcessCertEvent(host, event)
+		raised[key] = now
+	}
+	//solved problems are forgotten
+	self.certAlerts = raised
+}
+
+//Check the certificates until the process exits
+func (self *HttpReverseProxy) RunCertificateCheck() {
+	for {
+		cfg := hook.GCertCheckConfig
+		if cfg.Switch == global.SwitchOn {
+			self.checkCertificates(cfg.Days, time.Now())
+		}
+		time.Sleep(time.Duration(cfg.Interval) * time.Second)
+	}
+}
@@ -0,0 +1,75 @@
+package netservice
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ActivedRouter/global"
+	"ActivedRouter/hook"
+	"ActivedRouter/system"
+)
+
+func TestCertificateCheck(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "certcheck")
+	defer os.RemoveAll(dir)
+	certificateDir = dir
+	defer func() { certificateDir = global.CertificateData }()
+	now := time.Now()
+	modTime := now.Add(-time.Hour)
+	for domain, notAfter := range map[string]time.Time{
+		"valid.com":    now.Add(90 * 24 * time.Hour),
+		"expiring.com": now.Add(10 * 24 * time.Hour),
+		"expired.com":  now.Add(-time.Hour),
+	} {
+		cert, key := testCertificate(t, 1, notAfter, domain)
+		writeTestCertificate(t, domain, cert, key, modTime)
+	}
+	cert, key := testCertificate(t, 1, now.Add(90*24*time.Hour), "other.com")
+	writeTestCertificate(t, "mismatch.com", cert, key, modTime)
+	cert, key = testCertificate(t, 1, now.Add(90*24*time.Hour), "*.wild.com")
+	writeTestCertificate(t, "*.wild.com", cert, key, modTime)
+
+	proxy := NewReverseProxy()
+	proxy.httpsServer = NewHttpsServer()
+	proxy.ReloadCertificates()
+	//served but removed from the files
+	os.RemoveAll(filepath.Join(certificateDir, "expired.com"))
+
+	var alerts []*system.AlertRecord
+	hook.AlertRecorder = func(alert *system.AlertRecord) { alerts = append(alerts, alert) }
+	defer func() { hook.AlertRecorder = nil }()
+	events := proxy.certificateEvents(30, now)
+	want := []string{"expired.com expired 1", "expiring.com expiring 2", "mismatch.com mismatch 2"}
+	if len(events) != len(want) {
+		t.Fatalf("%d events,want %d", len(events), len(want))
+	}
+	for i, event := range events {
+		if got := fmt.Sprint(event.Domain, " ", event.Kind, " ", len(event.Sources)); got != want[i] {
+			t.Fatalf("event %d: %s,want %s", i, got, want[i])
+		}
+	}
+	if events[1].DaysLeft != 9 {
+		t.Fatal("unexpected days left", events[1].DaysLeft)
+	}
+
+	//raised once a day through the alert path of the hook engine
+	proxy.checkCertificates(30, now)
+	if len(alerts) != 3 || alerts[0].Subject != "ActivedRouter 证书警报" {
+		t.Fatalf("unexpected alerts %+v", alerts)
+	}
+	proxy.checkCertificates(30, now.Add(time.Hour))
+	if len(alerts) != 3 {
+		t.Fatal("alert repeated within a day", len(alerts))
+	}
+	proxy.checkCertificates(30, now.Add(25*time.Hour))
+	if len(alerts) != 6 {
+		t.Fatal("alert not repeated after a day", len(alerts))
+	}
+	if proxy.checkCertificates(5, now); len(alerts) != 6 {
+		t.Fatal("unexpected alerts", len(alerts))
+	}
+}
@@ -0,0 +1,248 @@
+package netservice
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"ActivedRouter/global"
+	"ActivedRouter/tools"
+)
+
+//certificate of a domain in the certificate dir
+type certificateState struct {
+	//modification time and size of the files last loaded
+	stamp    string
+	cert     *tls.Certificate
+	loadedAt time.Time
+	//error of the last load,the certificate loaded before is kept
+	err string
+}
+
+//Certificate inventory entry
+type CertificateInfo struct {
+	Domain      string   `json:"domain"`
+	Subject     string   `json:"subject,omitempty"`
+	SANs        []string `json:"sans,omitempty"`
+	Issuer      string   `json:"issuer,omitempty"`
+	Serial      string   `json:"serial,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	NotBefore   string   `json:"not_before,omitempty"`
+	NotAfter    string   `json:"not_after,omitempty"`
+	DaysLeft    int      `json:"days_left"`
+	LoadedAt    string   `json:"loaded_at,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+//Domain dir names are used as paths
+func validCertificateDomain(domain string) bool {
+	return domain != "" && domain != "." && domain != ".." && !strings.ContainsAny(domain, `/\`)
+}
+
+//Dir of the domain certificates,relative to the working directory
+var certificateDir = global.CertificateData
+
+func certificateFiles(domain string) (string, string) {
+	dir := filepath.Join(certificateDir, domain)
+	return filepath.Join(dir, global.DefaultCertificate), filepath.Join(dir, global.DefaultKey)
+}
+
+//Replace the uploaded crt or key of the domain,the key is only readable by the owner
+func saveCertificateFile(domain, filetype string, bts []byte) error {
+	certFile, keyFile := certificateFiles(domain)
+	file, perm := certFile, os.FileMode(0644)
+	switch filetype {
+	case "crt":
+	case "key":
+		file, perm = keyFile, 0600
+	default:
+		return fmt.Errorf("unknown file type %s", filetype)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return tools.WriteFileAtomic(file, bts, perm)
+}
+
+//Modification time and size of the certificate and key files
+func certificateStamp(domain string) (string, error) {
+	stamp := ""
+	certFile, keyFile := certificateFiles(domain)
+	for _, file := range []string{certFile, keyFile} {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d-%d;", stat.ModTime().UnixNano(), stat.Size())
+	}
+	return stamp, nil
+}
+
+//Load the key pair of the domain,the certificate must match the key
+func loadDomainCertificate(domain string) (*tls.Certificate, error) {
+	certFile, keyFile := certificateFiles(domain)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+//Reload the certificate of the domain from its files,
+//a pair that can't be loaded doesn't replace the active certificate
+func (self *HttpReverseProxy) ReloadCertificate(domain string) error {
+	if !validCertificateDomain(domain) {
+		return fmt.Errorf("invalid domain %s", domain)
+	}
+	stamp, err := certificateStamp(domain)
+	if err == nil {
+		var cert *tls.Certificate
+		if cert, err = loadDomainCertificate(domain); err == nil {
+			self.setCertificate(domain, cert, stamp)
+			return nil
+		}
+	}
+	self.certMutex.Lock()
+	defer self.certMutex.Unlock()
+	state := self.certState(domain)
+	state.stamp = stamp
+	state.err = err.Error()
+	log.Println("Load certificate of", domain, "error,keep the active certificate:", err)
+	return err
+}
+
+//must hold certMutex
+func (self *HttpReverseProxy) certState(domain string) *certificateState {
+	if self.certStates == nil {
+		self.certStates = make(map[string]*certificateState)
+	}
+	state, ok := self.certStates[domain]
+	if !ok {
+		state = &certificateState{}
+		self.certStates[domain] = state
+	}
+	return state
+}
+
+//Activate the certificate on the https listener
+func (self *HttpReverseProxy) setCertificate(domain string, cert *tls.Certificate, stamp string) {
+	self.certMutex.Lock()
+	defer self.certMutex.Unlock()
+	state := self.certState(domain)
+	state.stamp = stamp
+	state.cert = cert
+	state.loadedAt = time.Now()
+	state.err = ""
+	if self.httpsServer != nil {
+		self.httpsServer.SetDomainCertificate(domain, cert)
+	}
+	log.Println("Certificate of", domain, "loaded")
+}
+
+//Reload the certificates whose files changed,the removed domains are dropped
+func (self *HttpReverseProxy) ReloadCertificates() {
+	domains := make(map[string]bool)
+	if fileInfos, err := ioutil.ReadDir(certificateDir); err == nil {
+		for _, fileInfo := range fileInfos {
+			if fileInfo.IsDir() && validCertificateDomain(fileInfo.Name()) {
+				domains[fileInfo.Name()] = true
+			}
+		}
+	}
+	self.certMutex.Lock()
+	var removed []string
+	for domain := range self.certStates {
+		if !domains[domain] {
+			removed = append(removed, domain)
+			delete(self.certStates, domain)
+		}
+	}
+	stamps := make(map[string]string)
+	for domain := range self.certStates {
+		stamps[domain] = self.certStates[domain].stamp
+	}
+	self.certMutex.Unlock()
+	for _, domain := range removed {
+		if self.httpsServer != nil {
+			self.httpsServer.RemoveDomainCertificate(domain)
+		}
+		log.Println("Certificate of", domain, "removed")
+	}
+	for domain := range domains {
+		if stamp, err := certificateStamp(domain); err != nil || stamp != stamps[domain] {
+			self.ReloadCertificate(domain)
+		}
+	}
+}
+
+//Poll the certificate dir and reload the changed certificates
+func (self *HttpReverseProxy) WatchCertificates() {
+	for {
+		interval := time.Second * time.Duration(self.Config().ConfigWatchInterval)
+		if interval <= 0 {
+			interval = global.DefaultConfigWatchInterval * time.Second
+		}
+		time.Sleep(interval)
+		self.ReloadCertificates()
+	}
+}
+
+func newCertificateInfo(domain string, state *certificateState) *CertificateInfo {
+	info := &CertificateInfo{Domain: domain, Error: state.err}
+	if state.cert == nil {
+		return info
+	}
+	leaf := state.cert.Leaf
+	sum := sha256.Sum256(leaf.Raw)
+	info.Subject = leaf.Subject.String()
+	info.SANs = leaf.DNSNames
+	for _, ip := range leaf.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+	info.Issuer = leaf.Issuer.String()
+	info.Serial = leaf.SerialNumber.Text(16)
+	info.Fingerprint = hex.EncodeToString(sum[:])
+	info.NotBefore = leaf.NotBefore.Format("2006-01-02 15:04:05")
+	info.NotAfter = leaf.NotAfter.Format("2006-01-02 15:04:05")
+	info.DaysLeft = int(time.Until(leaf.NotAfter).Hours() / 24)
+	info.LoadedAt = state.loadedAt.Format("2006-01-02 15:04:05")
+	return info
+}
+
+//Inventory of the certificates ordered by domain
+func (self *HttpReverseProxy) Certificates() []*CertificateInfo {
+	self.certMutex.Lock()
+	defer self.certMutex.Unlock()
+	infos := make([]*CertificateInfo, 0, len(self.certStates))
+	for domain, state := range self.certStates {
+		infos = append(infos, newCertificateInfo(domain, state))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Domain < infos[j].Domain })
+	return infos
+}
+
+//Inventory entry of the domain
+func (self *HttpReverseProxy) Certificate(domain string) (*CertificateInfo, error) {
+	self.certMutex.Lock()
+	defer self.certMutex.Unlock()
+	state, ok := self.certStates[domain]
+	if !ok {
+		return nil, errors.New("no certificate of " + domain)
+	}
+	return newCertificateInfo(domain, state), nil
+}
@@ -0,0 +1,155 @@
+package netservice
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//Self signed certificate and key in PEM
+func testCertificate(t *testing.T, serial int64, notAfter time.Time, names ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(serial), Subject: pkix.Name{CommonName: names[0]},
+		DNSNames: names, NotBefore: time.Now().Add(-time.Hour), NotAfter: notAfter}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+//Write the pair in the certificate dir,the modification time is moved to make the change visible
+func writeTestCertificate(t *testing.T, domain string, certPEM, keyPEM []byte, modTime time.Time) {
+	certFile, keyFile := certificateFiles(domain)
+	os.MkdirAll(filepath.Dir(certFile), 0755)
+	for file, bts := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+		if bts == nil {
+			continue
+		}
+		if err := ioutil.WriteFile(file, bts, 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(file, modTime, modTime)
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "certificate")
+	defer os.RemoveAll(dir)
+	certificateDir = dir
+	defer func() { certificateDir = global.CertificateData }()
+	proxy := NewReverseProxy()
+	proxy.httpsServer = NewHttpsServer()
+	notAfter := time.Now().Add(30*24*time.Hour + time.Hour)
+	modTime := time.Now().Add(-time.Hour)
+
+	certA, keyA := testCertificate(t, 1, notAfter, "a.com", "www.a.com")
+	certB, _ := testCertificate(t, 2, notAfter, "b.com")
+	_, otherKey := testCertificate(t, 3, notAfter, "c.com")
+	writeTestCertificate(t, "a.com", certA, keyA, modTime)
+	writeTestCertificate(t, "b.com", certB, otherKey, modTime)
+	//a bad pair doesn't stop the others
+	proxy.ReloadCertificates()
+	if proxy.httpsServer.DomainCertificate("a.com") == nil || proxy.httpsServer.DomainCertificate("b.com") != nil {
+		t.Fatal("unexpected certificates loaded")
+	}
+	infos := proxy.Certificates()
+	if len(infos) != 2 || infos[0].Domain != "a.com" || infos[1].Error == "" {
+		t.Fatalf("unexpected inventory %+v", infos)
+	}
+	a := infos[0]
+	if a.Subject != "CN=a.com" || a.Issuer != "CN=a.com" || len(a.SANs) != 2 || a.SANs[1] != "www.a.com" || a.DaysLeft != 30 || a.Serial != "1" {
+		t.Fatalf("unexpected certificate info %+v", a)
+	}
+
+	//a changed pair is activated,a key that doesn't match the certificate keeps the active one
+	certA2, keyA2 := testCertificate(t, 4, notAfter, "a.com")
+	writeTestCertificate(t, "a.com", certA2, keyA2, modTime.Add(time.Minute))
+	proxy.ReloadCertificates()
+	if info, _ := proxy.Certificate("a.com"); info.Serial != "4" || info.Error != "" {
+		t.Fatalf("changed certificate not loaded %+v", info)
+	}
+	writeTestCertificate(t, "a.com", nil, otherKey, modTime.Add(2*time.Minute))
+	proxy.ReloadCertificates()
+	if info, _ := proxy.Certificate("a.com"); info.Serial != "4" || info.Error == "" {
+		t.Fatalf("mismatched key activated %+v", info)
+	}
+	if proxy.httpsServer.DomainCertificate("a.com").Leaf.SerialNumber.Int64() != 4 {
+		t.Fatal("active certificate replaced")
+	}
+	//unchanged files are not loaded again
+	proxy.certMutex.Lock()
+	loadedAt := proxy.certStates["b.com"].loadedAt
+	proxy.certMutex.Unlock()
+	proxy.ReloadCertificates()
+	proxy.certMutex.Lock()
+	reloaded := proxy.certStates["b.com"].loadedAt != loadedAt
+	proxy.certMutex.Unlock()
+	if reloaded {
+		t.Fatal("unchanged certificate reloaded")
+	}
+
+	//the matching key is uploaded
+	writeTestCertificate(t, "a.com", nil, keyA2, modTime.Add(3*time.Minute))
+	if err := proxy.ReloadCertificate("a.com"); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(filepath.Join(certificateDir, "a.com"))
+	proxy.ReloadCertificates()
+	if proxy.httpsServer.DomainCertificate("a.com") != nil || len(proxy.Certificates()) != 1 {
+		t.Fatal("removed certificate still active")
+	}
+	if proxy.ReloadCertificate("../a.com") == nil {
+		t.Fatal("invalid domain accepted")
+	}
+}
+
+func TestSaveCertificateFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "certificate")
+	defer os.RemoveAll(dir)
+	certificateDir = dir
+	defer func() { certificateDir = global.CertificateData }()
+	certPEM, keyPEM := testCertificate(t, 1, time.Now().Add(time.Hour), "a.com")
+	if err := saveCertificateFile("a.com", "crt", certPEM); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveCertificateFile("a.com", "key", keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	if saveCertificateFile("a.com", "pem", certPEM) == nil {
+		t.Fatal("unknown file type saved")
+	}
+	certFile, keyFile := certificateFiles("a.com")
+	for file, perm := range map[string]os.FileMode{certFile: 0644, keyFile: 0600} {
+		stat, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Mode().Perm() != perm {
+			t.Fatalf("%s written with %v", file, stat.Mode().Perm())
+		}
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	//no temp files are left
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "a.com")); len(files) != 2 {
+		t.Fatal("unexpected files", len(files))
+	}
+}
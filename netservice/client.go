@@ -103,6 +103,7 @@ func (self *Client) ConnectToServer(addr string) {
 //Connect to remote routing server
 func (self *Client) Run() {
 	log.Printf("Connecting to remote routing server, destination address %s:%s........\n", self.Host, self.Port)
+	registerClient(self)
 	var addr string
 	if self.Host == "*" {
 		addr = ":" + self.Port
@@ -132,7 +133,9 @@ func (self *Client) Run() {
 func (self *Client) Disconnect() {
 	self.Closed = true
 	//Stop all connections before stopping the server
-	self.ConnSocket.Close()
+	if self.ConnSocket != nil {
+		self.ConnSocket.Close()
+	}
 	//Send Close Message Exit Close the task
 	<-self.TaskFlag
 }
@@ -0,0 +1,259 @@
+package netservice
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+
+	"ActivedRouter/global"
+)
+
+//Client certificates of the domain,verified during the handshake
+type ClientAuthConfig struct {
+	Switch string `json:"switch"`
+	//PEM bundle of the CAs signing the client certificates,the internal CA by default
+	CAFile string `json:"ca_file,omitempty"`
+	//require,or optional to verify the certificate only if the client sends one
+	Mode string `json:"mode,omitempty"`
+	//common names or whole subjects allowed,every verified certificate is allowed if empty
+	AllowedSubjects []string `json:"allowed_subjects,omitempty"`
+	//headers passing the verified subject and the sha256 fingerprint to the backends,
+	//the values sent by the client are always removed
+	SubjectHeader     string `json:"subject_header,omitempty"`
+	FingerprintHeader string `json:"fingerprint_header,omitempty"`
+	//CRL signed by ca_file,ca.crl of the internal CA by default
+	CRLFile string `json:"crl_file,omitempty"`
+	pool    *x509.CertPool
+	crl     *revocationList
+}
+
+func (self *ClientAuthConfig) validate() error {
+	if self == nil {
+		return nil
+	}
+	if !validSwitch(self.Switch) {
+		return errors.New("client_auth switch must be on or off")
+	}
+	if self.Mode != "" && self.Mode != global.ClientAuthRequire && self.Mode != global.ClientAuthOptional {
+		return fmt.Errorf("unknown client_auth mode %s", self.Mode)
+	}
+	if !validHeaderName(self.SubjectHeader) || !validHeaderName(self.FingerprintHeader) {
+		return errors.New("invalid client_auth header")
+	}
+	self.pool = nil
+	self.crl = nil
+	if self.Switch != global.SwitchOn {
+		return nil
+	}
+	bts, err := ioutil.ReadFile(self.caFile())
+	if err != nil {
+		return fmt.Errorf("client_auth ca_file: %s", err)
+	}
+	self.pool = x509.NewCertPool()
+	var issuers []*x509.Certificate
+	for block, rest := pem.Decode(bts); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			self.pool.AddCert(cert)
+			issuers = append(issuers, cert)
+		}
+	}
+	if len(issuers) == 0 {
+		return fmt.Errorf("client_auth ca_file %s has no certificate", self.caFile())
+	}
+	//the internal CA writes its CRL on the first revocation
+	crl := &revocationList{file: self.CRLFile, issuers: issuers}
+	if crl.file == "" && self.CAFile == "" {
+		crl.file = path.Join(global.CADir, global.CACRL)
+		crl.optional = true
+	}
+	if crl.file != "" {
+		if err := crl.load(); err != nil {
+			return fmt.Errorf("client_auth crl_file: %s", err)
+		}
+		self.crl = crl
+	}
+	return nil
+}
+
+func (self *ClientAuthConfig) caFile() string {
+	if self.CAFile == "" {
+		return path.Join(global.CADir, global.CACertificate)
+	}
+	return self.CAFile
+}
+
+//Revoked serials of a CRL file,read again when the file changes
+type revocationList struct {
+	file     string
+	optional bool
+	issuers  []*x509.Certificate
+	mutex    sync.Mutex
+	stamp    string
+	issuer   []byte
+	serials  map[string]bool
+}
+
+//Read the PEM or DER list signed by one of the issuers,a missing optional file is an empty list
+func (self *revocationList) load() error {
+	stat, err := os.Stat(self.file)
+	if os.IsNotExist(err) && self.optional {
+		self.stamp, self.issuer, self.serials = "", nil, nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+	stamp := fmt.Sprintf("%d-%d", stat.ModTime().UnixNano(), stat.Size())
+	if stamp == self.stamp {
+		return nil
+	}
+	bts, err := ioutil.ReadFile(self.file)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(bts); block != nil {
+		bts = block.Bytes
+	}
+	list, err := x509.ParseRevocationList(bts)
+	if err != nil {
+		return err
+	}
+	signed := false
+	for _, issuer := range self.issuers {
+		if list.CheckSignatureFrom(issuer) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("%s not signed by the ca_file", self.file)
+	}
+	serials := make(map[string]bool)
+	for _, entry := range list.RevokedCertificateEntries {
+		serials[entry.SerialNumber.Text(16)] = true
+	}
+	self.stamp, self.issuer, self.serials = stamp, list.RawIssuer, serials
+	return nil
+}
+
+//Whether the certificate is in the list,a list that can't be read again is kept
+func (self *revocationList) revoked(cert *x509.Certificate) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if err := self.load(); err != nil {
+		log.Println("Reload client_auth crl error:", err)
+	}
+	return self.serials[cert.SerialNumber.Text(16)] && bytes.Equal(cert.RawIssuer, self.issuer)
+}
+
+//Client auth of the routing table
+type domainClientAuth struct {
+	clientAuth        tls.ClientAuthType
+	pool              *x509.CertPool
+	subjects          map[string]bool
+	crl               *revocationList
+	subjectHeader     string
+	fingerprintHeader string
+}
+
+//Return nil if client auth is off
+func newDomainClientAuth(node *LbNode) *domainClientAuth {
+	cfg := node.ClientAuth
+	if cfg == nil || cfg.Switch != global.SwitchOn || cfg.pool == nil {
+		return nil
+	}
+	auth := &domainClientAuth{
+		clientAuth:        tls.RequireAndVerifyClientCert,
+		pool:              cfg.pool,
+		crl:               cfg.crl,
+		subjectHeader:     cfg.SubjectHeader,
+		fingerprintHeader: cfg.FingerprintHeader,
+	}
+	if cfg.Mode == global.ClientAuthOptional {
+		auth.clientAuth = tls.VerifyClientCertIfGiven
+	}
+	if len(cfg.AllowedSubjects) > 0 {
+		auth.subjects = make(map[string]bool)
+		for _, subject := range cfg.AllowedSubjects {
+			auth.subjects[subject] = true
+		}
+	}
+	return auth
+}
+
+//Whether the subject of the verified certificate is allowed
+func (self *domainClientAuth) allowed(cert *x509.Certificate) bool {
+	return self.subjects == nil || self.subjects[cert.Subject.CommonName] || self.subjects[cert.Subject.String()]
+}
+
+//Verify the certificate with the CAs of the domain during the handshake
+func (self *domainClientAuth) apply(cfg *tls.Config) {
+	cfg.ClientAuth = self.clientAuth
+	cfg.ClientCAs = self.pool
+	cfg.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return nil
+		}
+		cert := state.PeerCertificates[0]
+		if !self.allowed(cert) {
+			return fmt.Errorf("client certificate %s not allowed", cert.Subject)
+		}
+		if self.crl != nil && self.crl.revoked(cert) {
+			return fmt.Errorf("client certificate %s is revoked", cert.SerialNumber.Text(16))
+		}
+		return nil
+	}
+}
+
+//Check the client certificate of the request,
+//the domain can't be reached over http or with the handshake of another server name
+func (self *domainClientAuth) check(w http.ResponseWriter, r *http.Request, domain string) bool {
+	if r.TLS == nil {
+		writeProxyError(w, r, http.StatusForbidden, r.Host+" needs a client certificate over https")
+		return false
+	}
+	if r.TLS.ServerName != domain {
+		writeProxyError(w, r, http.StatusMisdirectedRequest, r.Host+" doesn't match the server name of the connection")
+		return false
+	}
+	verified := len(r.TLS.VerifiedChains) > 0 && len(r.TLS.PeerCertificates) > 0
+	if (!verified && self.clientAuth == tls.RequireAndVerifyClientCert) || (verified && !self.allowed(r.TLS.PeerCertificates[0])) {
+		writeProxyError(w, r, http.StatusForbidden, r.Host+" client certificate not allowed")
+		return false
+	}
+	return true
+}
+
+//Replace the pass-through headers with the verified certificate
+func (self *domainClientAuth) setHeaders(r *http.Request) {
+	if self.subjectHeader != "" {
+		r.Header.Del(self.subjectHeader)
+	}
+	if self.fingerprintHeader != "" {
+		r.Header.Del(self.fingerprintHeader)
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return
+	}
+	cert := r.TLS.PeerCertificates[0]
+	if self.subjectHeader != "" {
+		r.Header.Set(self.subjectHeader, cert.Subject.String())
+	}
+	if self.fingerprintHeader != "" {
+		sum := sha256.Sum256(cert.Raw)
+		r.Header.Set(self.fingerprintHeader, hex.EncodeToString(sum[:]))
+	}
+}
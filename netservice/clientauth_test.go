@@ -0,0 +1,210 @@
+package netservice
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//Test CA signing client certificates
+type testClientCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestClientCA(t *testing.T, name string) *testClientCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testClientCA{cert: cert, key: key}
+}
+
+func (self *testClientCA) issue(t *testing.T, serial int64, name string) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(serial), Subject: pkix.Name{CommonName: name, Organization: []string{"abc"}},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	der, err := x509.CreateCertificate(rand.Reader, template, self.cert, key.Public(), self.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+//Write the CRL of the revoked serials
+func (self *testClientCA) writeCRL(t *testing.T, file string, serials ...int64) {
+	var entries []x509.RevocationListEntry
+	for _, serial := range serials {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{RevokedCertificateEntries: entries,
+		Number: big.NewInt(int64(len(serials))), ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}, self.cert, self.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644)
+}
+
+func TestClientAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Client-Subject") + "|" + r.Header.Get("X-Client-Fingerprint")))
+	}))
+	defer backend.Close()
+	backendUrl, _ := url.Parse(backend.URL)
+	dir, _ := ioutil.TempDir("", "clientauth")
+	defer os.RemoveAll(dir)
+
+	ca := newTestClientCA(t, "clients")
+	caFile := filepath.Join(dir, "clients.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0644)
+	crlFile := filepath.Join(dir, "clients.crl")
+	ca.writeCRL(t, crlFile)
+	configFile := filepath.Join(dir, "http_proxy.json")
+	clients := `"clients":[{"host":"` + backendUrl.Hostname() + `","port":"` + backendUrl.Port() + `"}]`
+	ioutil.WriteFile(configFile, []byte(`{"http_switch":"on","https_switch":"on","reserve_proxy":[
+		{"domain":"secure.abc.com","http_switch":"on","https_switch":"on",`+clients+`,
+		"client_auth":{"switch":"on","ca_file":"`+caFile+`","crl_file":"`+crlFile+`","allowed_subjects":["alice"],
+		"subject_header":"X-Client-Subject","fingerprint_header":"X-Client-Fingerprint"}},
+		{"domain":"open.abc.com","http_switch":"on","https_switch":"on",`+clients+`}]}`), 0644)
+	proxy := NewReverseProxy()
+	proxy.LoadProxyConfig(configFile)
+	if proxy.table().Domains["secure.abc.com"].ClientAuth == nil {
+		t.Fatal("client auth not loaded")
+	}
+
+	proxy.httpsServer = NewHttpsServer()
+	proxy.httpsServer.Handler = proxy
+	proxy.httpsServer.TLSConfig = &tls.Config{NextProtos: []string{"h2", "http/1.1", acmeALPNProto}}
+	proxy.httpsServer.TLSConfig.GetCertificate = proxy.httpsServer.defaultGetCertificate
+	proxy.httpsServer.TLSConfig.GetConfigForClient = proxy.configForClient
+	for _, domain := range []string{"secure.abc.com", "open.abc.com"} {
+		certPEM, keyPEM := testCertificate(t, 1, time.Now().Add(time.Hour), domain)
+		cert, _ := tls.X509KeyPair(certPEM, keyPEM)
+		proxy.httpsServer.SetDomainCertificate(domain, &cert)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.httpsServer.ServeTLS(l, "", "")
+	defer proxy.httpsServer.Close()
+
+	get := func(serverName, host string, certs ...tls.Certificate) (*http.Response, string, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true, Certificates: certs},
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("tcp", l.Addr().String())
+			},
+			ForceAttemptHTTP2: true,
+		}}
+		req, _ := http.NewRequest("GET", "https://"+host+"/", nil)
+		req.Header.Set("X-Client-Subject", "CN=forged")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body), nil
+	}
+
+	//the verified certificate is passed to the backend
+	alice := ca.issue(t, 2, "alice")
+	resp, body, err := get("secure.abc.com", "secure.abc.com", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(alice.Certificate[0])
+	if resp.StatusCode != http.StatusOK || body != "CN=alice,O=abc|"+hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, body)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Fatal("http/2 not negotiated", resp.Proto)
+	}
+	//no certificate,a subject not allowed and a certificate of another CA are refused in the handshake
+	for name, certs := range map[string][]tls.Certificate{
+		"none":    nil,
+		"mallory": {ca.issue(t, 3, "mallory")},
+		"other":   {newTestClientCA(t, "other").issue(t, 4, "alice")},
+	} {
+		if _, _, err := get("secure.abc.com", "secure.abc.com", certs...); err == nil {
+			t.Fatal("handshake accepted with certificate", name)
+		}
+	}
+	//the other domains don't ask for a certificate,but can't be used to reach the secure one
+	if resp, _, err := get("open.abc.com", "open.abc.com"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("open domain refused", err)
+	}
+	if resp, _, err := get("open.abc.com", "secure.abc.com"); err != nil || resp.StatusCode != http.StatusMisdirectedRequest {
+		t.Fatal("secure domain reached with the server name of another domain", err)
+	}
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://secure.abc.com/", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatal("secure domain reached over http", w.Code)
+	}
+
+	//the optional mode lets clients without a certificate in
+	if !proxy.updateConfig("test", func(cfg *ReverseProxyConfigData) bool {
+		cfg.ReverseProxy[0].ClientAuth.Mode = "optional"
+		return true
+	}) {
+		t.Fatal("update config failed")
+	}
+	if resp, body, err := get("secure.abc.com", "secure.abc.com"); err != nil || resp.StatusCode != http.StatusOK || body != "|" {
+		t.Fatalf("optional client certificate refused %v %s", err, body)
+	}
+	if _, _, err := get("secure.abc.com", "secure.abc.com", ca.issue(t, 5, "mallory")); err == nil {
+		t.Fatal("subject not allowed accepted in optional mode")
+	}
+
+	//the certificates revoked after the config is loaded are refused
+	ca.writeCRL(t, crlFile, 2, 6)
+	if _, _, err := get("secure.abc.com", "secure.abc.com", alice); err == nil {
+		t.Fatal("revoked certificate accepted")
+	}
+	if resp, _, err := get("secure.abc.com", "secure.abc.com", ca.issue(t, 7, "alice")); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("certificate not revoked refused", err)
+	}
+	//a CRL of another CA is refused
+	newTestClientCA(t, "clients").writeCRL(t, crlFile)
+	if (&ClientAuthConfig{Switch: "on", CAFile: caFile, CRLFile: crlFile}).validate() == nil {
+		t.Fatal("CRL of another CA accepted")
+	}
+}
+
+func TestClientAuthValidate(t *testing.T) {
+	for _, cfg := range []*ClientAuthConfig{
+		{Switch: "yes"},
+		{Switch: "on", Mode: "always"},
+		{Switch: "on", SubjectHeader: "X Subject"},
+		{Switch: "on", CAFile: "missing.pem"},
+	} {
+		if cfg.validate() == nil {
+			t.Fatalf("invalid client_auth accepted %+v", cfg)
+		}
+	}
+}
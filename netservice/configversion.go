@@ -0,0 +1,150 @@
+package netservice
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"ActivedRouter/global"
+	"ActivedRouter/tools"
+)
+
+//A saved version of a config file
+type ConfigVersion struct {
+	Version   int64  `json:"version"`
+	Timestamp int64  `json:"timestamp"`
+	User      string `json:"user"`
+	Comment   string `json:"comment,omitempty"`
+	File      string `json:"file"`
+	Content   string `json:"content,omitempty"`
+}
+
+//versions of config/http_proxy.json are kept in config/versions/http_proxy
+func configVersionDir(configFile string) string {
+	name := filepath.Base(configFile)
+	return filepath.Join(filepath.Dir(configFile), global.ConfigVersionDir, strings.TrimSuffix(name, filepath.Ext(name)))
+}
+
+//Number of versions kept for each config file
+func configVersionKeep() int {
+	if ServerConfigData.ConfigVersions > 0 {
+		return ServerConfigData.ConfigVersions
+	}
+	return global.DefaultConfigVersions
+}
+
+//Replace the config file atomically and keep the content as a new version,
+//the replaced file is applied even if the version can't be kept
+func saveConfigFile(configFile string, bts []byte, user, comment string) error {
+	if err := tools.WriteFileAtomic(configFile, bts, 0644); err != nil {
+		return err
+	}
+	if err := saveConfigVersion(configFile, bts, user, comment); err != nil {
+		log.Println("Save config version of", configFile, "error:", err)
+	}
+	return nil
+}
+
+//Store the content as the newest version and remove the oldest ones
+func saveConfigVersion(configFile string, bts []byte, user, comment string) error {
+	dir := configVersionDir(configFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	now := time.Now()
+	version := &ConfigVersion{
+		Version:   now.UnixNano(),
+		Timestamp: now.Unix(),
+		User:      user,
+		Comment:   comment,
+		File:      configFile,
+		Content:   string(bts),
+	}
+	data, err := json.MarshalIndent(version, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := tools.WriteFileAtomic(filepath.Join(dir, strconv.FormatInt(version.Version, 10)+".json"), data, 0644); err != nil {
+		return err
+	}
+	versions, err := ListConfigVersions(configFile)
+	if err != nil {
+		return err
+	}
+	if keep := configVersionKeep(); len(versions) > keep {
+		for _, old := range versions[keep:] {
+			os.Remove(filepath.Join(dir, strconv.FormatInt(old.Version, 10)+".json"))
+		}
+	}
+	return nil
+}
+
+//List the versions of the config file,newest first,without the content
+func ListConfigVersions(configFile string) ([]*ConfigVersion, error) {
+	dir := configVersionDir(configFile)
+	fileInfos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []*ConfigVersion{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	versions := []*ConfigVersion{}
+	for _, fileInfo := range fileInfos {
+		id, err := strconv.ParseInt(strings.TrimSuffix(fileInfo.Name(), ".json"), 10, 64)
+		if err != nil || fileInfo.IsDir() {
+			continue
+		}
+		if version, err := GetConfigVersion(configFile, id); err == nil {
+			version.Content = ""
+			versions = append(versions, version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+	return versions, nil
+}
+
+//Get a version of the config file with its content
+func GetConfigVersion(configFile string, id int64) (*ConfigVersion, error) {
+	bts, err := ioutil.ReadFile(filepath.Join(configVersionDir(configFile), strconv.FormatInt(id, 10)+".json"))
+	if err != nil {
+		return nil, errors.New("config version not found")
+	}
+	version := &ConfigVersion{}
+	if err := json.Unmarshal(bts, version); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+//Line diff between two versions,version 0 is the current file
+func DiffConfigVersions(configFile string, from, to int64) ([]string, error) {
+	content := func(id int64) (string, error) {
+		if id == 0 {
+			bts, err := ioutil.ReadFile(configFile)
+			return string(bts), err
+		}
+		version, err := GetConfigVersion(configFile, id)
+		if err != nil {
+			return "", err
+		}
+		return version.Content, nil
+	}
+	fromContent, err := content(from)
+	if err != nil {
+		return nil, err
+	}
+	toContent, err := content(to)
+	if err != nil {
+		return nil, err
+	}
+	return tools.DiffLines(fromContent, toContent), nil
+}
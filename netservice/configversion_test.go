@@ -0,0 +1,31 @@
+package netservice
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ActivedRouter/global"
+)
+
+func TestSaveConfigFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "configversion")
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "http_proxy.json")
+	if err := saveConfigFile(configFile, []byte("{}"), "admin", ""); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ := ListConfigVersions(configFile); len(versions) != 1 || versions[0].User != "admin" {
+		t.Fatal("version not kept", versions)
+	}
+	//the file is replaced and reported saved even if the version can't be kept
+	os.RemoveAll(filepath.Join(dir, global.ConfigVersionDir))
+	ioutil.WriteFile(filepath.Join(dir, global.ConfigVersionDir), nil, 0644)
+	if err := saveConfigFile(configFile, []byte(`{"a":1}`), "admin", ""); err != nil {
+		t.Fatal(err)
+	}
+	if bts, _ := ioutil.ReadFile(configFile); string(bts) != `{"a":1}` {
+		t.Fatal("config file not replaced", string(bts))
+	}
+}
@@ -0,0 +1,285 @@
+//ActivedRouter
+//Author:usher.yue
+//Amail:usher.yue@gmail.com
+//TencentQQ:4223665
+// Graceful shutdown and listening socket handoff
+
+package netservice
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//socket that can be passed to a new process,*net.TCPListener or *net.UDPConn
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+//listening socket that can be passed to a new process
+type handoffListener struct {
+	Addr     string
+	Listener fileListener
+}
+
+var gracefulMutex = &sync.Mutex{}
+
+//sockets inherited from the parent process,addr => file
+var inheritedListeners = make(map[string]*os.File)
+
+//pipe to the parent process,written once the inherited sockets are served
+var upgradeReady *os.File
+
+//closed once all the inherited sockets are listened on again
+var inheritedClaimed = make(chan struct{})
+
+//all listening sockets of this process,in creation order
+var gracefulListeners []*handoffListener
+
+//services drained on shutdown
+var gracefulHttpServers []*http.Server
+var gracefulRouterServers []*Server
+var gracefulClients []*Client
+var gracefulSNIListeners []*sniListener
+
+//Parse the sockets passed by the parent process,
+//fd 3 is the first address in the environment variable.
+func init() {
+	if fd, err := strconv.Atoi(os.Getenv(global.UpgradeReadyEnv)); err == nil {
+		upgradeReady = os.NewFile(uintptr(fd), "upgrade-ready")
+	}
+	os.Unsetenv(global.UpgradeReadyEnv)
+	addrs := os.Getenv(global.InheritListenersEnv)
+	os.Unsetenv(global.InheritListenersEnv)
+	if addrs != "" {
+		for i, addr := range strings.Split(addrs, ";") {
+			inheritedListeners[addr] = os.NewFile(uintptr(3+i), addr)
+		}
+	}
+	if len(inheritedListeners) == 0 {
+		close(inheritedClaimed)
+	}
+}
+
+//Take the socket inherited for key,gracefulMutex is held
+func claimInherited(key string) (*os.File, bool) {
+	file, ok := inheritedListeners[key]
+	if !ok {
+		return nil, false
+	}
+	delete(inheritedListeners, key)
+	if len(inheritedListeners) == 0 {
+		close(inheritedClaimed)
+	}
+	return file, true
+}
+
+//Tell the parent process to stop once all the inherited sockets are served.
+//Sockets of the addresses not configured any more are closed after half the upgrade timeout.
+func notifyUpgradeReady() {
+	if upgradeReady == nil {
+		return
+	}
+	select {
+	case <-inheritedClaimed:
+	case <-time.After(global.DefaultUpgradeTimeout * time.Second / 2):
+		gracefulMutex.Lock()
+		for addr, file := range inheritedListeners {
+			log.Println("Inherited socket not used:", addr)
+			file.Close()
+		}
+		inheritedListeners = make(map[string]*os.File)
+		gracefulMutex.Unlock()
+	}
+	upgradeReady.Write([]byte{1})
+	upgradeReady.Close()
+	upgradeReady = nil
+}
+
+//Listen on addr or reuse the socket inherited from the parent process
+func listenTCP(addr string) (net.Listener, error) {
+	gracefulMutex.Lock()
+	defer gracefulMutex.Unlock()
+	var l net.Listener
+	var err error
+	if file, ok := claimInherited(addr); ok {
+		l, err = net.FileListener(file)
+		file.Close()
+		if err == nil {
+			log.Println("Inherit listening socket:", addr)
+		}
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tcpListener, ok := l.(*net.TCPListener); ok {
+		gracefulListeners = append(gracefulListeners, &handoffListener{Addr: addr, Listener: tcpListener})
+	}
+	return l, nil
+}
+
+//Drop the closed socket of addr from the sockets passed to a new process
+func forgetListener(addr string) {
+	gracefulMutex.Lock()
+	defer gracefulMutex.Unlock()
+	//a new slice,upgradeProcess may be reading the old one
+	var listeners []*handoffListener
+	for _, l := range gracefulListeners {
+		if l.Addr != addr {
+			listeners = append(listeners, l)
+		}
+	}
+	gracefulListeners = listeners
+}
+
+//Listen on the udp addr or reuse the socket inherited from the parent process
+func listenUDP(addr string) (*net.UDPConn, error) {
+	gracefulMutex.Lock()
+	defer gracefulMutex.Unlock()
+	//udp sockets are passed with the prefix,the same port may be used by tcp
+	key := "udp://" + addr
+	var conn *net.UDPConn
+	if file, ok := claimInherited(key); ok {
+		packetConn, err := net.FilePacketConn(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		udpConn, ok := packetConn.(*net.UDPConn)
+		if !ok {
+			packetConn.Close()
+			return nil, errors.New("inherited socket " + addr + " is not udp")
+		}
+		log.Println("Inherit udp socket:", addr)
+		conn = udpConn
+	} else {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if conn, err = net.ListenUDP("udp", udpAddr); err != nil {
+			return nil, err
+		}
+	}
+	gracefulListeners = append(gracefulListeners, &handoffListener{Addr: key, Listener: conn})
+	return conn, nil
+}
+
+//Serve an http server on a handoff-able socket
+func serveHttp(srv *http.Server) error {
+	return serveWrappedHttp(srv, nil)
+}
+
+//Serve on the listener returned by wrap,the inherited socket is still the raw one
+func serveWrappedHttp(srv *http.Server, wrap func(net.Listener) net.Listener) error {
+	l, err := listenTCP(srv.Addr)
+	if err != nil {
+		return err
+	}
+	if wrap != nil {
+		l = wrap(l)
+	}
+	registerHttpServer(srv)
+	return srv.Serve(l)
+}
+
+func registerHttpServer(srv *http.Server) {
+	gracefulMutex.Lock()
+	gracefulHttpServers = append(gracefulHttpServers, srv)
+	gracefulMutex.Unlock()
+}
+
+func registerRouterServer(srv *Server) {
+	gracefulMutex.Lock()
+	gracefulRouterServers = append(gracefulRouterServers, srv)
+	gracefulMutex.Unlock()
+}
+
+func registerSNIListener(listener *sniListener) {
+	gracefulMutex.Lock()
+	gracefulSNIListeners = append(gracefulSNIListeners, listener)
+	gracefulMutex.Unlock()
+}
+
+func registerClient(client *Client) {
+	gracefulMutex.Lock()
+	gracefulClients = append(gracefulClients, client)
+	gracefulMutex.Unlock()
+}
+
+//Duration to drain the in-flight requests and connections
+func shutdownTimeout() time.Duration {
+	if ServerConfigData.ShutdownTimeout > 0 {
+		return time.Duration(ServerConfigData.ShutdownTimeout) * time.Second
+	}
+	return global.DefaultShutdownTimeout * time.Second
+}
+
+//Stop accepting,then drain the proxy requests,passthrough streams and client agent connections until the deadline
+func StopNetworkService() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+	gracefulMutex.Lock()
+	httpServers := gracefulHttpServers
+	routerServers := gracefulRouterServers
+	clients := gracefulClients
+	sniListeners := gracefulSNIListeners
+	gracefulMutex.Unlock()
+	wg := &sync.WaitGroup{}
+	for _, srv := range httpServers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Println("Shutdown http service", srv.Addr, err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	for _, srv := range routerServers {
+		wg.Add(1)
+		go func(srv *Server) {
+			defer wg.Done()
+			srv.Shutdown(ctx)
+		}(srv)
+	}
+	for _, listener := range sniListeners {
+		wg.Add(1)
+		go func(listener *sniListener) {
+			defer wg.Done()
+			listener.shutdown(ctx)
+		}(listener)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		DefaultTCPProxy.Shutdown(ctx)
+	}()
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *Client) {
+			defer wg.Done()
+			client.Disconnect()
+		}(client)
+	}
+	wg.Wait()
+	CloseAccessLoggers()
+	CloseSpanExporter()
+	if global.RunMode == global.ReverseProxyMode {
+		//keep the unfinished interval
+		saveProxyStatistics(global.GProxyHttpStatistics.NextInterval())
+	}
+	log.Println("ActivedRouter network service stopped")
+}
@@ -0,0 +1,126 @@
+//go:build !windows
+// +build !windows
+
+package netservice
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//Wait for the stop and upgrade signals
+//SIGTERM SIGINT  graceful shutdown
+//SIGUSR2         start the new binary with the listening sockets,then graceful shutdown
+//SIGHUP          reload the reverse proxy config file
+func WaitForSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2, syscall.SIGHUP)
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGTERM, syscall.SIGINT:
+			{
+				log.Println("Receive signal", sig, ",shutting down......")
+				StopNetworkService()
+				return
+			}
+		case syscall.SIGHUP:
+			{
+				if global.RunMode == global.ReverseProxyMode {
+					log.Println("Receive signal", sig, ",reloading proxy config......")
+					DefaultHttpReverseProxy.ReloadProxyConfig()
+				}
+			}
+		case syscall.SIGUSR2:
+			{
+				log.Println("Receive signal", sig, ",upgrading......")
+				if pid, err := upgradeProcess(); err != nil {
+					log.Println("Upgrade error:", err, ",keep serving")
+				} else {
+					log.Println("New process serving,pid:", pid)
+					StopNetworkService()
+					return
+				}
+			}
+		}
+	}
+}
+
+//Exec the binary again and pass all listening sockets to it,
+//return once the new process serves them.The new process is killed if it isn't ready in time.
+func upgradeProcess() (int, error) {
+	gracefulMutex.Lock()
+	listeners := gracefulListeners
+	gracefulMutex.Unlock()
+	var files []*os.File
+	var addrs []string
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, item := range listeners {
+		file, err := item.Listener.File()
+		if err != nil {
+			return 0, err
+		}
+		files = append(files, file)
+		addrs = append(addrs, item.Addr)
+	}
+	binary, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	//the new process writes to the pipe once ready,the read fails if it exits before
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+	files = append(files, readyWriter)
+	cmd := exec.Command(binary, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), global.InheritListenersEnv+"="+strings.Join(addrs, ";"),
+		global.UpgradeReadyEnv+"="+strconv.Itoa(3+len(addrs)))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	//only the new process holds the write end now
+	readyWriter.Close()
+	go cmd.Wait()
+	if err := waitUpgradeReady(ready, global.DefaultUpgradeTimeout*time.Second); err != nil {
+		cmd.Process.Kill()
+		return 0, err
+	}
+	return cmd.Process.Pid, nil
+}
+
+//Wait for the byte written by the new process
+func waitUpgradeReady(ready *os.File, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		if _, err := ready.Read(b[:]); err != nil {
+			result <- errors.New("new process exited before serving")
+			return
+		}
+		result <- nil
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return errors.New("new process not ready in time")
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package netservice
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWaitUpgradeReady(t *testing.T) {
+	//ready,exited before serving and not ready in time
+	for name, write := range map[string]func(w *os.File){
+		"ready":  func(w *os.File) { w.Write([]byte{1}); w.Close() },
+		"exited": func(w *os.File) { w.Close() },
+		"hang":   func(w *os.File) {},
+	} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(w)
+		err = waitUpgradeReady(r, 200*time.Millisecond)
+		if (err == nil) != (name == "ready") {
+			t.Fatal(name, err)
+		}
+		r.Close()
+		w.Close()
+	}
+}
@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package netservice
+
+import (
+	"log"
+	"os"
+	"os/signal"
+)
+
+//Wait for the stop signal,socket handoff is not supported on windows
+func WaitForSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	sig := <-signals
+	log.Println("Receive signal", sig, ",shutting down......")
+	StopNetworkService()
+}
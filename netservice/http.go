@@ -2,12 +2,13 @@ package netservice
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
-	"path"
+	"strconv"
+	"time"
 
 	"ActivedRouter/global"
 	"ActivedRouter/system"
@@ -28,11 +29,48 @@ func (self *Http) ClientInfos(w http.ResponseWriter, r *http.Request, _ httprout
 }
 
 //statistics
+//domain     only the domain
+//from to    unix timestamps of the first and last interval
+//summary=on merge the intervals of each domain
 func (self *Http) Statistics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	data := global.GProxyHttpStatistics.GetStatisticsList()
+	r.ParseForm()
+	from, _ := strconv.ParseInt(r.Form.Get("from"), 10, 64)
+	to, _ := strconv.ParseInt(r.Form.Get("to"), 10, 64)
+	data := global.GProxyHttpStatistics.GetStatistics(r.Form.Get("domain"), from, to)
+	if r.Form.Get("summary") == global.SwitchOn {
+		self.WriteJsonInterface(w, system.SummarizeStatistics(data))
+		return
+	}
 	self.WriteJsonInterface(w, data)
 }
 
+//busiest clients,paths,user agents and referers
+//domain     only the domain
+//dimension  client path user_agent referer,all if empty
+//window     recent minutes,the whole kept window if empty
+//n          items of each dimension
+func (self *Http) TopK(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	r.ParseForm()
+	dimension := r.Form.Get("dimension")
+	if dimension != "" {
+		known := false
+		for _, item := range system.TopKDimensions {
+			known = known || item == dimension
+		}
+		if !known {
+			self.WriteJsonInterface(w, map[string]interface{}{"status": 0, "error": "unknown dimension"})
+			return
+		}
+	}
+	window, _ := strconv.Atoi(r.Form.Get("window"))
+	n, err := strconv.Atoi(r.Form.Get("n"))
+	if err != nil || n <= 0 {
+		n = global.DefaultTopKItems
+	}
+	data := global.GProxyTopK.Top(r.Form.Get("domain"), dimension, window, n, time.Now())
+	self.WriteJsonInterface(w, map[string]interface{}{"status": 1, "top": data})
+}
+
 func (self *Http) WriteJsonString(w http.ResponseWriter, str string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(str))
@@ -52,8 +90,50 @@ func (self *Http) ActiveClientInfos(w http.ResponseWriter, r *http.Request, _ ht
 
 //The highest weight of the server
 func (self *Http) BestClients(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	data := global.GHostInfoTable.ActiveHostWeightList.Front().Value
-	self.WriteJsonInterface(w, data)
+	hosts := global.GHostInfoTable.ActiveHostsByWeight()
+	if len(hosts) == 0 {
+		self.WriteJsonString(w, `null`)
+		return
+	}
+	self.WriteJsonInterface(w, hosts[0])
+}
+
+//statistics history of the domains
+//resolution minute hour day,chosen by the time range if empty
+//domain from to filter the records
+func (self *Http) StatisticsHistory(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	self.writeHistory(w, r, system.RecordProxy, r.FormValue("domain"))
+}
+
+//statistics history of the hosts,filtered by ip
+func (self *Http) HostHistory(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	self.writeHistory(w, r, system.RecordHost, r.FormValue("ip"))
+}
+
+func (self *Http) writeHistory(w http.ResponseWriter, r *http.Request, kind, key string) {
+	from, _ := strconv.ParseInt(r.FormValue("from"), 10, 64)
+	to, _ := strconv.ParseInt(r.FormValue("to"), 10, 64)
+	resolution := r.FormValue("resolution")
+	switch resolution {
+	case system.ResolutionMinute, system.ResolutionHour, system.ResolutionDay:
+	case "":
+		resolution = system.AutoResolution(from, to)
+	default:
+		self.WriteJsonInterface(w, map[string]interface{}{"status": 0, "error": "unknown resolution"})
+		return
+	}
+	records, err := DefaultStatisticsStore().Query(resolution, kind, key, from, to)
+	if err != nil {
+		self.WriteJsonInterface(w, map[string]interface{}{"status": 0, "error": err.Error()})
+		return
+	}
+	self.WriteJsonInterface(w, map[string]interface{}{"status": 1, "resolution": resolution, "records": records})
+}
+
+//Prometheus metrics
+func (self *Http) Metrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(MetricsText())
 }
 
 //index redirect to static
@@ -77,20 +157,100 @@ func (self *Http) ProxyInfos(w http.ResponseWriter, r *http.Request, prms httpro
 	self.WriteJsonInterface(w, hostInfos)
 }
 
+//Tcp proxy listeners and node health,?addr= for one listener
+func (self *Http) TCPProxyInfos(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	self.WriteJsonInterface(w, DefaultTCPProxy.Status(r.URL.Query().Get("addr")))
+}
+
+//{"status":1} or {"status":0,"error":...}
+func (self *Http) writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		self.WriteJsonInterface(w, map[string]interface{}{"status": 0, "error": err.Error()})
+	} else {
+		self.WriteJsonString(w, `{"status":1}`)
+	}
+}
+
+//http://127.0.0.1:8080/addtcpproxy,post the tcp proxy item as json
+func (self *Http) AddTCPProxy(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	self.editTCPProxy(w, r, DefaultTCPProxy.AddListener)
+}
+
+//http://127.0.0.1:8080/updatetcpproxy,post the tcp proxy item as json,the addr can't be changed
+func (self *Http) UpdateTCPProxy(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	self.editTCPProxy(w, r, DefaultTCPProxy.UpdateListener)
+}
+
+func (self *Http) editTCPProxy(w http.ResponseWriter, r *http.Request, edit func(*TCPProxyItem, string) error) {
+	item := &TCPProxyItem{}
+	if err := json.NewDecoder(r.Body).Decode(item); err != nil {
+		self.writeResult(w, err)
+		return
+	}
+	self.writeResult(w, edit(item, self.adminUser(r)))
+}
+
+//http://127.0.0.1:8080/deltcpproxy?addr=0.0.0.0:3306
+func (self *Http) DeleteTCPProxy(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	self.writeResult(w, DefaultTCPProxy.RemoveListener(r.FormValue("addr"), self.adminUser(r)))
+}
+
+//http://127.0.0.1:8080/addtcpnode?addr=0.0.0.0:3306&host=192.168.1.12&port=3306&max_conns=100
+func (self *Http) AddTCPNode(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	self.editTCPNode(w, r, DefaultTCPProxy.AddNode)
+}
+
+//http://127.0.0.1:8080/updatetcpnode?addr=0.0.0.0:3306&host=192.168.1.12&port=3306&max_conns=200
+func (self *Http) UpdateTCPNode(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	self.editTCPNode(w, r, DefaultTCPProxy.UpdateNode)
+}
+
+func (self *Http) editTCPNode(w http.ResponseWriter, r *http.Request, edit func(string, *TCPNode, string) error) {
+	node := &TCPNode{Host: r.FormValue("host"), Port: r.FormValue("port")}
+	if maxConns := r.FormValue("max_conns"); maxConns != "" {
+		n, err := strconv.ParseInt(maxConns, 10, 64)
+		if err != nil {
+			self.writeResult(w, err)
+			return
+		}
+		node.MaxConns = n
+	}
+	self.writeResult(w, edit(r.FormValue("addr"), node, self.adminUser(r)))
+}
+
+//http://127.0.0.1:8080/deltcpnode?addr=0.0.0.0:3306&host=192.168.1.12&port=3306
+func (self *Http) DeleteTCPNode(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	self.writeResult(w, DefaultTCPProxy.RemoveNode(r.FormValue("addr"), r.FormValue("host"), r.FormValue("port"), self.adminUser(r)))
+}
+
+//http://127.0.0.1:8080/tcpproxyctl?addr=0.0.0.0:3306&action=start
+//start and stop don't change the config file
+func (self *Http) TCPProxyControl(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	addr := r.FormValue("addr")
+	switch r.FormValue("action") {
+	case "start":
+		self.writeResult(w, DefaultTCPProxy.StartListener(addr))
+	case "stop":
+		self.writeResult(w, DefaultTCPProxy.StopListener(addr))
+	default:
+		self.writeResult(w, errors.New("action must be start or stop"))
+	}
+}
+
 func (self *Http) DomainInfos(w http.ResponseWriter, r *http.Request, prms httprouter.Params) {
 	keysArray := DefaultHttpReverseProxy.DomainInfos()
 	self.WriteJsonInterface(w, keysArray)
 }
 
 func (self *Http) AddDomain(w http.ResponseWriter, r *http.Request, prms httprouter.Params) {
-	if DefaultHttpReverseProxy.AddDomainConfig(prms.ByName("domain")) {
+	if DefaultHttpReverseProxy.AddDomainConfig(prms.ByName("domain"), self.adminUser(r)) {
 		self.WriteJsonString(w, `{"status":"1"}`)
 	} else {
 		self.WriteJsonString(w, `{"status":"0"}`)
 	}
 }
 func (self *Http) DelDomain(w http.ResponseWriter, r *http.Request, prms httprouter.Params) {
-	if DefaultHttpReverseProxy.DeleteDomainConig(prms.ByName("domain")) {
+	if DefaultHttpReverseProxy.DeleteDomainConig(prms.ByName("domain"), self.adminUser(r)) {
 		self.WriteJsonString(w, `{"status":"1"}`)
 	} else {
 		self.WriteJsonString(w, `{"status":"0"}`)
@@ -102,7 +262,7 @@ func (self *Http) UpdateDomain(w http.ResponseWriter, r *http.Request, prms http
 	r.ParseForm()
 	preDomain := r.Form.Get("predomain")
 	updateDomain := r.Form.Get("updatedomain")
-	if DefaultHttpReverseProxy.UpdateDomain(preDomain, updateDomain, "on", "on") {
+	if DefaultHttpReverseProxy.UpdateDomain(preDomain, updateDomain, "on", "on", self.adminUser(r)) {
 		self.WriteJsonString(w, `{"status":"1"}`)
 	} else {
 		self.WriteJsonString(w, `{"status":"0"}`)
@@ -114,7 +274,7 @@ func (self *Http) AddProxyClient(w http.ResponseWriter, r *http.Request, _ httpr
 	domain := r.Form.Get("domain")
 	host := r.Form.Get("host")
 	port := r.Form.Get("port")
-	if ret := DefaultHttpReverseProxy.AddProxyClient(domain, host, port, "on", "on"); ret == -1 {
+	if ret := DefaultHttpReverseProxy.AddProxyClient(domain, host, port, "on", "on", self.adminUser(r)); ret == -1 {
 		self.WriteJsonString(w, `{"status":0,"data":{"code":-1}}`)
 	} else if ret == 0 {
 		self.WriteJsonString(w, `{"status":0,"data":{"code":0}}`)
@@ -127,7 +287,7 @@ func (self *Http) DeleteProxyClient(w http.ResponseWriter, r *http.Request, prms
 	domain := r.Form.Get("domain")
 	host := r.Form.Get("host")
 	port := r.Form.Get("port")
-	if ret := DefaultHttpReverseProxy.DeleteProxyClient(domain, host, port); !ret {
+	if ret := DefaultHttpReverseProxy.DeleteProxyClient(domain, host, port, self.adminUser(r)); !ret {
 		self.WriteJsonString(w, `{"status":0}`)
 	} else {
 		self.WriteJsonString(w, `{"status":1}`)
@@ -146,7 +306,7 @@ func (self *Http) UpdateProxyClient(w http.ResponseWriter, r *http.Request, prms
 		self.WriteJsonString(w, `{"status":0}`)
 		return
 	}
-	if ret := DefaultHttpReverseProxy.UpdateProxyClient(domain, preHost, prePort, updateHost, updatePort, "on", "on"); !ret {
+	if ret := DefaultHttpReverseProxy.UpdateProxyClient(domain, preHost, prePort, updateHost, updatePort, "on", "on", self.adminUser(r)); !ret {
 		self.WriteJsonString(w, `{"status":0}`)
 	} else {
 		self.WriteJsonString(w, `{"status":1}`)
@@ -161,15 +321,15 @@ func (self *Http) ProxyControl(w http.ResponseWriter, r *http.Request, prms http
 	var bSuccess = false
 	if proxyProtocol == "https" {
 		if proxySwitch == global.SwitchOn {
-			bSuccess = DefaultHttpReverseProxy.StartAllHttpsService()
+			bSuccess = DefaultHttpReverseProxy.StartAllHttpsService(self.adminUser(r))
 		} else if proxySwitch == global.SwitchOff {
-			bSuccess = DefaultHttpReverseProxy.StopAllHttpsService()
+			bSuccess = DefaultHttpReverseProxy.StopAllHttpsService(self.adminUser(r))
 		}
 	} else if proxyProtocol == "http" {
 		if proxySwitch == global.SwitchOn {
-			bSuccess = DefaultHttpReverseProxy.StartAllHttpService()
+			bSuccess = DefaultHttpReverseProxy.StartAllHttpService(self.adminUser(r))
 		} else if proxySwitch == global.SwitchOff {
-			bSuccess = DefaultHttpReverseProxy.StoptAllHttpService()
+			bSuccess = DefaultHttpReverseProxy.StoptAllHttpService(self.adminUser(r))
 		}
 	}
 	if bSuccess {
@@ -187,48 +347,175 @@ func (self *Http) UploadFile(w http.ResponseWriter, r *http.Request, prms httpro
 	} else {
 		filetype := r.PostFormValue("filetype")
 		domain := r.PostFormValue("domain")
-		if domain == "" {
+		if !validCertificateDomain(domain) {
 			goto ERROR
 		}
-		if filetype == "crt" {
-			if bts, err := ioutil.ReadAll(f); err != nil {
-				goto ERROR
-			} else {
-				filePath := "config/crtdata/" + domain
-				if _, err := os.Stat(filePath); err != nil {
-					os.MkdirAll(filePath, 0777)
-				}
-				if err := ioutil.WriteFile(path.Join(filePath, global.DefaultCertificate), bts, 0777); err != nil {
-					goto ERROR
-				} else {
-					goto SUCCESS
-				}
-			}
-		} else if filetype == "key" {
-			if bts, err := ioutil.ReadAll(f); err != nil {
-				goto ERROR
-			} else {
-				filePath := "config/crtdata/" + domain
-				if _, err := os.Stat(filePath); err != nil {
-					os.MkdirAll(filePath, 0777)
-				}
-				if err := ioutil.WriteFile(path.Join(filePath, global.DefaultKey), bts, 0777); err != nil {
-					goto ERROR
-				} else {
-					goto SUCCESS
-				}
-			}
-		} else {
+		if bts, err := ioutil.ReadAll(f); err != nil {
+			goto ERROR
+		} else if err := saveCertificateFile(domain, filetype, bts); err != nil {
+			log.Println("Save", filetype, "of", domain, "error:", err)
 			goto ERROR
 		}
 	}
-SUCCESS:
+	//the certificate is activated when the uploaded file matches the other one
+	if err := DefaultHttpReverseProxy.ReloadCertificate(r.PostFormValue("domain")); err != nil {
+		self.WriteJsonInterface(w, map[string]interface{}{"status": 1, "reload_error": err.Error()})
+		return
+	}
 	self.WriteJsonString(w, `{"status":1}`)
 	return
 ERROR:
 	self.WriteJsonString(w, `{"status":0}`)
 }
 
+//Certificate inventory,?domain= for one domain
+func (self *Http) Certificates(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if domain := r.URL.Query().Get("domain"); domain != "" {
+		info, err := DefaultHttpReverseProxy.Certificate(domain)
+		if err != nil {
+			self.writeResult(w, err)
+			return
+		}
+		self.WriteJsonInterface(w, info)
+		return
+	}
+	self.WriteJsonInterface(w, DefaultHttpReverseProxy.Certificates())
+}
+
+//Effective TLS policy of the domains,?domain= for one domain
+func (self *Http) SNIPassthrough(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	self.WriteJsonInterface(w, DefaultHttpReverseProxy.SNIStatus())
+}
+
+func (self *Http) TLSPolicy(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if domain := r.URL.Query().Get("domain"); domain != "" {
+		info, err := DefaultHttpReverseProxy.TLSPolicy(domain)
+		if err != nil {
+			self.writeResult(w, err)
+			return
+		}
+		self.WriteJsonInterface(w, info)
+		return
+	}
+	self.WriteJsonInterface(w, DefaultHttpReverseProxy.TLSPolicies())
+}
+
+//Download the certificate of the internal CA
+func (self *Http) CABundle(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	bundle, err := DefaultInternalCA.Bundle()
+	if err != nil {
+		self.writeResult(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", `attachment; filename="ca-bundle.pem"`)
+	w.Write(bundle)
+}
+
+//Download the revocation list of the internal CA
+func (self *Http) CACRL(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	crl, err := DefaultInternalCA.CRL()
+	if err != nil {
+		self.writeResult(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", `attachment; filename="ca.crl"`)
+	w.Write(crl)
+}
+
+//http://127.0.0.1:8080/reloadcertificate?domain=,reload all certificates without domain
+func (self *Http) ReloadCertificate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if domain := r.URL.Query().Get("domain"); domain != "" {
+		self.writeResult(w, DefaultHttpReverseProxy.ReloadCertificate(domain))
+		return
+	}
+	DefaultHttpReverseProxy.ReloadCertificates()
+	self.writeResult(w, nil)
+}
+
+//The admin user who makes the change,
+//basic auth user,X-Admin-User header or user parameter,default is the remote address
+func (self *Http) adminUser(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	if user := r.Header.Get("X-Admin-User"); user != "" {
+		return user
+	}
+	if user := r.FormValue("user"); user != "" {
+		return user
+	}
+	return r.RemoteAddr
+}
+
+//config file managed by the admin api,http_proxy or tcp_proxy
+func (self *Http) configFile(name string) string {
+	switch name {
+	case "", "http_proxy":
+		return DefaultHttpReverseProxy.ProxyCongfigFile
+	case "tcp_proxy":
+		return DefaultTCPProxy.ProxyConfigFile
+	}
+	return ""
+}
+
+//http://127.0.0.1:8080/configversions?file=http_proxy
+func (self *Http) ConfigVersions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	r.ParseForm()
+	configFile := self.configFile(r.Form.Get("file"))
+	if configFile == "" {
+		self.WriteJsonString(w, `{"status":0}`)
+		return
+	}
+	if versions, err := ListConfigVersions(configFile); err != nil {
+		self.WriteJsonString(w, `{"status":0}`)
+	} else {
+		self.WriteJsonInterface(w, versions)
+	}
+}
+
+//http://127.0.0.1:8080/configdiff?file=http_proxy&from=1&to=2
+//to is the current file when it's empty
+func (self *Http) ConfigDiff(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	r.ParseForm()
+	configFile := self.configFile(r.Form.Get("file"))
+	from, errFrom := strconv.ParseInt(r.Form.Get("from"), 10, 64)
+	to, _ := strconv.ParseInt(r.Form.Get("to"), 10, 64)
+	if configFile == "" || errFrom != nil {
+		self.WriteJsonString(w, `{"status":0}`)
+		return
+	}
+	if diff, err := DiffConfigVersions(configFile, from, to); err != nil {
+		self.WriteJsonString(w, `{"status":0}`)
+	} else {
+		self.WriteJsonInterface(w, map[string]interface{}{"status": 1, "data": diff})
+	}
+}
+
+//http://127.0.0.1:8080/configrollback?file=http_proxy&version=1
+func (self *Http) ConfigRollback(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	r.ParseForm()
+	version, err := strconv.ParseInt(r.Form.Get("version"), 10, 64)
+	if err != nil {
+		self.WriteJsonString(w, `{"status":0}`)
+		return
+	}
+	switch r.Form.Get("file") {
+	case "", "http_proxy":
+		err = DefaultHttpReverseProxy.RollbackProxyConfig(version, self.adminUser(r))
+	case "tcp_proxy":
+		err = DefaultTCPProxy.RollbackProxyConfig(version, self.adminUser(r))
+	default:
+		err = errors.New("unknown config file")
+	}
+	if err != nil {
+		self.WriteJsonInterface(w, map[string]interface{}{"status": 0, "error": err.Error()})
+	} else {
+		self.WriteJsonString(w, `{"status":1}`)
+	}
+}
+
 //create http service
 func NewHttp(host, port string) *Http {
 	return &Http{Host: host, Port: port}
@@ -241,8 +528,12 @@ func (self *Http) Run() {
 	//statistics
 	router.GET("/clientinfos", self.ClientInfos)
 	router.GET("/statistics", self.Statistics)
+	router.GET("/statisticshistory", self.StatisticsHistory)
+	router.GET("/hosthistory", self.HostHistory)
+	router.GET("/topk", self.TopK)
 	router.GET("/routerinfo", self.RouterInfo)
 	router.GET("/activeclients", self.ActiveClientInfos)
+	router.GET("/metrics", self.Metrics)
 	router.GET("/bestclients", self.ActiveClientInfos)
 	//Reverse Proxy  config file setting
 	router.GET("/proxyinfos/:domain", self.ProxyInfos)
@@ -253,13 +544,37 @@ func (self *Http) Run() {
 	router.GET("/delproxyclient", self.DeleteProxyClient)
 	router.GET("/updateproxyclient", self.UpdateProxyClient)
 	router.GET("/domaininfos", self.DomainInfos)
+	//certificates of the https proxy
+	router.GET("/certificates", self.Certificates)
+	router.GET("/reloadcertificate", self.ReloadCertificate)
+	router.GET("/tlspolicy", self.TLSPolicy)
+	//nodes of the server names passed through the https listener
+	router.GET("/snipassthrough", self.SNIPassthrough)
+	//internal CA
+	router.GET("/cabundle", self.CABundle)
+	router.GET("/cacrl", self.CACRL)
+	//tcp proxy listeners and nodes
+	router.GET("/tcpproxyinfos", self.TCPProxyInfos)
+	router.POST("/addtcpproxy", self.AddTCPProxy)
+	router.POST("/updatetcpproxy", self.UpdateTCPProxy)
+	router.GET("/deltcpproxy", self.DeleteTCPProxy)
+	router.GET("/addtcpnode", self.AddTCPNode)
+	router.GET("/updatetcpnode", self.UpdateTCPNode)
+	router.GET("/deltcpnode", self.DeleteTCPNode)
+	router.GET("/tcpproxyctl", self.TCPProxyControl)
 	//reverse proxy switch
 	router.GET("/proxyctl", self.ProxyControl)
+	//config file versions
+	router.GET("/configversions", self.ConfigVersions)
+	router.GET("/configdiff", self.ConfigDiff)
+	router.GET("/configrollback", self.ConfigRollback)
 	//statc file server
 	router.GET("/", self.Index)
 	//upload file
 	router.POST("/uploadfile", self.UploadFile)
 	router.ServeFiles("/static/*filepath", http.Dir("static"))
 	router.ServeFiles("/website/*filepath", http.Dir("website"))
-	log.Fatal(http.ListenAndServe(self.Host+":"+self.Port, router))
+	if err := serveHttp(&http.Server{Addr: self.Host + ":" + self.Port, Handler: router}); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
@@ -1,30 +1,34 @@
 package netservice
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"ActivedRouter/cache"
 	"ActivedRouter/global"
 	"ActivedRouter/system"
 	"ActivedRouter/tools"
 )
 
-var DefaultHttpReverseProxy = &HttpReverseProxy{Cfg: &ReverseProxyConfigData{}}
+var DefaultHttpReverseProxy = NewReverseProxy()
 
 //Create new reverse proxy instance
 func NewReverseProxy() *HttpReverseProxy {
-	return &HttpReverseProxy{Cfg: &ReverseProxyConfigData{}}
+	proxy := &HttpReverseProxy{}
+	proxy.routing.Store(newRoutingTable(&ReverseProxyConfigData{}))
+	return proxy
 }
 
 type HostInfo struct {
@@ -38,6 +42,20 @@ type LbNode struct {
 	HttpsSwitch string      `json:"https_switch"`
 	HttpSwitch  string      `json:"http_switch"`
 	Clients     []*HostInfo `json:"clients"`
+	//domain limits,override the global limits
+	MaxHeaderBytes   int64 `json:"max_header_bytes,omitempty"`
+	MaxBodyBytes     int64 `json:"max_body_bytes,omitempty"`
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty"`
+	//domain access log,overrides the global switch,format and sample rate
+	AccessLog *AccessLogConfig `json:"access_log,omitempty"`
+	//domain tracing,overrides the global switch and sample rate
+	Tracing *TracingConfig `json:"tracing,omitempty"`
+	//obtain and renew the certificate with the acme account,on off
+	AutoTLS string `json:"auto_tls,omitempty"`
+	//client certificates required on the https listener
+	ClientAuth *ClientAuthConfig `json:"client_auth,omitempty"`
+	//TLS policy of the domain,overrides the global one
+	TLS *TLSPolicyConfig `json:"tls,omitempty"`
 }
 
 //ReverseProxy Config
@@ -47,142 +65,221 @@ type ReverseProxyConfigData struct {
 	//global http switch
 	GlobalHttpSwitch string `json:"http_switch"`
 	//global https switch
-	GlobalHttpsSwitch string                       `json:"https_switch"`
-	HttpsProxyAddr    string                       `json:"https_proxy_addr"`
-	ReverseProxy      []*LbNode                    `json:"reserve_proxy"`
-	DomainProxySwitch map[string]map[string]string `json:"-"`
+	GlobalHttpsSwitch string    `json:"https_switch"`
+	HttpsProxyAddr    string    `json:"https_proxy_addr"`
+	ReverseProxy      []*LbNode `json:"reserve_proxy"`
+	//listener timeouts in seconds
+	ReadTimeout       int `json:"read_timeout,omitempty"`
+	ReadHeaderTimeout int `json:"read_header_timeout,omitempty"`
+	WriteTimeout      int `json:"write_timeout,omitempty"`
+	IdleTimeout       int `json:"idle_timeout,omitempty"`
+	//global request and response limits in bytes
+	MaxHeaderBytes   int64 `json:"max_header_bytes,omitempty"`
+	MaxBodyBytes     int64 `json:"max_body_bytes,omitempty"`
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty"`
+	//reload the config file when it changes,on off
+	ConfigWatch         string `json:"config_watch,omitempty"`
+	ConfigWatchInterval int    `json:"config_watch_interval,omitempty"`
+	//header carrying the request id,X-Request-Id by default
+	RequestIDHeader string `json:"request_id_header,omitempty"`
+	//export spans of the proxied requests
+	Tracing *TracingConfig `json:"tracing,omitempty"`
+	//access log of all domains
+	AccessLog *AccessLogConfig `json:"access_log,omitempty"`
+	//PROXY protocol headers on the http and https listeners
+	ProxyProtocol *ProxyProtocolConfig `json:"proxy_protocol,omitempty"`
+	//server names passed through the https listener without terminating TLS
+	SNIPassthrough []*SNIRoute `json:"sni_passthrough,omitempty"`
+	//health check of the passthrough nodes,the down ones are skipped
+	SNIHealthCheck *TCPHealthCheck `json:"sni_health_check,omitempty"`
+	//acme account of the domains with auto_tls on
+	ACME *ACMEConfig `json:"acme,omitempty"`
+	//TLS policy of all domains
+	TLS *TLSPolicyConfig `json:"tls,omitempty"`
 }
 
 //reverse proxy handler
 type HttpReverseProxy struct {
-	DomainHostList cache.Cacher
-	Cfg            *ReverseProxyConfigData
-	httpsServer    *HttpsServer
+	//current *routingTable,replaced as a whole on every change
+	routing     atomic.Value
+	httpsServer *HttpsServer
+	//certificates of the domains with auto_tls on
+	acme *ACMEManager
+	//certificates loaded from the certificate dir by domain
+	certMutex  sync.Mutex
+	certStates map[string]*certificateState
+	//handshake configs by server name,built again when the routing table changes
+	tlsMutex        sync.Mutex
+	tlsTable        *routingTable
+	tlsConfigs      map[string]*tls.Config
+	ticketKeys      [][32]byte
+	ticketRotatedAt time.Time
+	//OCSP responses stapled to the certificates by domain
+	ocspMutex  sync.Mutex
+	ocspStates map[string]*ocspState
+	//time of the last alert of the certificate problems
+	certAlerts map[string]time.Time
 	//certificate config
 	CertificateConfigData []*CertificateConfig
 	ProxyCongfigFile      string
-	ProxyMethod           string
+	//serialize admin edits and reloads,md5 of the config file last loaded or saved
+	editMutex    sync.Mutex
+	configDigest string
+}
+
+//Running config,it must not be modified
+func (self *HttpReverseProxy) Config() *ReverseProxyConfigData {
+	return self.table().Cfg
 }
 
 //domain list
 func (self *HttpReverseProxy) DomainInfos() []string {
-	data := *self.DomainHostList.GetStorage().GetData()
 	keysArr := make([]string, 0)
-	for k, _ := range data {
+	for k, _ := range self.table().Domains {
 		keysArr = append(keysArr, k)
 	}
 	return keysArr
 }
 
+//Change a copy of the running config,save it and swap the routing table
+//edit returns false to discard the change
+func (self *HttpReverseProxy) updateConfig(user string, edit func(cfg *ReverseProxyConfigData) bool) bool {
+	self.editMutex.Lock()
+	defer self.editMutex.Unlock()
+	cfg, err := cloneProxyConfig(self.Config())
+	if err != nil {
+		return false
+	}
+	if !edit(cfg) {
+		return false
+	}
+	//the clone loses the state derived from the config,e.g. the CAs of the client certificates
+	if err := cfg.validate(); err != nil {
+		log.Println("Invalid proxy config:", err)
+		return false
+	}
+	bts, err := self.saveConfig(cfg, user)
+	if err != nil {
+		log.Println("Save proxy config error:", err)
+		return false
+	}
+	self.applyProxyConfig(cfg, tools.Md5Encrypt(string(bts)))
+	return true
+}
+
 //Add the domain name to the configuration
-func (self *HttpReverseProxy) AddDomainConfig(domain string) bool {
-	for _, v := range self.Cfg.ReverseProxy {
-		if v.Domain == domain {
-			return false
+func (self *HttpReverseProxy) AddDomainConfig(domain, user string) bool {
+	return self.updateConfig(user, func(cfg *ReverseProxyConfigData) bool {
+		for _, v := range cfg.ReverseProxy {
+			if v.Domain == domain {
+				return false
+			}
 		}
-	}
-	self.Cfg.ReverseProxy = append(self.Cfg.ReverseProxy, &LbNode{Domain: domain})
-	if self.SaveToFile() {
-		//Hot update
-		self.DomainHostList.Set(domain, []*HostInfo{})
+		cfg.ReverseProxy = append(cfg.ReverseProxy, &LbNode{Domain: domain})
 		return true
-	}
-	return false
+	})
 }
 
 //save to file
-func (this *HttpReverseProxy) SaveToFile() bool {
-	if bts, err := json.MarshalIndent(this.Cfg, "", " "); err != nil {
+//the file is replaced atomically and kept as a version changed by user
+func (this *HttpReverseProxy) SaveToFile(user string) bool {
+	this.editMutex.Lock()
+	defer this.editMutex.Unlock()
+	if bts, err := this.saveConfig(this.Config(), user); err != nil {
+		log.Println("Save proxy config error:", err)
 		return false
 	} else {
-		if file, err := os.OpenFile(this.ProxyCongfigFile, os.O_RDWR|os.O_TRUNC, os.ModePerm); err != nil {
-			defer file.Close()
-			return false
-		} else {
-			if _, err := file.Write(bts); err != nil {
-				return false
-			}
-		}
+		this.configDigest = tools.Md5Encrypt(string(bts))
 	}
 	return true
 }
 
+//Write the config file,the caller holds editMutex
+func (this *HttpReverseProxy) saveConfig(cfg *ReverseProxyConfigData, user string) ([]byte, error) {
+	bts, err := json.MarshalIndent(cfg, "", " ")
+	if err != nil {
+		return nil, err
+	}
+	if err := saveConfigFile(this.ProxyCongfigFile, bts, user, ""); err != nil {
+		return nil, err
+	}
+	return bts, nil
+}
+
+//Roll the config file back to a saved version and apply it
+func (this *HttpReverseProxy) RollbackProxyConfig(id int64, user string) error {
+	this.editMutex.Lock()
+	defer this.editMutex.Unlock()
+	version, err := GetConfigVersion(this.ProxyCongfigFile, id)
+	if err != nil {
+		return err
+	}
+	cfg, err := parseProxyConfig([]byte(version.Content))
+	if err != nil {
+		return err
+	}
+	if err := saveConfigFile(this.ProxyCongfigFile, []byte(version.Content), user, fmt.Sprintf("rollback to %d", id)); err != nil {
+		return err
+	}
+	this.swapProxyConfig(cfg, tools.Md5Encrypt(version.Content), "Rollback proxy config")
+	return nil
+}
+
 //Delete the domain name and sync to the configuration file
-func (self *HttpReverseProxy) DeleteDomainConig(domain string) bool {
-	for k, v := range self.Cfg.ReverseProxy {
-		if v.Domain == domain {
-			//delete item
-			ret, _ := tools.DeleteSlice(self.Cfg.ReverseProxy, k)
-			self.Cfg.ReverseProxy = ret.([]*LbNode)
-			//hot update
-			self.DomainHostList.Del(domain)
-			self.SaveToFile()
+func (self *HttpReverseProxy) DeleteDomainConig(domain, user string) bool {
+	return self.updateConfig(user, func(cfg *ReverseProxyConfigData) bool {
+		for k, v := range cfg.ReverseProxy {
+			if v.Domain == domain {
+				//delete item
+				ret, _ := tools.DeleteSlice(cfg.ReverseProxy, k)
+				cfg.ReverseProxy = ret.([]*LbNode)
+				return true
+			}
 		}
-	}
-	return false
+		return false
+	})
 }
 
 //delete reverse proxydomain
-func (self *HttpReverseProxy) DeleteProxyClient(domain, hostip, port string) bool {
-	for _, v := range self.Cfg.ReverseProxy {
-		if v.Domain == domain {
-			for index, client := range v.Clients {
-				if client.Host == hostip && client.Port == port {
-					//delete item
-					ret, _ := tools.DeleteSlice(v.Clients, index)
-					v.Clients = ret.([]*HostInfo)
-					//hot update
-					if self.DomainHostList.Has(domain) {
-						clientInfoList := self.GetDomainHostList(domain)
-						for index, item := range clientInfoList {
-							if item.Host == hostip && item.Port == port {
-								resultSlice, _ := tools.DeleteSlice(clientInfoList, index)
-								self.DomainHostList.Set(domain, resultSlice)
-							}
-						}
-					}
-					if self.SaveToFile() {
+func (self *HttpReverseProxy) DeleteProxyClient(domain, hostip, port, user string) bool {
+	return self.updateConfig(user, func(cfg *ReverseProxyConfigData) bool {
+		for _, v := range cfg.ReverseProxy {
+			if v.Domain == domain {
+				for index, client := range v.Clients {
+					if client.Host == hostip && client.Port == port {
+						//delete item
+						ret, _ := tools.DeleteSlice(v.Clients, index)
+						v.Clients = ret.([]*HostInfo)
 						return true
-					} else {
-						return false
 					}
 				}
 			}
 		}
-	}
-	return false
+		return false
+	})
 }
 
 //Update Reverse Proxy Client Info
-func (self *HttpReverseProxy) UpdateProxyClient(domain, preHost, prePort, updateHost, updatePort, httpsSwitch, httpSwitch string) bool {
-	for _, v := range self.Cfg.ReverseProxy {
-		if v.Domain == domain {
-			v.HttpsSwitch = httpsSwitch
-			v.HttpSwitch = httpSwitch
-			for _, client := range v.Clients {
-				if client.Host == preHost && client.Port == prePort {
-					client.Host = updateHost
-					client.Port = updatePort
-					//hot update
-					if self.DomainHostList.Has(domain) {
-						clientInfoList := self.GetDomainHostList(domain)
-						for _, item := range clientInfoList {
-							if item.Host == preHost && item.Port == prePort {
-								item.Host = updateHost
-								item.Port = updatePort
-							}
-						}
-					}
-					if self.SaveToFile() {
+func (self *HttpReverseProxy) UpdateProxyClient(domain, preHost, prePort, updateHost, updatePort, httpsSwitch, httpSwitch, user string) bool {
+	found := false
+	ret := self.updateConfig(user, func(cfg *ReverseProxyConfigData) bool {
+		for _, v := range cfg.ReverseProxy {
+			if v.Domain == domain {
+				for _, client := range v.Clients {
+					if client.Host == preHost && client.Port == prePort {
+						v.HttpsSwitch = httpsSwitch
+						v.HttpSwitch = httpSwitch
+						client.Host = updateHost
+						client.Port = updatePort
+						found = true
 						return true
-					} else {
-						return false
 					}
 				}
 			}
 		}
-	}
-	return true
+		return false
+	})
+	return ret || !found
 }
 
 //Add the reverse proxy client to the specified domain name
@@ -190,116 +287,106 @@ func (self *HttpReverseProxy) UpdateProxyClient(domain, preHost, prePort, update
 // -1  Repeat
 //  0  Failure
 //  1  Success
-func (self *HttpReverseProxy) AddProxyClient(domain, hostip, port, httsSwitch, httpSwitch string) int {
-	for _, v := range self.Cfg.ReverseProxy {
-		if v.Domain == domain {
-			//proxy switch
-			v.HttpsSwitch = httsSwitch
-			v.HttpSwitch = httpSwitch
-			for _, client := range v.Clients {
-				if client.Host == hostip && client.Port == port {
-					return -1
+func (self *HttpReverseProxy) AddProxyClient(domain, hostip, port, httsSwitch, httpSwitch, user string) int {
+	repeat := false
+	ret := self.updateConfig(user, func(cfg *ReverseProxyConfigData) bool {
+		for _, v := range cfg.ReverseProxy {
+			if v.Domain == domain {
+				for _, client := range v.Clients {
+					if client.Host == hostip && client.Port == port {
+						repeat = true
+						return false
+					}
 				}
-			}
-			//Add the domain name repeatedly!
-			v.Clients = append(v.Clients, &HostInfo{port, hostip})
-			//hot update
-			if !self.DomainHostList.Has(domain) {
-				self.DomainHostList.Set(domain, []*HostInfo{&HostInfo{port, hostip}})
-			} else {
-				clientList, _ := self.DomainHostList.Get(domain)
-				clientInfoList, _ := clientList.([]*HostInfo)
-				self.DomainHostList.Set(domain, append(clientInfoList, &HostInfo{port, hostip}))
-			}
-			if self.SaveToFile() {
-				return 1
-			} else {
-				return 0
+				//proxy switch
+				v.HttpsSwitch = httsSwitch
+				v.HttpSwitch = httpSwitch
+				v.Clients = append(v.Clients, &HostInfo{port, hostip})
+				return true
 			}
 		}
+		cfg.ReverseProxy = append(cfg.ReverseProxy, &LbNode{Domain: domain, HttpsSwitch: "off", Clients: []*HostInfo{&HostInfo{port, hostip}}})
+		return true
+	})
+	if repeat {
+		return -1
+	} else if !ret {
+		return 0
 	}
-	self.Cfg.ReverseProxy = append(self.Cfg.ReverseProxy, &LbNode{Domain: domain, HttpsSwitch: "off", Clients: []*HostInfo{&HostInfo{port, hostip}}})
-	self.SaveToFile()
 	return 1
 }
 
 //update domain
-func (this *HttpReverseProxy) UpdateDomain(preDomain, updateDomain, httpsSwitch, httpSwitch string) bool {
-	for _, v := range this.Cfg.ReverseProxy {
-		if v.Domain == preDomain {
-			//proxy switch
-			v.HttpsSwitch = httpsSwitch
-			v.HttpSwitch = httpSwitch
-			v.Domain = updateDomain
-			//hot update
-			data, _ := this.DomainHostList.Get(preDomain)
-			this.DomainHostList.Del(preDomain)
-			this.DomainHostList.Set(updateDomain, data)
-			if this.SaveToFile() {
+func (this *HttpReverseProxy) UpdateDomain(preDomain, updateDomain, httpsSwitch, httpSwitch, user string) bool {
+	found := false
+	ret := this.updateConfig(user, func(cfg *ReverseProxyConfigData) bool {
+		for _, v := range cfg.ReverseProxy {
+			if v.Domain == preDomain {
+				//proxy switch
+				v.HttpsSwitch = httpsSwitch
+				v.HttpSwitch = httpSwitch
+				v.Domain = updateDomain
+				found = true
 				return true
-			} else {
-				return false
 			}
 		}
-	}
-	return true
+		return false
+	})
+	return ret || !found
 }
 
-func (self *HttpReverseProxy) ChangeSwitchStatus(domain, protocol, switchStatus string) {
-	for _, v := range self.Cfg.ReverseProxy {
-		if v.Domain == domain {
-			switch protocol {
-			case "http":
-				{
-					v.HttpSwitch = switchStatus
-				}
-			case "https":
-				{
-					v.HttpsSwitch = switchStatus
-				}
-			default:
-				{
-					return
+func (self *HttpReverseProxy) ChangeSwitchStatus(domain, protocol, switchStatus, user string) {
+	self.updateConfig(user, func(cfg *ReverseProxyConfigData) bool {
+		for _, v := range cfg.ReverseProxy {
+			if v.Domain == domain {
+				switch protocol {
+				case "http":
+					{
+						v.HttpSwitch = switchStatus
+					}
+				case "https":
+					{
+						v.HttpsSwitch = switchStatus
+					}
+				default:
+					{
+						return false
+					}
 				}
+				return true
 			}
-			self.SaveToFile()
 		}
-	}
+		return false
+	})
 }
 
 //hostlist by domain
 func (self *HttpReverseProxy) GetDomainHostList(domain string) []*HostInfo {
-	v, _ := self.DomainHostList.Get(domain)
-	vArr, _ := v.([]*HostInfo)
-	return vArr
+	if route, ok := self.table().Domains[domain]; ok {
+		return route.Hosts
+	}
+	return nil
 }
 
 //random method
-func (self *HttpReverseProxy) getRandomHost(domain string) *HostInfo {
-	v, _ := self.DomainHostList.Get(domain)
-	vArr, _ := v.([]*HostInfo)
-	proxyCount := len(vArr)
+func (self *HttpReverseProxy) getRandomHost(route *domainRoute) *HostInfo {
+	proxyCount := len(route.Hosts)
 	//fix bug :integer divide by zero
 	if proxyCount == 0 {
 		return nil
 	}
 	index := rand.Uint32() % uint32(proxyCount)
-	return vArr[index]
+	return route.Hosts[index]
 }
 
 //alived method
 //According to the domain name or ip to obtain the most active cluster host
-func (self *HttpReverseProxy) getAlivedHost(domain string) *HostInfo {
-	v, _ := self.DomainHostList.Get(domain)
-	vArr, _ := v.([]*HostInfo)
-	hostinfo := self.bestHostInfo(vArr)
-	return hostinfo
+func (self *HttpReverseProxy) getAlivedHost(route *domainRoute) *HostInfo {
+	return self.bestHostInfo(route.Hosts)
 }
 
 func (self *HttpReverseProxy) bestHostInfo(hosts []*HostInfo) *HostInfo {
-	hostSortedList := global.GHostInfoTable.ActiveHostWeightList
-	for el := hostSortedList.Front(); el != nil; el = el.Next() {
-		bestHost := el.Value.(system.HostInfo)
+	for _, bestHost := range global.GHostInfoTable.ActiveHostsByWeight() {
 		for _, host := range hosts {
 			if bestHost.Info.IP == host.Host || bestHost.Info.Domain == host.Host {
 				return host
@@ -310,23 +397,17 @@ func (self *HttpReverseProxy) bestHostInfo(hosts []*HostInfo) *HostInfo {
 }
 
 //proxy_method  random  and alived
-func (self *HttpReverseProxy) getHostInfo(host, proxyMethod string) *HostInfo {
-	requestHost := host
-	//Handle non-80 ports
-	if strings.IndexAny(host, ":") != -1 {
-		strs := strings.Split(host, ":")
-		requestHost = strs[0]
-	}
+func (self *HttpReverseProxy) getHostInfo(route *domainRoute, proxyMethod string) *HostInfo {
 	//random
 	//alived
 	switch proxyMethod {
 	case global.Random:
 		{
-			return self.getRandomHost(requestHost)
+			return self.getRandomHost(route)
 		}
 	case global.Alived:
 		{
-			return self.getAlivedHost(requestHost)
+			return self.getAlivedHost(route)
 		}
 	}
 	return nil
@@ -334,40 +415,32 @@ func (self *HttpReverseProxy) getHostInfo(host, proxyMethod string) *HostInfo {
 
 //Http and https access filters
 //If the request protocol is https, check whether the reverse proxy is allowed to pass
-func (self *HttpReverseProxy) accessFilter(w http.ResponseWriter, r *http.Request) bool {
+func (self *HttpReverseProxy) accessFilter(w http.ResponseWriter, r *http.Request, table *routingTable, route *domainRoute) bool {
 	//global https http switch
 	if r.TLS != nil {
 		if !self.httpsServer.checkValidHttpsReq(r.Host) {
-			w.Header().Set("Content-Type", "text/html")
-			w.Write([]byte(r.Host + "&nbsp;&nbsp;can't be accessed via https,please configure a digital certificate........."))
+			writeProxyError(w, r, http.StatusMisdirectedRequest, r.Host+" can't be accessed via https,please configure a digital certificate")
+			return false
 		}
-		if self.Cfg.GlobalHttpsSwitch == global.SwitchOff {
-			w.Header().Set("Content-Type", "text/html")
-			w.Write([]byte(r.Host + "&nbsp;&nbsp;Please open global https proxy switch........."))
-		} else if self.Cfg.GlobalHttpsSwitch == global.SwitchOn {
-			if proxySwitch, ok := self.Cfg.DomainProxySwitch[r.Host]; ok {
-				if httpsSwitch, ok := proxySwitch["https"]; ok {
-					if httpsSwitch == global.SwitchOn {
-						return true
-					}
+		if table.Cfg.GlobalHttpsSwitch == global.SwitchOff {
+			writeProxyError(w, r, http.StatusForbidden, r.Host+" please open global https proxy switch")
+		} else if table.Cfg.GlobalHttpsSwitch == global.SwitchOn {
+			if route != nil {
+				if route.HttpsSwitch == global.SwitchOn {
+					return true
 				}
-				w.Header().Set("Content-Type", "text/html")
-				w.Write([]byte(r.Host + "&nbsp;&nbsp;Please open https proxy switch........."))
+				writeProxyError(w, r, http.StatusForbidden, r.Host+" please open https proxy switch")
 			}
 		}
 	} else {
-		if self.Cfg.GlobalHttpSwitch == global.SwitchOff {
-			w.Header().Set("Content-Type", "text/html")
-			w.Write([]byte(r.Host + "&nbsp;&nbsp;Please open global http proxy switch........."))
+		if table.Cfg.GlobalHttpSwitch == global.SwitchOff {
+			writeProxyError(w, r, http.StatusForbidden, r.Host+" please open global http proxy switch")
 		} else {
-			if proxySwitch, ok := self.Cfg.DomainProxySwitch[r.Host]; ok {
-				if httpsSwitch, ok := proxySwitch["http"]; ok {
-					if httpsSwitch == global.SwitchOn {
-						return true
-					}
+			if route != nil {
+				if route.HttpSwitch == global.SwitchOn {
+					return true
 				}
-				w.Header().Set("Content-Type", "text/html")
-				w.Write([]byte(r.Host + "&nbsp;&nbsp;Please open http proxy switch........."))
+				writeProxyError(w, r, http.StatusForbidden, r.Host+" please open http proxy switch")
 			}
 		}
 	}
@@ -376,16 +449,65 @@ func (self *HttpReverseProxy) accessFilter(w http.ResponseWriter, r *http.Reques
 
 //Http and Https reverse proxy handeler
 func (self *HttpReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if !self.accessFilter(w, r) {
+	//the same routing snapshot is used during the whole request
+	if self.acme != nil && self.acme.serveHTTPChallenge(w, r) {
+		return
+	}
+	table := self.table()
+	route := table.Domains[stripHostPort(r.Host)]
+	r = withRequestID(w, r, table.RequestIDHeader)
+	var record *accessRecord
+	var span *proxySpan
+	if route != nil {
+		var recorder *accessResponseWriter
+		record, recorder = startAccessRecord(w, r)
+		w = recorder
+		if route.Tracing != nil {
+			span = route.Tracing.startSpan(r, route.Domain)
+		}
+		DefaultProxyMetrics.begin(route.Domain)
+		defer func() {
+			record.finish(recorder)
+			DefaultProxyMetrics.end(route.Domain, record)
+			//Update reverse proxy statistics
+			global.GProxyHttpStatistics.UpdateRequestStatistics(route.Domain, record.Upstream,
+				record.Status, record.BytesIn, record.BytesOut, record.Latency)
+			global.GProxyTopK.Observe(route.Domain, record.Time, map[string]string{
+				system.TopKClient:    record.clientIP(),
+				system.TopKPath:      r.URL.Path,
+				system.TopKUserAgent: record.UserAgent,
+				system.TopKReferer:   record.Referer,
+			})
+			if route.AccessLog != nil {
+				route.AccessLog.log(record)
+			}
+			if span != nil {
+				route.Tracing.endSpan(span, record)
+			}
+		}()
+	}
+	if !self.accessFilter(w, r, table, route) {
+		return
+	}
+	if route.ClientAuth != nil {
+		if !route.ClientAuth.check(w, r, route.Domain) {
+			return
+		}
+		route.ClientAuth.setHeaders(r)
+	}
+	if !self.checkRequestLimit(w, r, route.Limit) {
 		return
 	}
 	//Get the business server
-	hostinfo := self.getHostInfo(r.Host, self.ProxyMethod)
+	hostinfo := self.getHostInfo(route, table.ProxyMethod)
 	if hostinfo == nil {
 		//If you can't get the active host then use the random method。
-		hostinfo = self.getHostInfo(r.Host, global.Random)
+		hostinfo = self.getHostInfo(route, global.Random)
+		if span != nil {
+			span.Retries++
+		}
 		if hostinfo == nil {
-			w.Write([]byte(r.Host + "Can't find active server........."))
+			writeProxyError(w, r, http.StatusBadGateway, r.Host+" Can't find active server.........")
 			return
 		}
 	}
@@ -397,9 +519,17 @@ func (self *HttpReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	}
 	// Not modifyed the http request header
 	proxy := httputil.NewSingleHostReverseProxy(remote)
+	limitResponse := self.limitResponse(route.Limit)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		//the client gets our request id,not a second one from upstream
+		resp.Header.Del(table.RequestIDHeader)
+		record.UpstreamStatus = resp.StatusCode
+		DefaultProxyMetrics.setBackendUp(route.Domain, remote.Host, true)
+		return limitResponse(resp)
+	}
+	record.Upstream = remote.Host
+	proxy.ErrorHandler = self.proxyErrorHandler(route.Domain, remote.Host)
 	proxy.ServeHTTP(w, r)
-	//Update reverse proxy statistics
-	go global.GProxyHttpStatistics.UpdateClusterStatistics(r.Host, 0)
 }
 
 //Load Certificate Config
@@ -424,66 +554,33 @@ func (self *HttpReverseProxy) LoadCertificateConfig(certificateConfigFile string
 
 //Load proxy config
 func (self *HttpReverseProxy) LoadProxyConfig(proxyConfigFile string) {
-	var httpAddr, httpsAddr, httpSwitch, httpsSwitch string
+	var httpAddr, httpsAddr string
 	self.ProxyCongfigFile = proxyConfigFile
-	file, err := os.Open(proxyConfigFile)
-	defer file.Close()
+	cfg, digest, err := parseProxyConfigFile(proxyConfigFile)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
-	if bts, err := ioutil.ReadAll(file); err != nil {
-		log.Fatalln(err.Error())
-	} else {
-		if err := json.Unmarshal(bts, &self.Cfg); err != nil {
-			log.Fatalln("Parse proxy config file .....")
-		}
-		self.Cfg.DomainProxySwitch = make(map[string]map[string]string)
-		httpSwitch = self.Cfg.GlobalHttpSwitch
-		httpsSwitch = self.Cfg.GlobalHttpsSwitch
-		//http https  off
-		if httpSwitch != global.SwitchOn && httpsSwitch != global.SwitchOn {
-			log.Fatalln("Please open http or https reverse proxy switch.....")
-		}
-		//Get the http switch
-		if httpSwitch == global.SwitchOn {
-			if self.Cfg.HttpProxyAddr == "" {
-				httpAddr = global.DefaultHttpAddr
-			} else {
-				httpAddr = self.Cfg.HttpProxyAddr
-			}
-			log.Println("Http Switch:" + httpSwitch)
-			log.Println("Http  Addr:" + httpAddr)
-		}
-		//Get the https switch
-		if httpsSwitch == global.SwitchOn {
-			if self.Cfg.HttpsProxyAddr == "" {
-				httpsAddr = global.DefaultHttsAddr
-			} else {
-				httpsAddr = self.Cfg.HttpsProxyAddr
-			}
-			log.Println("Https Switch:" + httpsSwitch)
-			log.Println("Https Addr:" + httpsAddr)
-		}
-		//Proxy method
-		if self.Cfg.ProxyMethod == "" {
-			self.ProxyMethod = global.Random
+	//Get the http switch
+	if cfg.GlobalHttpSwitch == global.SwitchOn {
+		if cfg.HttpProxyAddr == "" {
+			httpAddr = global.DefaultHttpAddr
 		} else {
-			self.ProxyMethod = self.Cfg.ProxyMethod
+			httpAddr = cfg.HttpProxyAddr
 		}
-		//Create a memory cache to store the list of domain names
-		self.DomainHostList = cache.Newcache("memory")
-		clients := self.Cfg.ReverseProxy
-		for _, client := range clients {
-			subDomain := client.Domain
-			//Domain proxy switch
-			self.Cfg.DomainProxySwitch[subDomain] = map[string]string{"http": client.HttpSwitch, "https": client.HttpsSwitch}
-			var subClientList []*HostInfo
-			for _, hostInfo := range client.Clients {
-				subClientList = append(subClientList, hostInfo)
-			}
-			self.DomainHostList.Set(subDomain, subClientList)
+		log.Println("Http Switch:" + cfg.GlobalHttpSwitch)
+		log.Println("Http  Addr:" + httpAddr)
+	}
+	//Get the https switch
+	if cfg.GlobalHttpsSwitch == global.SwitchOn {
+		if cfg.HttpsProxyAddr == "" {
+			httpsAddr = global.DefaultHttsAddr
+		} else {
+			httpsAddr = cfg.HttpsProxyAddr
 		}
+		log.Println("Https Switch:" + cfg.GlobalHttpsSwitch)
+		log.Println("Https Addr:" + httpsAddr)
 	}
+	self.applyProxyConfig(cfg, digest)
 }
 
 //Run the http statistics service
@@ -495,63 +592,107 @@ func (self *HttpReverseProxy) BeginHttpStatistics() {
 			{
 				//reset timer
 				timerStatistics.Reset(time.Second * global.Http_Statistics_Interval)
-				//Incremental statistical curve(曲线)
-				global.GProxyHttpStatistics.UpdateClusterStatistics("", 1)
+				//Incremental statistical curve(曲线),keep the finished interval on disk
+				saveProxyStatistics(global.GProxyHttpStatistics.NextInterval())
 			}
 		}
 	}
 }
 
 //start all https service
-func (self *HttpReverseProxy) StartAllHttpsService() bool {
-	self.Cfg.GlobalHttpsSwitch = global.SwitchOn
-	return self.SaveToFile()
+func (self *HttpReverseProxy) StartAllHttpsService(user string) bool {
+	return self.setGlobalSwitch("https", global.SwitchOn, user)
 }
 
 //stop all  https service
-func (self *HttpReverseProxy) StopAllHttpsService() bool {
-	self.Cfg.GlobalHttpsSwitch = global.SwitchOff
-	return self.SaveToFile()
+func (self *HttpReverseProxy) StopAllHttpsService(user string) bool {
+	return self.setGlobalSwitch("https", global.SwitchOff, user)
 }
 
 //start all  http service
-func (self *HttpReverseProxy) StartAllHttpService() bool {
-	self.Cfg.GlobalHttpSwitch = global.SwitchOn
-	return self.SaveToFile()
+func (self *HttpReverseProxy) StartAllHttpService(user string) bool {
+	return self.setGlobalSwitch("http", global.SwitchOn, user)
 }
 
 //stop all http service
-func (self *HttpReverseProxy) StoptAllHttpService() bool {
-	self.Cfg.GlobalHttpSwitch = global.SwitchOff
-	return self.SaveToFile()
+func (self *HttpReverseProxy) StoptAllHttpService(user string) bool {
+	return self.setGlobalSwitch("http", global.SwitchOff, user)
+}
+
+func (self *HttpReverseProxy) setGlobalSwitch(protocol, switchStatus, user string) bool {
+	return self.updateConfig(user, func(cfg *ReverseProxyConfigData) bool {
+		if protocol == "https" {
+			cfg.GlobalHttpsSwitch = switchStatus
+		} else {
+			cfg.GlobalHttpSwitch = switchStatus
+		}
+		return true
+	})
+}
+
+//Read the PROXY protocol header with the config of the running routing table
+func (self *HttpReverseProxy) proxyProtocolListener(l net.Listener) net.Listener {
+	return newProxyProtocolListener(l, func() *ProxyProtocolConfig { return self.Config().ProxyProtocol })
+}
+
+//The PROXY protocol header is read before the ClientHello,
+//the passthrough server names are routed before the https server terminates TLS
+func (self *HttpReverseProxy) httpsListener(l net.Listener) net.Listener {
+	listener := newSNIListener(self.proxyProtocolListener(l), func() []*SNIRoute { return self.Config().SNIPassthrough })
+	registerSNIListener(listener)
+	return listener
 }
 
 //Run Reverse Proxy
 func (self *HttpReverseProxy) StartProxyServer() {
+	cfg := self.Config()
+	self.acme = NewACMEManager()
 	//Http service switch
-	if self.Cfg.GlobalHttpSwitch == global.SwitchOn {
+	if cfg.GlobalHttpSwitch == global.SwitchOn {
 		go func() {
-			err := http.ListenAndServe(self.Cfg.HttpProxyAddr, DefaultHttpReverseProxy)
-			if err != nil {
+			err := serveWrappedHttp(self.newProxyServer(cfg.HttpProxyAddr, DefaultHttpReverseProxy), self.proxyProtocolListener)
+			if err != nil && err != http.ErrServerClosed {
 				log.Fatalln("ListenAndServe HTTP: ", err)
 			} else {
-				log.Println("Listen Http :", self.Cfg.HttpProxyAddr)
+				log.Println("Listen Http :", cfg.HttpProxyAddr)
 			}
 		}()
 	}
 	//Https  service switch
-	if self.Cfg.GlobalHttpsSwitch == global.SwitchOn {
+	if cfg.GlobalHttpsSwitch == global.SwitchOn {
+		self.httpsServer = NewHttpsServer()
+		self.setServerLimit(&self.httpsServer.Server)
+		self.httpsServer.WrapListener = self.httpsListener
+		self.httpsServer.ChallengeCertificate = self.acme.challengeCertificate
+		self.httpsServer.GetConfigForClient = self.configForClient
+		//the configs of the domains are cloned from this one,so the http protocols are listed too
+		self.httpsServer.TLSConfig = &tls.Config{NextProtos: []string{"h2", "http/1.1", acmeALPNProto}}
+	}
+	//Load the certificates and reload them when their files change
+	self.ReloadCertificates()
+	go self.WatchCertificates()
+	//Alert the certificates close to the expiry
+	go self.RunCertificateCheck()
+	if cfg.GlobalHttpsSwitch == global.SwitchOn {
+		//Rotate the session ticket keys and staple the OCSP responses
+		go self.RunTicketKeyRotation()
+		go self.RunOCSPStapling()
+		go self.RunSNIHealthCheck()
 		go func() {
-			self.httpsServer = NewHttpsServer()
-			self.httpsServer.AddDomainCertificateConfig(self.CertificateConfigData)
-			err := self.httpsServer.RunHttpsService(self.Cfg.HttpsProxyAddr, "", "", self)
-			if err != nil {
+			err := self.httpsServer.RunHttpsService(cfg.HttpsProxyAddr, "", "", self)
+			if err != nil && err != http.ErrServerClosed {
 				log.Fatalln("RunHttpServer:", err)
 			} else {
-				log.Println("Listen Http SSL:", self.Cfg.HttpsProxyAddr)
+				log.Println("Listen Http SSL:", cfg.HttpsProxyAddr)
 			}
 		}()
 	}
+	//Reload the config file when it changes
+	if cfg.ConfigWatch == global.SwitchOn {
+		go self.WatchProxyConfig()
+	}
+	//Obtain and renew the certificates of the auto_tls domains
+	go self.runACME()
 	//Open http reverse proxy statistics
 	//You can choose whether to open, because this option will affect the http request speed,
 	// you can turn off.
@@ -4,7 +4,10 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"sync"
 )
 
 func NewHttpsServer() *HttpsServer {
@@ -23,11 +26,25 @@ type HttpsServer struct {
 	http.Server
 	//If GetCertificate is set, the leaf certificate is returned by calling this function.
 	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	//If WrapListener is set, the connections are accepted from the listener it returns.
+	WrapListener func(net.Listener) net.Listener
+	//If ChallengeCertificate returns a certificate, it is used instead of the domain certificate.
+	ChallengeCertificate func(*tls.ClientHelloInfo) *tls.Certificate
+	//If GetConfigForClient is set, the handshake uses the config it returns for the server name.
+	GetConfigForClient func(*tls.ClientHelloInfo) (*tls.Config, error)
+	//domain certificates,replaced while the server is running
+	certMutex    sync.RWMutex
+	certificates map[string]*tls.Certificate
 }
 
 //If the GetCertificate field is not set, defaultGetCertificate will be used as the default value
 func (self *HttpsServer) defaultGetCertificate(clientInfo *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	if x509Cert, ok := self.TLSConfig.NameToCertificate[clientInfo.ServerName]; ok {
+	if self.ChallengeCertificate != nil {
+		if cert := self.ChallengeCertificate(clientInfo); cert != nil {
+			return cert, nil
+		}
+	}
+	if x509Cert := self.DomainCertificate(clientInfo.ServerName); x509Cert != nil {
 		return x509Cert, nil
 	}
 	clientInfo.Conn.Close()
@@ -50,31 +67,75 @@ func (self *HttpsServer) AddDomainCertificateItem(domain, certFile, keyFile stri
 		if self.TLSConfig == nil {
 			self.TLSConfig = &tls.Config{}
 		}
-		if self.TLSConfig.NameToCertificate == nil {
-			self.TLSConfig.NameToCertificate = make(map[string]*tls.Certificate)
-		}
-		self.TLSConfig.Certificates = append(self.TLSConfig.Certificates, x509Cert)
-		self.TLSConfig.NameToCertificate[domain] = &x509Cert
+		self.SetDomainCertificate(domain, &x509Cert)
 	}
 	return nil
 }
 
-//Add the certificate to the tls.Config.Certificates list, and add the domain name mapping
+//Add or replace the certificate of the domain,safe while the server is running
+func (self *HttpsServer) SetDomainCertificate(domain string, cert *tls.Certificate) {
+	self.certMutex.Lock()
+	defer self.certMutex.Unlock()
+	if self.certificates == nil {
+		self.certificates = make(map[string]*tls.Certificate)
+	}
+	self.certificates[domain] = cert
+}
+
+//Replace the certificate of the domain if it is still old
+func (self *HttpsServer) ReplaceDomainCertificate(domain string, old, cert *tls.Certificate) bool {
+	self.certMutex.Lock()
+	defer self.certMutex.Unlock()
+	if self.certificates[domain] != old {
+		return false
+	}
+	self.certificates[domain] = cert
+	return true
+}
+
+//Stop serving the certificate of the domain
+func (self *HttpsServer) RemoveDomainCertificate(domain string) {
+	self.certMutex.Lock()
+	defer self.certMutex.Unlock()
+	delete(self.certificates, domain)
+}
+
+//Certificate of the domain,nil if there is none
+func (self *HttpsServer) DomainCertificate(domain string) *tls.Certificate {
+	self.certMutex.RLock()
+	defer self.certMutex.RUnlock()
+	return self.certificates[domain]
+}
+
+//Add the certificates of the list,a pair that can't be loaded doesn't stop the others,
+//the first error is returned
 func (self *HttpsServer) AddDomainCertificateConfig(config []*CertificateConfig) error {
+	var first error
 	for _, v := range config {
 		if err := self.AddDomainCertificateItem(v.Domain, v.CertFile, v.KeyFile); err != nil {
-			return err
+			log.Println("Load certificate of", v.Domain, "error:", err)
+			if first == nil {
+				first = err
+			}
 		}
 	}
-	return nil
+	return first
+}
+
+//Copy of the domain certificates
+func (self *HttpsServer) DomainCertificates() map[string]*tls.Certificate {
+	self.certMutex.RLock()
+	defer self.certMutex.RUnlock()
+	certs := make(map[string]*tls.Certificate, len(self.certificates))
+	for domain, cert := range self.certificates {
+		certs[domain] = cert
+	}
+	return certs
 }
 
 //Check the legitimacy of https access
 func (self *HttpsServer) checkValidHttpsReq(host string) bool {
-	if _, ok := self.TLSConfig.NameToCertificate[host]; ok {
-		return true
-	}
-	return false
+	return self.DomainCertificate(host) != nil
 }
 
 //Start the https server
@@ -92,8 +153,19 @@ func (self *HttpsServer) RunHttpsService(addr, certFile, keyFile string, handler
 	} else {
 		self.TLSConfig.GetCertificate = self.defaultGetCertificate
 	}
+	if self.GetConfigForClient != nil {
+		self.TLSConfig.GetConfigForClient = self.GetConfigForClient
+	}
 	if self.GetCertificate == nil && self.TLSConfig == nil {
 		return errors.New("RunHttpsService:No Https configuration,Please call AddDomainCertificateConfig  AddDomainCertificateItem or  AddDomainCertificateItem function......")
 	}
-	return self.ListenAndServeTLS(certFile, keyFile)
+	l, err := listenTCP(addr)
+	if err != nil {
+		return err
+	}
+	if self.WrapListener != nil {
+		l = self.WrapListener(l)
+	}
+	registerHttpServer(&self.Server)
+	return self.ServeTLS(l, certFile, keyFile)
 }
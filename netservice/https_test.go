@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"testing"
+	"time"
 )
 
 type Handler struct {
@@ -21,10 +22,17 @@ var handler = &Handler{}
 //handshake_server.go hs.cert, err = c.config.getCertificate(hs.clientHelloInfo())
 func Test_Https(t *testing.T) {
 	httpsServer := NewHttpsServer()
-	httpsServer.Init()
+	err := httpsServer.AddDomainCertificateItem("www.abc.com", "../config/crtdata/www.abc.com/server.crt", "../config/crtdata/www.abc.com/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
 	//	cert, _ := httpsServer.TLSConfig.GetCertificate(nil)
 	//	fmt.Println(cert)
 	//err := httpsServer.RunHttpsService(":3344", "../config/ca/server.crt", "../config/ca/server.key", handler)
-	err := httpsServer.RunHttpsService(":3344", "", "", handler)
-	log.Println(err)
+	go func() {
+		err := httpsServer.RunHttpsService("127.0.0.1:3344", "", "", handler)
+		log.Println(err)
+	}()
+	time.Sleep(time.Millisecond * 100)
+	httpsServer.Close()
 }
@@ -0,0 +1,409 @@
+package netservice
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"ActivedRouter/global"
+	"ActivedRouter/tools"
+)
+
+//Certificate issued by the internal CA
+type IssuedCertificate struct {
+	Serial    string     `json:"serial"`
+	Name      string     `json:"name"`
+	Type      string     `json:"type"`
+	SANs      []string   `json:"sans,omitempty"`
+	NotBefore time.Time  `json:"not_before"`
+	NotAfter  time.Time  `json:"not_after"`
+	CertFile  string     `json:"cert_file"`
+	KeyFile   string     `json:"key_file"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+//Name,type and validity of a new certificate,the SANs are dns names,ip addresses or emails
+type IssueRequest struct {
+	Name string
+	Type string
+	SANs []string
+	Days int
+}
+
+//CA in config/ca,ca/ca.crt and ca/ca.key sign the certificates kept in issued,
+//index.json lists them and ca.crl the revoked ones
+type InternalCA struct {
+	Dir   string
+	mutex sync.Mutex
+}
+
+var DefaultInternalCA = NewInternalCA(global.CADir)
+
+func NewInternalCA(dir string) *InternalCA {
+	return &InternalCA{Dir: dir}
+}
+
+func (self *InternalCA) certFile() string {
+	return filepath.Join(self.Dir, global.CACertificate)
+}
+
+func (self *InternalCA) indexFile() string {
+	return filepath.Join(self.Dir, global.CAIndex)
+}
+
+func (self *InternalCA) crlFile() string {
+	return filepath.Join(self.Dir, global.CACRL)
+}
+
+//Certificate and key of the CA,the key in PKCS#1,PKCS#8 or SEC 1
+func (self *InternalCA) load() (*x509.Certificate, crypto.Signer, error) {
+	bts, err := ioutil.ReadFile(self.certFile())
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return nil, nil, errors.New("no certificate in " + self.certFile())
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyFile := filepath.Join(self.Dir, global.CAKey)
+	if bts, err = ioutil.ReadFile(keyFile); err != nil {
+		return nil, nil, err
+	}
+	if block, _ = pem.Decode(bts); block == nil {
+		return nil, nil, errors.New("no key in " + keyFile)
+	}
+	var key interface{}
+	if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+			if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return nil, nil, fmt.Errorf("unsupported key in %s", keyFile)
+			}
+		}
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported key in %s", keyFile)
+	}
+	return cert, signer, nil
+}
+
+func (self *InternalCA) readIndex() ([]*IssuedCertificate, error) {
+	var list []*IssuedCertificate
+	bts, err := ioutil.ReadFile(self.indexFile())
+	if os.IsNotExist(err) {
+		return list, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bts, &list); err != nil {
+		return nil, fmt.Errorf("%s: %s", self.indexFile(), err)
+	}
+	return list, nil
+}
+
+func (self *InternalCA) writeIndex(list []*IssuedCertificate) error {
+	bts, err := json.MarshalIndent(list, "", " ")
+	if err != nil {
+		return err
+	}
+	return tools.WriteFileAtomic(self.indexFile(), bts, 0644)
+}
+
+//The name is used as the file name
+func validIssueName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\ `) && !strings.HasPrefix(name, ".")
+}
+
+//Sort the SANs into the template
+func addSANs(template *x509.Certificate, sans []string) error {
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if strings.Contains(san, "@") {
+			if _, err := mail.ParseAddress(san); err != nil {
+				return fmt.Errorf("invalid email %s", san)
+			}
+			template.EmailAddresses = append(template.EmailAddresses, san)
+		} else if san != "" && !strings.ContainsAny(san, `/\ :`) {
+			template.DNSNames = append(template.DNSNames, san)
+		} else {
+			return fmt.Errorf("invalid san %q", san)
+		}
+	}
+	return nil
+}
+
+//Issue a server or client certificate,the key and certificate are saved in issued
+func (self *InternalCA) Issue(req *IssueRequest) (*IssuedCertificate, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !validIssueName(req.Name) {
+		return nil, fmt.Errorf("invalid name %q", req.Name)
+	}
+	usage := x509.ExtKeyUsageServerAuth
+	switch req.Type {
+	case "", global.CAServer:
+		req.Type = global.CAServer
+		//a server certificate is valid for its name without SANs
+		if len(req.SANs) == 0 {
+			req.SANs = []string{req.Name}
+		}
+	case global.CAClient:
+		usage = x509.ExtKeyUsageClientAuth
+	default:
+		return nil, fmt.Errorf("unknown certificate type %s", req.Type)
+	}
+	if req.Days < 0 {
+		return nil, errors.New("days can't be negative")
+	}
+	if req.Days == 0 {
+		req.Days = global.DefaultCADays
+	}
+	caCert, caKey, err := self.load()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.AddDate(0, 0, req.Days)
+	if notAfter.After(caCert.NotAfter) {
+		return nil, fmt.Errorf("the certificate would outlive the CA,which expires on %s", caCert.NotAfter.Format("2006-01-02"))
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: req.Name, Organization: caCert.Subject.Organization},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if err := addSANs(template, req.SANs); err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	list, err := self.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	issued := &IssuedCertificate{
+		Serial:    serial.Text(16),
+		Name:      req.Name,
+		Type:      req.Type,
+		SANs:      req.SANs,
+		NotBefore: template.NotBefore,
+		NotAfter:  template.NotAfter,
+	}
+	dir := filepath.Join(self.Dir, global.CAIssuedDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	base := filepath.Join(dir, req.Name+"-"+issued.Serial)
+	issued.CertFile, issued.KeyFile = base+".crt", base+".key"
+	if err := tools.WriteFileAtomic(issued.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return nil, err
+	}
+	//the chain up to the CA
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})...)
+	if err := tools.WriteFileAtomic(issued.CertFile, chain, 0644); err != nil {
+		return nil, err
+	}
+	if err := self.writeIndex(append(list, issued)); err != nil {
+		return nil, err
+	}
+	return issued, nil
+}
+
+//Certificates issued by the CA,the newest first
+func (self *InternalCA) List() ([]*IssuedCertificate, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	list, err := self.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].NotBefore.After(list[j].NotBefore) })
+	return list, nil
+}
+
+//Revoke the certificate and publish a new CRL
+func (self *InternalCA) Revoke(serial string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	list, err := self.readIndex()
+	if err != nil {
+		return err
+	}
+	serial = strings.TrimLeft(strings.ToLower(serial), "0")
+	var found *IssuedCertificate
+	for _, issued := range list {
+		if issued.Serial == serial {
+			found = issued
+		}
+	}
+	if found == nil {
+		return fmt.Errorf("certificate %s not found", serial)
+	}
+	if found.RevokedAt != nil {
+		return fmt.Errorf("certificate %s is revoked", serial)
+	}
+	now := time.Now()
+	found.RevokedAt = &now
+	if err := self.writeCRL(list); err != nil {
+		return err
+	}
+	return self.writeIndex(list)
+}
+
+//Sign the list of the revoked certificates,valid until the next revocation or CACRLDays
+func (self *InternalCA) writeCRL(list []*IssuedCertificate) error {
+	caCert, caKey, err := self.load()
+	if err != nil {
+		return err
+	}
+	var entries []x509.RevocationListEntry
+	for _, issued := range list {
+		if issued.RevokedAt != nil {
+			serial, _ := new(big.Int).SetString(issued.Serial, 16)
+			entries = append(entries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: *issued.RevokedAt})
+		}
+	}
+	//a CA without the key usage extension may sign CRLs,crypto/x509 wants the bit
+	if caCert.KeyUsage == 0 {
+		issuer := *caCert
+		issuer.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		caCert = &issuer
+	}
+	now := time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                now,
+		NextUpdate:                now.AddDate(0, 0, global.DefaultCACRLDays),
+	}, caCert, caKey)
+	if err != nil {
+		return err
+	}
+	return tools.WriteFileAtomic(self.crlFile(), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644)
+}
+
+//Whether the CRL is unreadable or its next update is within CACRLRefreshDays
+func crlExpiring(bts []byte, now time.Time) bool {
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return true
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		return true
+	}
+	return crl.NextUpdate.Before(now.AddDate(0, 0, global.CACRLRefreshDays))
+}
+
+//The CA certificate in PEM,installed by the clients and backends to trust the issued certificates
+func (self *InternalCA) Bundle() ([]byte, error) {
+	caCert, _, err := self.load()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), nil
+}
+
+//The CRL in PEM,an empty one is signed before the first revocation
+//and the list is signed again when its next update is near
+func (self *InternalCA) CRL() ([]byte, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if bts, err := ioutil.ReadFile(self.crlFile()); err == nil && !crlExpiring(bts, time.Now()) {
+		return bts, nil
+	}
+	list, err := self.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	if err := self.writeCRL(list); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(self.crlFile())
+}
+
+//Run the command of global.CACommand and print the result
+func RunCACommand() error {
+	ca := DefaultInternalCA
+	switch global.CACommand {
+	case global.CAIssue:
+		var sans []string
+		for _, san := range strings.Split(global.CASANs, ",") {
+			if san = strings.TrimSpace(san); san != "" {
+				sans = append(sans, san)
+			}
+		}
+		issued, err := ca.Issue(&IssueRequest{Name: global.CAName, Type: global.CAType, SANs: sans, Days: global.CADays})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Issued %s certificate %s\nserial: %s\nsans: %s\nexpires: %s\ncertificate: %s\nkey: %s\n", issued.Type, issued.Name,
+			issued.Serial, strings.Join(issued.SANs, ","), issued.NotAfter.Format("2006-01-02 15:04:05"), issued.CertFile, issued.KeyFile)
+	case global.CAList:
+		list, err := ca.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SERIAL\tNAME\tTYPE\tSANS\tEXPIRES\tSTATUS")
+		for _, issued := range list {
+			status := "valid"
+			if issued.RevokedAt != nil {
+				status = "revoked " + issued.RevokedAt.Format("2006-01-02")
+			} else if time.Now().After(issued.NotAfter) {
+				status = "expired"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", issued.Serial, issued.Name, issued.Type,
+				strings.Join(issued.SANs, ","), issued.NotAfter.Format("2006-01-02"), status)
+		}
+		w.Flush()
+	case global.CARevoke:
+		if err := ca.Revoke(global.CASerial); err != nil {
+			return err
+		}
+		fmt.Println("Revoked certificate", global.CASerial, "CRL:", ca.crlFile())
+	default:
+		return fmt.Errorf("unknown ca command %q,issue list or revoke", global.CACommand)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package netservice
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+func TestInternalCA(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "internalca")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "ca"), 0755)
+	for _, file := range []string{global.CACertificate, global.CAKey} {
+		bts, err := ioutil.ReadFile(filepath.Join("../config/ca", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(filepath.Join(dir, file), bts, 0600)
+	}
+	ca := NewInternalCA(dir)
+	bundle, err := ca.Bundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundle) {
+		t.Fatal("no certificate in the bundle")
+	}
+
+	server, err := ca.Issue(&IssueRequest{Name: "api.internal", SANs: []string{"api.internal", "10.0.0.5", "ops@abc.com"}, Days: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ca.Issue(&IssueRequest{Name: "agent1", Type: global.CAClient})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		issued *IssuedCertificate
+		usage  x509.ExtKeyUsage
+		name   string
+	}{{server, x509.ExtKeyUsageServerAuth, "10.0.0.5"}, {client, x509.ExtKeyUsageClientAuth, ""}} {
+		bts, _ := ioutil.ReadFile(v.issued.CertFile)
+		block, _ := pem.Decode(bts)
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: v.name, KeyUsages: []x509.ExtKeyUsage{v.usage}}); err != nil {
+			t.Fatal(v.issued.Name, err)
+		}
+		if leaf.Subject.CommonName != v.issued.Name || leaf.SerialNumber.Text(16) != v.issued.Serial {
+			t.Fatalf("unexpected certificate %s %s", leaf.Subject, leaf.SerialNumber.Text(16))
+		}
+		if stat, err := os.Stat(v.issued.KeyFile); err != nil || stat.Mode().Perm() != 0600 {
+			t.Fatal("key not saved", err)
+		}
+	}
+	if days := time.Until(server.NotAfter).Hours() / 24; days < 29 || days > 30 {
+		t.Fatal("unexpected validity", days)
+	}
+	if client.SANs != nil || client.NotAfter.Before(time.Now().AddDate(0, 0, global.DefaultCADays-1)) {
+		t.Fatalf("unexpected client certificate %+v", client)
+	}
+	for _, req := range []*IssueRequest{
+		{Name: "../x"},
+		{Name: "x", Type: "peer"},
+		{Name: "x", SANs: []string{"http://x"}},
+		{Name: "x", Days: 200 * 365},
+	} {
+		if _, err := ca.Issue(req); err == nil {
+			t.Fatal("invalid request accepted", req)
+		}
+	}
+
+	//revoked certificates are published in the CRL
+	crl, err := ca.CRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := parseTestCRL(t, crl); len(list.RevokedCertificateEntries) != 0 {
+		t.Fatal("unexpected revoked certificates")
+	}
+	if err := ca.Revoke("00" + server.Serial); err != nil {
+		t.Fatal(err)
+	}
+	if ca.Revoke(server.Serial) == nil || ca.Revoke("abc") == nil {
+		t.Fatal("revoked twice or unknown serial")
+	}
+	crl, _ = ca.CRL()
+	list := parseTestCRL(t, crl)
+	if len(list.RevokedCertificateEntries) != 1 || list.RevokedCertificateEntries[0].SerialNumber.Text(16) != server.Serial {
+		t.Fatal("revoked certificate not in the CRL")
+	}
+	//a CRL near its next update is signed again with the same entries
+	caCert, caKey, _ := ca.load()
+	caCert.KeyUsage |= x509.KeyUsageCRLSign
+	der, _ := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number: big.NewInt(1), ThisUpdate: time.Now().AddDate(0, 0, -7), NextUpdate: time.Now().Add(time.Hour),
+	}, caCert, caKey)
+	ioutil.WriteFile(ca.crlFile(), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644)
+	crl, _ = ca.CRL()
+	list = parseTestCRL(t, crl)
+	if list.NextUpdate.Before(time.Now().AddDate(0, 0, global.DefaultCACRLDays-1)) || len(list.RevokedCertificateEntries) != 1 {
+		t.Fatal("stale CRL not signed again", list.NextUpdate)
+	}
+	issued, err := ca.List()
+	if err != nil || len(issued) != 2 {
+		t.Fatal("unexpected list", issued, err)
+	}
+	for _, v := range issued {
+		if (v.RevokedAt != nil) != (v.Serial == server.Serial) {
+			t.Fatalf("unexpected revocation %+v", v)
+		}
+	}
+}
+
+func parseTestCRL(t *testing.T, crl []byte) *x509.RevocationList {
+	block, _ := pem.Decode(crl)
+	if block == nil {
+		t.Fatal("no CRL")
+	}
+	list, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _, _ := NewInternalCA("../config/ca").load()
+	if err := list.CheckSignatureFrom(caCert); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
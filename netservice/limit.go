@@ -0,0 +1,197 @@
+package netservice
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+var errResponseTooLarge = errors.New("upstream response exceeds the size limit")
+
+//Request and response size limits of a domain,0 means unlimited
+type ProxyLimit struct {
+	MaxHeaderBytes   int64
+	MaxBodyBytes     int64
+	MaxResponseBytes int64
+}
+
+//Merge the domain settings with the global defaults
+func newProxyLimit(cfg *ReverseProxyConfigData, node *LbNode) *ProxyLimit {
+	limit := &ProxyLimit{
+		MaxHeaderBytes:   cfg.MaxHeaderBytes,
+		MaxBodyBytes:     cfg.MaxBodyBytes,
+		MaxResponseBytes: cfg.MaxResponseBytes,
+	}
+	if node.MaxHeaderBytes > 0 {
+		limit.MaxHeaderBytes = node.MaxHeaderBytes
+	}
+	if node.MaxBodyBytes > 0 {
+		limit.MaxBodyBytes = node.MaxBodyBytes
+	}
+	if node.MaxResponseBytes > 0 {
+		limit.MaxResponseBytes = node.MaxResponseBytes
+	}
+	return limit
+}
+
+//Size of the request line and header fields as sent by the client
+func requestHeaderSize(r *http.Request) int64 {
+	size := int64(len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4)
+	for k, values := range r.Header {
+		for _, v := range values {
+			size += int64(len(k) + len(v) + 4)
+		}
+	}
+	return size
+}
+
+//Request body wrapper,keep the read error to tell the client errors from upstream errors
+type limitBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (self *limitBody) Read(p []byte) (int, error) {
+	n, err := self.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		self.err = err
+	}
+	return n, err
+}
+
+//Upstream response body wrapper,fail after reading more than remain bytes
+type limitResponseBody struct {
+	io.ReadCloser
+	remain int64
+}
+
+func (self *limitResponseBody) Read(p []byte) (int, error) {
+	if self.remain <= 0 {
+		//a body of exactly the limit passes,only a byte past it fails
+		var probe [1]byte
+		n, err := self.ReadCloser.Read(probe[:])
+		if n > 0 {
+			return 0, errResponseTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > self.remain {
+		p = p[:self.remain+1]
+	}
+	n, err := self.ReadCloser.Read(p)
+	self.remain -= int64(n)
+	if self.remain < 0 {
+		return n + int(self.remain), errResponseTooLarge
+	}
+	return n, err
+}
+
+//Check the request header and body size before proxying
+//Return false if the request has been rejected
+func (self *HttpReverseProxy) checkRequestLimit(w http.ResponseWriter, r *http.Request, limit *ProxyLimit) bool {
+	if limit.MaxHeaderBytes > 0 && requestHeaderSize(r) > limit.MaxHeaderBytes {
+		self.rejectRequest(w, r, http.StatusRequestEntityTooLarge, global.RejectHeaderTooLarge)
+		return false
+	}
+	if limit.MaxBodyBytes > 0 {
+		if r.ContentLength > limit.MaxBodyBytes {
+			self.rejectRequest(w, r, http.StatusRequestEntityTooLarge, global.RejectBodyTooLarge)
+			return false
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, limit.MaxBodyBytes)
+		}
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &limitBody{ReadCloser: r.Body}
+	}
+	return true
+}
+
+//Reject the upstream response when it is larger than the limit
+func (self *HttpReverseProxy) limitResponse(limit *ProxyLimit) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if limit.MaxResponseBytes <= 0 {
+			return nil
+		}
+		if resp.ContentLength > limit.MaxResponseBytes {
+			return errResponseTooLarge
+		}
+		resp.Body = &limitResponseBody{ReadCloser: resp.Body, remain: limit.MaxResponseBytes}
+		return nil
+	}
+}
+
+//Map proxy errors to the client status code and count the rejected requests
+//Other errors mark the backend of the domain down
+func (self *HttpReverseProxy) proxyErrorHandler(domain, backend string) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			self.rejectRequest(w, r, http.StatusRequestEntityTooLarge, global.RejectBodyTooLarge)
+			return
+		}
+		if errors.Is(err, errResponseTooLarge) {
+			self.rejectRequest(w, r, http.StatusBadGateway, global.RejectResponseTooLarge)
+			return
+		}
+		if body, ok := r.Body.(*limitBody); ok && body.err != nil {
+			var netErr net.Error
+			if errors.As(body.err, &netErr) && netErr.Timeout() {
+				self.rejectRequest(w, r, http.StatusRequestTimeout, global.RejectTimeout)
+				return
+			}
+			if errors.As(body.err, &maxBytesErr) {
+				self.rejectRequest(w, r, http.StatusRequestEntityTooLarge, global.RejectBodyTooLarge)
+				return
+			}
+		}
+		log.Println("http: proxy error:", requestID(r), err)
+		DefaultProxyMetrics.setBackendUp(domain, backend, false)
+		writeProxyError(w, r, http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
+	}
+}
+
+//Write the error status and update the reject statistics
+func (self *HttpReverseProxy) rejectRequest(w http.ResponseWriter, r *http.Request, status int, reason string) {
+	w.Header().Set("Connection", "close")
+	writeProxyError(w, r, status, http.StatusText(status))
+	go global.GProxyHttpStatistics.UpdateClusterRejected(stripHostPort(r.Host), reason)
+}
+
+//Create the listener server with the configured timeouts
+func (self *HttpReverseProxy) newProxyServer(addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	self.setServerLimit(srv)
+	return srv
+}
+
+//Protect the listener from slow clients
+func (self *HttpReverseProxy) setServerLimit(srv *http.Server) {
+	cfg := self.Config()
+	srv.ReadTimeout = time.Duration(cfg.ReadTimeout) * time.Second
+	srv.ReadHeaderTimeout = time.Duration(cfg.ReadHeaderTimeout) * time.Second
+	srv.WriteTimeout = time.Duration(cfg.WriteTimeout) * time.Second
+	srv.IdleTimeout = time.Duration(cfg.IdleTimeout) * time.Second
+	srv.MaxHeaderBytes = self.maxHeaderBytes()
+}
+
+//The listener must accept the largest header allowed by any domain
+func (self *HttpReverseProxy) maxHeaderBytes() int {
+	cfg := self.Config()
+	max := cfg.MaxHeaderBytes
+	for _, node := range cfg.ReverseProxy {
+		if node.MaxHeaderBytes > max {
+			max = node.MaxHeaderBytes
+		}
+	}
+	if max <= 0 {
+		return global.DefaultProxyMaxHeaderBytes
+	}
+	return int(max)
+}
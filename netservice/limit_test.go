@@ -0,0 +1,20 @@
+package netservice
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestLimitResponseBody(t *testing.T) {
+	for size, tooLarge := range map[int]bool{99: false, 100: false, 101: true} {
+		body := &limitResponseBody{ReadCloser: ioutil.NopCloser(strings.NewReader(strings.Repeat("a", size))), remain: 100}
+		bts, err := ioutil.ReadAll(body)
+		if (err == errResponseTooLarge) != tooLarge {
+			t.Fatalf("body of %d bytes: unexpected error %v", size, err)
+		}
+		if !tooLarge && len(bts) != size {
+			t.Fatalf("body of %d bytes: read %d bytes", size, len(bts))
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package netservice
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"ActivedRouter/global"
+	"ActivedRouter/system"
+)
+
+//Upper bounds of the latency histogram buckets in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var DefaultProxyMetrics = NewProxyMetrics()
+
+type requestMetricKey struct {
+	Domain  string
+	Status  string
+	Backend string
+}
+
+type backendMetricKey struct {
+	Domain  string
+	Backend string
+}
+
+//Cumulative latency histogram
+type latencyHistogram struct {
+	Buckets []uint64
+	Count   uint64
+	Sum     float64
+}
+
+//Reverse proxy counters exposed by /metrics
+type ProxyMetrics struct {
+	mutex     sync.Mutex
+	requests  map[requestMetricKey]uint64
+	latency   map[string]*latencyHistogram
+	inFlight  map[string]int64
+	backendUp map[backendMetricKey]bool
+}
+
+func NewProxyMetrics() *ProxyMetrics {
+	return &ProxyMetrics{
+		requests:  make(map[requestMetricKey]uint64),
+		latency:   make(map[string]*latencyHistogram),
+		inFlight:  make(map[string]int64),
+		backendUp: make(map[backendMetricKey]bool),
+	}
+}
+
+//A request of the domain started
+func (self *ProxyMetrics) begin(domain string) {
+	self.mutex.Lock()
+	self.inFlight[domain]++
+	self.mutex.Unlock()
+}
+
+//A request of the domain finished
+func (self *ProxyMetrics) end(domain string, record *accessRecord) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.inFlight[domain]--
+	self.requests[requestMetricKey{domain, strconv.Itoa(record.Status), record.Upstream}]++
+	histogram, ok := self.latency[domain]
+	if !ok {
+		histogram = &latencyHistogram{Buckets: make([]uint64, len(latencyBuckets))}
+		self.latency[domain] = histogram
+	}
+	for i, bound := range latencyBuckets {
+		if record.Latency <= bound {
+			histogram.Buckets[i]++
+		}
+	}
+	histogram.Count++
+	histogram.Sum += record.Latency
+}
+
+//Passive health of the backend,down after a transport error,up after a response
+func (self *ProxyMetrics) setBackendUp(domain, backend string, up bool) {
+	self.mutex.Lock()
+	self.backendUp[backendMetricKey{domain, backend}] = up
+	self.mutex.Unlock()
+}
+
+//Drop the series of the domains and backends not in the routing table,
+//the in-flight gauge is kept until the requests of a removed domain finish
+func (self *ProxyMetrics) retain(table *routingTable) {
+	backends := make(map[backendMetricKey]bool)
+	for domain, route := range table.Domains {
+		for _, host := range route.Hosts {
+			backends[backendMetricKey{domain, net.JoinHostPort(host.Host, host.Port)}] = true
+		}
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for key := range self.requests {
+		//requests rejected before a backend is chosen have no backend
+		if table.Domains[key.Domain] == nil || (key.Backend != "" && !backends[backendMetricKey{key.Domain, key.Backend}]) {
+			delete(self.requests, key)
+		}
+	}
+	for domain := range self.latency {
+		if table.Domains[domain] == nil {
+			delete(self.latency, domain)
+		}
+	}
+	for domain, count := range self.inFlight {
+		if table.Domains[domain] == nil && count == 0 {
+			delete(self.inFlight, domain)
+		}
+	}
+	for key := range self.backendUp {
+		if !backends[key] {
+			delete(self.backendUp, key)
+		}
+	}
+}
+
+//Prometheus text exposition
+type metricSample struct {
+	name   string
+	labels []string
+	value  float64
+}
+
+type metricFamily struct {
+	help    string
+	typ     string
+	samples []metricSample
+}
+
+type metricsWriter struct {
+	families map[string]*metricFamily
+	order    []string
+}
+
+func newMetricsWriter() *metricsWriter {
+	return &metricsWriter{families: make(map[string]*metricFamily)}
+}
+
+//Add a sample,labels are name value pairs
+func (self *metricsWriter) add(family, typ, help, name string, value float64, labels ...string) {
+	item, ok := self.families[family]
+	if !ok {
+		item = &metricFamily{help: help, typ: typ}
+		self.families[family] = item
+		self.order = append(self.order, family)
+	}
+	item.samples = append(item.samples, metricSample{name: name, labels: labels, value: value})
+}
+
+func (self *metricsWriter) gauge(name, help string, value float64, labels ...string) {
+	self.add(name, "gauge", help, name, value, labels...)
+}
+
+func (self *metricsWriter) counter(name, help string, value float64, labels ...string) {
+	self.add(name, "counter", help, name, value, labels...)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (self *metricsWriter) bytes() []byte {
+	var buf bytes.Buffer
+	for _, name := range self.order {
+		family := self.families[name]
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, family.help, name, family.typ)
+		for _, sample := range family.samples {
+			buf.WriteString(sample.name)
+			if len(sample.labels) > 0 {
+				buf.WriteByte('{')
+				for i := 0; i+1 < len(sample.labels); i += 2 {
+					if i > 0 {
+						buf.WriteByte(',')
+					}
+					fmt.Fprintf(&buf, `%s="%s"`, sample.labels[i], escapeLabelValue(sample.labels[i+1]))
+				}
+				buf.WriteByte('}')
+			}
+			buf.WriteByte(' ')
+			buf.WriteString(formatMetricValue(sample.value))
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+//Proxy requests,latency,in-flight requests and backend health
+func (self *ProxyMetrics) collect(writer *metricsWriter) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	requestKeys := make([]requestMetricKey, 0, len(self.requests))
+	for key := range self.requests {
+		requestKeys = append(requestKeys, key)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		a, b := requestKeys[i], requestKeys[j]
+		if a.Domain != b.Domain {
+			return a.Domain < b.Domain
+		}
+		if a.Status != b.Status {
+			return a.Status < b.Status
+		}
+		return a.Backend < b.Backend
+	})
+	for _, key := range requestKeys {
+		writer.counter("activedrouter_proxy_requests_total", "Proxied requests by domain,status and backend.",
+			float64(self.requests[key]), "domain", key.Domain, "status", key.Status, "backend", key.Backend)
+	}
+	for _, domain := range sortedKeys(self.latency) {
+		histogram := self.latency[domain]
+		const name = "activedrouter_proxy_request_duration_seconds"
+		const help = "Latency of the proxied requests."
+		for i, bound := range latencyBuckets {
+			writer.add(name, "histogram", help, name+"_bucket", float64(histogram.Buckets[i]),
+				"domain", domain, "le", formatMetricValue(bound))
+		}
+		writer.add(name, "histogram", help, name+"_bucket", float64(histogram.Count), "domain", domain, "le", "+Inf")
+		writer.add(name, "histogram", help, name+"_sum", histogram.Sum, "domain", domain)
+		writer.add(name, "histogram", help, name+"_count", float64(histogram.Count), "domain", domain)
+	}
+	for _, domain := range sortedKeys(self.inFlight) {
+		writer.gauge("activedrouter_proxy_requests_in_flight", "Requests being proxied.",
+			float64(self.inFlight[domain]), "domain", domain)
+	}
+	backendKeys := make([]backendMetricKey, 0, len(self.backendUp))
+	for key := range self.backendUp {
+		backendKeys = append(backendKeys, key)
+	}
+	sort.Slice(backendKeys, func(i, j int) bool {
+		if backendKeys[i].Domain != backendKeys[j].Domain {
+			return backendKeys[i].Domain < backendKeys[j].Domain
+		}
+		return backendKeys[i].Backend < backendKeys[j].Backend
+	})
+	for _, key := range backendKeys {
+		up := 0.0
+		if self.backendUp[key] {
+			up = 1
+		}
+		writer.gauge("activedrouter_proxy_backend_up", "Whether the last request to the backend got a response.",
+			up, "domain", key.Domain, "backend", key.Backend)
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//Connected client agents and the state of every host
+func collectHostMetrics(writer *metricsWriter) {
+	gracefulMutex.Lock()
+	routerServers := gracefulRouterServers
+	gracefulMutex.Unlock()
+	connected := 0
+	for _, srv := range routerServers {
+		connected += srv.ConnCount()
+	}
+	writer.gauge("activedrouter_router_connected_clients", "Client agents connected to the router.", float64(connected))
+	hosts := global.GHostInfoTable.HostsSnapshot()
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Info.IP < hosts[j].Info.IP
+	})
+	for _, host := range hosts {
+		up := 0.0
+		if host.Status == system.ACTIVE {
+			up = 1
+		}
+		writer.gauge("activedrouter_host_up", "Whether the client agent of the host is active.",
+			up, "cluster", host.Info.Cluster, "ip", host.Info.IP)
+		writer.gauge("activedrouter_host_last_active_timestamp_seconds", "Last heartbeat of the host.",
+			float64(host.LastActive), "cluster", host.Info.Cluster, "ip", host.Info.IP)
+		collectStructMetrics(writer, "activedrouter_host", reflect.ValueOf(host.Info), "cluster", host.Info.Cluster, "ip", host.Info.IP)
+	}
+}
+
+//Every numeric field of the struct is a gauge named after the field path,
+//VM.UsedPercent is activedrouter_host_vm_used_percent,slice items are labeled by index
+func collectStructMetrics(writer *metricsWriter, prefix string, value reflect.Value, labels ...string) {
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := prefix + "_" + snakeCase(field.Name)
+		help := "Host " + field.Name + "."
+		fieldValue := value.Field(i)
+		switch fieldValue.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			writer.gauge(name, help, float64(fieldValue.Int()), labels...)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			writer.gauge(name, help, float64(fieldValue.Uint()), labels...)
+		case reflect.Float32, reflect.Float64:
+			writer.gauge(name, help, fieldValue.Float(), labels...)
+		case reflect.Slice:
+			for j := 0; j < fieldValue.Len(); j++ {
+				item := fieldValue.Index(j)
+				itemLabels := append(append([]string{}, labels...), "index", strconv.Itoa(j))
+				switch item.Kind() {
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+					writer.gauge(name, help, float64(item.Int()), itemLabels...)
+				case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+					writer.gauge(name, help, float64(item.Uint()), itemLabels...)
+				case reflect.Float32, reflect.Float64:
+					writer.gauge(name, help, item.Float(), itemLabels...)
+				}
+			}
+		case reflect.Ptr, reflect.Struct:
+			collectStructMetrics(writer, name, fieldValue, labels...)
+		}
+	}
+}
+
+//CpuPercent is cpu_percent,VM is vm,Load15 is load15
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var buf bytes.Buffer
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				buf.WriteByte('_')
+			}
+		}
+		buf.WriteRune(unicode.ToLower(r))
+	}
+	return buf.String()
+}
+
+//Packets,bytes and sessions of the udp proxy listeners
+func collectUDPMetrics(writer *metricsWriter) {
+	for _, stat := range DefaultTCPProxy.UDPStats() {
+		writer.counter("activedrouter_udp_packets_total", "Datagrams relayed by the udp proxy.",
+			float64(stat.PacketsIn), "listener", stat.Addr, "direction", "in")
+		writer.counter("activedrouter_udp_packets_total", "Datagrams relayed by the udp proxy.",
+			float64(stat.PacketsOut), "listener", stat.Addr, "direction", "out")
+		writer.counter("activedrouter_udp_bytes_total", "Bytes relayed by the udp proxy.",
+			float64(stat.BytesIn), "listener", stat.Addr, "direction", "in")
+		writer.counter("activedrouter_udp_bytes_total", "Bytes relayed by the udp proxy.",
+			float64(stat.BytesOut), "listener", stat.Addr, "direction", "out")
+		writer.counter("activedrouter_udp_dropped_packets_total", "Datagrams dropped without an available node.",
+			float64(stat.Dropped), "listener", stat.Addr)
+		writer.gauge("activedrouter_udp_sessions", "Client sessions of the udp proxy.",
+			float64(stat.Sessions), "listener", stat.Addr)
+	}
+}
+
+//Connections and bytes of the tcp proxy listeners,the state of their nodes
+func collectTCPMetrics(writer *metricsWriter) {
+	for _, stat := range DefaultTCPProxy.Status("") {
+		writer.counter("activedrouter_tcp_connections_total", "Connections proxied by the tcp proxy.",
+			float64(stat.TotalConns), "listener", stat.Addr)
+		writer.counter("activedrouter_tcp_rejected_connections_total", "Connections rejected by the tcp proxy limits.",
+			float64(stat.Rejected), "listener", stat.Addr)
+		writer.counter("activedrouter_tcp_bytes_total", "Bytes relayed by the tcp proxy.",
+			float64(stat.BytesIn), "listener", stat.Addr, "direction", "in")
+		writer.counter("activedrouter_tcp_bytes_total", "Bytes relayed by the tcp proxy.",
+			float64(stat.BytesOut), "listener", stat.Addr, "direction", "out")
+		writer.gauge("activedrouter_tcp_active_connections", "Connections being proxied by the tcp proxy.",
+			float64(stat.ActiveConns), "listener", stat.Addr)
+		for _, node := range stat.Nodes {
+			up := 1.0
+			if node.Status == global.NodeDown {
+				up = 0
+			}
+			writer.gauge("activedrouter_tcp_node_up", "Whether the tcp node passes its health check.",
+				up, "listener", stat.Addr, "node", net.JoinHostPort(node.Host, node.Port))
+		}
+	}
+}
+
+//Prometheus text format of all metrics
+func MetricsText() []byte {
+	writer := newMetricsWriter()
+	DefaultProxyMetrics.collect(writer)
+	collectHostMetrics(writer)
+	collectTCPMetrics(writer)
+	collectUDPMetrics(writer)
+	return writer.bytes()
+}
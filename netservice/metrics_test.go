@@ -0,0 +1,96 @@
+package netservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"ActivedRouter/global"
+	"ActivedRouter/gopsutil/load"
+	"ActivedRouter/gopsutil/mem"
+	"ActivedRouter/system"
+)
+
+func TestMetricsText(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer backend.Close()
+	backendUrl, _ := url.Parse(backend.URL)
+	//nothing listens on the closed server
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadUrl, _ := url.Parse(dead.URL)
+	dead.Close()
+
+	cfg := &ReverseProxyConfigData{
+		GlobalHttpSwitch: "on",
+		ReverseProxy: []*LbNode{
+			{Domain: "metrics.abc.com", HttpSwitch: "on", Clients: []*HostInfo{{Host: backendUrl.Hostname(), Port: backendUrl.Port()}}},
+			{Domain: "metrics.abcd.com", HttpSwitch: "on", Clients: []*HostInfo{{Host: deadUrl.Hostname(), Port: deadUrl.Port()}}},
+		},
+	}
+	proxy := NewReverseProxy()
+	proxy.applyProxyConfig(cfg, "")
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://metrics.abc.com/", nil))
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://metrics.abcd.com/", nil))
+
+	global.GHostInfoTable.UpdateHostTable("10.0.0.9", &system.SystemInfo{
+		Cluster:    "web",
+		IP:         "10.0.0.9",
+		CpuNums:    4,
+		VM:         &mem.VirtualMemoryStat{Total: 1024, UsedPercent: 12.5},
+		LD:         &load.LoadAvgStat{Load1: 0.5},
+		CpuPercent: []float64{10, 20},
+	})
+	text := string(MetricsText())
+	for _, line := range []string{
+		"# TYPE activedrouter_proxy_requests_total counter",
+		`activedrouter_proxy_requests_total{domain="metrics.abc.com",status="404",backend="` + backendUrl.Host + `"} 1`,
+		`activedrouter_proxy_requests_total{domain="metrics.abcd.com",status="502",backend="` + deadUrl.Host + `"} 1`,
+		"# TYPE activedrouter_proxy_request_duration_seconds histogram",
+		`activedrouter_proxy_request_duration_seconds_bucket{domain="metrics.abc.com",le="+Inf"} 1`,
+		`activedrouter_proxy_request_duration_seconds_count{domain="metrics.abc.com"} 1`,
+		`activedrouter_proxy_requests_in_flight{domain="metrics.abc.com"} 0`,
+		`activedrouter_proxy_backend_up{domain="metrics.abc.com",backend="` + backendUrl.Host + `"} 1`,
+		`activedrouter_proxy_backend_up{domain="metrics.abcd.com",backend="` + deadUrl.Host + `"} 0`,
+		"activedrouter_router_connected_clients 0",
+		`activedrouter_host_up{cluster="web",ip="10.0.0.9"} 1`,
+		`activedrouter_host_cpu_nums{cluster="web",ip="10.0.0.9"} 4`,
+		`activedrouter_host_vm_total{cluster="web",ip="10.0.0.9"} 1024`,
+		`activedrouter_host_vm_used_percent{cluster="web",ip="10.0.0.9"} 12.5`,
+		`activedrouter_host_ld_load1{cluster="web",ip="10.0.0.9"} 0.5`,
+		`activedrouter_host_cpu_percent{cluster="web",ip="10.0.0.9",index="1"} 20`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Fatal("missing metric", line, "\n", text)
+		}
+	}
+	//one TYPE line per family
+	if strings.Count(text, "# TYPE activedrouter_host_vm_total gauge") != 1 {
+		t.Fatal("duplicate family", text)
+	}
+
+	//the series of a removed domain and a removed backend are dropped
+	cfg = &ReverseProxyConfigData{
+		GlobalHttpSwitch: "on",
+		ReverseProxy: []*LbNode{
+			{Domain: "metrics.abc.com", HttpSwitch: "on", Clients: []*HostInfo{{Host: deadUrl.Hostname(), Port: deadUrl.Port()}}},
+		},
+	}
+	proxy.applyProxyConfig(cfg, "")
+	text = string(MetricsText())
+	if strings.Contains(text, "metrics.abcd.com") || strings.Contains(text, backendUrl.Host) ||
+		!strings.Contains(text, `activedrouter_proxy_request_duration_seconds_count{domain="metrics.abc.com"} 1`) {
+		t.Fatal("removed series kept\n", text)
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	for name, expected := range map[string]string{"VM": "vm", "UsedPercent": "used_percent", "Load15": "load15", "HTTPServer": "http_server", "CpuNums": "cpu_nums"} {
+		if snakeCase(name) != expected {
+			t.Fatal(name, snakeCase(name))
+		}
+	}
+}
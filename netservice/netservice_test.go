@@ -8,8 +8,8 @@ import (
 )
 
 func Test_proxyConfig(t *testing.T) {
-	ProxyHandler.LoadProxyConfig("../config/http_proxy.json")
-	log.Println(ProxyHandler.Cfg)
+	DefaultHttpReverseProxy.LoadProxyConfig("../config/http_proxy.json")
+	log.Println(DefaultHttpReverseProxy.Config())
 	//ProxyHandler.DeleteDomainConig("www.abcd.com")
 	///ProxyHandler.AddDomainConfig("www.abcd.com")
 	//ProxyHandler.AddProxyClient("www.abcd.com", "127.0.0.21", "8080")
@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	"ActivedRouter/global"
+	"ActivedRouter/hook"
 )
 
 //start networkservice
@@ -22,6 +23,11 @@ func StartNetworkService() {
 			go NewServer().Run(ServerConfigData.Host, ServerConfigData.Port)
 			//Run Http Service
 			go NewHttp(ServerConfigData.HttpHost, ServerConfigData.HttpPort).Run()
+			//Statistics history
+			go RunStatisticsStore()
+			//Daily report
+			hook.AlertRecorder = recordAlert
+			go RunReportScheduler()
 			log.Println("ActivedRouter is Running In Server Mode...")
 		}
 	case global.ClientMode:
@@ -41,14 +47,21 @@ func StartNetworkService() {
 			go NewHttp(ServerConfigData.HttpHost, ServerConfigData.HttpPort).Run()
 			//Run ReserveProxy Service
 			go DefaultHttpReverseProxy.StartProxyServer()
+			//Run TCP Proxy Service
+			DefaultTCPProxy.StartTCPProxy()
+			//Run UDP Proxy Service
+			DefaultTCPProxy.StartUDPProxy()
+			//Statistics history,certificate alerts are recorded
+			go RunStatisticsStore()
+			//Daily report of the proxy traffic
+			hook.AlertRecorder = recordAlert
+			go RunReportScheduler()
 			log.Println("ActivedRouter is Running  In ReverseProxy Mode...")
 		}
 	}
-	ListenAndServePProf(global.HTTP_PPROF_Default_Addr, nil)
-	global.NetworkSwitch <- true
-}
-
-//stop service
-func StopNetworkService() {
-	<-global.NetworkSwitch
+	go ListenAndServePProf(global.HTTP_PPROF_Default_Addr, nil)
+	//the parent process of an upgrade stops once the sockets are served
+	go notifyUpgradeReady()
+	//block until the stop or upgrade signal
+	WaitForSignal()
 }
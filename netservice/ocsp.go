@@ -0,0 +1,215 @@
+package netservice
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+//OCSP messages of RFC 6960
+var (
+	oidOCSPSHA1  = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+)
+
+//signature algorithms of the responses
+var ocspSignatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+	"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+	"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+	"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+	"1.2.840.10045.4.1":     x509.ECDSAWithSHA1,
+	"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+	"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+	"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+	"1.3.101.112":           x509.PureEd25519,
+}
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	KeyHash       []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequestEntry struct {
+	Cert ocspCertID
+}
+
+type ocspTBSRequest struct {
+	Version     int `asn1:"explicit,tag:0,default:0,optional"`
+	RequestList []ocspRequestEntry
+}
+
+type ocspRequest struct {
+	TBSRequest ocspTBSRequest
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version     int `asn1:"explicit,tag:0,default:0,optional"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+	Extensions  []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked    ocspRevokedInfo  `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate time.Time        `asn1:"generalized"`
+	NextUpdate time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	Extensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+//Verified status of the certificate
+type ocspStatus struct {
+	ThisUpdate time.Time
+	NextUpdate time.Time
+}
+
+//Id of the certificate in the requests and the responses
+func newOCSPCertID(leaf, issuer *x509.Certificate) (ocspCertID, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return ocspCertID{}, err
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+	return ocspCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidOCSPSHA1, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash[:],
+		KeyHash:       keyHash[:],
+		SerialNumber:  leaf.SerialNumber,
+	}, nil
+}
+
+//Ask the responder for the status of the certificate,the raw response is returned
+func fetchOCSPResponse(client *http.Client, responder string, leaf, issuer *x509.Certificate) ([]byte, error) {
+	id, err := newOCSPCertID(leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	req, err := asn1.Marshal(ocspRequest{TBSRequest: ocspTBSRequest{RequestList: []ocspRequestEntry{{Cert: id}}}})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(responder, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ocsp responder %s: %s", responder, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+//Parse the response and check it is a good status of the certificate signed by the issuer
+//or by a responder the issuer delegated
+func verifyOCSPResponse(raw []byte, leaf, issuer *x509.Certificate, now time.Time) (*ocspStatus, error) {
+	var resp ocspResponse
+	if rest, err := asn1.Unmarshal(raw, &resp); err != nil || len(rest) > 0 {
+		return nil, errors.New("ocsp: malformed response")
+	}
+	if resp.Status != 0 {
+		return nil, fmt.Errorf("ocsp: responder status %d", resp.Status)
+	}
+	if !resp.Response.ResponseType.Equal(oidOCSPBasic) {
+		return nil, errors.New("ocsp: not a basic response")
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return nil, errors.New("ocsp: malformed basic response")
+	}
+	var data ocspResponseData
+	if _, err := asn1.Unmarshal(basic.TBSResponseData.FullBytes, &data); err != nil {
+		return nil, errors.New("ocsp: malformed response data")
+	}
+	algorithm, ok := ocspSignatureAlgorithms[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("ocsp: unsupported signature algorithm %s", basic.SignatureAlgorithm.Algorithm)
+	}
+	signers := []*x509.Certificate{issuer}
+	for _, rawCert := range basic.Certificates {
+		cert, err := x509.ParseCertificate(rawCert.FullBytes)
+		if err != nil || cert.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		for _, usage := range cert.ExtKeyUsage {
+			if usage == x509.ExtKeyUsageOCSPSigning {
+				signers = append(signers, cert)
+			}
+		}
+	}
+	signed := false
+	for _, signer := range signers {
+		if signer.CheckSignature(algorithm, basic.TBSResponseData.FullBytes, basic.Signature.RightAlign()) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return nil, errors.New("ocsp: response not signed by the issuer")
+	}
+	id, err := newOCSPCertID(leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	for _, single := range data.Responses {
+		if single.CertID.SerialNumber == nil || single.CertID.SerialNumber.Cmp(id.SerialNumber) != 0 ||
+			!bytes.Equal(single.CertID.NameHash, id.NameHash) {
+			continue
+		}
+		switch {
+		case bool(single.Good):
+		case bool(single.Unknown):
+			return nil, errors.New("ocsp: certificate unknown to the responder")
+		default:
+			return nil, fmt.Errorf("ocsp: certificate revoked at %s", single.Revoked.RevocationTime)
+		}
+		if single.ThisUpdate.After(now.Add(5 * time.Minute)) {
+			return nil, errors.New("ocsp: response not valid yet")
+		}
+		if !single.NextUpdate.IsZero() && !single.NextUpdate.After(now) {
+			return nil, errors.New("ocsp: response expired")
+		}
+		return &ocspStatus{ThisUpdate: single.ThisUpdate, NextUpdate: single.NextUpdate}, nil
+	}
+	return nil, errors.New("ocsp: no status of the certificate")
+}
@@ -6,5 +6,5 @@ import (
 )
 
 func ListenAndServePProf(addr string, handler http.Handler) {
-	http.ListenAndServe(addr, handler)
+	serveHttp(&http.Server{Addr: addr, Handler: handler})
 }
@@ -0,0 +1,304 @@
+package netservice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//signature of the PROXY protocol v2 header
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+//Longest v1 header including CRLF
+const proxyProtocolV1MaxLength = 107
+
+//Accept PROXY protocol headers from the trusted load balancers
+type ProxyProtocolConfig struct {
+	Switch string `json:"switch"`
+	//addresses or CIDRs allowed to send the header,the header of other sources is not parsed
+	TrustedCIDRs []string `json:"trusted_cidrs"`
+	//seconds to wait for the header
+	HeaderTimeout int `json:"header_timeout,omitempty"`
+	trusted       []*net.IPNet
+}
+
+func (self *ProxyProtocolConfig) validate() error {
+	if self == nil {
+		return nil
+	}
+	if !validSwitch(self.Switch) {
+		return errors.New("proxy_protocol switch must be on or off")
+	}
+	if self.HeaderTimeout < 0 {
+		return errors.New("proxy_protocol header_timeout must not be negative")
+	}
+	self.trusted = nil
+	for _, cidr := range self.TrustedCIDRs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("proxy_protocol trusted_cidrs: %s", err)
+		}
+		self.trusted = append(self.trusted, ipNet)
+	}
+	if self.Switch == global.SwitchOn && len(self.trusted) == 0 {
+		return errors.New("proxy_protocol needs trusted_cidrs")
+	}
+	return nil
+}
+
+func (self *ProxyProtocolConfig) enabled() bool {
+	return self != nil && self.Switch == global.SwitchOn
+}
+
+func (self *ProxyProtocolConfig) trustedAddr(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range self.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *ProxyProtocolConfig) headerTimeout() time.Duration {
+	if self.HeaderTimeout == 0 {
+		return global.DefaultProxyProtocolTimeout * time.Second
+	}
+	return time.Duration(self.HeaderTimeout) * time.Second
+}
+
+//Listener reading the PROXY protocol header of the trusted connections,
+//the config is read for every connection so a reload takes effect at once
+type proxyProtocolListener struct {
+	net.Listener
+	config func() *ProxyProtocolConfig
+}
+
+func newProxyProtocolListener(l net.Listener, config func() *ProxyProtocolConfig) net.Listener {
+	return &proxyProtocolListener{Listener: l, config: config}
+}
+
+func (self *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := self.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	cfg := self.config()
+	if !cfg.enabled() || !cfg.trustedAddr(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn), timeout: cfg.headerTimeout()}, nil
+}
+
+//Connection with the addresses of the PROXY protocol header,
+//the header is read by the first Read RemoteAddr or LocalAddr in the goroutine serving the connection
+type proxyProtocolConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	src     net.Addr
+	dst     net.Addr
+	err     error
+}
+
+//Read the header,a connection with an invalid header is closed
+func (self *proxyProtocolConn) parse() error {
+	self.once.Do(func() {
+		self.Conn.SetReadDeadline(time.Now().Add(self.timeout))
+		self.src, self.dst, self.err = readProxyHeader(self.reader)
+		self.Conn.SetReadDeadline(time.Time{})
+		if self.err != nil {
+			self.Conn.Close()
+		}
+	})
+	return self.err
+}
+
+func (self *proxyProtocolConn) Read(b []byte) (int, error) {
+	if err := self.parse(); err != nil {
+		return 0, err
+	}
+	return self.reader.Read(b)
+}
+
+func (self *proxyProtocolConn) RemoteAddr() net.Addr {
+	if self.parse() == nil && self.src != nil {
+		return self.src
+	}
+	return self.Conn.RemoteAddr()
+}
+
+func (self *proxyProtocolConn) LocalAddr() net.Addr {
+	if self.parse() == nil && self.dst != nil {
+		return self.dst
+	}
+	return self.Conn.LocalAddr()
+}
+
+//keep the half-close of the tcp proxy
+func (self *proxyProtocolConn) CloseWrite() error {
+	if cw, ok := self.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return self.Conn.Close()
+}
+
+//Read a v1 or v2 header,nil addresses without a header or for LOCAL and UNKNOWN headers
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	switch first[0] {
+	case 'P':
+		if prefix, err := r.Peek(6); err == nil && string(prefix) == "PROXY " {
+			return readProxyHeaderV1(r)
+		}
+	case '\r':
+		if prefix, err := r.Peek(len(proxyProtocolV2Sig)); err == nil && bytes.Equal(prefix, proxyProtocolV2Sig) {
+			return readProxyHeaderV2(r)
+		}
+	}
+	return nil, nil, nil
+}
+
+//PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < proxyProtocolV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("proxy protocol v1 header too long")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.New("invalid proxy protocol v1 header")
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil || (fields[1] == "TCP4") != (srcIP.To4() != nil) {
+		return nil, nil, errors.New("invalid proxy protocol v1 address")
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+//12 bytes signature,version and command,family and protocol,length,addresses and TLVs
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, errors.New("invalid proxy protocol v2 version")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	switch header[12] & 0x0f {
+	case 0x0:
+		//LOCAL,health checks of the load balancer
+		return nil, nil, nil
+	case 0x1:
+	default:
+		return nil, nil, errors.New("invalid proxy protocol v2 command")
+	}
+	switch header[13] >> 4 {
+	case 0x1:
+		if len(body) < 12 {
+			return nil, nil, errors.New("short proxy protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))},
+			&net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}, nil
+	case 0x2:
+		if len(body) < 36 {
+			return nil, nil, errors.New("short proxy protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))},
+			&net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}, nil
+	}
+	//unix sockets and unspecified families keep the real addresses
+	return nil, nil, nil
+}
+
+//Write the v1 or v2 header for the connection from src to dst
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	srcAddr, ok1 := src.(*net.TCPAddr)
+	dstAddr, ok2 := dst.(*net.TCPAddr)
+	ipv4 := ok1 && ok2 && srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil
+	ipv6 := ok1 && ok2 && !ipv4 && srcAddr.IP.To4() == nil && dstAddr.IP.To4() == nil
+	var buf bytes.Buffer
+	switch version {
+	case global.ProxyProtocolV1:
+		switch {
+		case ipv4:
+			fmt.Fprintf(&buf, "PROXY TCP4 %s %s %d %d\r\n", srcAddr.IP.To4(), dstAddr.IP.To4(), srcAddr.Port, dstAddr.Port)
+		case ipv6:
+			fmt.Fprintf(&buf, "PROXY TCP6 %s %s %d %d\r\n", srcAddr.IP, dstAddr.IP, srcAddr.Port, dstAddr.Port)
+		default:
+			buf.WriteString("PROXY UNKNOWN\r\n")
+		}
+	case global.ProxyProtocolV2:
+		buf.Write(proxyProtocolV2Sig)
+		ports := make([]byte, 4)
+		switch {
+		case ipv4:
+			binary.BigEndian.PutUint16(ports[0:2], uint16(srcAddr.Port))
+			binary.BigEndian.PutUint16(ports[2:4], uint16(dstAddr.Port))
+			buf.Write([]byte{0x21, 0x11, 0, 12})
+			buf.Write(srcAddr.IP.To4())
+			buf.Write(dstAddr.IP.To4())
+			buf.Write(ports)
+		case ipv6:
+			binary.BigEndian.PutUint16(ports[0:2], uint16(srcAddr.Port))
+			binary.BigEndian.PutUint16(ports[2:4], uint16(dstAddr.Port))
+			buf.Write([]byte{0x21, 0x21, 0, 36})
+			buf.Write(srcAddr.IP.To16())
+			buf.Write(dstAddr.IP.To16())
+			buf.Write(ports)
+		default:
+			//PROXY command with unspecified family
+			buf.Write([]byte{0x21, 0x00, 0, 0})
+		}
+	default:
+		return fmt.Errorf("unknown proxy protocol version %s", version)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,197 @@
+package netservice
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+func TestProxyProtocolHeaders(t *testing.T) {
+	for _, c := range []struct {
+		version  string
+		src, dst string
+	}{
+		{global.ProxyProtocolV1, "192.168.0.1:56324", "10.0.0.1:443"},
+		{global.ProxyProtocolV1, "[2001:db8::1]:1000", "[2001:db8::2]:80"},
+		{global.ProxyProtocolV2, "192.168.0.1:56324", "10.0.0.1:443"},
+		{global.ProxyProtocolV2, "[2001:db8::1]:1000", "[2001:db8::2]:80"},
+	} {
+		src, _ := net.ResolveTCPAddr("tcp", c.src)
+		dst, _ := net.ResolveTCPAddr("tcp", c.dst)
+		buf := &bytes.Buffer{}
+		if err := writeProxyHeader(buf, c.version, src, dst); err != nil {
+			t.Fatal(err)
+		}
+		buf.WriteString("payload")
+		r := bufio.NewReader(buf)
+		gotSrc, gotDst, err := readProxyHeader(r)
+		if err != nil {
+			t.Fatal(c.version, c.src, err)
+		}
+		if gotSrc.String() != src.String() || gotDst.String() != dst.String() {
+			t.Fatalf("%s got %s %s,want %s %s", c.version, gotSrc, gotDst, src, dst)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "payload" {
+			t.Fatalf("%s left %q", c.version, rest)
+		}
+	}
+
+	//no header,unknown and LOCAL headers keep the real addresses
+	for _, data := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY UNKNOWN\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00",
+	} {
+		src, dst, err := readProxyHeader(bufio.NewReader(strings.NewReader(data)))
+		if err != nil || src != nil || dst != nil {
+			t.Fatalf("%q got %v %v %v", data, src, dst, err)
+		}
+	}
+	for _, data := range []string{
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1\r\n",
+		"PROXY TCP4 2001:db8::1 5.6.7.8 1 2\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 70000 2\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04abcd",
+	} {
+		if _, _, err := readProxyHeader(bufio.NewReader(strings.NewReader(data))); err == nil {
+			t.Fatalf("invalid header %q accepted", data)
+		}
+	}
+}
+
+func TestProxyProtocolConfig(t *testing.T) {
+	for _, cfg := range []*ProxyProtocolConfig{
+		{Switch: "yes", TrustedCIDRs: []string{"127.0.0.1"}},
+		{Switch: global.SwitchOn},
+		{Switch: global.SwitchOn, TrustedCIDRs: []string{"10.0.0.0/33"}},
+		{Switch: global.SwitchOn, TrustedCIDRs: []string{"10.0.0.1"}, HeaderTimeout: -1},
+	} {
+		if cfg.validate() == nil {
+			t.Fatal("invalid config accepted", cfg)
+		}
+	}
+	cfg := &ProxyProtocolConfig{Switch: global.SwitchOn, TrustedCIDRs: []string{"10.0.0.0/8", "::1"}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{"10.1.2.3:80": true, "[::1]:80": true, "11.0.0.1:80": false} {
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+		if cfg.trustedAddr(tcpAddr) != want {
+			t.Fatalf("%s trusted %v", addr, !want)
+		}
+	}
+}
+
+//Http server answering with the remote address of the request
+func startRemoteAddrServer(t *testing.T, trusted string) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ProxyProtocolConfig{Switch: global.SwitchOn, TrustedCIDRs: []string{trusted}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})}
+	go srv.Serve(newProxyProtocolListener(l, func() *ProxyProtocolConfig { return cfg }))
+	return l.Addr().String(), func() { srv.Close() }
+}
+
+func remoteAddrRequest(t *testing.T, addr, header string) (int, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(header + "GET / HTTP/1.0\r\nHost: test\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestProxyProtocolHttpListener(t *testing.T) {
+	header := "PROXY TCP4 203.0.113.7 127.0.0.1 40000 80\r\n"
+	addr, stop := startRemoteAddrServer(t, "127.0.0.0/8")
+	defer stop()
+	if _, got := remoteAddrRequest(t, addr, header); got != "203.0.113.7:40000" {
+		t.Fatalf("got remote addr %s", got)
+	}
+	//the header is optional
+	if _, got := remoteAddrRequest(t, addr, ""); !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Fatalf("got remote addr %s without header", got)
+	}
+	//the header of an untrusted source is not parsed
+	untrusted, stopUntrusted := startRemoteAddrServer(t, "10.0.0.0/8")
+	defer stopUntrusted()
+	if status, _ := remoteAddrRequest(t, untrusted, header); status != http.StatusBadRequest {
+		t.Fatal("untrusted header accepted", status)
+	}
+}
+
+func TestTCPProxySendProxyProtocol(t *testing.T) {
+	//backend answering with the header it received
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				src, _, err := readProxyHeader(bufio.NewReader(conn))
+				if err != nil || src == nil {
+					conn.Write([]byte("no header"))
+					return
+				}
+				conn.Write([]byte(src.String()))
+			}(conn)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(backend.Addr().String())
+	for _, version := range []string{global.ProxyProtocolV1, global.ProxyProtocolV2} {
+		item := &TCPProxyItem{LbNode: []*TCPNode{{Host: host, Port: port}}, SendProxyProtocol: version,
+			ProxyProtocol: &ProxyProtocolConfig{Switch: global.SwitchOn, TrustedCIDRs: []string{"127.0.0.1"}}}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		item.ListenAddr = l.Addr().String()
+		if err := item.validate(); err != nil {
+			t.Fatal(err)
+		}
+		listener := newTCPListener(item, newProxyProtocolListener(l, func() *ProxyProtocolConfig { return item.ProxyProtocol }))
+		go listener.serve()
+		//the address received from the load balancer is passed on to the node
+		if got := tcpRoundTrip(t, item.ListenAddr, "PROXY TCP4 198.51.100.9 127.0.0.1 1234 80\r\n"); got != "198.51.100.9:1234" {
+			t.Fatalf("%s backend got %q", version, got)
+		}
+		if got := tcpRoundTrip(t, item.ListenAddr, "direct"); !strings.HasPrefix(got, "127.0.0.1:") {
+			t.Fatalf("%s backend got %q without header", version, got)
+		}
+		listener.shutdown(context.Background())
+	}
+	if (&TCPProxyItem{ListenAddr: "127.0.0.1:1", LbNode: []*TCPNode{{Host: host, Port: port}}, SendProxyProtocol: "v3"}).validate() == nil {
+		t.Fatal("unknown send_proxy_protocol accepted")
+	}
+}
@@ -0,0 +1,322 @@
+package netservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"ActivedRouter/global"
+	"ActivedRouter/tools"
+)
+
+//Read,parse and validate the proxy config file
+//Return the config and the md5 of the file content
+func parseProxyConfigFile(proxyConfigFile string) (*ReverseProxyConfigData, string, error) {
+	bts, err := ioutil.ReadFile(proxyConfigFile)
+	if err != nil {
+		return nil, "", err
+	}
+	cfg, err := parseProxyConfig(bts)
+	if err != nil {
+		return nil, "", fmt.Errorf("Parse proxy config file %s: %s", proxyConfigFile, err.Error())
+	}
+	return cfg, tools.Md5Encrypt(string(bts)), nil
+}
+
+//Parse and validate the proxy config content
+func parseProxyConfig(bts []byte) (*ReverseProxyConfigData, error) {
+	cfg := &ReverseProxyConfigData{}
+	if err := json.Unmarshal(bts, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	cfg.setDefaults()
+	return cfg, nil
+}
+
+func validSwitch(value string) bool {
+	return value == "" || value == global.SwitchOn || value == global.SwitchOff
+}
+
+//Check the config before it replaces the running one
+func (self *ReverseProxyConfigData) validate() error {
+	if self.GlobalHttpSwitch != global.SwitchOn && self.GlobalHttpsSwitch != global.SwitchOn {
+		return errors.New("Please open http or https reverse proxy switch.....")
+	}
+	if !validSwitch(self.GlobalHttpSwitch) || !validSwitch(self.GlobalHttpsSwitch) || !validSwitch(self.ConfigWatch) {
+		return errors.New("switch must be on or off")
+	}
+	if self.ProxyMethod != "" && self.ProxyMethod != global.Random && self.ProxyMethod != global.Alived {
+		return fmt.Errorf("unknown proxy_method %s", self.ProxyMethod)
+	}
+	if self.ReadTimeout < 0 || self.ReadHeaderTimeout < 0 || self.WriteTimeout < 0 || self.IdleTimeout < 0 || self.ConfigWatchInterval < 0 {
+		return errors.New("timeouts and intervals can't be negative")
+	}
+	if self.MaxHeaderBytes < 0 || self.MaxBodyBytes < 0 || self.MaxResponseBytes < 0 {
+		return errors.New("size limits can't be negative")
+	}
+	if !validHeaderName(self.RequestIDHeader) {
+		return fmt.Errorf("invalid request_id_header %s", self.RequestIDHeader)
+	}
+	if err := self.AccessLog.validate(); err != nil {
+		return err
+	}
+	if err := self.Tracing.validate(); err != nil {
+		return err
+	}
+	if err := self.ProxyProtocol.validate(); err != nil {
+		return err
+	}
+	if err := validateSNIRoutes(self.SNIPassthrough); err != nil {
+		return err
+	}
+	if err := self.SNIHealthCheck.validate(); err != nil {
+		return fmt.Errorf("sni_%s", err)
+	}
+	if err := self.ACME.validate(); err != nil {
+		return err
+	}
+	if err := self.TLS.validate(); err != nil {
+		return err
+	}
+	//the global versions merged with the defaults
+	if policy := newDomainTLSPolicy(self, nil); policy.minVersion > policy.maxVersion {
+		return errors.New("tls: min_version is above max_version")
+	}
+	if self.TLS != nil && self.TLS.OCSPFile != "" {
+		return errors.New("tls: ocsp_file is set by domain")
+	}
+	if self.Tracing != nil && self.Tracing.Switch == global.SwitchOn && self.Tracing.Endpoint == "" {
+		return errors.New("tracing: endpoint can't be empty")
+	}
+	domains := make(map[string]bool)
+	for _, node := range self.ReverseProxy {
+		if node.Domain == "" {
+			return errors.New("domain can't be empty")
+		}
+		if domains[node.Domain] {
+			return fmt.Errorf("duplicate domain %s", node.Domain)
+		}
+		domains[node.Domain] = true
+		if !validSwitch(node.HttpSwitch) || !validSwitch(node.HttpsSwitch) {
+			return fmt.Errorf("domain %s: switch must be on or off", node.Domain)
+		}
+		if node.MaxHeaderBytes < 0 || node.MaxBodyBytes < 0 || node.MaxResponseBytes < 0 {
+			return fmt.Errorf("domain %s: size limits can't be negative", node.Domain)
+		}
+		if err := node.AccessLog.validate(); err != nil {
+			return fmt.Errorf("domain %s: %s", node.Domain, err.Error())
+		}
+		if err := node.Tracing.validate(); err != nil {
+			return fmt.Errorf("domain %s: %s", node.Domain, err.Error())
+		}
+		if err := node.ClientAuth.validate(); err != nil {
+			return fmt.Errorf("domain %s: %s", node.Domain, err.Error())
+		}
+		if err := node.TLS.validate(); err != nil {
+			return fmt.Errorf("domain %s: %s", node.Domain, err.Error())
+		}
+		if node.TLS != nil && node.TLS.TicketKeyRotation != 0 {
+			return fmt.Errorf("domain %s: tls: ticket_key_rotation is global", node.Domain)
+		}
+		if policy := newDomainTLSPolicy(self, node); policy.minVersion > policy.maxVersion {
+			return fmt.Errorf("domain %s: tls: min_version is above max_version", node.Domain)
+		}
+		if !validSwitch(node.AutoTLS) {
+			return fmt.Errorf("domain %s: auto_tls must be on or off", node.Domain)
+		}
+		if node.AutoTLS == global.SwitchOn && (strings.Contains(node.Domain, "*") || !self.ACME.enabled()) {
+			return fmt.Errorf("domain %s: auto_tls needs a domain name without wildcard and the acme switch on", node.Domain)
+		}
+		for _, client := range node.Clients {
+			if client.Host == "" {
+				return fmt.Errorf("domain %s: client host can't be empty", node.Domain)
+			}
+			if port, err := strconv.Atoi(client.Port); err != nil || port <= 0 || port > 65535 {
+				return fmt.Errorf("domain %s: invalid port %s of client %s", node.Domain, client.Port, client.Host)
+			}
+		}
+	}
+	return nil
+}
+
+//Fill the default values
+func (self *ReverseProxyConfigData) setDefaults() {
+	if self.ReadHeaderTimeout == 0 {
+		self.ReadHeaderTimeout = global.DefaultProxyReadHeaderTimeout
+	}
+	if self.IdleTimeout == 0 {
+		self.IdleTimeout = global.DefaultProxyIdleTimeout
+	}
+	if self.ConfigWatchInterval == 0 {
+		self.ConfigWatchInterval = global.DefaultConfigWatchInterval
+	}
+}
+
+//Swap in the routing table built from cfg,cfg must not be modified afterwards
+func (self *HttpReverseProxy) applyProxyConfig(cfg *ReverseProxyConfigData, digest string) {
+	table := newRoutingTable(cfg)
+	self.routing.Store(table)
+	self.configDigest = digest
+	closeUnusedAccessLoggers(table)
+	closeUnusedSpanExporter(table)
+	if self.acme != nil {
+		self.acme.notify()
+	}
+	domains := make(map[string]bool)
+	for domain := range table.Domains {
+		domains[domain] = true
+	}
+	global.GProxyTopK.Retain(domains)
+	DefaultProxyMetrics.retain(table)
+}
+
+//Reload the proxy config file,the running config is kept if the new one is invalid
+func (self *HttpReverseProxy) ReloadProxyConfig() error {
+	self.editMutex.Lock()
+	defer self.editMutex.Unlock()
+	cfg, digest, err := parseProxyConfigFile(self.ProxyCongfigFile)
+	if err != nil {
+		log.Println("Reload proxy config error,keep the running config:", err)
+		return err
+	}
+	self.swapProxyConfig(cfg, digest, "Reload proxy config")
+	return nil
+}
+
+//Apply cfg and log the changes to the running config,the caller holds editMutex
+func (self *HttpReverseProxy) swapProxyConfig(cfg *ReverseProxyConfigData, digest, action string) {
+	changes := diffProxyConfig(self.Config(), cfg)
+	self.applyProxyConfig(cfg, digest)
+	if len(changes) == 0 {
+		log.Println(action + ":no changes")
+	}
+	for _, change := range changes {
+		log.Println(action+":", change)
+	}
+}
+
+//Poll the config file and reload it when the content changes
+func (self *HttpReverseProxy) WatchProxyConfig() {
+	interval := time.Second * time.Duration(self.Config().ConfigWatchInterval)
+	log.Println("Watching proxy config file", self.ProxyCongfigFile)
+	timerWatch := time.NewTimer(interval)
+	//don't report the same invalid content again
+	lastDigest := ""
+	for {
+		select {
+		case <-timerWatch.C:
+			{
+				timerWatch.Reset(interval)
+				bts, err := ioutil.ReadFile(self.ProxyCongfigFile)
+				if err != nil {
+					continue
+				}
+				digest := tools.Md5Encrypt(string(bts))
+				self.editMutex.Lock()
+				changed := digest != self.configDigest && digest != lastDigest
+				self.editMutex.Unlock()
+				if changed {
+					lastDigest = digest
+					self.ReloadProxyConfig()
+				}
+			}
+		}
+	}
+}
+
+func jsonString(cfg interface{}) string {
+	bts, _ := json.Marshal(cfg)
+	return string(bts)
+}
+
+//Describe the differences between two configs
+func diffProxyConfig(oldCfg, newCfg *ReverseProxyConfigData) []string {
+	var changes []string
+	diffValue := func(name string, oldValue, newValue interface{}) {
+		if oldValue != newValue {
+			changes = append(changes, fmt.Sprintf("%s %v => %v", name, oldValue, newValue))
+		}
+	}
+	diffValue("proxy_method", oldCfg.ProxyMethod, newCfg.ProxyMethod)
+	diffValue("http_switch", oldCfg.GlobalHttpSwitch, newCfg.GlobalHttpSwitch)
+	diffValue("https_switch", oldCfg.GlobalHttpsSwitch, newCfg.GlobalHttpsSwitch)
+	diffValue("max_header_bytes", oldCfg.MaxHeaderBytes, newCfg.MaxHeaderBytes)
+	diffValue("max_body_bytes", oldCfg.MaxBodyBytes, newCfg.MaxBodyBytes)
+	diffValue("max_response_bytes", oldCfg.MaxResponseBytes, newCfg.MaxResponseBytes)
+	diffValue("access_log", jsonString(oldCfg.AccessLog), jsonString(newCfg.AccessLog))
+	diffValue("tracing", jsonString(oldCfg.Tracing), jsonString(newCfg.Tracing))
+	diffValue("request_id_header", oldCfg.RequestIDHeader, newCfg.RequestIDHeader)
+	diffValue("proxy_protocol", jsonString(oldCfg.ProxyProtocol), jsonString(newCfg.ProxyProtocol))
+	diffValue("sni_passthrough", jsonString(oldCfg.SNIPassthrough), jsonString(newCfg.SNIPassthrough))
+	diffValue("sni_health_check", jsonString(oldCfg.SNIHealthCheck), jsonString(newCfg.SNIHealthCheck))
+	diffValue("acme", jsonString(oldCfg.ACME), jsonString(newCfg.ACME))
+	diffValue("tls", jsonString(oldCfg.TLS), jsonString(newCfg.TLS))
+	//listener settings can't be changed without a restart
+	restartValue := func(name string, oldValue, newValue interface{}) {
+		if oldValue != newValue {
+			changes = append(changes, fmt.Sprintf("%s %v => %v (takes effect after restart)", name, oldValue, newValue))
+		}
+	}
+	restartValue("http_proxy_addr", oldCfg.HttpProxyAddr, newCfg.HttpProxyAddr)
+	restartValue("https_proxy_addr", oldCfg.HttpsProxyAddr, newCfg.HttpsProxyAddr)
+	restartValue("read_timeout", oldCfg.ReadTimeout, newCfg.ReadTimeout)
+	restartValue("read_header_timeout", oldCfg.ReadHeaderTimeout, newCfg.ReadHeaderTimeout)
+	restartValue("write_timeout", oldCfg.WriteTimeout, newCfg.WriteTimeout)
+	restartValue("idle_timeout", oldCfg.IdleTimeout, newCfg.IdleTimeout)
+	restartValue("config_watch", oldCfg.ConfigWatch, newCfg.ConfigWatch)
+	oldNodes := make(map[string]*LbNode)
+	for _, node := range oldCfg.ReverseProxy {
+		oldNodes[node.Domain] = node
+	}
+	newNodes := make(map[string]*LbNode)
+	for _, node := range newCfg.ReverseProxy {
+		newNodes[node.Domain] = node
+		oldNode, ok := oldNodes[node.Domain]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("add domain %s with %d clients", node.Domain, len(node.Clients)))
+			continue
+		}
+		diffValue("domain "+node.Domain+" http_switch", oldNode.HttpSwitch, node.HttpSwitch)
+		diffValue("domain "+node.Domain+" https_switch", oldNode.HttpsSwitch, node.HttpsSwitch)
+		diffValue("domain "+node.Domain+" max_header_bytes", oldNode.MaxHeaderBytes, node.MaxHeaderBytes)
+		diffValue("domain "+node.Domain+" max_body_bytes", oldNode.MaxBodyBytes, node.MaxBodyBytes)
+		diffValue("domain "+node.Domain+" max_response_bytes", oldNode.MaxResponseBytes, node.MaxResponseBytes)
+		diffValue("domain "+node.Domain+" access_log", jsonString(oldNode.AccessLog), jsonString(node.AccessLog))
+		diffValue("domain "+node.Domain+" tracing", jsonString(oldNode.Tracing), jsonString(node.Tracing))
+		diffValue("domain "+node.Domain+" auto_tls", oldNode.AutoTLS, node.AutoTLS)
+		diffValue("domain "+node.Domain+" client_auth", jsonString(oldNode.ClientAuth), jsonString(node.ClientAuth))
+		diffValue("domain "+node.Domain+" tls", jsonString(oldNode.TLS), jsonString(node.TLS))
+		oldClients := make(map[string]bool)
+		for _, client := range oldNode.Clients {
+			oldClients[client.Host+":"+client.Port] = true
+		}
+		newClients := make(map[string]bool)
+		for _, client := range node.Clients {
+			addr := client.Host + ":" + client.Port
+			newClients[addr] = true
+			if !oldClients[addr] {
+				changes = append(changes, fmt.Sprintf("domain %s add client %s", node.Domain, addr))
+			}
+		}
+		for _, client := range oldNode.Clients {
+			addr := client.Host + ":" + client.Port
+			if !newClients[addr] {
+				changes = append(changes, fmt.Sprintf("domain %s delete client %s", node.Domain, addr))
+			}
+		}
+	}
+	for _, node := range oldCfg.ReverseProxy {
+		if _, ok := newNodes[node.Domain]; !ok {
+			changes = append(changes, fmt.Sprintf("delete domain %s", node.Domain))
+		}
+	}
+	return changes
+}
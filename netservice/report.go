@@ -0,0 +1,389 @@
+package netservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"ActivedRouter/global"
+	"ActivedRouter/hook"
+	"ActivedRouter/system"
+)
+
+//Requests and errors of a domain
+type DomainReport struct {
+	Domain       string
+	Requests     int64
+	ClientErrors int64 //4xx
+	ServerErrors int64 //5xx
+	ErrorRate    float64
+	Rejected     int64
+	BytesOut     int64
+	LatencyP50   float64
+	LatencyP99   float64
+}
+
+//Latency of a backend
+type BackendReport struct {
+	Domain       string
+	Backend      string
+	Requests     int64
+	ServerErrors int64
+	LatencyAvg   float64
+	LatencyP99   float64
+}
+
+//A host that was not active during part of the day
+type HostReport struct {
+	IP              string
+	Cluster         string
+	UnactiveMinutes int64
+	Samples         int64
+}
+
+//Alerts with the same host and subject
+type AlertReport struct {
+	Host    string
+	Subject string
+	Count   int
+	First   int64
+	Last    int64
+	Info    string //info of the last alert
+}
+
+//Disk usage of a host compared with the day before
+type DiskReport struct {
+	IP          string
+	Cluster     string
+	UsedPercent float64 //average of the day
+	MaxPercent  float64
+	Change      float64 //difference to the average of the day before
+}
+
+//Summary of a day
+type DailyReport struct {
+	Date          string
+	From          int64
+	To            int64
+	Generated     int64
+	Domains       []*DomainReport
+	SlowBackends  []*BackendReport
+	UnactiveHosts []*HostReport
+	Alerts        []*AlertReport
+	Disk          []*DiskReport
+}
+
+//Build the report of the local day containing day
+func BuildDailyReport(store *system.StatisticsStore, day time.Time, now time.Time) (*DailyReport, error) {
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	from, to := start.Unix(), start.AddDate(0, 0, 1).Unix()-1
+	report := &DailyReport{Date: start.Format("2006-01-02"), From: from, To: to, Generated: now.Unix()}
+	proxies, err := store.Summarize(system.RecordProxy, from, to, now)
+	if err != nil {
+		return nil, err
+	}
+	backends := []*BackendReport{}
+	for domain, record := range proxies {
+		if record.Proxy == nil {
+			continue
+		}
+		stat := record.Proxy
+		item := &DomainReport{
+			Domain:       domain,
+			Requests:     stat.RequestCount,
+			ClientErrors: stat.StatusClass["4xx"],
+			ServerErrors: stat.StatusClass["5xx"],
+			BytesOut:     stat.BytesOut,
+			LatencyP50:   stat.LatencyP50,
+			LatencyP99:   stat.LatencyP99,
+		}
+		for _, count := range stat.Rejected {
+			item.Rejected += count
+		}
+		if item.Requests > 0 {
+			item.ErrorRate = float64(item.ServerErrors) / float64(item.Requests)
+		}
+		report.Domains = append(report.Domains, item)
+		for backend, traffic := range stat.Backends {
+			if traffic.RequestCount == 0 {
+				continue
+			}
+			item := &BackendReport{
+				Domain:       domain,
+				Backend:      backend,
+				Requests:     traffic.RequestCount,
+				ServerErrors: traffic.StatusClass["5xx"],
+				LatencyP99:   traffic.LatencyP99,
+			}
+			if traffic.Latency != nil && traffic.Latency.Count > 0 {
+				item.LatencyAvg = traffic.Latency.Sum / float64(traffic.Latency.Count)
+			}
+			backends = append(backends, item)
+		}
+	}
+	sort.Slice(report.Domains, func(i, j int) bool {
+		return report.Domains[i].Domain < report.Domains[j].Domain
+	})
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].LatencyP99 > backends[j].LatencyP99
+	})
+	if len(backends) > global.ReportSlowBackends {
+		backends = backends[:global.ReportSlowBackends]
+	}
+	report.SlowBackends = backends
+	hosts, err := store.Summarize(system.RecordHost, from, to, now)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := store.Summarize(system.RecordHost, from-86400, from-1, now)
+	if err != nil {
+		return nil, err
+	}
+	for ip, record := range hosts {
+		if record.Host == nil {
+			continue
+		}
+		stat := record.Host
+		if stat.Active < stat.Samples {
+			//hosts are sampled every minute
+			report.UnactiveHosts = append(report.UnactiveHosts, &HostReport{
+				IP:              ip,
+				Cluster:         stat.Cluster,
+				UnactiveMinutes: stat.Samples - stat.Active,
+				Samples:         stat.Samples,
+			})
+		}
+		if disk, ok := stat.Metrics["disk_used_percent"]; ok && disk.Count > 0 {
+			item := &DiskReport{IP: ip, Cluster: stat.Cluster, UsedPercent: disk.Avg, MaxPercent: disk.Max}
+			if before, ok := previous[ip]; ok && before.Host != nil {
+				if prevDisk, ok := before.Host.Metrics["disk_used_percent"]; ok && prevDisk.Count > 0 {
+					item.Change = disk.Avg - prevDisk.Avg
+				}
+			}
+			report.Disk = append(report.Disk, item)
+		}
+	}
+	sort.Slice(report.UnactiveHosts, func(i, j int) bool {
+		return report.UnactiveHosts[i].UnactiveMinutes > report.UnactiveHosts[j].UnactiveMinutes
+	})
+	sort.Slice(report.Disk, func(i, j int) bool {
+		return report.Disk[i].UsedPercent > report.Disk[j].UsedPercent
+	})
+	alerts, err := store.QueryAlerts(from, to)
+	if err != nil {
+		return nil, err
+	}
+	grouped := make(map[string]*AlertReport)
+	for _, alert := range alerts {
+		id := alert.Host + "|" + alert.Subject
+		item, ok := grouped[id]
+		if !ok {
+			item = &AlertReport{Host: alert.Host, Subject: alert.Subject, First: alert.Timestamp}
+			grouped[id] = item
+			report.Alerts = append(report.Alerts, item)
+		}
+		item.Count++
+		item.Last = alert.Timestamp
+		item.Info = alert.Info
+	}
+	return report, nil
+}
+
+//Render the report as html,plain text or json
+func RenderReport(report *DailyReport, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case global.ReportJson:
+		bts, err := json.MarshalIndent(report, "", " ")
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(bts)
+		buf.WriteByte('\n')
+	case global.ReportHtml:
+		if err := reportHtmlTemplate.Execute(&buf, report); err != nil {
+			return nil, err
+		}
+	case global.ReportPlain:
+		writePlainReport(&buf, report)
+	default:
+		return nil, errors.New("unknown report format " + format)
+	}
+	return buf.Bytes(), nil
+}
+
+func formatReportTime(timestamp int64) string {
+	return time.Unix(timestamp, 0).Format("15:04:05")
+}
+
+func writePlainReport(buf *bytes.Buffer, report *DailyReport) {
+	fmt.Fprintf(buf, "ActivedRouter daily report %s\n\n", report.Date)
+	writer := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "DOMAIN\tREQUESTS\t4XX\t5XX\tERROR RATE\tREJECTED\tBYTES OUT\tP50\tP99")
+	for _, item := range report.Domains {
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%d\t%.2f%%\t%d\t%d\t%.3fs\t%.3fs\n", item.Domain, item.Requests, item.ClientErrors,
+			item.ServerErrors, item.ErrorRate*100, item.Rejected, item.BytesOut, item.LatencyP50, item.LatencyP99)
+	}
+	writer.Flush()
+	fmt.Fprintln(buf, "\nSlowest backends")
+	writer = tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "DOMAIN\tBACKEND\tREQUESTS\t5XX\tAVG\tP99")
+	for _, item := range report.SlowBackends {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%d\t%.3fs\t%.3fs\n", item.Domain, item.Backend, item.Requests,
+			item.ServerErrors, item.LatencyAvg, item.LatencyP99)
+	}
+	writer.Flush()
+	fmt.Fprintln(buf, "\nUnactive hosts")
+	writer = tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "IP\tCLUSTER\tUNACTIVE MINUTES\tSAMPLES")
+	for _, item := range report.UnactiveHosts {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%d\n", item.IP, item.Cluster, item.UnactiveMinutes, item.Samples)
+	}
+	writer.Flush()
+	fmt.Fprintln(buf, "\nAlerts")
+	writer = tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "HOST\tSUBJECT\tCOUNT\tFIRST\tLAST\tINFO")
+	for _, item := range report.Alerts {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\t%s\n", item.Host, item.Subject, item.Count,
+			formatReportTime(item.First), formatReportTime(item.Last), item.Info)
+	}
+	writer.Flush()
+	fmt.Fprintln(buf, "\nDisk usage")
+	writer = tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "IP\tCLUSTER\tAVG USED\tMAX USED\tCHANGE")
+	for _, item := range report.Disk {
+		fmt.Fprintf(writer, "%s\t%s\t%.2f%%\t%.2f%%\t%+.2f%%\n", item.IP, item.Cluster, item.UsedPercent, item.MaxPercent, item.Change)
+	}
+	writer.Flush()
+}
+
+var reportHtmlTemplate = htmltemplate.Must(htmltemplate.New("report").Funcs(htmltemplate.FuncMap{
+	"percent": func(v float64) string { return fmt.Sprintf("%.2f%%", v*100) },
+	"seconds": func(v float64) string { return fmt.Sprintf("%.3fs", v) },
+	"clock":   formatReportTime,
+	"fixed":   func(v float64) string { return fmt.Sprintf("%.2f", v) },
+}).Parse(`<html>
+	<head>
+		<title>ActivedRouter每日报告 {{.Date}}</title>
+	</head>
+	<body>
+		<h3>ActivedRouter每日报告 {{.Date}}</h3>
+		<h4>域名请求</h4>
+		<table border="1" cellspacing="0" cellpadding="4">
+			<tr><th>Domain</th><th>Requests</th><th>4xx</th><th>5xx</th><th>Error Rate</th><th>Rejected</th><th>Bytes Out</th><th>P50</th><th>P99</th></tr>
+			{{range .Domains}}<tr><td>{{.Domain}}</td><td>{{.Requests}}</td><td>{{.ClientErrors}}</td><td>{{.ServerErrors}}</td><td>{{percent .ErrorRate}}</td><td>{{.Rejected}}</td><td>{{.BytesOut}}</td><td>{{seconds .LatencyP50}}</td><td>{{seconds .LatencyP99}}</td></tr>
+			{{end}}
+		</table>
+		<h4>最慢的后端</h4>
+		<table border="1" cellspacing="0" cellpadding="4">
+			<tr><th>Domain</th><th>Backend</th><th>Requests</th><th>5xx</th><th>Avg</th><th>P99</th></tr>
+			{{range .SlowBackends}}<tr><td>{{.Domain}}</td><td>{{.Backend}}</td><td>{{.Requests}}</td><td>{{.ServerErrors}}</td><td>{{seconds .LatencyAvg}}</td><td>{{seconds .LatencyP99}}</td></tr>
+			{{end}}
+		</table>
+		<h4>下线的服务器</h4>
+		<table border="1" cellspacing="0" cellpadding="4">
+			<tr><th>IP</th><th>Cluster</th><th>Unactive Minutes</th><th>Samples</th></tr>
+			{{range .UnactiveHosts}}<tr><td>{{.IP}}</td><td>{{.Cluster}}</td><td>{{.UnactiveMinutes}}</td><td>{{.Samples}}</td></tr>
+			{{end}}
+		</table>
+		<h4>报警</h4>
+		<table border="1" cellspacing="0" cellpadding="4">
+			<tr><th>Host</th><th>Subject</th><th>Count</th><th>First</th><th>Last</th><th>Info</th></tr>
+			{{range .Alerts}}<tr><td>{{.Host}}</td><td>{{.Subject}}</td><td>{{.Count}}</td><td>{{clock .First}}</td><td>{{clock .Last}}</td><td>{{.Info}}</td></tr>
+			{{end}}
+		</table>
+		<h4>磁盘使用率</h4>
+		<table border="1" cellspacing="0" cellpadding="4">
+			<tr><th>IP</th><th>Cluster</th><th>Avg Used</th><th>Max Used</th><th>Change</th></tr>
+			{{range .Disk}}<tr><td>{{.IP}}</td><td>{{.Cluster}}</td><td>{{fixed .UsedPercent}}%</td><td>{{fixed .MaxPercent}}%</td><td>{{fixed .Change}}%</td></tr>
+			{{end}}
+		</table>
+	</body>
+</html>
+`))
+
+//Send the report by email or post the json to the webhook
+func deliverReport(cfg *hook.ReportConfig, report *DailyReport) error {
+	body, err := RenderReport(report, cfg.Format)
+	if err != nil {
+		return err
+	}
+	if cfg.Format == global.ReportJson {
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Post(cfg.Webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook returned %s", resp.Status)
+		}
+		return nil
+	}
+	mailtype := "plain"
+	if cfg.Format == global.ReportHtml {
+		mailtype = "html"
+	}
+	return hook.SendReportEmail("ActivedRouter每日报告 "+report.Date, string(body), mailtype)
+}
+
+//Send the report of the previous day at the configured time
+func RunReportScheduler() {
+	cfg := hook.GReportConfig
+	if cfg.Switch != global.SwitchOn {
+		return
+	}
+	log.Println("Daily report is scheduled at", cfg.Time)
+	for {
+		next := cfg.NextRun(time.Now())
+		time.Sleep(next.Sub(time.Now()))
+		now := time.Now()
+		report, err := BuildDailyReport(DefaultStatisticsStore(), now.AddDate(0, 0, -1), now)
+		if err == nil {
+			err = deliverReport(cfg, report)
+		}
+		if err != nil {
+			log.Println("Daily report error:", err)
+		}
+	}
+}
+
+//Save the alerts of the hook script for the daily report
+func recordAlert(alert *system.AlertRecord) {
+	if err := DefaultStatisticsStore().SaveAlert(alert); err != nil {
+		log.Println("Save alert error:", err)
+	}
+}
+
+//Print the report of global.ReportDate to stdout,yesterday if empty
+func PrintReport() {
+	now := time.Now()
+	day := now.AddDate(0, 0, -1)
+	if global.ReportDate != "" {
+		var err error
+		if day, err = time.ParseInLocation("2006-01-02", global.ReportDate, time.Local); err != nil {
+			log.Fatalln("Report date error:", err)
+		}
+	}
+	format := global.ReportFormat
+	if format == "" {
+		format = global.ReportPlain
+	}
+	report, err := BuildDailyReport(DefaultStatisticsStore(), day, now)
+	if err != nil {
+		log.Fatalln("Build report error:", err)
+	}
+	body, err := RenderReport(report, format)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	os.Stdout.Write(body)
+}
@@ -0,0 +1,154 @@
+package netservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"ActivedRouter/global"
+	"ActivedRouter/gopsutil/disk"
+	"ActivedRouter/hook"
+	"ActivedRouter/system"
+)
+
+func reportTraffic(requests, errors int64, latency float64) system.TrafficStatistics {
+	histogram := system.NewLatencyHistogram()
+	for i := int64(0); i < requests; i++ {
+		histogram.Observe(latency)
+	}
+	return system.TrafficStatistics{
+		RequestCount: requests,
+		StatusClass:  map[string]int64{"2xx": requests - errors, "5xx": errors},
+		Latency:      histogram,
+	}
+}
+
+func TestDailyReport(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "report")
+	defer os.RemoveAll(dir)
+	store := system.NewStatisticsStore(dir, system.StatisticsRetention{})
+	day := time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local)
+	base := day.Add(10 * time.Hour).Unix()
+	fast, slow := reportTraffic(90, 0, 0.01), reportTraffic(10, 5, 2)
+	total := reportTraffic(100, 5, 0.01)
+	store.SaveProxyStatistics(map[string]*system.HttpProxyStatistics{
+		"www.abc.com": {
+			Timestamp:         base,
+			TrafficStatistics: total,
+			Rejected:          map[string]int64{"rate": 3},
+			Backends:          map[string]*system.TrafficStatistics{"127.0.0.1:8001": &fast, "127.0.0.1:8002": &slow},
+		},
+	})
+	host := system.HostInfo{Status: system.ACTIVE, Info: &system.SystemInfo{IP: "10.0.0.1", Cluster: "web", DISK: &disk.DiskUsageStat{UsedPercent: 40}}}
+	store.SaveHostStatistics([]system.HostInfo{host}, base-86400)
+	host.Info.DISK.UsedPercent = 50
+	store.SaveHostStatistics([]system.HostInfo{host}, base)
+	host.Status = system.UNACTIVE
+	store.SaveHostStatistics([]system.HostInfo{host}, base+60)
+	store.SaveAlert(&system.AlertRecord{Timestamp: base, Host: "10.0.0.1", Subject: "ActivedRouter Disk警报", Info: "first"})
+	store.SaveAlert(&system.AlertRecord{Timestamp: base + 60, Host: "10.0.0.1", Subject: "ActivedRouter Disk警报", Info: "second"})
+
+	report, err := BuildDailyReport(store, day.Add(12*time.Hour), day.AddDate(0, 0, 1).Add(8*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Date != "2026-10-18" || len(report.Domains) != 1 {
+		t.Fatal("unexpected report", report)
+	}
+	domain := report.Domains[0]
+	if domain.Requests != 100 || domain.ServerErrors != 5 || domain.ErrorRate != 0.05 || domain.Rejected != 3 {
+		t.Fatal("unexpected domain", domain)
+	}
+	if len(report.SlowBackends) != 2 || report.SlowBackends[0].Backend != "127.0.0.1:8002" || report.SlowBackends[0].LatencyAvg != 2 {
+		t.Fatal("unexpected backends", report.SlowBackends)
+	}
+	if len(report.UnactiveHosts) != 1 || report.UnactiveHosts[0].UnactiveMinutes != 1 {
+		t.Fatal("unexpected hosts", report.UnactiveHosts)
+	}
+	if len(report.Alerts) != 1 || report.Alerts[0].Count != 2 || report.Alerts[0].Info != "second" {
+		t.Fatal("unexpected alerts", report.Alerts)
+	}
+	if len(report.Disk) != 1 || report.Disk[0].UsedPercent != 50 || report.Disk[0].Change != 10 {
+		t.Fatal("unexpected disk", report.Disk)
+	}
+
+	for _, format := range []string{global.ReportPlain, global.ReportHtml, global.ReportJson} {
+		body, err := RenderReport(report, format)
+		if err != nil || !bytes.Contains(body, []byte("www.abc.com")) || !bytes.Contains(body, []byte("127.0.0.1:8002")) {
+			t.Fatal("unexpected", format, "report", err, string(body))
+		}
+	}
+	if _, err := RenderReport(report, "pdf"); err == nil {
+		t.Fatal("unknown format rendered")
+	}
+}
+
+func TestDeliverReportWebhook(t *testing.T) {
+	var received DailyReport
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer webhook.Close()
+	cfg := &hook.ReportConfig{Switch: global.SwitchOn, Format: global.ReportJson, Webhook: webhook.URL}
+	if err := deliverReport(cfg, &DailyReport{Date: "2026-10-18"}); err != nil {
+		t.Fatal(err)
+	}
+	if received.Date != "2026-10-18" {
+		t.Fatal("report not posted", received)
+	}
+	cfg.Webhook = webhook.URL + "/missing"
+	if err := deliverReport(cfg, &DailyReport{}); err == nil {
+		t.Fatal("webhook error ignored")
+	}
+}
+
+func TestReverseProxyReport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	backendUrl, _ := url.Parse(backend.URL)
+	dir, _ := ioutil.TempDir("", "report")
+	defer os.RemoveAll(dir)
+	DefaultStatisticsStore()
+	defaultStore := statisticsStore
+	statisticsStore = system.NewStatisticsStore(dir, system.StatisticsRetention{})
+	defer func() { statisticsStore = defaultStore }()
+
+	cfg := &ReverseProxyConfigData{
+		GlobalHttpSwitch: "on",
+		ReverseProxy: []*LbNode{
+			{Domain: "report.abc.com", HttpSwitch: "on", Clients: []*HostInfo{{Host: backendUrl.Hostname(), Port: backendUrl.Port()}}},
+		},
+	}
+	proxy := NewReverseProxy()
+	proxy.applyProxyConfig(cfg, "")
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://report.abc.com/", nil))
+	//the interval saved on shutdown or when it's finished
+	saveProxyStatistics(global.GProxyHttpStatistics.NextInterval())
+
+	now := time.Now()
+	report, err := BuildDailyReport(DefaultStatisticsStore(), now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range report.Domains {
+		if domain.Domain == "report.abc.com" && domain.Requests == 1 {
+			return
+		}
+	}
+	t.Fatal("proxy traffic missing in the report", report.Domains)
+}
@@ -0,0 +1,87 @@
+package netservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//Longest request id accepted from the client
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+//fallback when the random source fails
+var requestIDCounter uint64
+
+//Generate a unique request id,32 hex characters
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%016x%016x", time.Now().UnixNano(), atomic.AddUint64(&requestIDCounter, 1))
+	}
+	return hex.EncodeToString(buf)
+}
+
+//Client ids are kept only if they are short printable tokens
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+//Valid header name of the config
+func validHeaderName(name string) bool {
+	return name == "" || (validRequestID(name) && !strings.ContainsAny(name, ":()<>@,;\\\"/[]?={}"))
+}
+
+//Accept the incoming request id or generate one,
+//forward it upstream,return it to the client and attach it to the request context
+func withRequestID(w http.ResponseWriter, r *http.Request, header string) *http.Request {
+	id := r.Header.Get(header)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	r.Header.Set(header, id)
+	w.Header().Set(header, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+//Request id of the request,empty if it has none
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+//Header name carrying the request id
+func (self *ReverseProxyConfigData) requestIDHeader() string {
+	if self.RequestIDHeader == "" {
+		return global.RequestIDHeader
+	}
+	return http.CanonicalHeaderKey(self.RequestIDHeader)
+}
+
+//Error page with the request id so the user can report it
+func writeProxyError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if id := requestID(r); id != "" {
+		fmt.Fprintf(w, "%s\nrequest id: %s\n", message, id)
+	} else {
+		fmt.Fprintln(w, message)
+	}
+}
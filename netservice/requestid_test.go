@@ -0,0 +1,71 @@
+package netservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var upstreamID string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get("X-Trace-Id")
+		w.Header().Set("X-Trace-Id", "from-backend")
+	}))
+	defer backend.Close()
+	backendUrl, _ := url.Parse(backend.URL)
+
+	cfg := &ReverseProxyConfigData{
+		GlobalHttpSwitch: "on",
+		RequestIDHeader:  "x-trace-id",
+		ReverseProxy: []*LbNode{
+			{Domain: "www.abc.com", HttpSwitch: "on", Clients: []*HostInfo{{Host: backendUrl.Hostname(), Port: backendUrl.Port()}}},
+			{Domain: "www.abcd.com", HttpSwitch: "on"},
+			{Domain: "www.abcde.com", HttpSwitch: "off"},
+		},
+	}
+	proxy := NewReverseProxy()
+	proxy.applyProxyConfig(cfg, "")
+
+	//generated
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://www.abc.com/", nil))
+	id := w.Header().Get("X-Trace-Id")
+	if len(id) != 32 || upstreamID != id || len(w.Header()["X-Trace-Id"]) != 1 {
+		t.Fatal("unexpected request id", id, upstreamID, w.Header()["X-Trace-Id"])
+	}
+	//accepted from the client
+	r := httptest.NewRequest("GET", "http://www.abc.com/", nil)
+	r.Header.Set("X-Trace-Id", "client-id")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	if w.Header().Get("X-Trace-Id") != "client-id" || upstreamID != "client-id" {
+		t.Fatal("client request id not kept", w.Header().Get("X-Trace-Id"), upstreamID)
+	}
+	//invalid id replaced
+	r = httptest.NewRequest("GET", "http://www.abc.com/", nil)
+	r.Header.Set("X-Trace-Id", "bad id")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	if id := w.Header().Get("X-Trace-Id"); id == "bad id" || len(id) != 32 {
+		t.Fatal("invalid request id kept", id)
+	}
+	//error page
+	r = httptest.NewRequest("GET", "http://www.abcd.com/", nil)
+	r.Header.Set("X-Trace-Id", "error-id")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "request id: error-id") {
+		t.Fatal("unexpected error page", w.Code, w.Body.String())
+	}
+	//rejected by the switch
+	r = httptest.NewRequest("GET", "http://www.abcde.com/", nil)
+	r.Header.Set("X-Trace-Id", "switch-id")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "request id: switch-id") {
+		t.Fatal("unexpected switch off page", w.Code, w.Body.String())
+	}
+}
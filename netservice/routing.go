@@ -0,0 +1,96 @@
+package netservice
+
+import (
+	"encoding/json"
+	"strings"
+
+	"ActivedRouter/global"
+)
+
+//Routing state of a domain
+type domainRoute struct {
+	Domain      string
+	HttpSwitch  string
+	HttpsSwitch string
+	Hosts       []*HostInfo
+	Limit       *ProxyLimit
+	//nil if the access log is off
+	AccessLog *domainAccessLog
+	//nil if tracing is off
+	Tracing *domainTracing
+	//nil if client auth is off
+	ClientAuth *domainClientAuth
+	TLS        *domainTLSPolicy
+}
+
+//Immutable routing snapshot,
+//a change builds a new table and swaps it atomically,so requests never see a half applied change.
+type routingTable struct {
+	Cfg         *ReverseProxyConfigData
+	ProxyMethod string
+	Domains     map[string]*domainRoute
+	//canonical request id header name
+	RequestIDHeader string
+	//TLS policy of the server names without a domain
+	TLS *domainTLSPolicy
+}
+
+//Build the routing table,the table owns copies of the hosts
+func newRoutingTable(cfg *ReverseProxyConfigData) *routingTable {
+	table := &routingTable{
+		Cfg:             cfg,
+		ProxyMethod:     cfg.ProxyMethod,
+		Domains:         make(map[string]*domainRoute),
+		RequestIDHeader: cfg.requestIDHeader(),
+		TLS:             newDomainTLSPolicy(cfg, nil),
+	}
+	//Proxy method
+	if table.ProxyMethod == "" {
+		table.ProxyMethod = global.Random
+	}
+	for _, node := range cfg.ReverseProxy {
+		route := &domainRoute{
+			Domain:      node.Domain,
+			HttpSwitch:  node.HttpSwitch,
+			HttpsSwitch: node.HttpsSwitch,
+			Limit:       newProxyLimit(cfg, node),
+			AccessLog:   newDomainAccessLog(cfg, node),
+			Tracing:     newDomainTracing(cfg, node),
+			ClientAuth:  newDomainClientAuth(node),
+			TLS:         newDomainTLSPolicy(cfg, node),
+		}
+		for _, hostInfo := range node.Clients {
+			host := *hostInfo
+			route.Hosts = append(route.Hosts, &host)
+		}
+		table.Domains[node.Domain] = route
+	}
+	return table
+}
+
+//Current routing table
+func (self *HttpReverseProxy) table() *routingTable {
+	return self.routing.Load().(*routingTable)
+}
+
+//Deep copy of the config for copy-on-write changes
+func cloneProxyConfig(cfg *ReverseProxyConfigData) (*ReverseProxyConfigData, error) {
+	bts, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	clone := &ReverseProxyConfigData{}
+	if err := json.Unmarshal(bts, clone); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+//Handle non-80 ports
+func stripHostPort(host string) string {
+	if strings.IndexAny(host, ":") != -1 {
+		strs := strings.Split(host, ":")
+		return strs[0]
+	}
+	return host
+}
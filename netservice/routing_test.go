@@ -0,0 +1,87 @@
+package netservice
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const routingTestConfig = `{
+ "http_switch": "on",
+ "https_switch": "off",
+ "proxy_method": "random",
+ "reserve_proxy": [
+  {
+   "domain": "www.abc.com",
+   "http_switch": "on",
+   "https_switch": "off",
+   "clients": []
+  }
+ ]
+}`
+
+//Requests keep being served while the config is changed concurrently
+func TestRoutingConcurrentUpdate(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	backend := httptest.NewServer(handler)
+	defer backend.Close()
+	backendUrl, _ := url.Parse(backend.URL)
+	//added and deleted while serving
+	extra := httptest.NewServer(handler)
+	defer extra.Close()
+	extraUrl, _ := url.Parse(extra.URL)
+
+	dir, _ := ioutil.TempDir("", "routing")
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "http_proxy.json")
+	ioutil.WriteFile(configFile, []byte(routingTestConfig), 0644)
+
+	proxy := NewReverseProxy()
+	proxy.LoadProxyConfig(configFile)
+	if proxy.AddProxyClient("www.abc.com", backendUrl.Hostname(), backendUrl.Port(), "off", "on", "test") != 1 {
+		t.Fatal("add proxy client failed")
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				r := httptest.NewRequest("GET", "http://www.abc.com/", nil)
+				w := httptest.NewRecorder()
+				proxy.ServeHTTP(w, r)
+				if w.Code != http.StatusOK {
+					t.Error("unexpected status", w.Code)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		proxy.AddProxyClient("www.abc.com", extraUrl.Hostname(), extraUrl.Port(), "off", "on", "test")
+		proxy.DeleteProxyClient("www.abc.com", extraUrl.Hostname(), extraUrl.Port(), "test")
+		proxy.UpdateDomain("www.abc.com", "www.abc.com", "off", "on", "test")
+		proxy.ReloadProxyConfig()
+	}
+	close(stop)
+	wg.Wait()
+
+	hosts := proxy.GetDomainHostList("www.abc.com")
+	if len(hosts) != 1 || hosts[0].Port != backendUrl.Port() {
+		t.Fatal("unexpected hosts", hosts)
+	}
+}
@@ -1,11 +1,13 @@
 package netservice
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"sync"
 
 	"strings"
 	"time"
@@ -26,6 +28,13 @@ type ServerConfig struct {
 	ServerMode string `json:"srvmode"`
 	HttpHost   string `json:"httphost"`
 	HttpPort   string `json:"httpport"`
+	//seconds to drain connections on shutdown
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	//number of saved versions of each config file
+	ConfigVersions int `json:"config_versions"`
+	//statistics history,days kept for each resolution
+	StatisticsDir       string                     `json:"statistics_dir"`
+	StatisticsRetention system.StatisticsRetention `json:"statistics_retention"`
 }
 
 //loade serverConfig
@@ -52,11 +61,40 @@ type Server struct {
 	Port         string
 	TaskFlag     chan bool    //syn channel
 	ListenSocket net.Listener //conn
+	//client agent connections
+	conns     map[net.Conn]bool
+	connMutex *sync.Mutex
+	connGroup *sync.WaitGroup
+	closed    bool
 }
 
 //create server
 func NewServer() *Server {
-	return &Server{TaskFlag: make(chan bool, 0)}
+	return &Server{TaskFlag: make(chan bool, 0), conns: make(map[net.Conn]bool), connMutex: &sync.Mutex{}, connGroup: &sync.WaitGroup{}}
+}
+
+//number of connected client agents
+func (self *Server) ConnCount() int {
+	self.connMutex.Lock()
+	defer self.connMutex.Unlock()
+	return len(self.conns)
+}
+
+//track the client agent connection,return false when the server is shutting down
+func (self *Server) trackConn(c net.Conn, add bool) bool {
+	self.connMutex.Lock()
+	defer self.connMutex.Unlock()
+	if add {
+		if self.closed {
+			return false
+		}
+		self.conns[c] = true
+		self.connGroup.Add(1)
+	} else if _, ok := self.conns[c]; ok {
+		delete(self.conns, c)
+		self.connGroup.Done()
+	}
+	return true
 }
 
 //Data Receive
@@ -64,6 +102,10 @@ func (self *Server) OnDataRecv(c net.Conn) {
 	//return
 	log.Printf("accept connect from %s\n", c.RemoteAddr().String())
 	defer c.Close()
+	if !self.trackConn(c, true) {
+		return
+	}
+	defer self.trackConn(c, false)
 	buffer := make([]byte, global.SERVER_BUFFER_SIZE)
 	//Declare a pipe for receiving unpacked data
 	readerChannel := make(chan []byte, 1024)
@@ -115,6 +157,42 @@ func (self *Server) StopServer() {
 	<-self.TaskFlag
 }
 
+//Stop accepting and drain the client agent connections,
+//the connections still open at the deadline are closed.
+func (self *Server) Shutdown(ctx context.Context) {
+	self.connMutex.Lock()
+	self.closed = true
+	if self.ListenSocket != nil {
+		self.ListenSocket.Close()
+	}
+	//let the pending heartbeat packets be read
+	deadline := time.Now().Add(time.Second * global.CLIENT_HEARTBEAT_INTERVAL)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	for c := range self.conns {
+		c.SetReadDeadline(deadline)
+	}
+	self.connMutex.Unlock()
+	drained := make(chan bool)
+	go func() {
+		self.connGroup.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		{
+			self.connMutex.Lock()
+			for c := range self.conns {
+				c.Close()
+			}
+			self.connMutex.Unlock()
+		}
+	}
+	self.StopServer()
+}
+
 //Timing monitoring of routing server information
 func (self *Server) checkRouterInfo() {
 	timerRouterInfo := time.NewTimer(time.Second * global.SERVER_CHECK_ROUTER_INTERVAL)
@@ -182,18 +260,28 @@ func (self *Server) Run(host, port string) {
 		addr = self.Host + ":" + self.Port
 	}
 	//listen
-	l, err := net.Listen("tcp", addr)
+	l, err := listenTCP(addr)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 	//save listen socket
+	self.connMutex.Lock()
 	self.ListenSocket = l
+	self.connMutex.Unlock()
+	registerRouterServer(self)
 	//accept
 	go func() {
 		for {
 			conn, err := l.Accept()
 			if err != nil {
+				self.connMutex.Lock()
+				closed := self.closed
+				self.connMutex.Unlock()
+				if closed {
+					return
+				}
 				log.Println(err)
+				continue
 			}
 			//Data Recv
 			go self.OnDataRecv(conn)
@@ -0,0 +1,307 @@
+package netservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//Pool of the connections whose TLS server name matches,the stream is passed through without decrypting
+type SNIRoute struct {
+	//example.com or *.example.com
+	ServerName string     `json:"server_name"`
+	Method     string     `json:"method"`
+	LbNode     []*TCPNode `json:"lbnode"`
+	//round robin position
+	next uint64
+}
+
+func validateSNIRoutes(routes []*SNIRoute) error {
+	names := make(map[string]bool)
+	for _, route := range routes {
+		if route == nil {
+			return errors.New("empty sni route")
+		}
+		route.ServerName = strings.TrimSuffix(strings.ToLower(route.ServerName), ".")
+		name := strings.TrimPrefix(route.ServerName, "*.")
+		if name == "" || strings.Contains(name, "*") {
+			return fmt.Errorf("invalid sni server_name %s", route.ServerName)
+		}
+		if names[route.ServerName] {
+			return fmt.Errorf("duplicate sni server_name %s", route.ServerName)
+		}
+		names[route.ServerName] = true
+		if err := validateNodes(route.Method, route.LbNode); err != nil {
+			return fmt.Errorf("sni %s: %s", route.ServerName, err)
+		}
+	}
+	return nil
+}
+
+//Route of the server name,exact names before wildcards and the longest wildcard first
+func matchSNIRoute(routes []*SNIRoute, serverName string) *SNIRoute {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if name == "" {
+		return nil
+	}
+	for _, route := range routes {
+		if route.ServerName == name {
+			return route
+		}
+	}
+	for i := strings.Index(name, "."); i >= 0; i = strings.Index(name, ".") {
+		name = name[i+1:]
+		for _, route := range routes {
+			if route.ServerName == "*."+name {
+				return route
+			}
+		}
+	}
+	return nil
+}
+
+//Read the ClientHello and return the server name,
+//the returned connection replays the bytes read even if the hello is invalid
+func peekServerName(conn net.Conn, timeout time.Duration) (net.Conn, string, error) {
+	buf := &bytes.Buffer{}
+	var serverName string
+	peeked := false
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	err := tls.Server(&helloRecorder{Conn: conn, reader: io.TeeReader(conn, buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName, peeked = hello.ServerName, true
+			return nil, errors.New("client hello peeked")
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	replay := &sniConn{Conn: conn, reader: io.MultiReader(buf, conn)}
+	if !peeked {
+		return replay, "", err
+	}
+	return replay, serverName, nil
+}
+
+//connection reading the ClientHello,the alert of the aborted handshake is dropped
+type helloRecorder struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (self *helloRecorder) Read(b []byte) (int, error) {
+	return self.reader.Read(b)
+}
+
+func (self *helloRecorder) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+//connection replaying the peeked ClientHello
+type sniConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (self *sniConn) Read(b []byte) (int, error) {
+	return self.reader.Read(b)
+}
+
+//keep the half-close of the proxied stream
+func (self *sniConn) CloseWrite() error {
+	if cw, ok := self.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return self.Conn.Close()
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+//Listener passing the matching server names through to their pools before the TLS handshake,
+//the other connections are accepted by the terminating https server
+type sniListener struct {
+	net.Listener
+	routes  func() []*SNIRoute
+	results chan acceptResult
+	done    chan struct{}
+	once    sync.Once
+	//passed through connections,client => backend
+	mutex     sync.Mutex
+	conns     map[net.Conn]net.Conn
+	draining  bool
+	connGroup sync.WaitGroup
+}
+
+func newSNIListener(l net.Listener, routes func() []*SNIRoute) *sniListener {
+	listener := &sniListener{
+		Listener: l,
+		routes:   routes,
+		results:  make(chan acceptResult),
+		done:     make(chan struct{}),
+		conns:    make(map[net.Conn]net.Conn),
+	}
+	go listener.serve()
+	return listener
+}
+
+func (self *sniListener) serve() {
+	for {
+		conn, err := self.Listener.Accept()
+		if err != nil {
+			self.deliver(acceptResult{err: err})
+			//the server backs off on temporary errors
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go self.route(conn)
+	}
+}
+
+//Peek the server name of the connection,unmatched ones are handed to Accept
+func (self *sniListener) route(conn net.Conn) {
+	routes := self.routes()
+	if len(routes) == 0 {
+		self.deliver(acceptResult{conn: conn})
+		return
+	}
+	peeked, serverName, err := peekServerName(conn, global.DefaultClientHelloTimeout*time.Second)
+	route := matchSNIRoute(routes, serverName)
+	if err != nil || route == nil {
+		self.deliver(acceptResult{conn: peeked})
+		return
+	}
+	defer peeked.Close()
+	backend, node, err := dialNodes(orderNodes(route.LbNode, route.Method, &route.next), global.DefaultTCPConnectTimeout*time.Second)
+	if err != nil {
+		log.Println("SNI passthrough", serverName, err)
+		return
+	}
+	defer atomic.AddInt64(&node.active, -1)
+	defer backend.Close()
+	if !self.trackConn(peeked, backend, true) {
+		return
+	}
+	defer self.trackConn(peeked, backend, false)
+	pipeConn(peeked, backend, nil, nil)
+}
+
+//Add or remove a passed through connection,no more are added once draining
+func (self *sniListener) trackConn(client, backend net.Conn, add bool) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if add {
+		if self.draining {
+			return false
+		}
+		self.connGroup.Add(1)
+		self.conns[client] = backend
+	} else if _, ok := self.conns[client]; ok {
+		delete(self.conns, client)
+		self.connGroup.Done()
+	}
+	return true
+}
+
+func (self *sniListener) deliver(result acceptResult) {
+	select {
+	case self.results <- result:
+	case <-self.done:
+		if result.conn != nil {
+			result.conn.Close()
+		}
+	}
+}
+
+func (self *sniListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-self.results:
+		return result.conn, result.err
+	case <-self.done:
+		return nil, net.ErrClosed
+	}
+}
+
+//Stop accepting,the passed through connections are kept until they finish
+func (self *sniListener) Close() error {
+	err := self.Listener.Close()
+	self.once.Do(func() { close(self.done) })
+	return err
+}
+
+//Stop accepting,wait for the passed through connections and close the rest at the deadline
+func (self *sniListener) shutdown(ctx context.Context) {
+	self.Close()
+	self.mutex.Lock()
+	self.draining = true
+	self.mutex.Unlock()
+	drained := make(chan bool)
+	go func() {
+		self.connGroup.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		{
+			self.mutex.Lock()
+			for client, backend := range self.conns {
+				client.Close()
+				backend.Close()
+			}
+			self.mutex.Unlock()
+			<-drained
+		}
+	}
+}
+
+//Check the nodes of the passthrough server names with sni_health_check until the process exits,
+//the check of the running config is used in every round
+func (self *HttpReverseProxy) RunSNIHealthCheck() {
+	for {
+		cfg := self.Config()
+		interval := global.DefaultTCPHealthInterval * time.Second
+		if check := cfg.SNIHealthCheck; check.enabled() {
+			var nodes []*TCPNode
+			for _, route := range cfg.SNIPassthrough {
+				nodes = append(nodes, route.LbNode...)
+			}
+			checkTCPNodes(nodes, check)
+			interval = check.interval()
+		}
+		time.Sleep(interval)
+	}
+}
+
+//Passthrough server name and its nodes for the admin api
+type SNIRouteStatus struct {
+	ServerName string           `json:"server_name"`
+	Method     string           `json:"method"`
+	Nodes      []*TCPNodeStatus `json:"nodes"`
+}
+
+//State of the passthrough server names of the https listener
+func (self *HttpReverseProxy) SNIStatus() []*SNIRouteStatus {
+	statuses := make([]*SNIRouteStatus, 0)
+	for _, route := range self.Config().SNIPassthrough {
+		status := &SNIRouteStatus{ServerName: route.ServerName, Method: route.Method, Nodes: make([]*TCPNodeStatus, 0)}
+		for _, node := range route.LbNode {
+			status.Nodes = append(status.Nodes, node.status())
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -0,0 +1,212 @@
+package netservice
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//First flight of a TLS client for the server name
+func clientHello(t *testing.T, serverName string) string {
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	buf := make([]byte, 16384)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	return string(buf[:n])
+}
+
+func TestMatchSNIRoute(t *testing.T) {
+	node := &TCPNode{Host: "127.0.0.1", Port: "443"}
+	routes := []*SNIRoute{
+		{ServerName: "*.example.com", LbNode: []*TCPNode{node}},
+		{ServerName: "*.api.example.com", LbNode: []*TCPNode{node}},
+		{ServerName: "Www.Example.com.", LbNode: []*TCPNode{node}},
+	}
+	if err := validateSNIRoutes(routes); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"www.example.com":      "www.example.com",
+		"WWW.example.com.":     "www.example.com",
+		"a.example.com":        "*.example.com",
+		"a.b.example.com":      "*.example.com",
+		"v1.api.example.com":   "*.api.example.com",
+		"x.v1.api.example.com": "*.api.example.com",
+		"example.com":          "",
+		"other.org":            "",
+		"":                     "",
+	} {
+		route := matchSNIRoute(routes, name)
+		if (route == nil && want != "") || (route != nil && route.ServerName != want) {
+			t.Fatalf("%s matched %v,want %s", name, route, want)
+		}
+	}
+	for _, invalid := range [][]*SNIRoute{
+		{{ServerName: "", LbNode: []*TCPNode{node}}},
+		{{ServerName: "*", LbNode: []*TCPNode{node}}},
+		{{ServerName: "a.*.com", LbNode: []*TCPNode{node}}},
+		{{ServerName: "a.com"}},
+		{{ServerName: "a.com", LbNode: []*TCPNode{node}}, {ServerName: "A.com", LbNode: []*TCPNode{node}}},
+	} {
+		if validateSNIRoutes(invalid) == nil {
+			t.Fatal("invalid routes accepted", invalid[0])
+		}
+	}
+}
+
+func TestTCPProxySNIRouting(t *testing.T) {
+	node1, stop1 := startEchoServer(t, "one")
+	defer stop1()
+	node2, stop2 := startEchoServer(t, "two")
+	defer stop2()
+	fallback, stop3 := startEchoServer(t, "default")
+	defer stop3()
+	listener := startTestTCPListener(t, &TCPProxyItem{LbNode: []*TCPNode{fallback}, SNIRoutes: []*SNIRoute{
+		{ServerName: "db.example.com", LbNode: []*TCPNode{node1}},
+		{ServerName: "*.example.com", LbNode: []*TCPNode{node2}},
+	}})
+	defer listener.shutdown(context.Background())
+	addr := listener.listener.Addr().String()
+	for name, want := range map[string]string{"db.example.com": "one:", "web.example.com": "two:", "other.org": "default:", "": "default:"} {
+		hello := clientHello(t, name)
+		//the ClientHello reaches the node unchanged
+		if got := tcpRoundTrip(t, addr, hello); got != want+hello {
+			t.Fatalf("%s got %q", name, got[:len(want)])
+		}
+	}
+	//not TLS
+	if got := tcpRoundTrip(t, addr, "plain"); got != "default:plain" {
+		t.Fatalf("got %q", got)
+	}
+
+	//without a default pool the unmatched names are closed
+	routesOnly := startTestTCPListener(t, &TCPProxyItem{SNIRoutes: []*SNIRoute{{ServerName: "db.example.com", LbNode: []*TCPNode{node1}}}})
+	defer routesOnly.shutdown(context.Background())
+	if got := tcpRoundTrip(t, routesOnly.listener.Addr().String(), clientHello(t, "other.org")); got != "" {
+		t.Fatalf("unmatched name got %q", got)
+	}
+}
+
+func TestSNIPassthroughSharedPort(t *testing.T) {
+	node, stop := startEchoServer(t, "passthrough")
+	defer stop()
+	httpsServer := NewHttpsServer()
+	if err := httpsServer.AddDomainCertificateItem("www.abc.com", "../config/crtdata/www.abc.com/server.crt", "../config/crtdata/www.abc.com/server.key"); err != nil {
+		t.Fatal(err)
+	}
+	httpsServer.TLSConfig.GetCertificate = httpsServer.defaultGetCertificate
+	httpsServer.Handler = handler
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := []*SNIRoute{{ServerName: "*.customer.com", Method: global.RoundRobin, LbNode: []*TCPNode{node}}}
+	if err := validateSNIRoutes(routes); err != nil {
+		t.Fatal(err)
+	}
+	go httpsServer.ServeTLS(newSNIListener(l, func() []*SNIRoute { return routes }), "", "")
+	defer httpsServer.Close()
+	addr := l.Addr().String()
+
+	//matched names are passed through
+	hello := clientHello(t, "shop.customer.com")
+	if got := tcpRoundTrip(t, addr, hello); got != "passthrough:"+hello {
+		t.Fatalf("passthrough got %d bytes", len(got))
+	}
+	//the others are terminated by the https server
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "www.abc.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.0\r\nHost: www.abc.com\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(string(body), "TTTTTTTT") {
+		t.Fatalf("https server answered %q", body)
+	}
+}
+
+func TestSNIListenerShutdown(t *testing.T) {
+	node, stop := startEchoServer(t, "passthrough")
+	defer stop()
+	routes := []*SNIRoute{{ServerName: "shop.customer.com", LbNode: []*TCPNode{node}}}
+	dial := func(listener *sniListener) net.Conn {
+		conn, err := net.DialTimeout("tcp", listener.Addr().String(), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		hello := clientHello(t, "shop.customer.com")
+		conn.Write([]byte(hello))
+		buf := make([]byte, len("passthrough:")+len(hello))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	newListener := func() *sniListener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newSNIListener(l, func() []*SNIRoute { return routes })
+	}
+
+	//the stream is drained before the shutdown returns
+	listener := newListener()
+	conn := dial(listener)
+	defer conn.Close()
+	stopped := make(chan bool)
+	go func() {
+		listener.shutdown(context.Background())
+		close(stopped)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-stopped:
+		t.Fatal("shutdown returned with an open stream")
+	default:
+	}
+	conn.Write([]byte("more"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "more" {
+		t.Fatalf("stream cut by the shutdown:%q %v", buf, err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown not finished after the stream")
+	}
+
+	//the streams left at the deadline are closed
+	listener = newListener()
+	conn = dial(listener)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	listener.shutdown(ctx)
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,63 @@
+package netservice
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"ActivedRouter/global"
+	"ActivedRouter/system"
+)
+
+var (
+	statisticsStore     *system.StatisticsStore
+	statisticsStoreOnce sync.Once
+)
+
+//Store of the statistics history configured in server.json
+func DefaultStatisticsStore() *system.StatisticsStore {
+	statisticsStoreOnce.Do(func() {
+		dir := ServerConfigData.StatisticsDir
+		if dir == "" {
+			dir = global.DefaultStatisticsDir
+		}
+		statisticsStore = system.NewStatisticsStore(dir, ServerConfigData.StatisticsRetention)
+	})
+	return statisticsStore
+}
+
+//Save the finished interval of the proxy statistics
+func saveProxyStatistics(finished map[string]*system.HttpProxyStatistics) {
+	if len(finished) == 0 {
+		return
+	}
+	if err := DefaultStatisticsStore().SaveProxyStatistics(finished); err != nil {
+		log.Println("Save proxy statistics error:", err)
+	}
+}
+
+//Sample the hosts every minute,roll up the finished hours and days and remove the expired data
+func RunStatisticsStore() {
+	store := DefaultStatisticsStore()
+	timerSample := time.NewTimer(time.Second * global.Http_Statistics_Interval)
+	for {
+		select {
+		case <-timerSample.C:
+			{
+				timerSample.Reset(time.Second * global.Http_Statistics_Interval)
+				now := time.Now()
+				if hosts := global.GHostInfoTable.HostsSnapshot(); len(hosts) > 0 {
+					if err := store.SaveHostStatistics(hosts, now.Unix()); err != nil {
+						log.Println("Save host statistics error:", err)
+					}
+				}
+				if err := store.Rollup(now); err != nil {
+					log.Println("Roll up statistics error:", err)
+				}
+				if err := store.Cleanup(now); err != nil {
+					log.Println("Clean up statistics error:", err)
+				}
+			}
+		}
+	}
+}
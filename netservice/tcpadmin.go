@@ -0,0 +1,219 @@
+package netservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"ActivedRouter/global"
+)
+
+//Edit a copy of the tcp items,validate and save it as a version changed by user,
+//then apply it: removed listeners are stopped and changed running ones go on with the edited items
+func (self *TCPProxy) updateConfig(user string, edit func(cfg *TCPProxyConfig) error) error {
+	return self.updateConfigWithComment(user, "", edit)
+}
+
+//updateConfig with the comment of the saved version
+func (self *TCPProxy) updateConfigWithComment(user, comment string, edit func(cfg *TCPProxyConfig) error) error {
+	self.editMutex.Lock()
+	defer self.editMutex.Unlock()
+	self.Mutex.RLock()
+	current := self.TCPProxyConfigData
+	bts, err := json.Marshal(current)
+	self.Mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	var cfg TCPProxyConfig
+	if err := json.Unmarshal(bts, &cfg); err != nil {
+		return err
+	}
+	//the udp items are not edited,their listeners keep the running items
+	cfg.UDPProxyItems = current.UDPProxyItems
+	if err := edit(&cfg); err != nil {
+		return err
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	//unchanged items keep the state of their nodes
+	for i, item := range cfg.TCPProxyitems {
+		for _, old := range current.TCPProxyitems {
+			if old.ListenAddr == item.ListenAddr && sameTCPItem(old, item) {
+				cfg.TCPProxyitems[i] = old
+			}
+		}
+	}
+	if bts, err = json.MarshalIndent(cfg, "", " "); err != nil {
+		return err
+	}
+	if err := saveConfigFile(self.ProxyConfigFile, bts, user, comment); err != nil {
+		return err
+	}
+	self.Mutex.Lock()
+	//the running listeners proxy the new connections with the edited items,
+	//only the removed addrs stop listening
+	var stopped []string
+	for addr, listener := range self.listeners {
+		_, item := findTCPItem(&cfg, addr)
+		if item == nil {
+			stopped = append(stopped, addr)
+		} else if running := listener.item(); item != running {
+			keepTCPNodes(running, item)
+			listener.setItem(item)
+		}
+	}
+	self.setConfig(cfg)
+	self.Mutex.Unlock()
+	for _, addr := range stopped {
+		self.StopListener(addr)
+	}
+	return nil
+}
+
+//Move the nodes of the running item to the edited one by host:port,
+//so the active connections and the health state of the kept nodes go on
+func keepTCPNodes(running, item *TCPProxyItem) {
+	reset := !item.HealthCheck.enabled()
+	item.LbNode = keepNodes(running.LbNode, item.LbNode, reset)
+	for _, route := range item.SNIRoutes {
+		for _, old := range running.SNIRoutes {
+			if old.ServerName == route.ServerName {
+				route.LbNode = keepNodes(old.LbNode, route.LbNode, reset)
+			}
+		}
+	}
+}
+
+//The kept nodes take the edited max_conns,
+//they are back in rotation when the health check is turned off
+func keepNodes(running, nodes []*TCPNode, reset bool) []*TCPNode {
+	kept := make([]*TCPNode, len(nodes))
+	for i, node := range nodes {
+		kept[i] = node
+		for _, old := range running {
+			if old.Addr() == node.Addr() {
+				atomic.StoreInt64(&old.MaxConns, node.MaxConns)
+				if reset {
+					old.resetHealth()
+				}
+				kept[i] = old
+				break
+			}
+		}
+	}
+	return kept
+}
+
+func sameTCPItem(a, b *TCPProxyItem) bool {
+	bts1, err1 := json.Marshal(a)
+	bts2, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && bytes.Equal(bts1, bts2)
+}
+
+func findTCPItem(cfg *TCPProxyConfig, addr string) (int, *TCPProxyItem) {
+	for i, item := range cfg.TCPProxyitems {
+		if item.ListenAddr == addr {
+			return i, item
+		}
+	}
+	return -1, nil
+}
+
+//Add a listener,it's started when the tcp proxy is on
+func (self *TCPProxy) AddListener(item *TCPProxyItem, user string) error {
+	err := self.updateConfig(user, func(cfg *TCPProxyConfig) error {
+		if _, old := findTCPItem(cfg, item.ListenAddr); old != nil {
+			return fmt.Errorf("tcp proxy %s exists", item.ListenAddr)
+		}
+		cfg.TCPProxyitems = append(cfg.TCPProxyitems, item)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	self.Mutex.RLock()
+	on := self.TCPProxyConfigData.TCPSwitch == global.SwitchOn
+	self.Mutex.RUnlock()
+	if on {
+		return self.StartListener(item.ListenAddr)
+	}
+	return nil
+}
+
+//Replace the listener with the same addr,a running one goes on with the new item
+func (self *TCPProxy) UpdateListener(item *TCPProxyItem, user string) error {
+	return self.updateConfig(user, func(cfg *TCPProxyConfig) error {
+		i, old := findTCPItem(cfg, item.ListenAddr)
+		if old == nil {
+			return fmt.Errorf("tcp proxy %s not found", item.ListenAddr)
+		}
+		cfg.TCPProxyitems[i] = item
+		return nil
+	})
+}
+
+//Remove the listener,a running one stops accepting and drains its connections
+func (self *TCPProxy) RemoveListener(addr, user string) error {
+	return self.updateConfig(user, func(cfg *TCPProxyConfig) error {
+		i, old := findTCPItem(cfg, addr)
+		if old == nil {
+			return fmt.Errorf("tcp proxy %s not found", addr)
+		}
+		cfg.TCPProxyitems = append(cfg.TCPProxyitems[:i], cfg.TCPProxyitems[i+1:]...)
+		return nil
+	})
+}
+
+//Add a node to the default pool of the listener
+func (self *TCPProxy) AddNode(addr string, node *TCPNode, user string) error {
+	return self.updateConfig(user, func(cfg *TCPProxyConfig) error {
+		_, item := findTCPItem(cfg, addr)
+		if item == nil {
+			return fmt.Errorf("tcp proxy %s not found", addr)
+		}
+		for _, v := range item.LbNode {
+			if v.Host == node.Host && v.Port == node.Port {
+				return fmt.Errorf("node %s exists", node.Addr())
+			}
+		}
+		item.LbNode = append(item.LbNode, node)
+		return nil
+	})
+}
+
+//Change the connection limit of a node in the default pool
+func (self *TCPProxy) UpdateNode(addr string, node *TCPNode, user string) error {
+	return self.updateConfig(user, func(cfg *TCPProxyConfig) error {
+		_, item := findTCPItem(cfg, addr)
+		if item == nil {
+			return fmt.Errorf("tcp proxy %s not found", addr)
+		}
+		for _, v := range item.LbNode {
+			if v.Host == node.Host && v.Port == node.Port {
+				v.MaxConns = node.MaxConns
+				return nil
+			}
+		}
+		return fmt.Errorf("node %s not found", node.Addr())
+	})
+}
+
+//Remove a node from the default pool of the listener
+func (self *TCPProxy) RemoveNode(addr, host, port, user string) error {
+	return self.updateConfig(user, func(cfg *TCPProxyConfig) error {
+		_, item := findTCPItem(cfg, addr)
+		if item == nil {
+			return fmt.Errorf("tcp proxy %s not found", addr)
+		}
+		for i, v := range item.LbNode {
+			if v.Host == host && v.Port == port {
+				item.LbNode = append(item.LbNode[:i], item.LbNode[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("node %s:%s not found", host, port)
+	})
+}
@@ -0,0 +1,226 @@
+package netservice
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+func tcpStatus(t *testing.T, proxy *TCPProxy, addr string) *TCPListenerStatus {
+	statuses := proxy.Status(addr)
+	if len(statuses) != 1 {
+		t.Fatalf("%d listeners on %s", len(statuses), addr)
+	}
+	return statuses[0]
+}
+
+func TestTCPProxyAdmin(t *testing.T) {
+	node1, stop1 := startEchoServer(t, "one")
+	defer stop1()
+	node2, stop2 := startEchoServer(t, "two")
+	defer stop2()
+	dir, _ := ioutil.TempDir("", "tcpadmin")
+	defer os.RemoveAll(dir)
+	addr1, addr2 := deadNode(t).Addr(), deadNode(t).Addr()
+	configFile := filepath.Join(dir, "tcp_proxy.json")
+	ioutil.WriteFile(configFile, []byte(`{"tcp_switch":"on","tcp_proxy_items":[{"addr":"`+addr1+
+		`","method":"roundrobin","lbnode":[{"host":"`+node1.Host+`","port":"`+node1.Port+`"}]}]}`), 0644)
+	proxy := NewTCPProxy()
+	proxy.LoadTCPProxyConfig(configFile)
+	proxy.StartTCPProxy()
+	defer proxy.Shutdown(context.Background())
+
+	if got := tcpRoundTrip(t, addr1, "x"); got != "one:x" {
+		t.Fatalf("got %q", got)
+	}
+	status := tcpStatus(t, proxy, addr1)
+	if !status.Running || status.TotalConns != 1 || status.BytesIn != 1 || status.BytesOut != 5 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	//a running listener goes on with the new node,the counters are kept
+	if err := proxy.AddNode(addr1, &TCPNode{Host: node2.Host, Port: node2.Port}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if proxy.AddNode(addr1, &TCPNode{Host: node2.Host, Port: node2.Port}, "admin") == nil {
+		t.Fatal("duplicate node added")
+	}
+	answers := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		answers[tcpRoundTrip(t, addr1, "x")] = true
+	}
+	if !answers["one:x"] || !answers["two:x"] {
+		t.Fatal("unexpected answers", answers)
+	}
+	if status := tcpStatus(t, proxy, addr1); status.TotalConns != 3 || len(status.Nodes) != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	//adding a listener doesn't restart the others
+	proxy.Mutex.RLock()
+	running := proxy.listeners[addr1]
+	proxy.Mutex.RUnlock()
+	item := &TCPProxyItem{ListenAddr: addr2, LbNode: []*TCPNode{{Host: node2.Host, Port: node2.Port}}}
+	if err := proxy.AddListener(item, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	proxy.Mutex.RLock()
+	restarted := proxy.listeners[addr1] != running
+	proxy.Mutex.RUnlock()
+	if restarted {
+		t.Fatal("unchanged listener restarted")
+	}
+	if got := tcpRoundTrip(t, addr2, "y"); got != "two:y" {
+		t.Fatalf("got %q", got)
+	}
+	if err := proxy.UpdateListener(&TCPProxyItem{ListenAddr: addr2, LbNode: []*TCPNode{{Host: node1.Host, Port: node1.Port}}}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if got := tcpRoundTrip(t, addr2, "y"); got != "one:y" {
+		t.Fatalf("got %q after update", got)
+	}
+	//the last node can't be removed
+	if proxy.RemoveNode(addr2, node1.Host, node1.Port, "admin") == nil {
+		t.Fatal("empty pool accepted")
+	}
+	if err := proxy.UpdateNode(addr1, &TCPNode{Host: node1.Host, Port: node1.Port, MaxConns: 10}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.RemoveNode(addr1, node2.Host, node2.Port, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	//stop and start without changing the config
+	if err := proxy.StopListener(addr2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.DialTimeout("tcp", addr2, time.Second); err == nil {
+		t.Fatal("stopped listener accepting")
+	}
+	if tcpStatus(t, proxy, addr2).Running {
+		t.Fatal("stopped listener running")
+	}
+	if err := proxy.StartListener(addr2); err != nil {
+		t.Fatal(err)
+	}
+	if got := tcpRoundTrip(t, addr2, "z"); got != "one:z" {
+		t.Fatalf("got %q after restart", got)
+	}
+	if err := proxy.RemoveListener(addr2, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if len(proxy.Status(addr2)) != 0 {
+		t.Fatal("removed listener reported")
+	}
+	if _, err := net.DialTimeout("tcp", addr2, time.Second); err == nil {
+		t.Fatal("removed listener accepting")
+	}
+
+	//the changes are saved
+	saved := NewTCPProxy()
+	saved.LoadTCPProxyConfig(configFile)
+	items := saved.TCPProxyConfigData.TCPProxyitems
+	if len(items) != 1 || items[0].ListenAddr != addr1 || len(items[0].LbNode) != 1 || items[0].LbNode[0].MaxConns != 10 ||
+		items[0].Method != global.RoundRobin {
+		t.Fatalf("unexpected saved config %+v", items[0])
+	}
+	versions, _ := ListConfigVersions(configFile)
+	if len(versions) != 6 {
+		t.Fatal("unexpected versions", len(versions))
+	}
+
+	//roll back to the two nodes of the first version,the next edit keeps them
+	if err := proxy.RollbackProxyConfig(versions[len(versions)-1].Version, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if status := tcpStatus(t, proxy, addr1); len(status.Nodes) != 2 {
+		t.Fatalf("rollback not applied %+v", status)
+	}
+	if err := proxy.UpdateNode(addr1, &TCPNode{Host: node1.Host, Port: node1.Port, MaxConns: 5}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	answers = map[string]bool{}
+	for i := 0; i < 2; i++ {
+		answers[tcpRoundTrip(t, addr1, "x")] = true
+	}
+	if !answers["one:x"] || !answers["two:x"] {
+		t.Fatal("rollback lost by the next edit", answers)
+	}
+	saved = NewTCPProxy()
+	saved.LoadTCPProxyConfig(configFile)
+	if items := saved.TCPProxyConfigData.TCPProxyitems; len(items) != 1 || len(items[0].LbNode) != 2 {
+		t.Fatalf("unexpected saved config %+v", items)
+	}
+}
+
+func TestTCPProxyEditKeepsNodes(t *testing.T) {
+	node1, stop1 := startEchoServer(t, "one")
+	defer stop1()
+	node2, stop2 := startEchoServer(t, "two")
+	defer stop2()
+	dir, _ := ioutil.TempDir("", "tcpadmin")
+	defer os.RemoveAll(dir)
+	addr := deadNode(t).Addr()
+	configFile := filepath.Join(dir, "tcp_proxy.json")
+	ioutil.WriteFile(configFile, []byte(`{"tcp_switch":"on","tcp_proxy_items":[{"addr":"`+addr+
+		`","health_check":{"switch":"on","interval":3600},"lbnode":[{"host":"`+node1.Host+`","port":"`+node1.Port+`"}]}]}`), 0644)
+	proxy := NewTCPProxy()
+	proxy.LoadTCPProxyConfig(configFile)
+	proxy.StartTCPProxy()
+	defer proxy.Shutdown(context.Background())
+	proxy.Mutex.RLock()
+	listener := proxy.listeners[addr]
+	proxy.Mutex.RUnlock()
+	held := holdConn(t, addr, "one:")
+	defer held.Close()
+	running := listener.item().LbNode[0]
+	running.recordCheck(errors.New("check failed"), 1, 1)
+
+	//the node keeps its connection and health state,the socket and the held stream are kept
+	if err := proxy.AddNode(addr, &TCPNode{Host: node2.Host, Port: node2.Port}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.UpdateNode(addr, &TCPNode{Host: node1.Host, Port: node1.Port, MaxConns: 3}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	proxy.Mutex.RLock()
+	restarted := proxy.listeners[addr] != listener
+	proxy.Mutex.RUnlock()
+	if restarted {
+		t.Fatal("edited listener restarted")
+	}
+	status := tcpStatus(t, proxy, addr)
+	if len(status.Nodes) != 2 || status.ActiveConns != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if node := status.Nodes[0]; node.ActiveConns != 1 || node.MaxConns != 3 || node.Status != global.NodeDown {
+		t.Fatalf("node state lost %+v", node)
+	}
+	held.Write([]byte("x"))
+	buf := make([]byte, 1)
+	if _, err := held.Read(buf); err != nil || string(buf) != "x" {
+		t.Fatalf("held stream got %q %v", buf, err)
+	}
+	//the down node is skipped by the new connections
+	if got := tcpRoundTrip(t, addr, "y"); got != "two:y" {
+		t.Fatalf("got %q", got)
+	}
+
+	//turning the health check off puts the node back in rotation
+	if err := proxy.UpdateListener(&TCPProxyItem{ListenAddr: addr, LbNode: []*TCPNode{{Host: node1.Host, Port: node1.Port}}}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if node := tcpStatus(t, proxy, addr).Nodes[0]; node.Status == global.NodeDown || node.ActiveConns != 1 {
+		t.Fatalf("unexpected node state %+v", node)
+	}
+	if got := tcpRoundTrip(t, addr, "z"); got != "one:z" {
+		t.Fatalf("got %q", got)
+	}
+}
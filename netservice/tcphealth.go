@@ -0,0 +1,241 @@
+package netservice
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//Health check of the tcp proxy nodes,a plain connect without send and expect
+type TCPHealthCheck struct {
+	Switch string `json:"switch"`
+	//seconds between the checks and to wait for the node
+	Interval int `json:"interval,omitempty"`
+	Timeout  int `json:"timeout,omitempty"`
+	//bytes written after connecting and the prefix expected in the answer,
+	//hex:0a0b for binary patterns
+	Send   string `json:"send,omitempty"`
+	Expect string `json:"expect,omitempty"`
+	//successive results changing the state of a node
+	Rise int `json:"rise,omitempty"`
+	Fall int `json:"fall,omitempty"`
+}
+
+func (self *TCPHealthCheck) validate() error {
+	if self == nil {
+		return nil
+	}
+	if !validSwitch(self.Switch) {
+		return errors.New("health_check switch must be on or off")
+	}
+	if self.Interval < 0 || self.Timeout < 0 || self.Rise < 0 || self.Fall < 0 {
+		return errors.New("health_check values must not be negative")
+	}
+	if _, err := decodePattern(self.Send); err != nil {
+		return fmt.Errorf("health_check send: %s", err)
+	}
+	if _, err := decodePattern(self.Expect); err != nil {
+		return fmt.Errorf("health_check expect: %s", err)
+	}
+	return nil
+}
+
+func (self *TCPHealthCheck) enabled() bool {
+	return self != nil && self.Switch == global.SwitchOn
+}
+
+func (self *TCPHealthCheck) interval() time.Duration {
+	if self.Interval == 0 {
+		return global.DefaultTCPHealthInterval * time.Second
+	}
+	return time.Duration(self.Interval) * time.Second
+}
+
+func (self *TCPHealthCheck) timeout() time.Duration {
+	if self.Timeout == 0 {
+		return global.DefaultTCPHealthTimeout * time.Second
+	}
+	return time.Duration(self.Timeout) * time.Second
+}
+
+func (self *TCPHealthCheck) rise() int {
+	if self.Rise == 0 {
+		return global.DefaultTCPHealthRise
+	}
+	return self.Rise
+}
+
+func (self *TCPHealthCheck) fall() int {
+	if self.Fall == 0 {
+		return global.DefaultTCPHealthFall
+	}
+	return self.Fall
+}
+
+//hex:0d0a or the plain bytes
+func decodePattern(pattern string) ([]byte, error) {
+	if strings.HasPrefix(pattern, "hex:") {
+		return hex.DecodeString(pattern[len("hex:"):])
+	}
+	return []byte(pattern), nil
+}
+
+//Connect the node,send and read the expected answer
+func (self *TCPHealthCheck) check(node *TCPNode) error {
+	timeout := self.timeout()
+	conn, err := net.DialTimeout("tcp", node.Addr(), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	send, _ := decodePattern(self.Send)
+	if len(send) != 0 {
+		if _, err := conn.Write(send); err != nil {
+			return err
+		}
+	}
+	expect, _ := decodePattern(self.Expect)
+	if len(expect) != 0 {
+		answer := make([]byte, len(expect))
+		n, err := io.ReadFull(conn, answer)
+		if !bytes.Equal(answer[:n], expect) {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("unexpected answer %q", answer)
+		}
+	}
+	return nil
+}
+
+//health check state of a node
+type nodeHealth struct {
+	mutex     sync.Mutex
+	checked   bool
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+//Record the result of a check,the node is taken out of rotation after fall failures
+//and put back after rise successes
+func (self *TCPNode) recordCheck(err error, rise, fall int) {
+	self.health.mutex.Lock()
+	defer self.health.mutex.Unlock()
+	self.health.checked = true
+	self.health.lastCheck = time.Now()
+	if err != nil {
+		self.health.lastError = err.Error()
+		self.health.successes = 0
+		self.health.failures++
+		if self.health.failures >= fall && atomic.CompareAndSwapInt32(&self.down, 0, 1) {
+			log.Println("TCP node", self.Addr(), "is down:", err)
+		}
+		return
+	}
+	self.health.lastError = ""
+	self.health.failures = 0
+	self.health.successes++
+	if self.health.successes >= rise && atomic.CompareAndSwapInt32(&self.down, 1, 0) {
+		log.Println("TCP node", self.Addr(), "is up")
+	}
+}
+
+//Forget the checks,the node is back in rotation
+func (self *TCPNode) resetHealth() {
+	self.health.mutex.Lock()
+	defer self.health.mutex.Unlock()
+	self.health.checked = false
+	self.health.successes = 0
+	self.health.failures = 0
+	self.health.lastError = ""
+	atomic.StoreInt32(&self.down, 0)
+}
+
+//Taken out of rotation by the health check
+func (self *TCPNode) Down() bool {
+	return atomic.LoadInt32(&self.down) == 1
+}
+
+//Node state for the admin api
+type TCPNodeStatus struct {
+	Host        string `json:"host"`
+	Port        string `json:"port"`
+	Status      string `json:"status"`
+	ActiveConns int64  `json:"active_conns"`
+	MaxConns    int64  `json:"max_conns"`
+	LastCheck   string `json:"last_check,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+func (self *TCPNode) status() *TCPNodeStatus {
+	self.health.mutex.Lock()
+	defer self.health.mutex.Unlock()
+	status := &TCPNodeStatus{
+		Host:        self.Host,
+		Port:        self.Port,
+		Status:      global.NodeUp,
+		ActiveConns: self.ActiveConns(),
+		MaxConns:    atomic.LoadInt64(&self.MaxConns),
+		LastError:   self.health.lastError,
+	}
+	if self.Down() {
+		status.Status = global.NodeDown
+	} else if !self.health.checked {
+		status.Status = global.NodeUnchecked
+	}
+	if self.health.checked {
+		status.LastCheck = self.health.lastCheck.Format("2006-01-02 15:04:05")
+	}
+	return status
+}
+
+//Check all nodes of the listener until it is shut down,
+//the health_check of the running item is used in every round
+func (self *tcpListener) healthCheck() {
+	for {
+		interval := global.DefaultTCPHealthInterval * time.Second
+		if check := self.item().HealthCheck; check.enabled() {
+			self.checkNodes()
+			interval = check.interval()
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-self.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+//One round of checks of the default pool and the server name pools
+func (self *tcpListener) checkNodes() {
+	item := self.item()
+	checkTCPNodes(item.nodes(), item.HealthCheck)
+}
+
+//Check the nodes at the same time and wait for all results
+func checkTCPNodes(nodes []*TCPNode, check *TCPHealthCheck) {
+	wg := &sync.WaitGroup{}
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node *TCPNode) {
+			defer wg.Done()
+			node.recordCheck(check.check(node), check.rise(), check.fall())
+		}(node)
+	}
+	wg.Wait()
+}
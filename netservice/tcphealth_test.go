@@ -0,0 +1,154 @@
+package netservice
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+func TestTCPHealthCheck(t *testing.T) {
+	node, stop := startEchoServer(t, "echo")
+	defer stop()
+	for check, ok := range map[*TCPHealthCheck]bool{
+		{}:                                      true,
+		{Send: "ping", Expect: "echo:ping"}:     true,
+		{Send: "hex:0102", Expect: "hex:6563"}:  true,
+		{Expect: "pong"}:                        false,
+		{Send: "ping", Expect: "echo:pingpong"}: false,
+	} {
+		if err := check.check(node); (err == nil) != ok {
+			t.Fatalf("check %+v: %v", check, err)
+		}
+	}
+	if (&TCPHealthCheck{Timeout: 1}).check(deadNode(t)) == nil {
+		t.Fatal("dead node passed")
+	}
+	if (&TCPHealthCheck{Expect: "hex:zz"}).validate() == nil {
+		t.Fatal("invalid pattern accepted")
+	}
+
+	//down after fall failures,up after rise successes
+	if node.status().Status != global.NodeUnchecked {
+		t.Fatal("unexpected status", node.status())
+	}
+	for i, want := range []string{global.NodeUp, global.NodeDown, global.NodeDown} {
+		node.recordCheck(net.ErrClosed, 3, 2)
+		if node.status().Status != want {
+			t.Fatalf("failure %d: status %s", i, node.status().Status)
+		}
+	}
+	for i, want := range []string{global.NodeDown, global.NodeDown, global.NodeUp} {
+		node.recordCheck(nil, 3, 2)
+		if node.status().Status != want {
+			t.Fatalf("success %d: status %s", i, node.status().Status)
+		}
+	}
+}
+
+func TestTCPProxyHealthRotation(t *testing.T) {
+	node, stop := startEchoServer(t, "alive")
+	defer stop()
+	dead := deadNode(t)
+	listener := startTestTCPListener(t, &TCPProxyItem{Method: global.RoundRobin, LbNode: []*TCPNode{dead, node},
+		HealthCheck: &TCPHealthCheck{Switch: global.SwitchOn, Interval: 60, Timeout: 1, Fall: 1}})
+	defer listener.shutdown(context.Background())
+	//the first round runs when the listener starts
+	for i := 0; i < 100 && !dead.Down(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !dead.Down() || node.Down() {
+		t.Fatal("unexpected node state", dead.status(), node.status())
+	}
+	if dead.status().LastError == "" {
+		t.Fatal("error of the check not recorded")
+	}
+	for i := 0; i < 3; i++ {
+		if got := tcpRoundTrip(t, listener.listener.Addr().String(), "x"); got != "alive:x" {
+			t.Fatalf("got %q", got)
+		}
+	}
+	//no node left
+	node.recordCheck(net.ErrClosed, 1, 1)
+	expectClosed(t, listener.listener.Addr().String())
+}
+
+//The proxy closes the connection without connecting a node
+func expectClosed(t *testing.T, addr string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(make([]byte, 16))
+	if ne, ok := err.(net.Error); n != 0 || err == nil || (ok && ne.Timeout()) {
+		t.Fatal("connection not closed", n, err)
+	}
+}
+
+//Open a connection through the proxy and wait for the greeting of the node
+func holdConn(t *testing.T, addr, greeting string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(greeting))
+	if _, err := conn.Read(buf); err != nil || string(buf) != greeting {
+		t.Fatalf("got %q %v", buf, err)
+	}
+	return conn
+}
+
+func TestTCPProxyConnectionLimits(t *testing.T) {
+	node, stop := startEchoServer(t, "echo")
+	defer stop()
+
+	//rejected at once without a queue timeout
+	listener := startTestTCPListener(t, &TCPProxyItem{MaxConns: 1, LbNode: []*TCPNode{node}})
+	defer listener.shutdown(context.Background())
+	addr := listener.listener.Addr().String()
+	held := holdConn(t, addr, "echo:")
+	expectClosed(t, addr)
+	if atomic.LoadUint64(&listener.counters.rejected) != 1 {
+		t.Fatal("rejected connection not counted")
+	}
+	held.Close()
+
+	//queued until the node has a free slot
+	limited := &TCPNode{Host: node.Host, Port: node.Port, MaxConns: 1}
+	queued := startTestTCPListener(t, &TCPProxyItem{QueueTimeout: 5, LbNode: []*TCPNode{limited}})
+	defer queued.shutdown(context.Background())
+	addr = queued.listener.Addr().String()
+	held = holdConn(t, addr, "echo:")
+	queued.mutex.Lock()
+	released := queued.released
+	queued.mutex.Unlock()
+	result := make(chan string)
+	go func() {
+		result <- tcpRoundTrip(t, addr, "queued")
+	}()
+	select {
+	case got := <-result:
+		t.Fatalf("got %q over the node limit", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+	//the queued connection waits without waking itself up
+	select {
+	case <-released:
+		held.Close()
+		t.Fatal("queued connection retried without a released slot")
+	default:
+	}
+	held.Close()
+	if got := <-result; got != "echo:queued" {
+		t.Fatalf("queued connection got %q", got)
+	}
+	if limited.ActiveConns() > 1 {
+		t.Fatal("node limit exceeded", limited.ActiveConns())
+	}
+}
@@ -1,22 +1,60 @@
 package netservice
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"ActivedRouter/global"
 )
 
-var DefaultTCPProxy = &TCPProxy{}
+var DefaultTCPProxy = NewTCPProxy()
 
 //tcp node
 type TCPNode struct {
 	Host string `json:"host"`
 	Port string `json:"port"`
+	//most connections to the node,0 is unlimited
+	MaxConns int64 `json:"max_conns,omitempty"`
+	//connections being proxied to the node
+	active int64
+	//1 when taken out of rotation by the health check
+	down   int32
+	health nodeHealth
+}
+
+func (self *TCPNode) Addr() string {
+	return net.JoinHostPort(self.Host, self.Port)
+}
+
+//Connections being proxied to the node
+func (self *TCPNode) ActiveConns() int64 {
+	return atomic.LoadInt64(&self.active)
+}
+
+//Count a new connection unless the node is full
+func (self *TCPNode) acquire() bool {
+	for {
+		active := atomic.LoadInt64(&self.active)
+		maxConns := atomic.LoadInt64(&self.MaxConns)
+		if maxConns > 0 && active >= maxConns {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&self.active, active, active+1) {
+			return true
+		}
+	}
 }
 
 //tcp proxy config
@@ -24,134 +62,689 @@ type TCPProxyItem struct {
 	ListenAddr string     `json:"addr"`
 	Method     string     `json:"method"`
 	LbNode     []*TCPNode `json:"lbnode"`
+	//seconds to connect a node before falling back to the next one
+	ConnectTimeout int `json:"connect_timeout,omitempty"`
+	//accept PROXY protocol headers from the trusted load balancers
+	ProxyProtocol *ProxyProtocolConfig `json:"proxy_protocol,omitempty"`
+	//send the client address to the nodes in a v1 or v2 PROXY protocol header
+	SendProxyProtocol string `json:"send_proxy_protocol,omitempty"`
+	//route TLS streams by server name,lbnode is the default pool
+	SNIRoutes []*SNIRoute `json:"sni_routes,omitempty"`
+	//take failing nodes out of rotation
+	HealthCheck *TCPHealthCheck `json:"health_check,omitempty"`
+	//most client connections of the listener,0 is unlimited
+	MaxConns int64 `json:"max_conns,omitempty"`
+	//seconds a connection waits for a free listener or node slot,0 rejects it at once
+	QueueTimeout int `json:"queue_timeout,omitempty"`
 }
 type TCPProxyConfig struct {
 	TCPSwitch     string          `json:"tcp_switch"`
 	TCPProxyitems []*TCPProxyItem `json:"tcp_proxy_items"`
+	UDPSwitch     string          `json:"udp_switch,omitempty"`
+	UDPProxyItems []*UDPProxyItem `json:"udp_proxy_items,omitempty"`
 }
 
 type TCPProxy struct {
 	TCPProxyConfigData TCPProxyConfig
 	TCPLBMap           map[string]*TCPProxyItem
-	//connection pool
-	TCPConnPool     map[string]net.Conn
-	TCPConnMap      map[string][]net.Conn
-	ProxyConfigFile string
-	Mutex           *sync.RWMutex
+	ProxyConfigFile    string
+	Mutex              *sync.RWMutex
+	//running listeners,listen addr => listener
+	listeners    map[string]*tcpListener
+	udpListeners map[string]*udpListener
+	//listen addr => counters,kept when a listener is restarted
+	counters map[string]*tcpCounters
+	//serializes the changes of the admin api
+	editMutex sync.Mutex
 }
 
 func NewTCPProxy() *TCPProxy {
-	return &TCPProxy{Mutex: &sync.RWMutex{}}
+	return &TCPProxy{
+		ProxyConfigFile: global.TCPProxyConfig,
+		TCPLBMap:        make(map[string]*TCPProxyItem),
+		Mutex:           &sync.RWMutex{},
+		listeners:       make(map[string]*tcpListener),
+		udpListeners:    make(map[string]*udpListener),
+		counters:        make(map[string]*tcpCounters),
+	}
 }
 
-func (self *TCPProxy) SaveToFile() bool {
-	if bts, err := json.Marshal(self.TCPProxyConfigData); err != nil {
+func (self *TCPProxyItem) validate() error {
+	if self.ListenAddr == "" {
+		return errors.New("tcp proxy item without addr")
+	}
+	if _, _, err := net.SplitHostPort(self.ListenAddr); err != nil {
+		return fmt.Errorf("tcp proxy addr %s: %s", self.ListenAddr, err)
+	}
+	//the default pool is optional when routing by server name
+	if len(self.SNIRoutes) == 0 || len(self.LbNode) != 0 {
+		if err := validateNodes(self.Method, self.LbNode); err != nil {
+			return fmt.Errorf("tcp proxy %s: %s", self.ListenAddr, err)
+		}
+	}
+	if err := validateSNIRoutes(self.SNIRoutes); err != nil {
+		return fmt.Errorf("tcp proxy %s: %s", self.ListenAddr, err)
+	}
+	if self.ConnectTimeout < 0 || self.MaxConns < 0 || self.QueueTimeout < 0 {
+		return fmt.Errorf("tcp proxy %s: connect_timeout max_conns and queue_timeout must not be negative", self.ListenAddr)
+	}
+	for _, node := range self.nodes() {
+		if node.MaxConns < 0 {
+			return fmt.Errorf("tcp proxy %s: max_conns of %s must not be negative", self.ListenAddr, node.Addr())
+		}
+	}
+	if err := self.HealthCheck.validate(); err != nil {
+		return fmt.Errorf("tcp proxy %s: %s", self.ListenAddr, err)
+	}
+	if err := self.ProxyProtocol.validate(); err != nil {
+		return fmt.Errorf("tcp proxy %s: %s", self.ListenAddr, err)
+	}
+	switch self.SendProxyProtocol {
+	case "", global.ProxyProtocolV1, global.ProxyProtocolV2:
+	default:
+		return fmt.Errorf("tcp proxy %s: send_proxy_protocol must be v1 or v2", self.ListenAddr)
+	}
+	return nil
+}
+
+//Nodes of the default pool and the server name pools
+func (self *TCPProxyItem) nodes() []*TCPNode {
+	nodes := append([]*TCPNode{}, self.LbNode...)
+	for _, route := range self.SNIRoutes {
+		nodes = append(nodes, route.LbNode...)
+	}
+	return nodes
+}
+
+//Balancing method and nodes of a tcp or udp pool
+func validateNodes(method string, nodes []*TCPNode) error {
+	switch method {
+	case "", global.Random, global.RoundRobin, global.LeastConn:
+	default:
+		return fmt.Errorf("unknown method %s", method)
+	}
+	if len(nodes) == 0 {
+		return errors.New("no lbnode")
+	}
+	for _, node := range nodes {
+		if node == nil || node.Host == "" || node.Port == "" {
+			return errors.New("lbnode needs host and port")
+		}
+	}
+	return nil
+}
+
+func (self *TCPProxyConfig) validate() error {
+	if !validSwitch(self.TCPSwitch) {
+		return errors.New("tcp_switch must be on or off")
+	}
+	addrs := make(map[string]bool)
+	for _, item := range self.TCPProxyitems {
+		if item == nil {
+			return errors.New("empty tcp proxy item")
+		}
+		if err := item.validate(); err != nil {
+			return err
+		}
+		if addrs[item.ListenAddr] {
+			return fmt.Errorf("duplicate tcp proxy addr %s", item.ListenAddr)
+		}
+		addrs[item.ListenAddr] = true
+	}
+	if !validSwitch(self.UDPSwitch) {
+		return errors.New("udp_switch must be on or off")
+	}
+	udpAddrs := make(map[string]bool)
+	for _, item := range self.UDPProxyItems {
+		if item == nil {
+			return errors.New("empty udp proxy item")
+		}
+		if err := item.validate(); err != nil {
+			return err
+		}
+		if udpAddrs[item.ListenAddr] {
+			return fmt.Errorf("duplicate udp proxy addr %s", item.ListenAddr)
+		}
+		udpAddrs[item.ListenAddr] = true
+	}
+	return nil
+}
+
+//the file is replaced atomically and kept as a version changed by user
+func (self *TCPProxy) SaveToFile(user string) bool {
+	if bts, err := json.MarshalIndent(self.TCPProxyConfigData, "", " "); err != nil {
 		return false
 	} else {
-		if file, err := os.OpenFile(self.ProxyConfigFile, os.O_RDWR|os.O_TRUNC, os.ModePerm); err != nil {
-			defer file.Close()
+		if err := saveConfigFile(self.ProxyConfigFile, bts, user, ""); err != nil {
+			log.Println("Save tcp proxy config error:", err)
 			return false
-		} else {
-			if _, err := file.Write(bts); err != nil {
-				return false
-			}
 		}
 	}
 	return true
 }
 
-//Load tcp proxy config file..
+//Roll the tcp items back to a saved version and apply them
+func (self *TCPProxy) RollbackProxyConfig(id int64, user string) error {
+	version, err := GetConfigVersion(self.ProxyConfigFile, id)
+	if err != nil {
+		return err
+	}
+	var saved TCPProxyConfig
+	if err := json.Unmarshal([]byte(version.Content), &saved); err != nil {
+		return err
+	}
+	//applied like an edit,the running udp items are kept
+	return self.updateConfigWithComment(user, fmt.Sprintf("rollback to %d", id), func(cfg *TCPProxyConfig) error {
+		cfg.TCPProxyitems = saved.TCPProxyitems
+		return nil
+	})
+}
+
+//Load tcp proxy config file,the tcp proxy is off without the file
 func (self *TCPProxy) LoadTCPProxyConfig(configFile string) {
-	if f, err := os.Open(configFile); err != nil {
-		goto ERROR
+	self.ProxyConfigFile = configFile
+	bts, err := ioutil.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		log.Println("TCP proxy config file not found,tcp proxy is off")
+		return
+	} else if err != nil {
+		log.Fatalln("Parse TCP Config File error:", err)
+	}
+	var cfg TCPProxyConfig
+	if err := json.Unmarshal(bts, &cfg); err != nil {
+		log.Fatalln("Parse TCP Config File error:", err)
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatalln("Parse TCP Config File error:", err)
+	}
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+	self.setConfig(cfg)
+}
+
+//Replace the config,the caller holds the Mutex
+func (self *TCPProxy) setConfig(cfg TCPProxyConfig) {
+	self.TCPProxyConfigData = cfg
+	self.TCPLBMap = make(map[string]*TCPProxyItem)
+	for _, v := range cfg.TCPProxyitems {
+		self.TCPLBMap[v.ListenAddr] = v
+	}
+}
+
+//Start a listener for every tcp proxy item
+func (self *TCPProxy) StartTCPProxy() {
+	self.Mutex.RLock()
+	cfg := self.TCPProxyConfigData
+	self.Mutex.RUnlock()
+	if cfg.TCPSwitch != global.SwitchOn {
+		return
+	}
+	for _, v := range cfg.TCPProxyitems {
+		if err := self.StartListener(v.ListenAddr); err != nil {
+			log.Fatalln("Start TCP Reverse Proxy Server  error!", err)
+		}
+	}
+}
+
+//Start proxying the configured item listening on addr
+func (self *TCPProxy) StartListener(addr string) error {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+	item, ok := self.TCPLBMap[addr]
+	if !ok {
+		return fmt.Errorf("tcp proxy %s not found", addr)
+	}
+	if _, ok := self.listeners[addr]; ok {
+		return fmt.Errorf("tcp proxy %s is running", addr)
+	}
+	l, err := listenTCP(addr)
+	if err != nil {
+		return err
+	}
+	//the edited items may turn proxy_protocol on and off
+	var listener *tcpListener
+	l = newProxyProtocolListener(l, func() *ProxyProtocolConfig { return listener.item().ProxyProtocol })
+	listener = newTCPListener(item, l)
+	if counters, ok := self.counters[addr]; ok {
+		listener.counters = counters
 	} else {
-		if bts, err := ioutil.ReadAll(f); err != nil {
-			goto ERROR
-		} else {
-			if err := json.Unmarshal(bts, &self.TCPProxyConfigData); err != nil {
-				goto ERROR
-			} else {
-				for _, v := range self.TCPProxyConfigData.TCPProxyitems {
-					self.TCPLBMap[v.ListenAddr] = v
-				}
+		self.counters[addr] = listener.counters
+	}
+	self.listeners[addr] = listener
+	log.Println("TCP proxy listening on", addr)
+	go listener.serve()
+	return nil
+}
+
+//Stop accepting on addr,the connections are drained in the background
+func (self *TCPProxy) StopListener(addr string) error {
+	self.Mutex.Lock()
+	listener, ok := self.listeners[addr]
+	delete(self.listeners, addr)
+	self.Mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("tcp proxy %s is not running", addr)
+	}
+	listener.stopAccepting()
+	forgetListener(addr)
+	log.Println("TCP proxy stopped listening on", addr)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), global.DefaultShutdownTimeout*time.Second)
+		defer cancel()
+		listener.shutdown(ctx)
+	}()
+	return nil
+}
+
+//Listener and node state for the admin api
+type TCPListenerStatus struct {
+	Addr        string           `json:"addr"`
+	Running     bool             `json:"running"`
+	ActiveConns int64            `json:"active_conns"`
+	MaxConns    int64            `json:"max_conns"`
+	TotalConns  uint64           `json:"total_conns"`
+	Rejected    uint64           `json:"rejected"`
+	BytesIn     uint64           `json:"bytes_in"`  //from the clients
+	BytesOut    uint64           `json:"bytes_out"` //to the clients
+	Nodes       []*TCPNodeStatus `json:"nodes"`
+}
+
+//State of the configured listeners,all of them when addr is empty
+func (self *TCPProxy) Status(addr string) []*TCPListenerStatus {
+	self.Mutex.RLock()
+	defer self.Mutex.RUnlock()
+	statuses := make([]*TCPListenerStatus, 0)
+	for _, item := range self.TCPProxyConfigData.TCPProxyitems {
+		if addr != "" && item.ListenAddr != addr {
+			continue
+		}
+		status := &TCPListenerStatus{Addr: item.ListenAddr, MaxConns: item.MaxConns, Nodes: make([]*TCPNodeStatus, 0)}
+		if listener, ok := self.listeners[item.ListenAddr]; ok {
+			status.Running = true
+			status.ActiveConns = atomic.LoadInt64(&listener.active)
+		}
+		if counters, ok := self.counters[item.ListenAddr]; ok {
+			status.TotalConns = atomic.LoadUint64(&counters.total)
+			status.Rejected = atomic.LoadUint64(&counters.rejected)
+			status.BytesIn = atomic.LoadUint64(&counters.bytesIn)
+			status.BytesOut = atomic.LoadUint64(&counters.bytesOut)
+		}
+		for _, node := range item.nodes() {
+			status.Nodes = append(status.Nodes, node.status())
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+//Stop accepting on all listeners and drain the connections until the deadline,
+//udp sessions are closed at once
+func (self *TCPProxy) Shutdown(ctx context.Context) {
+	self.Mutex.Lock()
+	listeners := self.listeners
+	self.listeners = make(map[string]*tcpListener)
+	for _, listener := range self.udpListeners {
+		listener.shutdown()
+	}
+	self.udpListeners = make(map[string]*udpListener)
+	self.Mutex.Unlock()
+	wg := &sync.WaitGroup{}
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func(listener *tcpListener) {
+			defer wg.Done()
+			listener.shutdown(ctx)
+		}(listener)
+	}
+	wg.Wait()
+}
+
+//a running tcp proxy listener
+type tcpListener struct {
+	//*TCPProxyItem,replaced when the item is edited
+	current  atomic.Value
+	listener net.Listener
+	//round robin position
+	next uint64
+	//client connection => backend connection
+	mutex     sync.Mutex
+	conns     map[net.Conn]net.Conn
+	closed    bool
+	connGroup sync.WaitGroup
+	//closed by the shutdown
+	done chan struct{}
+	//proxied connections
+	active   int64
+	counters *tcpCounters
+	//closed and replaced when a slot is freed,wakes up the queued connections
+	released chan struct{}
+}
+
+func newTCPListener(item *TCPProxyItem, l net.Listener) *tcpListener {
+	listener := &tcpListener{
+		listener: l,
+		conns:    make(map[net.Conn]net.Conn),
+		done:     make(chan struct{}),
+		released: make(chan struct{}),
+		counters: &tcpCounters{},
+	}
+	listener.current.Store(item)
+	return listener
+}
+
+//Running item,the connections keep the one they started with
+func (self *tcpListener) item() *TCPProxyItem {
+	return self.current.Load().(*TCPProxyItem)
+}
+
+//Proxy the new connections with the edited item without closing the socket
+func (self *tcpListener) setItem(item *TCPProxyItem) {
+	self.current.Store(item)
+	//a higher limit may free the queued connections
+	self.mutex.Lock()
+	close(self.released)
+	self.released = make(chan struct{})
+	self.mutex.Unlock()
+}
+
+//connections and bytes of a listen addr
+type tcpCounters struct {
+	total    uint64
+	rejected uint64
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+func (self *tcpListener) serve() {
+	go self.healthCheck()
+	var delay time.Duration
+	for {
+		conn, err := self.listener.Accept()
+		if err != nil {
+			self.mutex.Lock()
+			closed := self.closed
+			self.mutex.Unlock()
+			if closed {
 				return
 			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				//back off like net/http
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			log.Println("TCP proxy", self.item().ListenAddr, "accept error:", err)
+			return
 		}
+		delay = 0
+		go self.handle(conn)
 	}
-ERROR:
-	log.Fatalln("Parse TCP Config File error!")
 }
 
-//lock
-func (self *TCPProxy) ProxySend(localAddr, remoteAddr string, data []byte) (int, error) {
-	var conn net.Conn
-	if c, ok := self.TCPConnPool[remoteAddr]; !ok {
-		conn = c
-	} else {
-		conns := self.TCPConnMap[localAddr]
-		if len(conns) == 0 {
-			return 0, errors.New("readerror")
+//track the client connection,return false when the listener is shutting down
+func (self *tcpListener) trackConn(client, backend net.Conn, add bool) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if add {
+		if self.closed {
+			return false
+		}
+		if _, ok := self.conns[client]; !ok {
+			self.connGroup.Add(1)
 		}
-		conn = conns[rand.Intn(len(conns))]
+		self.conns[client] = backend
+	} else if _, ok := self.conns[client]; ok {
+		delete(self.conns, client)
+		self.connGroup.Done()
 	}
-	if n, err := conn.Write(data); err != nil {
-		return 0, errors.New("send error")
-	} else {
-		return n, nil
+	return true
+}
+
+func (self *tcpListener) handle(client net.Conn) {
+	defer client.Close()
+	if !self.trackConn(client, nil, true) {
+		return
+	}
+	defer self.trackConn(client, nil, false)
+	item := self.item()
+	//the header of a load balancer is read before choosing a node
+	if pc, ok := client.(*proxyProtocolConn); ok {
+		if err := pc.parse(); err != nil {
+			log.Println("TCP proxy", item.ListenAddr, "proxy protocol error:", err)
+			return
+		}
+	}
+	nodes, method, next := item.LbNode, item.Method, &self.next
+	stream := client
+	if len(item.SNIRoutes) != 0 {
+		var serverName string
+		var err error
+		//streams without a valid ClientHello go to the default pool
+		stream, serverName, err = peekServerName(client, global.DefaultClientHelloTimeout*time.Second)
+		if route := matchSNIRoute(item.SNIRoutes, serverName); route != nil {
+			nodes, method, next = route.LbNode, route.Method, &route.next
+		} else if len(nodes) == 0 {
+			log.Println("TCP proxy", item.ListenAddr, "no pool for server name", serverName, err)
+			return
+		}
+	}
+	backend, node, err := self.connect(item, nodes, method, next)
+	if err != nil {
+		log.Println("TCP proxy", item.ListenAddr, err)
+		return
 	}
+	defer self.release(node)
+	defer backend.Close()
+	if !self.trackConn(client, backend, true) {
+		return
+	}
+	if item.SendProxyProtocol != "" {
+		if err := writeProxyHeader(backend, item.SendProxyProtocol, client.RemoteAddr(), client.LocalAddr()); err != nil {
+			log.Println("TCP proxy", item.ListenAddr, "send proxy protocol error:", err)
+			return
+		}
+	}
+	atomic.AddUint64(&self.counters.total, 1)
+	pipeConn(stream, backend, &self.counters.bytesIn, &self.counters.bytesOut)
 }
 
-//lock
-func (self *TCPProxy) ProxyRecv(localAddr, remoteAddr string, data []byte) (int, error) {
-	var conn net.Conn
-	if c, ok := self.TCPConnPool[remoteAddr]; !ok {
-		conn = c
-	} else {
-		conns := self.TCPConnMap[localAddr]
-		if len(conns) == 0 {
-			return 0, errors.New("readerror")
+//Order the nodes for a new connection or session,
+//leastconn sorts by the active count,the others rotate from the chosen node
+func orderNodes(nodes []*TCPNode, method string, next *uint64) []*TCPNode {
+	ordered := make([]*TCPNode, 0, len(nodes))
+	switch method {
+	case global.LeastConn:
+		ordered = append(ordered, nodes...)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].ActiveConns() < ordered[j].ActiveConns()
+		})
+		return ordered
+	case global.RoundRobin:
+		start := int((atomic.AddUint64(next, 1) - 1) % uint64(len(nodes)))
+		return append(append(ordered, nodes[start:]...), nodes[:start]...)
+	}
+	start := rand.Intn(len(nodes))
+	return append(append(ordered, nodes[start:]...), nodes[:start]...)
+}
+
+//Take a listener slot and connect a node,
+//wait for a slot freed by another connection until the queue timeout
+func (self *tcpListener) connect(item *TCPProxyItem, nodes []*TCPNode, method string, next *uint64) (net.Conn, *TCPNode, error) {
+	deadline := time.Now().Add(time.Duration(item.QueueTimeout) * time.Second)
+	for {
+		self.mutex.Lock()
+		released := self.released
+		self.mutex.Unlock()
+		if self.acquire() {
+			backend, node, err := dialNodes(orderNodes(nodes, method, next), item.connectTimeout())
+			if err == nil {
+				return backend, node, nil
+			}
+			if err != errNodesBusy {
+				self.release(nil)
+				return nil, nil, err
+			}
+			//give the slot back without waking the queue,
+			//this connection waits for a node slot too and would only wake itself up
+			atomic.AddInt64(&self.active, -1)
 		}
-		conn = conns[rand.Intn(len(conns))]
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			atomic.AddUint64(&self.counters.rejected, 1)
+			return nil, nil, errors.New("connection limit reached")
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-released:
+		case <-timer.C:
+		case <-self.done:
+			timer.Stop()
+			return nil, nil, errors.New("tcp proxy is closed")
+		}
+		timer.Stop()
 	}
-	if n, err := conn.Read(data); err != nil {
-		return 0, errors.New("readerror")
-	} else {
-		return n, nil
+}
+
+//Count a new connection unless the listener is full
+func (self *tcpListener) acquire() bool {
+	maxConns := self.item().MaxConns
+	for {
+		active := atomic.LoadInt64(&self.active)
+		if maxConns > 0 && active >= maxConns {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&self.active, active, active+1) {
+			return true
+		}
 	}
 }
 
-func (self *TCPProxy) StartTCPProxy() {
-	for _, v := range self.TCPProxyConfigData.TCPProxyitems {
-		if l, err := net.Listen("tcp", v.ListenAddr); err != nil {
-			goto ERROR
-		} else {
-			go func(l net.Listener, addr string) {
-				for {
-					if conn, err := l.Accept(); err != nil {
-						remoteAddr := conn.RemoteAddr().String()
-						loadlAddr := addr
-						//GO READ
-						go func(conn net.Conn, localAddr, remoteAddr string) {
-
-							data := make([]byte, 1024)
-							if rdLen, err := conn.Read(data); err != nil {
-								self.ProxySend(loadlAddr, remoteAddr, data[0:rdLen])
-							}
-
-						}(conn, loadlAddr, remoteAddr)
-						//GO WRITE
-						go func(conn net.Conn, localAddr, remoteAddr string) {
-							for {
-								data := make([]byte, 1024)
-								self.ProxySend(loadlAddr, remoteAddr, data)
-							}
-						}(conn, loadlAddr, remoteAddr)
-					}
+//Free the slots of the listener and the node,wake up the queued connections
+func (self *tcpListener) release(node *TCPNode) {
+	if node != nil {
+		atomic.AddInt64(&node.active, -1)
+	}
+	atomic.AddInt64(&self.active, -1)
+	self.mutex.Lock()
+	close(self.released)
+	self.released = make(chan struct{})
+	self.mutex.Unlock()
+}
+
+func (self *TCPProxyItem) connectTimeout() time.Duration {
+	if self.ConnectTimeout == 0 {
+		return global.DefaultTCPConnectTimeout * time.Second
+	}
+	return time.Duration(self.ConnectTimeout) * time.Second
+}
+
+var errNodesBusy = errors.New("all nodes reached max_conns")
+
+//Connect the first of the ordered nodes,fall back to the next one when it fails,
+//the nodes that are down or full are skipped
+func dialNodes(nodes []*TCPNode, timeout time.Duration) (net.Conn, *TCPNode, error) {
+	var lastErr error
+	busy := false
+	for _, node := range nodes {
+		if node.Down() {
+			continue
+		}
+		if !node.acquire() {
+			busy = true
+			continue
+		}
+		conn, err := net.DialTimeout("tcp", node.Addr(), timeout)
+		if err == nil {
+			return conn, node, nil
+		}
+		atomic.AddInt64(&node.active, -1)
+		lastErr = err
+	}
+	if lastErr == nil {
+		if busy {
+			return nil, nil, errNodesBusy
+		}
+		return nil, nil, errors.New("no healthy node")
+	}
+	return nil, nil, fmt.Errorf("no available node: %v", lastErr)
+}
+
+//Close the socket,the accepted connections go on
+func (self *tcpListener) stopAccepting() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.closed {
+		close(self.done)
+		self.listener.Close()
+	}
+	self.closed = true
+}
+
+//Stop accepting,wait for the connections and close the rest at the deadline
+func (self *tcpListener) shutdown(ctx context.Context) {
+	self.stopAccepting()
+	drained := make(chan bool)
+	go func() {
+		self.connGroup.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		{
+			self.mutex.Lock()
+			for client, backend := range self.conns {
+				client.Close()
+				if backend != nil {
+					backend.Close()
 				}
-			}(l, v.ListenAddr)
-			return
+			}
+			self.mutex.Unlock()
+			<-drained
+		}
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+//reader adding the bytes read to a counter
+type countingReader struct {
+	reader io.Reader
+	count  *uint64
+}
+
+func (self *countingReader) Read(b []byte) (int, error) {
+	n, err := self.reader.Read(b)
+	atomic.AddUint64(self.count, uint64(n))
+	return n, err
+}
+
+//Copy both directions until both are finished,the bytes are added to the counters while copying,
+//the end of one direction is passed on as a half-close
+func pipeConn(client, backend net.Conn, in, out *uint64) {
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn, count *uint64) {
+		defer wg.Done()
+		var reader io.Reader = src
+		if count != nil {
+			reader = &countingReader{reader: src, count: count}
+		}
+		_, err := io.Copy(dst, reader)
+		if cw, ok := dst.(closeWriter); ok && err == nil {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+			src.Close()
 		}
 	}
-ERROR:
-	log.Fatalln("Start TCP Reverse Proxy Server  error!")
+	go copyHalf(backend, client, in)
+	go copyHalf(client, backend, out)
+	wg.Wait()
 }
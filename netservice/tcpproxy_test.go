@@ -0,0 +1,214 @@
+package netservice
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//Echo server writing its name before echoing,the write side is closed after the client's
+func startEchoServer(t *testing.T, name string) (*TCPNode, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.Write([]byte(name + ":"))
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if n > 0 {
+						conn.Write(buf[:n])
+					}
+					if err != nil {
+						break
+					}
+				}
+				conn.(*net.TCPConn).CloseWrite()
+			}(conn)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	return &TCPNode{Host: host, Port: port}, func() { l.Close() }
+}
+
+//Address nothing listens on
+func deadNode(t *testing.T) *TCPNode {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	return &TCPNode{Host: host, Port: port}
+}
+
+func startTestTCPListener(t *testing.T, item *TCPProxyItem) *tcpListener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.ListenAddr = l.Addr().String()
+	if err := item.validate(); err != nil {
+		t.Fatal(err)
+	}
+	listener := newTCPListener(item, l)
+	go listener.serve()
+	return listener
+}
+
+//Send the message,half-close and read the whole answer
+func tcpRoundTrip(t *testing.T, addr, message string) string {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(message))
+	conn.(*net.TCPConn).CloseWrite()
+	bts, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bts)
+}
+
+func TestTCPProxyRoundRobinFallback(t *testing.T) {
+	node1, stop1 := startEchoServer(t, "one")
+	defer stop1()
+	node2, stop2 := startEchoServer(t, "two")
+	defer stop2()
+	listener := startTestTCPListener(t, &TCPProxyItem{Method: global.RoundRobin, ConnectTimeout: 1,
+		LbNode: []*TCPNode{node1, deadNode(t), node2}})
+	defer listener.shutdown(context.Background())
+	addr := listener.listener.Addr().String()
+	//the dead node falls back to the next one
+	for i, want := range []string{"one:hello", "two:hello", "two:hello", "one:hello"} {
+		if got := tcpRoundTrip(t, addr, "hello"); got != want {
+			t.Fatalf("connection %d got %q,want %q", i, got, want)
+		}
+	}
+}
+
+func TestTCPProxyHalfClose(t *testing.T) {
+	node, stop := startEchoServer(t, "echo")
+	defer stop()
+	listener := startTestTCPListener(t, &TCPProxyItem{LbNode: []*TCPNode{node}})
+	defer listener.shutdown(context.Background())
+	//the answer is complete only if the half-close reached the backend and came back
+	message := strings.Repeat("x", 100000)
+	if got := tcpRoundTrip(t, listener.listener.Addr().String(), message); got != "echo:"+message {
+		t.Fatalf("got %d bytes", len(got))
+	}
+}
+
+func TestTCPProxyLeastConn(t *testing.T) {
+	node1, stop1 := startEchoServer(t, "one")
+	defer stop1()
+	node2, stop2 := startEchoServer(t, "two")
+	defer stop2()
+	listener := startTestTCPListener(t, &TCPProxyItem{Method: global.LeastConn, LbNode: []*TCPNode{node1, node2}})
+	defer listener.shutdown(context.Background())
+	addr := listener.listener.Addr().String()
+	held, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	buf := make([]byte, 4)
+	held.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := held.Read(buf); err != nil || string(buf) != "one:" {
+		t.Fatalf("first connection %q %v", buf, err)
+	}
+	for i := 0; i < 3; i++ {
+		if got := tcpRoundTrip(t, addr, "hi"); got != "two:hi" {
+			t.Fatalf("got %q while one is busy", got)
+		}
+	}
+	//the proxy finishes the connection after the client
+	for i := 0; i < 100 && node2.ActiveConns() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if node1.ActiveConns() != 1 || node2.ActiveConns() != 0 {
+		t.Fatal("unexpected active connections", node1.ActiveConns(), node2.ActiveConns())
+	}
+}
+
+func TestTCPProxyShutdown(t *testing.T) {
+	node, stop := startEchoServer(t, "echo")
+	defer stop()
+	listener := startTestTCPListener(t, &TCPProxyItem{LbNode: []*TCPNode{node}})
+	addr := listener.listener.Addr().String()
+	held, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	held.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	held.Read(buf)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	listener.shutdown(ctx)
+	//the connection still open at the deadline is closed
+	if _, err := ioutil.ReadAll(held); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Fatal("listener still accepting")
+	}
+	if node.ActiveConns() != 0 {
+		t.Fatal("active connections left", node.ActiveConns())
+	}
+}
+
+func TestTCPProxyConfig(t *testing.T) {
+	node, stop := startEchoServer(t, "echo")
+	defer stop()
+	for _, cfg := range []*TCPProxyConfig{
+		{TCPSwitch: "yes"},
+		{TCPSwitch: global.SwitchOn, TCPProxyitems: []*TCPProxyItem{{ListenAddr: "127.0.0.1:1", LbNode: []*TCPNode{node}, Method: "hash"}}},
+		{TCPSwitch: global.SwitchOn, TCPProxyitems: []*TCPProxyItem{{ListenAddr: "127.0.0.1:1"}}},
+		{TCPSwitch: global.SwitchOn, TCPProxyitems: []*TCPProxyItem{{ListenAddr: "nowhere", LbNode: []*TCPNode{node}}}},
+		{TCPSwitch: global.SwitchOn, TCPProxyitems: []*TCPProxyItem{
+			{ListenAddr: "127.0.0.1:1", LbNode: []*TCPNode{node}},
+			{ListenAddr: "127.0.0.1:1", LbNode: []*TCPNode{node}},
+		}},
+	} {
+		if cfg.validate() == nil {
+			t.Fatal("invalid config accepted", cfg)
+		}
+	}
+
+	dir, _ := ioutil.TempDir("", "tcpproxy")
+	defer os.RemoveAll(dir)
+	addr := deadNode(t).Addr()
+	configFile := filepath.Join(dir, "tcp_proxy.json")
+	ioutil.WriteFile(configFile, []byte(`{"tcp_switch":"on","tcp_proxy_items":[{"addr":"`+addr+
+		`","method":"random","lbnode":[{"host":"`+node.Host+`","port":"`+node.Port+`"}]}]}`), 0644)
+	proxy := NewTCPProxy()
+	proxy.LoadTCPProxyConfig(configFile)
+	proxy.StartTCPProxy()
+	defer proxy.Shutdown(context.Background())
+	if got := tcpRoundTrip(t, addr, "config"); got != "echo:config" {
+		t.Fatalf("got %q", got)
+	}
+	if err := proxy.StartListener(addr); err == nil {
+		t.Fatal("listener started twice")
+	}
+}
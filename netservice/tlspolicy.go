@@ -0,0 +1,546 @@
+package netservice
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//protocol versions by name
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//curves by name
+var tlsCurves = map[string]tls.CurveID{}
+
+func init() {
+	for _, curve := range []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521, tls.X25519MLKEM768} {
+		tlsCurves[curve.String()] = curve
+	}
+}
+
+//TLS settings of the https listener,the settings of a domain override the global ones
+type TLSPolicyConfig struct {
+	//1.0 1.1 1.2 1.3,1.2 and 1.3 by default
+	MinVersion string `json:"min_version,omitempty"`
+	MaxVersion string `json:"max_version,omitempty"`
+	//TLS 1.2 cipher suites by name,the TLS 1.3 suites are not configurable
+	CipherSuites []string `json:"cipher_suites,omitempty"`
+	//X25519 CurveP256 CurveP384 CurveP521 X25519MLKEM768
+	Curves []string `json:"curves,omitempty"`
+	//on off
+	SessionTickets string `json:"session_tickets,omitempty"`
+	//seconds between two rotations of the session ticket keys,global only
+	TicketKeyRotation int `json:"ticket_key_rotation,omitempty"`
+	//staple the response of the OCSP responder,on off
+	OCSPStapling string `json:"ocsp_stapling,omitempty"`
+	//responder url,the one of the certificate by default
+	OCSPResponder string `json:"ocsp_responder,omitempty"`
+	//DER response stapled instead of asking the responder,by domain only
+	OCSPFile     string `json:"ocsp_file,omitempty"`
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+	curves       []tls.CurveID
+}
+
+func (self *TLSPolicyConfig) validate() error {
+	if self == nil {
+		return nil
+	}
+	if !validSwitch(self.SessionTickets) || !validSwitch(self.OCSPStapling) {
+		return errors.New("tls: switch must be on or off")
+	}
+	var ok bool
+	self.minVersion, self.maxVersion = 0, 0
+	if self.MinVersion != "" {
+		if self.minVersion, ok = tlsVersions[self.MinVersion]; !ok {
+			return fmt.Errorf("tls: unknown min_version %s", self.MinVersion)
+		}
+	}
+	if self.MaxVersion != "" {
+		if self.maxVersion, ok = tlsVersions[self.MaxVersion]; !ok {
+			return fmt.Errorf("tls: unknown max_version %s", self.MaxVersion)
+		}
+	}
+	if self.minVersion != 0 && self.maxVersion != 0 && self.minVersion > self.maxVersion {
+		return errors.New("tls: min_version is above max_version")
+	}
+	self.cipherSuites = nil
+	for _, name := range self.CipherSuites {
+		id, err := cipherSuiteID(name)
+		if err != nil {
+			return err
+		}
+		self.cipherSuites = append(self.cipherSuites, id)
+	}
+	self.curves = nil
+	for _, name := range self.Curves {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return fmt.Errorf("tls: unknown curve %s", name)
+		}
+		self.curves = append(self.curves, curve)
+	}
+	if self.TicketKeyRotation != 0 && self.TicketKeyRotation < global.MinTicketKeyRotation {
+		return fmt.Errorf("tls: ticket_key_rotation must be at least %d seconds", global.MinTicketKeyRotation)
+	}
+	if self.OCSPResponder != "" {
+		if u, err := url.Parse(self.OCSPResponder); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("tls: invalid ocsp_responder %s", self.OCSPResponder)
+		}
+	}
+	return nil
+}
+
+//Id of the secure TLS 1.2 cipher suite
+func cipherSuiteID(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name != name {
+			continue
+		}
+		for _, version := range suite.SupportedVersions {
+			if version == tls.VersionTLS12 {
+				return suite.ID, nil
+			}
+		}
+		return 0, fmt.Errorf("tls: cipher suite %s is not configurable", name)
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("tls: insecure cipher suite %s", name)
+		}
+	}
+	return 0, fmt.Errorf("tls: unknown cipher suite %s", name)
+}
+
+//Seconds between two rotations of the session ticket keys
+func (self *ReverseProxyConfigData) ticketKeyRotation() int {
+	if self.TLS == nil || self.TLS.TicketKeyRotation == 0 {
+		return global.DefaultTicketKeyRotation
+	}
+	return self.TLS.TicketKeyRotation
+}
+
+//TLS policy of the routing table,the domain settings merged with the global ones
+type domainTLSPolicy struct {
+	minVersion     uint16
+	maxVersion     uint16
+	cipherSuites   []uint16
+	curves         []tls.CurveID
+	sessionTickets bool
+	//responder or file,empty if stapling is off
+	ocspSource    string
+	ocspResponder string
+	ocspFile      string
+}
+
+//The global policy if node is nil
+func newDomainTLSPolicy(cfg *ReverseProxyConfigData, node *LbNode) *domainTLSPolicy {
+	policy := &domainTLSPolicy{minVersion: tls.VersionTLS12, maxVersion: tls.VersionTLS13, sessionTickets: true}
+	stapling := global.SwitchOff
+	for _, tlsCfg := range []*TLSPolicyConfig{cfg.TLS, nodeTLSPolicy(node)} {
+		if tlsCfg == nil {
+			continue
+		}
+		if tlsCfg.minVersion != 0 {
+			policy.minVersion = tlsCfg.minVersion
+		}
+		if tlsCfg.maxVersion != 0 {
+			policy.maxVersion = tlsCfg.maxVersion
+		}
+		if len(tlsCfg.cipherSuites) > 0 {
+			policy.cipherSuites = tlsCfg.cipherSuites
+		}
+		if len(tlsCfg.curves) > 0 {
+			policy.curves = tlsCfg.curves
+		}
+		if tlsCfg.SessionTickets != "" {
+			policy.sessionTickets = tlsCfg.SessionTickets == global.SwitchOn
+		}
+		if tlsCfg.OCSPStapling != "" {
+			stapling = tlsCfg.OCSPStapling
+		}
+		if tlsCfg.OCSPResponder != "" {
+			policy.ocspResponder = tlsCfg.OCSPResponder
+		}
+	}
+	//a stapled file turns stapling on unless the domain turns it off
+	if tlsCfg := nodeTLSPolicy(node); tlsCfg != nil && tlsCfg.OCSPFile != "" && tlsCfg.OCSPStapling != global.SwitchOff {
+		policy.ocspSource, policy.ocspFile = global.OCSPSourceFile, tlsCfg.OCSPFile
+	} else if stapling == global.SwitchOn {
+		policy.ocspSource = global.OCSPSourceResponder
+	}
+	return policy
+}
+
+func nodeTLSPolicy(node *LbNode) *TLSPolicyConfig {
+	if node == nil {
+		return nil
+	}
+	return node.TLS
+}
+
+//Apply the policy to the handshake config
+func (self *domainTLSPolicy) apply(cfg *tls.Config) {
+	cfg.MinVersion = self.minVersion
+	cfg.MaxVersion = self.maxVersion
+	cfg.CipherSuites = self.cipherSuites
+	cfg.CurvePreferences = self.curves
+	cfg.SessionTicketsDisabled = !self.sessionTickets
+}
+
+//Handshake config of the server name,nil to use the server config
+func (self *HttpReverseProxy) configForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	//the acme challenge is answered with the server config
+	for _, proto := range hello.SupportedProtos {
+		if proto == acmeALPNProto {
+			return nil, nil
+		}
+	}
+	return self.domainTLSConfig(hello.ServerName), nil
+}
+
+//Config of the domain cloned from the server config,
+//the configs are built again when the routing table changes.
+//The names without a domain share the global policy.
+func (self *HttpReverseProxy) domainTLSConfig(serverName string) *tls.Config {
+	table := self.table()
+	self.tlsMutex.Lock()
+	defer self.tlsMutex.Unlock()
+	if self.tlsTable != table {
+		self.tlsTable = table
+		self.tlsConfigs = make(map[string]*tls.Config)
+	}
+	route := table.Domains[serverName]
+	name := ""
+	if route != nil {
+		name = route.Domain
+	}
+	if cfg, ok := self.tlsConfigs[name]; ok {
+		return cfg
+	}
+	cfg := self.httpsServer.TLSConfig.Clone()
+	if route != nil {
+		route.TLS.apply(cfg)
+		if route.ClientAuth != nil {
+			route.ClientAuth.apply(cfg)
+		}
+	} else {
+		table.TLS.apply(cfg)
+	}
+	if len(self.ticketKeys) > 0 {
+		cfg.SetSessionTicketKeys(domainTicketKeys(self.ticketKeys, name))
+	}
+	self.tlsConfigs[name] = cfg
+	return cfg
+}
+
+//Ticket keys of the domain,a ticket of one domain can't be resumed with another one
+func domainTicketKeys(keys [][32]byte, name string) [][32]byte {
+	domainKeys := make([][32]byte, 0, len(keys))
+	for _, key := range keys {
+		domainKeys = append(domainKeys, sha256.Sum256(append(key[:], name...)))
+	}
+	return domainKeys
+}
+
+//Issue the tickets with a new key,the tickets of the previous keys can still be resumed
+func (self *HttpReverseProxy) rotateTicketKeys(now time.Time) error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	self.tlsMutex.Lock()
+	defer self.tlsMutex.Unlock()
+	self.ticketKeys = append([][32]byte{key}, self.ticketKeys...)
+	if len(self.ticketKeys) > global.TicketKeyCount {
+		self.ticketKeys = self.ticketKeys[:global.TicketKeyCount]
+	}
+	self.ticketRotatedAt = now
+	for name, cfg := range self.tlsConfigs {
+		cfg.SetSessionTicketKeys(domainTicketKeys(self.ticketKeys, name))
+	}
+	return nil
+}
+
+//Rotate the session ticket keys until the process exits
+func (self *HttpReverseProxy) RunTicketKeyRotation() {
+	for {
+		rotation := time.Duration(self.Config().ticketKeyRotation()) * time.Second
+		self.tlsMutex.Lock()
+		due := len(self.ticketKeys) == 0 || time.Since(self.ticketRotatedAt) >= rotation
+		self.tlsMutex.Unlock()
+		if due {
+			if err := self.rotateTicketKeys(time.Now()); err != nil {
+				log.Println("Rotate session ticket keys error:", err)
+			}
+		}
+		time.Sleep(global.MinTicketKeyRotation * time.Second)
+	}
+}
+
+//OCSP response stapled to the certificate of the domain
+type ocspState struct {
+	source string
+	//the certificate served after the last refresh
+	served *tls.Certificate
+	//status of the stapled response,nil if nothing is stapled
+	status    *ocspStatus
+	updatedAt time.Time
+	refreshAt time.Time
+	err       error
+}
+
+//Response of the certificate,from the file or the responder
+func (self *domainTLSPolicy) ocspResponse(cert *tls.Certificate, now time.Time) ([]byte, *ocspStatus, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, nil, errors.New("ocsp: the issuer certificate is not in the chain")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, nil, err
+		}
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	var raw []byte
+	if self.ocspSource == global.OCSPSourceFile {
+		raw, err = ioutil.ReadFile(self.ocspFile)
+	} else if responder := self.responder(leaf); responder != "" {
+		raw, err = fetchOCSPResponse(&http.Client{Timeout: global.OCSPTimeout * time.Second}, responder, leaf, issuer)
+	} else {
+		err = errors.New("ocsp: the certificate has no responder")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	status, err := verifyOCSPResponse(raw, leaf, issuer, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, status, nil
+}
+
+//Configured responder or the one of the certificate
+func (self *domainTLSPolicy) responder(leaf *x509.Certificate) string {
+	if self.ocspResponder != "" {
+		return self.ocspResponder
+	}
+	if leaf != nil && len(leaf.OCSPServer) > 0 {
+		return leaf.OCSPServer[0]
+	}
+	return ""
+}
+
+//Staple the responses of the domains,a failed refresh keeps the stapled response until it expires
+func (self *HttpReverseProxy) refreshOCSP(now time.Time) {
+	if self.httpsServer == nil {
+		return
+	}
+	table := self.table()
+	for domain, route := range table.Domains {
+		cert := self.httpsServer.DomainCertificate(domain)
+		state := self.ocspState(domain)
+		if cert == nil || route.TLS.ocspSource == "" {
+			if cert != nil && len(cert.OCSPStaple) > 0 && state != nil && cert == state.served {
+				unstapled := *cert
+				unstapled.OCSPStaple = nil
+				self.httpsServer.ReplaceDomainCertificate(domain, cert, &unstapled)
+			}
+			self.setOCSPState(domain, nil)
+			continue
+		}
+		if state != nil && cert == state.served && state.source == route.TLS.ocspSource && now.Before(state.refreshAt) {
+			continue
+		}
+		next := &ocspState{source: route.TLS.ocspSource, served: cert, updatedAt: now}
+		raw, status, err := route.TLS.ocspResponse(cert, now)
+		if err != nil {
+			log.Println("Staple OCSP response of", domain, "error:", err)
+			next.err = err
+			next.refreshAt = now.Add(global.DefaultOCSPRetry * time.Second)
+			//the stapled response is kept while it is valid
+			if state != nil && cert == state.served && state.status != nil {
+				if state.status.NextUpdate.IsZero() || state.status.NextUpdate.After(now) {
+					next.status = state.status
+				} else {
+					unstapled := *cert
+					unstapled.OCSPStaple = nil
+					if self.httpsServer.ReplaceDomainCertificate(domain, cert, &unstapled) {
+						next.served = &unstapled
+					}
+				}
+			}
+			self.setOCSPState(domain, next)
+			continue
+		}
+		stapled := *cert
+		stapled.OCSPStaple = raw
+		if !self.httpsServer.ReplaceDomainCertificate(domain, cert, &stapled) {
+			//replaced meanwhile,stapled on the next refresh
+			continue
+		}
+		next.served, next.status = &stapled, status
+		next.refreshAt = now.Add(global.DefaultOCSPRefresh * time.Second)
+		if !status.NextUpdate.IsZero() && route.TLS.ocspSource == global.OCSPSourceResponder {
+			//refresh halfway to the next update
+			if half := status.ThisUpdate.Add(status.NextUpdate.Sub(status.ThisUpdate) / 2); half.Before(next.refreshAt) {
+				next.refreshAt = half
+			}
+		}
+		self.setOCSPState(domain, next)
+	}
+	self.ocspMutex.Lock()
+	for domain := range self.ocspStates {
+		if table.Domains[domain] == nil {
+			delete(self.ocspStates, domain)
+		}
+	}
+	self.ocspMutex.Unlock()
+}
+
+func (self *HttpReverseProxy) ocspState(domain string) *ocspState {
+	self.ocspMutex.Lock()
+	defer self.ocspMutex.Unlock()
+	return self.ocspStates[domain]
+}
+
+func (self *HttpReverseProxy) setOCSPState(domain string, state *ocspState) {
+	self.ocspMutex.Lock()
+	defer self.ocspMutex.Unlock()
+	if state == nil {
+		delete(self.ocspStates, domain)
+		return
+	}
+	if self.ocspStates == nil {
+		self.ocspStates = make(map[string]*ocspState)
+	}
+	self.ocspStates[domain] = state
+}
+
+//Staple the OCSP responses until the process exits
+func (self *HttpReverseProxy) RunOCSPStapling() {
+	for {
+		self.refreshOCSP(time.Now())
+		time.Sleep(global.DefaultOCSPCheckInterval * time.Second)
+	}
+}
+
+//Effective TLS policy of the domain
+type TLSPolicyInfo struct {
+	Domain     string `json:"domain"`
+	MinVersion string `json:"min_version"`
+	MaxVersion string `json:"max_version"`
+	//the go defaults if empty
+	CipherSuites      []string   `json:"cipher_suites"`
+	Curves            []string   `json:"curves"`
+	SessionTickets    string     `json:"session_tickets"`
+	TicketKeyRotation int        `json:"ticket_key_rotation"`
+	ClientAuth        string     `json:"client_auth"`
+	OCSPSource        string     `json:"ocsp_source,omitempty"`
+	OCSPResponder     string     `json:"ocsp_responder,omitempty"`
+	OCSPFile          string     `json:"ocsp_file,omitempty"`
+	OCSPStapled       bool       `json:"ocsp_stapled"`
+	OCSPThisUpdate    *time.Time `json:"ocsp_this_update,omitempty"`
+	OCSPNextUpdate    *time.Time `json:"ocsp_next_update,omitempty"`
+	OCSPUpdatedAt     *time.Time `json:"ocsp_updated_at,omitempty"`
+	OCSPError         string     `json:"ocsp_error,omitempty"`
+}
+
+//Policy of the route with the status of the stapled response
+func (self *HttpReverseProxy) tlsPolicy(table *routingTable, route *domainRoute) *TLSPolicyInfo {
+	policy := route.TLS
+	info := &TLSPolicyInfo{
+		Domain:            route.Domain,
+		MinVersion:        tls.VersionName(policy.minVersion),
+		MaxVersion:        tls.VersionName(policy.maxVersion),
+		CipherSuites:      []string{},
+		Curves:            []string{},
+		SessionTickets:    global.SwitchOff,
+		TicketKeyRotation: table.Cfg.ticketKeyRotation(),
+		ClientAuth:        global.SwitchOff,
+		OCSPSource:        policy.ocspSource,
+		OCSPFile:          policy.ocspFile,
+	}
+	for _, id := range policy.cipherSuites {
+		info.CipherSuites = append(info.CipherSuites, tls.CipherSuiteName(id))
+	}
+	for _, curve := range policy.curves {
+		info.Curves = append(info.Curves, curve.String())
+	}
+	if policy.sessionTickets {
+		info.SessionTickets = global.SwitchOn
+	}
+	if route.ClientAuth != nil {
+		info.ClientAuth = global.ClientAuthRequire
+		if route.ClientAuth.clientAuth == tls.VerifyClientCertIfGiven {
+			info.ClientAuth = global.ClientAuthOptional
+		}
+	}
+	if policy.ocspSource == global.OCSPSourceResponder {
+		var leaf *x509.Certificate
+		if self.httpsServer != nil {
+			if cert := self.httpsServer.DomainCertificate(route.Domain); cert != nil {
+				leaf = cert.Leaf
+			}
+		}
+		info.OCSPResponder = policy.responder(leaf)
+	}
+	if state := self.ocspState(route.Domain); state != nil && policy.ocspSource != "" {
+		updatedAt := state.updatedAt
+		info.OCSPUpdatedAt = &updatedAt
+		if state.err != nil {
+			info.OCSPError = state.err.Error()
+		}
+		if state.status != nil {
+			thisUpdate, nextUpdate := state.status.ThisUpdate, state.status.NextUpdate
+			info.OCSPStapled = true
+			info.OCSPThisUpdate = &thisUpdate
+			if !nextUpdate.IsZero() {
+				info.OCSPNextUpdate = &nextUpdate
+			}
+		}
+	}
+	return info
+}
+
+//Effective TLS policies of the domains
+func (self *HttpReverseProxy) TLSPolicies() []*TLSPolicyInfo {
+	table := self.table()
+	infos := make([]*TLSPolicyInfo, 0, len(table.Domains))
+	for _, route := range table.Domains {
+		infos = append(infos, self.tlsPolicy(table, route))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Domain < infos[j].Domain })
+	return infos
+}
+
+//Effective TLS policy of the domain
+func (self *HttpReverseProxy) TLSPolicy(domain string) (*TLSPolicyInfo, error) {
+	table := self.table()
+	route := table.Domains[domain]
+	if route == nil {
+		return nil, fmt.Errorf("domain %s not found", domain)
+	}
+	return self.tlsPolicy(table, route), nil
+}
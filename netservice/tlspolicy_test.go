@@ -0,0 +1,277 @@
+package netservice
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Https server of the proxy with the handshake configs of the domains
+func startTLSPolicyServer(t *testing.T, proxy *HttpReverseProxy) string {
+	proxy.httpsServer = NewHttpsServer()
+	proxy.httpsServer.Handler = proxy
+	proxy.httpsServer.TLSConfig = &tls.Config{NextProtos: []string{"h2", "http/1.1", acmeALPNProto}}
+	proxy.httpsServer.TLSConfig.GetCertificate = proxy.httpsServer.defaultGetCertificate
+	proxy.httpsServer.TLSConfig.GetConfigForClient = proxy.configForClient
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.httpsServer.ServeTLS(l, "", "")
+	return l.Addr().String()
+}
+
+func loadTestProxyConfig(t *testing.T, dir, config string) *HttpReverseProxy {
+	configFile := filepath.Join(dir, "http_proxy.json")
+	ioutil.WriteFile(configFile, []byte(config), 0644)
+	proxy := NewReverseProxy()
+	proxy.LoadProxyConfig(configFile)
+	return proxy
+}
+
+func TestTLSPolicy(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tlspolicy")
+	defer os.RemoveAll(dir)
+	proxy := loadTestProxyConfig(t, dir, `{"https_switch":"on",
+		"tls":{"cipher_suites":["TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"],"curves":["CurveP256"],"ticket_key_rotation":3600},
+		"reserve_proxy":[{"domain":"legacy.abc.com","https_switch":"on","tls":{"max_version":"1.2"}},
+		{"domain":"modern.abc.com","https_switch":"on","tls":{"min_version":"1.3","session_tickets":"off"}}]}`)
+	addr := startTLSPolicyServer(t, proxy)
+	defer proxy.httpsServer.Close()
+	for _, domain := range []string{"legacy.abc.com", "modern.abc.com"} {
+		certPEM, keyPEM := testCertificate(t, 1, time.Now().Add(time.Hour), domain)
+		cert, _ := tls.X509KeyPair(certPEM, keyPEM)
+		proxy.httpsServer.SetDomainCertificate(domain, &cert)
+	}
+	dial := func(cfg *tls.Config) (tls.ConnectionState, error) {
+		cfg.InsecureSkipVerify = true
+		conn, err := tls.Dial("tcp", addr, cfg)
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState(), nil
+	}
+
+	//the domain versions and the global suites and curves
+	state, err := dial(&tls.Config{ServerName: "legacy.abc.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != tls.VersionTLS12 || state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("unexpected legacy handshake %x %x", state.Version, state.CipherSuite)
+	}
+	if _, err := dial(&tls.Config{ServerName: "legacy.abc.com", CurvePreferences: []tls.CurveID{tls.X25519}}); err == nil {
+		t.Fatal("curve outside the policy accepted")
+	}
+	if _, err := dial(&tls.Config{ServerName: "modern.abc.com", MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Fatal("TLS 1.2 accepted by a TLS 1.3 domain")
+	}
+	if state, err := dial(&tls.Config{ServerName: "modern.abc.com"}); err != nil || state.Version != tls.VersionTLS13 {
+		t.Fatal("TLS 1.3 refused", err)
+	}
+
+	//the tickets are resumed across a rotation of the keys
+	if err := proxy.rotateTicketKeys(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	cache := tls.NewLRUClientSessionCache(4)
+	if state, err := dial(&tls.Config{ServerName: "legacy.abc.com", ClientSessionCache: cache}); err != nil || state.DidResume {
+		t.Fatal("unexpected first handshake", err)
+	}
+	proxy.rotateTicketKeys(time.Now())
+	if state, err := dial(&tls.Config{ServerName: "legacy.abc.com", ClientSessionCache: cache}); err != nil || !state.DidResume {
+		t.Fatal("session not resumed after a rotation", err)
+	}
+	//the older keys are dropped
+	for i := 0; i < 3; i++ {
+		proxy.rotateTicketKeys(time.Now())
+	}
+	if state, err := dial(&tls.Config{ServerName: "legacy.abc.com", ClientSessionCache: cache}); err != nil || state.DidResume {
+		t.Fatal("ticket of a dropped key resumed", err)
+	}
+
+	legacy, _ := proxy.TLSPolicy("legacy.abc.com")
+	modern, _ := proxy.TLSPolicy("modern.abc.com")
+	if legacy.MinVersion != "TLS 1.2" || legacy.MaxVersion != "TLS 1.2" || len(legacy.CipherSuites) != 1 ||
+		legacy.Curves[0] != "CurveP256" || legacy.SessionTickets != "on" || legacy.TicketKeyRotation != 3600 {
+		t.Fatalf("unexpected legacy policy %+v", legacy)
+	}
+	if modern.MinVersion != "TLS 1.3" || modern.SessionTickets != "off" || modern.ClientAuth != "off" {
+		t.Fatalf("unexpected modern policy %+v", modern)
+	}
+	if _, err := proxy.TLSPolicy("none.abc.com"); err == nil || len(proxy.TLSPolicies()) != 2 {
+		t.Fatal("unexpected policies")
+	}
+}
+
+func TestTLSPolicyValidate(t *testing.T) {
+	for _, cfg := range []string{
+		`{"https_switch":"on","tls":{"min_version":"1.4"}}`,
+		`{"https_switch":"on","tls":{"min_version":"1.3","max_version":"1.2"}}`,
+		`{"https_switch":"on","tls":{"max_version":"1.1"}}`,
+		`{"https_switch":"on","reserve_proxy":[{"domain":"a.com","tls":{"min_version":"1.3","max_version":"1.2"}}]}`,
+		`{"https_switch":"on","tls":{"cipher_suites":["TLS_RSA_WITH_RC4_128_SHA"]}}`,
+		`{"https_switch":"on","tls":{"cipher_suites":["TLS_AES_128_GCM_SHA256"]}}`,
+		`{"https_switch":"on","tls":{"curves":["P-256"]}}`,
+		`{"https_switch":"on","tls":{"ticket_key_rotation":10}}`,
+		`{"https_switch":"on","tls":{"ocsp_file":"a.der"}}`,
+		`{"https_switch":"on","tls":{"ocsp_responder":"ocsp.abc.com"}}`,
+		`{"https_switch":"on","tls":{"min_version":"1.3"},"reserve_proxy":[{"domain":"a.com","tls":{"max_version":"1.2"}}]}`,
+		`{"https_switch":"on","reserve_proxy":[{"domain":"a.com","tls":{"ticket_key_rotation":3600}}]}`,
+	} {
+		if _, err := parseProxyConfig([]byte(cfg)); err == nil {
+			t.Fatal("invalid config accepted", cfg)
+		}
+	}
+	//the versions of the merged policy are in order
+	if _, err := parseProxyConfig([]byte(`{"https_switch":"on","tls":{"min_version":"1.0","max_version":"1.1"},
+		"reserve_proxy":[{"domain":"a.com","tls":{"max_version":"1.3"}}]}`)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//Certificate of the domain issued by the CA with the chain
+func (self *testClientCA) issueServer(t *testing.T, serial int64, domain, responder string) *tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(serial), Subject: pkix.Name{CommonName: domain}, DNSNames: []string{domain},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(24 * time.Hour), OCSPServer: []string{responder}}
+	der, err := x509.CreateCertificate(rand.Reader, template, self.cert, key.Public(), self.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return &tls.Certificate{Certificate: [][]byte{der, self.cert.Raw}, PrivateKey: key, Leaf: leaf}
+}
+
+//Response of the CA for the certificate id
+func (self *testClientCA) ocspResponse(t *testing.T, id ocspCertID, revoked bool, thisUpdate, nextUpdate time.Time) []byte {
+	single := ocspSingleResponse{CertID: id, ThisUpdate: thisUpdate.UTC(), NextUpdate: nextUpdate.UTC()}
+	if revoked {
+		single.Revoked = ocspRevokedInfo{RevocationTime: thisUpdate.UTC()}
+	} else {
+		single.Good = true
+	}
+	keyHash, _ := asn1.Marshal(id.KeyHash)
+	tbs, err := asn1.Marshal(ocspResponseData{
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: keyHash},
+		ProducedAt:  thisUpdate.UTC(),
+		Responses:   []ocspSingleResponse{single},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(tbs)
+	sig, _ := ecdsa.SignASN1(rand.Reader, self.key, sum[:])
+	basic, _ := asn1.Marshal(ocspBasicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+		Signature:          asn1.BitString{Bytes: sig, BitLength: len(sig) * 8},
+	})
+	resp, _ := asn1.Marshal(ocspResponse{Response: ocspResponseBytes{ResponseType: oidOCSPBasic, Response: basic}})
+	return resp
+}
+
+func TestOCSPStapling(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "ocsp")
+	defer os.RemoveAll(dir)
+	ca := newTestClientCA(t, "issuer")
+	now := time.Now().Truncate(time.Second)
+	var mutex sync.Mutex
+	requests, revoked := 0, false
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var req ocspRequest
+		if _, err := asn1.Unmarshal(body, &req); err != nil || len(req.TBSRequest.RequestList) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(ca.ocspResponse(t, req.TBSRequest.RequestList[0].Cert, revoked, now, now.Add(2*time.Hour)))
+	}))
+	defer responder.Close()
+	asked := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return requests
+	}
+	fileCert := ca.issueServer(t, 3, "file.abc.com", "")
+	fileID, _ := newOCSPCertID(fileCert.Leaf, ca.cert)
+	ocspFile := filepath.Join(dir, "file.der")
+	ioutil.WriteFile(ocspFile, ca.ocspResponse(t, fileID, false, now, now.Add(2*time.Hour)), 0644)
+	proxy := loadTestProxyConfig(t, dir, `{"https_switch":"on","tls":{"ocsp_stapling":"on"},"reserve_proxy":[
+		{"domain":"www.abc.com","https_switch":"on"},
+		{"domain":"file.abc.com","https_switch":"on","tls":{"ocsp_file":"`+ocspFile+`"}},
+		{"domain":"off.abc.com","https_switch":"on","tls":{"ocsp_stapling":"off"}}]}`)
+	addr := startTLSPolicyServer(t, proxy)
+	defer proxy.httpsServer.Close()
+	proxy.httpsServer.SetDomainCertificate("www.abc.com", ca.issueServer(t, 2, "www.abc.com", responder.URL))
+	proxy.httpsServer.SetDomainCertificate("file.abc.com", fileCert)
+	proxy.httpsServer.SetDomainCertificate("off.abc.com", ca.issueServer(t, 4, "off.abc.com", responder.URL))
+	staple := func(domain string) []byte {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: domain, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().OCSPResponse
+	}
+
+	//from the responder of the certificate and from the file
+	proxy.refreshOCSP(now)
+	if len(staple("www.abc.com")) == 0 || len(staple("file.abc.com")) == 0 || len(staple("off.abc.com")) > 0 {
+		t.Fatal("unexpected stapled responses")
+	}
+	proxy.refreshOCSP(now.Add(time.Minute))
+	if asked() != 1 {
+		t.Fatal("response asked again before the refresh", asked())
+	}
+	//a reloaded certificate is stapled at once
+	proxy.httpsServer.SetDomainCertificate("www.abc.com", ca.issueServer(t, 5, "www.abc.com", responder.URL))
+	proxy.refreshOCSP(now.Add(2 * time.Minute))
+	if asked() != 2 || len(staple("www.abc.com")) == 0 {
+		t.Fatal("reloaded certificate not stapled", asked())
+	}
+	info, _ := proxy.TLSPolicy("www.abc.com")
+	if !info.OCSPStapled || info.OCSPSource != "responder" || info.OCSPResponder != responder.URL || info.OCSPNextUpdate == nil {
+		t.Fatalf("unexpected policy %+v", info)
+	}
+
+	//a failed refresh keeps the valid response,an expired one is removed
+	mutex.Lock()
+	revoked = true
+	mutex.Unlock()
+	proxy.refreshOCSP(now.Add(61 * time.Minute))
+	if info, _ := proxy.TLSPolicy("www.abc.com"); !info.OCSPStapled || info.OCSPError == "" || len(staple("www.abc.com")) == 0 {
+		t.Fatalf("valid response removed %+v", info)
+	}
+	proxy.refreshOCSP(now.Add(3 * time.Hour))
+	if info, _ := proxy.TLSPolicy("www.abc.com"); info.OCSPStapled || len(staple("www.abc.com")) > 0 {
+		t.Fatalf("expired response still stapled %+v", info)
+	}
+
+	//responses of another signer are refused
+	other := newTestClientCA(t, "issuer")
+	id, _ := newOCSPCertID(fileCert.Leaf, ca.cert)
+	if _, err := verifyOCSPResponse(other.ocspResponse(t, id, false, now, now.Add(time.Hour)), fileCert.Leaf, ca.cert, now); err == nil {
+		t.Fatal("response of another signer accepted")
+	}
+}
@@ -0,0 +1,421 @@
+package netservice
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//Tracing config,the global one is the default of every domain
+//A domain can only override Switch and SampleRate
+type TracingConfig struct {
+	//on off
+	Switch string `json:"switch,omitempty"`
+	//OTLP/HTTP traces endpoint,e.g. http://127.0.0.1:4318/v1/traces
+	Endpoint    string            `json:"endpoint,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"`
+	//fraction of the new traces sampled,the sampled flag of an incoming traceparent is kept
+	SampleRate float64 `json:"sample_rate,omitempty"`
+	//spans per export request
+	BatchSize int `json:"batch_size,omitempty"`
+	//seconds between two exports
+	FlushInterval int `json:"flush_interval,omitempty"`
+}
+
+//W3C trace context of the parent
+type traceParent struct {
+	TraceID string
+	SpanID  string
+	Sampled bool
+}
+
+//Span of a proxied request
+type proxySpan struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	TraceState   string
+	Sampled      bool
+	Name         string
+	Start        time.Time
+	End          time.Time
+	Domain       string
+	Path         string
+	Method       string
+	Backend      string
+	Status       int
+	Retries      int
+}
+
+//Tracing of a domain in the routing table
+type domainTracing struct {
+	sampleRate float64
+	exporter   *spanExporter
+}
+
+//Batching OTLP/HTTP exporter,spans are dropped when the queue is full
+type spanExporter struct {
+	cfg    TracingConfig
+	client *http.Client
+	spans  chan *proxySpan
+	done   chan struct{}
+	//guards closed
+	mutex   sync.RWMutex
+	closed  bool
+	dropped int64
+}
+
+//The exporter is kept across routing table swaps while its config doesn't change
+var (
+	tracingExporter      *spanExporter
+	tracingExporterMutex sync.Mutex
+)
+
+//Check the tracing settings
+func (self *TracingConfig) validate() error {
+	if self == nil {
+		return nil
+	}
+	if !validSwitch(self.Switch) {
+		return errors.New("tracing: switch must be on or off")
+	}
+	if self.SampleRate < 0 || self.SampleRate > 1 {
+		return errors.New("tracing: sample_rate must be between 0 and 1")
+	}
+	if self.BatchSize < 0 || self.FlushInterval < 0 {
+		return errors.New("tracing: batch_size and flush_interval can't be negative")
+	}
+	if self.Endpoint != "" {
+		if u, err := url.Parse(self.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("tracing: invalid endpoint %s", self.Endpoint)
+		}
+	}
+	return nil
+}
+
+//Merge the domain settings with the global ones,return nil if tracing is off
+func newDomainTracing(cfg *ReverseProxyConfigData, node *LbNode) *domainTracing {
+	if cfg.Tracing == nil || cfg.Tracing.Endpoint == "" {
+		return nil
+	}
+	switchStatus, sampleRate := cfg.Tracing.Switch, cfg.Tracing.SampleRate
+	if node.Tracing != nil {
+		if node.Tracing.Switch != "" {
+			switchStatus = node.Tracing.Switch
+		}
+		if node.Tracing.SampleRate > 0 {
+			sampleRate = node.Tracing.SampleRate
+		}
+	}
+	if switchStatus != global.SwitchOn {
+		return nil
+	}
+	if sampleRate == 0 {
+		sampleRate = 1
+	}
+	return &domainTracing{sampleRate: sampleRate, exporter: openSpanExporter(cfg.Tracing)}
+}
+
+//Get the exporter of the config,replace the running one if the config changed
+func openSpanExporter(cfg *TracingConfig) *spanExporter {
+	tracingExporterMutex.Lock()
+	defer tracingExporterMutex.Unlock()
+	exporterCfg := *cfg
+	//domain only settings don't matter to the exporter
+	exporterCfg.Switch, exporterCfg.SampleRate = "", 0
+	if exporterCfg.ServiceName == "" {
+		exporterCfg.ServiceName = global.DefaultTracingServiceName
+	}
+	if exporterCfg.BatchSize == 0 {
+		exporterCfg.BatchSize = global.DefaultTracingBatchSize
+	}
+	if exporterCfg.FlushInterval == 0 {
+		exporterCfg.FlushInterval = global.DefaultTracingFlushInterval
+	}
+	if tracingExporter != nil && reflect.DeepEqual(tracingExporter.cfg, exporterCfg) {
+		return tracingExporter
+	}
+	if tracingExporter != nil {
+		go tracingExporter.Close()
+	}
+	tracingExporter = &spanExporter{
+		cfg:    exporterCfg,
+		client: &http.Client{Timeout: time.Second * 10},
+		spans:  make(chan *proxySpan, exporterCfg.BatchSize*4),
+		done:   make(chan struct{}),
+	}
+	go tracingExporter.run()
+	return tracingExporter
+}
+
+//Close the exporter if no domain uses it
+func closeUnusedSpanExporter(table *routingTable) {
+	for _, route := range table.Domains {
+		if route.Tracing != nil {
+			return
+		}
+	}
+	CloseSpanExporter()
+}
+
+//Export the queued spans and stop the exporter
+func CloseSpanExporter() {
+	tracingExporterMutex.Lock()
+	exporter := tracingExporter
+	tracingExporter = nil
+	tracingExporterMutex.Unlock()
+	if exporter != nil {
+		exporter.Close()
+	}
+}
+
+//Parse the traceparent header,version-format-trace_id-parent_id-trace_flags
+func parseTraceParent(value string) (*traceParent, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return nil, false
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isLowerHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return nil, false
+	}
+	if !isLowerHex(traceID, 32) || traceID == strings.Repeat("0", 32) {
+		return nil, false
+	}
+	if !isLowerHex(spanID, 16) || spanID == strings.Repeat("0", 16) {
+		return nil, false
+	}
+	if !isLowerHex(flags, 2) {
+		return nil, false
+	}
+	flagBits, _ := strconv.ParseUint(flags, 16, 8)
+	return &traceParent{TraceID: traceID, SpanID: spanID, Sampled: flagBits&1 == 1}, true
+}
+
+func isLowerHex(value string, length int) bool {
+	if len(value) != length {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if !(value[i] >= '0' && value[i] <= '9') && !(value[i] >= 'a' && value[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+//Start the span of the request and propagate the trace context upstream
+func (self *domainTracing) startSpan(r *http.Request, domain string) *proxySpan {
+	span := &proxySpan{
+		SpanID:     randomHex(8),
+		TraceState: r.Header.Get("Tracestate"),
+		Name:       r.Method + " " + domain,
+		Start:      time.Now(),
+		Domain:     domain,
+		Path:       r.URL.Path,
+		Method:     r.Method,
+	}
+	if parent, ok := parseTraceParent(r.Header.Get("Traceparent")); ok {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+		span.Sampled = parent.Sampled
+	} else {
+		span.TraceID = randomHex(16)
+		span.Sampled = self.sampleRate >= 1 || mathrand.Float64() < self.sampleRate
+		//tracestate without a valid traceparent must be dropped
+		span.TraceState = ""
+		r.Header.Del("Tracestate")
+	}
+	flags := "00"
+	if span.Sampled {
+		flags = "01"
+	}
+	r.Header.Set("Traceparent", "00-"+span.TraceID+"-"+span.SpanID+"-"+flags)
+	return span
+}
+
+//Complete the span with the result of the request and queue it for export
+func (self *domainTracing) endSpan(span *proxySpan, record *accessRecord) {
+	if !span.Sampled {
+		return
+	}
+	span.End = time.Now()
+	span.Backend = record.Upstream
+	span.Status = record.Status
+	self.exporter.export(span)
+}
+
+//Queue the span,never blocks
+func (self *spanExporter) export(span *proxySpan) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if self.closed {
+		return
+	}
+	select {
+	case self.spans <- span:
+	default:
+		atomic.AddInt64(&self.dropped, 1)
+	}
+}
+
+//Export the queued spans and stop
+func (self *spanExporter) Close() {
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return
+	}
+	self.closed = true
+	close(self.spans)
+	self.mutex.Unlock()
+	<-self.done
+}
+
+func (self *spanExporter) run() {
+	defer close(self.done)
+	ticker := time.NewTicker(time.Second * time.Duration(self.cfg.FlushInterval))
+	defer ticker.Stop()
+	batch := make([]*proxySpan, 0, self.cfg.BatchSize)
+	for {
+		select {
+		case span, ok := <-self.spans:
+			if !ok {
+				self.send(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= self.cfg.BatchSize {
+				self.send(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			self.send(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+//POST the spans to the collector as OTLP JSON
+func (self *spanExporter) send(spans []*proxySpan) {
+	if len(spans) == 0 {
+		return
+	}
+	bts, err := json.Marshal(self.otlpRequest(spans))
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest("POST", self.cfg.Endpoint, bytes.NewReader(bts))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range self.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := self.client.Do(req)
+	if err != nil {
+		log.Println("Export spans error:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Println("Export spans error: collector returned", resp.Status)
+	}
+}
+
+//OTLP JSON encoding,see opentelemetry-proto trace/v1/trace.proto
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            struct {
+		Code int `json:"code,omitempty"`
+	} `json:"status"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+//int64 values are strings in OTLP JSON
+func intAttribute(key string, value int) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"intValue": strconv.Itoa(value)}}
+}
+
+func (self *spanExporter) otlpRequest(spans []*proxySpan) interface{} {
+	otlpSpans := make([]*otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		item := &otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentSpanID,
+			TraceState:        span.TraceState,
+			Name:              span.Name,
+			Kind:              global.SpanKindServer,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes: []otlpAttribute{
+				stringAttribute("http.request.method", span.Method),
+				stringAttribute("server.address", span.Domain),
+				stringAttribute("url.path", span.Path),
+				stringAttribute("http.route", span.Domain),
+				stringAttribute("activedrouter.backend", span.Backend),
+				intAttribute("activedrouter.retries", span.Retries),
+				intAttribute("http.response.status_code", span.Status),
+			},
+		}
+		if span.Status >= http.StatusInternalServerError {
+			item.Status.Code = global.SpanStatusError
+		}
+		otlpSpans = append(otlpSpans, item)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{stringAttribute("service.name", self.cfg.ServiceName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "ActivedRouter/netservice"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,122 @@
+package netservice
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	parent, ok := parseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || parent.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || parent.SpanID != "00f067aa0ba902b7" || !parent.Sampled {
+		t.Fatal("unexpected traceparent", parent)
+	}
+	for _, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, ok := parseTraceParent(value); ok {
+			t.Fatal("invalid traceparent accepted", value)
+		}
+	}
+	//future versions may append fields
+	if _, ok := parseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"); !ok {
+		t.Fatal("future version rejected")
+	}
+}
+
+func TestTracingExport(t *testing.T) {
+	var upstreamParent, upstreamState string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamParent = r.Header.Get("Traceparent")
+		upstreamState = r.Header.Get("Tracestate")
+	}))
+	defer backend.Close()
+	backendUrl, _ := url.Parse(backend.URL)
+
+	//collector stand-in
+	var mutex sync.Mutex
+	var exported []map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bts, _ := ioutil.ReadAll(r.Body)
+		request := struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]interface{} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}{}
+		if err := json.Unmarshal(bts, &request); err != nil || r.Header.Get("Authorization") != "token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mutex.Lock()
+		exported = append(exported, request.ResourceSpans[0].ScopeSpans[0].Spans...)
+		mutex.Unlock()
+	}))
+	defer collector.Close()
+
+	clients := []*HostInfo{{Host: backendUrl.Hostname(), Port: backendUrl.Port()}}
+	cfg := &ReverseProxyConfigData{
+		GlobalHttpSwitch: "on",
+		Tracing: &TracingConfig{Switch: "on", Endpoint: collector.URL + "/v1/traces",
+			Headers: map[string]string{"Authorization": "token"}},
+		ReverseProxy: []*LbNode{
+			{Domain: "www.abc.com", HttpSwitch: "on", Clients: clients},
+			//only continued traces are sampled
+			{Domain: "www.abcd.com", HttpSwitch: "on", Clients: clients, Tracing: &TracingConfig{SampleRate: 0.000001}},
+		},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewReverseProxy()
+	proxy.applyProxyConfig(cfg, "")
+
+	r := httptest.NewRequest("GET", "http://www.abc.com/index", nil)
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.Header.Set("Tracestate", "vendor=value")
+	proxy.ServeHTTP(httptest.NewRecorder(), r)
+	parent, ok := parseTraceParent(upstreamParent)
+	if !ok || parent.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || parent.SpanID == "00f067aa0ba902b7" || upstreamState != "vendor=value" {
+		t.Fatal("trace context not propagated", upstreamParent, upstreamState)
+	}
+	spanID := parent.SpanID
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://www.abcd.com/", nil))
+	if !strings.HasSuffix(upstreamParent, "-00") {
+		t.Fatal("unexpected sampled flag", upstreamParent)
+	}
+	CloseSpanExporter()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(exported) != 1 {
+		t.Fatal("unexpected span count", len(exported))
+	}
+	span := exported[0]
+	if span["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" || span["spanId"] != spanID ||
+		span["parentSpanId"] != "00f067aa0ba902b7" || span["traceState"] != "vendor=value" {
+		t.Fatal("unexpected span", span)
+	}
+	attributes := make(map[string]interface{})
+	for _, item := range span["attributes"].([]interface{}) {
+		attribute := item.(map[string]interface{})
+		for _, value := range attribute["value"].(map[string]interface{}) {
+			attributes[attribute["key"].(string)] = value
+		}
+	}
+	if attributes["server.address"] != "www.abc.com" || attributes["activedrouter.backend"] != backendUrl.Host ||
+		attributes["http.response.status_code"] != "200" || attributes["activedrouter.retries"] != "0" {
+		t.Fatal("unexpected attributes", attributes)
+	}
+}
@@ -0,0 +1,290 @@
+package netservice
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//udp proxy config,the nodes are shared with the tcp proxy
+type UDPProxyItem struct {
+	ListenAddr string     `json:"addr"`
+	Method     string     `json:"method"`
+	LbNode     []*TCPNode `json:"lbnode"`
+	//seconds a client session is kept without packets
+	SessionTimeout int `json:"session_timeout,omitempty"`
+	//largest datagram in bytes,longer ones are truncated
+	BufferSize int `json:"buffer_size,omitempty"`
+	//sessions kept at once,each holds a socket to the node
+	MaxSessions int `json:"max_sessions,omitempty"`
+}
+
+func (self *UDPProxyItem) validate() error {
+	if self.ListenAddr == "" {
+		return errors.New("udp proxy item without addr")
+	}
+	if _, _, err := net.SplitHostPort(self.ListenAddr); err != nil {
+		return fmt.Errorf("udp proxy addr %s: %s", self.ListenAddr, err)
+	}
+	if err := validateNodes(self.Method, self.LbNode); err != nil {
+		return fmt.Errorf("udp proxy %s: %s", self.ListenAddr, err)
+	}
+	if self.SessionTimeout < 0 || self.BufferSize < 0 || self.BufferSize > global.MaxUDPBufferSize || self.MaxSessions < 0 {
+		return fmt.Errorf("udp proxy %s: invalid session_timeout,buffer_size or max_sessions", self.ListenAddr)
+	}
+	return nil
+}
+
+func (self *UDPProxyItem) sessionTimeout() time.Duration {
+	if self.SessionTimeout == 0 {
+		return global.DefaultUDPSessionTimeout * time.Second
+	}
+	return time.Duration(self.SessionTimeout) * time.Second
+}
+
+func (self *UDPProxyItem) maxSessions() int {
+	if self.MaxSessions == 0 {
+		return global.DefaultUDPMaxSessions
+	}
+	return self.MaxSessions
+}
+
+func (self *UDPProxyItem) bufferSize() int {
+	if self.BufferSize == 0 {
+		return global.DefaultUDPBufferSize
+	}
+	return self.BufferSize
+}
+
+//Packet and byte counters of a udp listener
+type UDPProxyStats struct {
+	Addr       string `json:"addr"`
+	Sessions   int    `json:"sessions"`
+	PacketsIn  uint64 `json:"packets_in"`  //from the clients
+	PacketsOut uint64 `json:"packets_out"` //to the clients
+	BytesIn    uint64 `json:"bytes_in"`
+	BytesOut   uint64 `json:"bytes_out"`
+	Dropped    uint64 `json:"dropped"` //packets without an available node or above max_sessions
+}
+
+//Start a udp listener for every udp proxy item
+func (self *TCPProxy) StartUDPProxy() {
+	self.Mutex.RLock()
+	cfg := self.TCPProxyConfigData
+	self.Mutex.RUnlock()
+	if cfg.UDPSwitch != global.SwitchOn {
+		return
+	}
+	for _, v := range cfg.UDPProxyItems {
+		if err := self.StartUDPListener(v.ListenAddr); err != nil {
+			log.Fatalln("Start UDP Proxy Server error!", err)
+		}
+	}
+}
+
+//Start proxying the configured udp item listening on addr
+func (self *TCPProxy) StartUDPListener(addr string) error {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+	var item *UDPProxyItem
+	for _, v := range self.TCPProxyConfigData.UDPProxyItems {
+		if v.ListenAddr == addr {
+			item = v
+		}
+	}
+	if item == nil {
+		return fmt.Errorf("udp proxy %s not found", addr)
+	}
+	if _, ok := self.udpListeners[addr]; ok {
+		return fmt.Errorf("udp proxy %s is running", addr)
+	}
+	conn, err := listenUDP(addr)
+	if err != nil {
+		return err
+	}
+	listener := newUDPListener(item, conn)
+	self.udpListeners[addr] = listener
+	log.Println("UDP proxy listening on", addr)
+	go listener.serve()
+	return nil
+}
+
+//Counters of the running udp listeners
+func (self *TCPProxy) UDPStats() []*UDPProxyStats {
+	self.Mutex.RLock()
+	defer self.Mutex.RUnlock()
+	stats := make([]*UDPProxyStats, 0, len(self.udpListeners))
+	for _, addr := range sortedKeys(self.udpListeners) {
+		stats = append(stats, self.udpListeners[addr].stats())
+	}
+	return stats
+}
+
+//a running udp proxy listener
+type udpListener struct {
+	item *UDPProxyItem
+	conn *net.UDPConn
+	//round robin position
+	next uint64
+	//client address => session
+	mutex    sync.Mutex
+	sessions map[string]*udpSession
+	closed   bool
+	//counters
+	packetsIn  uint64
+	packetsOut uint64
+	bytesIn    uint64
+	bytesOut   uint64
+	dropped    uint64
+}
+
+//packets of a client address go to the same node,the answers go back to it
+type udpSession struct {
+	client     *net.UDPAddr
+	backend    *net.UDPConn
+	node       *TCPNode
+	lastActive int64
+}
+
+func newUDPListener(item *UDPProxyItem, conn *net.UDPConn) *udpListener {
+	return &udpListener{item: item, conn: conn, sessions: make(map[string]*udpSession)}
+}
+
+func (self *udpListener) serve() {
+	buf := make([]byte, self.item.bufferSize())
+	for {
+		n, client, err := self.conn.ReadFromUDP(buf)
+		if err != nil {
+			self.mutex.Lock()
+			closed := self.closed
+			self.mutex.Unlock()
+			if closed {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.Println("UDP proxy", self.item.ListenAddr, "read error:", err)
+			return
+		}
+		atomic.AddUint64(&self.packetsIn, 1)
+		atomic.AddUint64(&self.bytesIn, uint64(n))
+		session, err := self.session(client)
+		if err != nil {
+			atomic.AddUint64(&self.dropped, 1)
+			continue
+		}
+		atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+		session.backend.Write(buf[:n])
+	}
+}
+
+var errUDPSessionsFull = errors.New("udp proxy sessions are full")
+
+//Session of the client,a new one is connected to the node chosen by the method
+func (self *udpListener) session(client *net.UDPAddr) (*udpSession, error) {
+	key := client.String()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if session, ok := self.sessions[key]; ok {
+		return session, nil
+	}
+	if self.closed {
+		return nil, errors.New("udp proxy is closed")
+	}
+	if len(self.sessions) >= self.item.maxSessions() {
+		return nil, errUDPSessionsFull
+	}
+	var lastErr error
+	for _, node := range orderNodes(self.item.LbNode, self.item.Method, &self.next) {
+		addr, err := net.ResolveUDPAddr("udp", node.Addr())
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		backend, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		session := &udpSession{client: client, backend: backend, node: node, lastActive: time.Now().UnixNano()}
+		atomic.AddInt64(&node.active, 1)
+		self.sessions[key] = session
+		go self.relay(key, session)
+		return session, nil
+	}
+	log.Println("UDP proxy", self.item.ListenAddr, "no available node:", lastErr)
+	return nil, lastErr
+}
+
+//Send the answers of the node back to the client until the session is idle
+func (self *udpListener) relay(key string, session *udpSession) {
+	defer self.removeSession(key, session)
+	timeout := self.item.sessionTimeout()
+	buf := make([]byte, self.item.bufferSize())
+	for {
+		session.backend.SetReadDeadline(time.Now().Add(timeout))
+		n, err := session.backend.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				idle := time.Since(time.Unix(0, atomic.LoadInt64(&session.lastActive)))
+				if idle < timeout {
+					continue
+				}
+				return
+			}
+			//refused by the node,the session is kept until it is idle
+			if !errors.Is(err, net.ErrClosed) {
+				continue
+			}
+			return
+		}
+		atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+		if _, err := self.conn.WriteToUDP(buf[:n], session.client); err == nil {
+			atomic.AddUint64(&self.packetsOut, 1)
+			atomic.AddUint64(&self.bytesOut, uint64(n))
+		}
+	}
+}
+
+func (self *udpListener) removeSession(key string, session *udpSession) {
+	self.mutex.Lock()
+	if self.sessions[key] == session {
+		delete(self.sessions, key)
+	}
+	self.mutex.Unlock()
+	session.backend.Close()
+	atomic.AddInt64(&session.node.active, -1)
+}
+
+func (self *udpListener) stats() *UDPProxyStats {
+	self.mutex.Lock()
+	sessions := len(self.sessions)
+	self.mutex.Unlock()
+	return &UDPProxyStats{
+		Addr:       self.item.ListenAddr,
+		Sessions:   sessions,
+		PacketsIn:  atomic.LoadUint64(&self.packetsIn),
+		PacketsOut: atomic.LoadUint64(&self.packetsOut),
+		BytesIn:    atomic.LoadUint64(&self.bytesIn),
+		BytesOut:   atomic.LoadUint64(&self.bytesOut),
+		Dropped:    atomic.LoadUint64(&self.dropped),
+	}
+}
+
+//Close the socket and all sessions
+func (self *udpListener) shutdown() {
+	self.mutex.Lock()
+	self.closed = true
+	self.conn.Close()
+	for _, session := range self.sessions {
+		session.backend.Close()
+	}
+	self.mutex.Unlock()
+}
@@ -0,0 +1,166 @@
+package netservice
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"ActivedRouter/global"
+)
+
+//Udp echo server answering with its name before the datagram
+func startUDPEchoServer(t *testing.T, name string) (*TCPNode, func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, client, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(append([]byte(name+":"), buf[:n]...), client)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	return &TCPNode{Host: host, Port: port}, func() { conn.Close() }
+}
+
+func startTestUDPListener(t *testing.T, item *UDPProxyItem) *udpListener {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.ListenAddr = conn.LocalAddr().String()
+	if err := item.validate(); err != nil {
+		t.Fatal(err)
+	}
+	listener := newUDPListener(item, conn)
+	go listener.serve()
+	return listener
+}
+
+func udpRoundTrip(t *testing.T, client *net.UDPConn, message string) string {
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestUDPProxySessions(t *testing.T) {
+	node1, stop1 := startUDPEchoServer(t, "one")
+	defer stop1()
+	node2, stop2 := startUDPEchoServer(t, "two")
+	defer stop2()
+	listener := startTestUDPListener(t, &UDPProxyItem{Method: global.RoundRobin, SessionTimeout: 1, LbNode: []*TCPNode{node1, node2}})
+	defer listener.shutdown()
+	proxyAddr := listener.conn.LocalAddr().(*net.UDPAddr)
+
+	clientA, _ := net.DialUDP("udp", nil, proxyAddr)
+	defer clientA.Close()
+	clientB, _ := net.DialUDP("udp", nil, proxyAddr)
+	defer clientB.Close()
+	//every client keeps the node of its session
+	for i := 0; i < 3; i++ {
+		if got := udpRoundTrip(t, clientA, "a"); got != "one:a" {
+			t.Fatalf("client a got %q", got)
+		}
+		if got := udpRoundTrip(t, clientB, "b"); got != "two:b" {
+			t.Fatalf("client b got %q", got)
+		}
+	}
+	stats := listener.stats()
+	if stats.Sessions != 2 || stats.PacketsIn != 6 || stats.PacketsOut != 6 || stats.BytesIn != 6 || stats.BytesOut != 30 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if node1.ActiveConns() != 1 || node2.ActiveConns() != 1 {
+		t.Fatal("unexpected sessions of the nodes", node1.ActiveConns(), node2.ActiveConns())
+	}
+
+	//idle sessions expire
+	deadline := time.Now().Add(5 * time.Second)
+	for listener.stats().Sessions != 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if listener.stats().Sessions != 0 || node1.ActiveConns() != 0 || node2.ActiveConns() != 0 {
+		t.Fatal("sessions not expired", listener.stats())
+	}
+	//a new session is created for the next packet
+	if got := udpRoundTrip(t, clientA, "again"); got != "one:again" {
+		t.Fatalf("client a got %q after expiry", got)
+	}
+}
+
+func TestUDPProxyBufferSize(t *testing.T) {
+	node, stop := startUDPEchoServer(t, "echo")
+	defer stop()
+	listener := startTestUDPListener(t, &UDPProxyItem{BufferSize: 4, LbNode: []*TCPNode{node}})
+	defer listener.shutdown()
+	client, _ := net.DialUDP("udp", nil, listener.conn.LocalAddr().(*net.UDPAddr))
+	defer client.Close()
+	//the request and the answer are truncated to the buffer size
+	if got := udpRoundTrip(t, client, "truncated"); got != "echo" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestUDPProxyMaxSessions(t *testing.T) {
+	node, stop := startUDPEchoServer(t, "echo")
+	defer stop()
+	listener := startTestUDPListener(t, &UDPProxyItem{MaxSessions: 1, LbNode: []*TCPNode{node}})
+	defer listener.shutdown()
+	addr := listener.conn.LocalAddr().(*net.UDPAddr)
+	client1, _ := net.DialUDP("udp", nil, addr)
+	defer client1.Close()
+	client2, _ := net.DialUDP("udp", nil, addr)
+	defer client2.Close()
+	if got := udpRoundTrip(t, client1, "x"); got != "echo:x" {
+		t.Fatalf("got %q", got)
+	}
+	//a new client above max_sessions is dropped,the session kept answers
+	client2.Write([]byte("y"))
+	client2.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := client2.Read(make([]byte, 16)); err == nil {
+		t.Fatal("session above max_sessions answered")
+	}
+	if got := udpRoundTrip(t, client1, "z"); got != "echo:z" {
+		t.Fatalf("got %q", got)
+	}
+	if stats := listener.stats(); stats.Sessions != 1 || stats.Dropped != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestUDPProxyConfig(t *testing.T) {
+	node := &TCPNode{Host: "127.0.0.1", Port: "53"}
+	for _, cfg := range []*TCPProxyConfig{
+		{UDPSwitch: "yes"},
+		{UDPSwitch: global.SwitchOn, UDPProxyItems: []*UDPProxyItem{{ListenAddr: "127.0.0.1:53"}}},
+		{UDPSwitch: global.SwitchOn, UDPProxyItems: []*UDPProxyItem{{ListenAddr: "127.0.0.1:53", LbNode: []*TCPNode{node}, BufferSize: 1 << 20}}},
+		{UDPSwitch: global.SwitchOn, UDPProxyItems: []*UDPProxyItem{{ListenAddr: "127.0.0.1:53", LbNode: []*TCPNode{node}, MaxSessions: -1}}},
+		{UDPSwitch: global.SwitchOn, UDPProxyItems: []*UDPProxyItem{
+			{ListenAddr: "127.0.0.1:53", LbNode: []*TCPNode{node}},
+			{ListenAddr: "127.0.0.1:53", LbNode: []*TCPNode{node}},
+		}},
+	} {
+		if cfg.validate() == nil {
+			t.Fatal("invalid config accepted", cfg)
+		}
+	}
+	//the same port for tcp and udp
+	cfg := &TCPProxyConfig{
+		TCPProxyitems: []*TCPProxyItem{{ListenAddr: "127.0.0.1:53", LbNode: []*TCPNode{node}}},
+		UDPProxyItems: []*UDPProxyItem{{ListenAddr: "127.0.0.1:53", LbNode: []*TCPNode{node}}},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -118,6 +118,26 @@ var initDiskPie=function(){
 }
 
 //init http request   line chart 
+//热点客户端,路径,UA,来源
+var initTopKTables=function(){
+	$.get("/topk?window=15&n=5",function(data){
+		var html="";
+		for(var domain in data.top){
+			html+="<h4>"+$("<span>").text(domain).html()+"</h4><div class='row'>";
+			for(var dimension in data.top[domain]){
+				html+="<div class='col-md-3'><table class='table table-condensed'><tr><th>"+dimension+"</th><th>count</th></tr>";
+				var items=data.top[domain][dimension];
+				for(var i=0;i<items.length;i++){
+					html+="<tr><td>"+$("<span>").text(items[i].key).html()+"</td><td>"+items[i].count+"</td></tr>";
+				}
+				html+="</table></div>";
+			}
+			html+="</div>";
+		}
+		$("#topk-tables").html(html);
+	});
+};
+
 var initHttpLineChart=function(){
 	var colorTable=[
 		["rgba(75,192,192,0.4)","rgba(75,192,192,1)"],
@@ -647,9 +667,11 @@ var loadIndexContent=function(){
 	//init http
 	if(routerInfo.RunMode=="reverseproxy"){
 			initHttpLineChart();
+			initTopKTables();
 	}else{
 		//非反向代理模式下隐藏折线图
 		$("#http-proxy-statistics").css("display","none");
+		$("#http-proxy-topk").css("display","none");
 	}
 };
 
@@ -0,0 +1,92 @@
+package system
+
+import (
+	"math"
+)
+
+//延迟直方图的桶:第i个桶的上界是 1ms*1.2^i,相对误差不超过20%
+const (
+	histogramBase   = 0.001
+	histogramFactor = 1.2
+)
+
+//可合并的延迟直方图,单位秒
+//所有直方图的桶边界相同,不同时间段,不同集群的直方图可以直接相加
+type LatencyHistogram struct {
+	Buckets map[int]int64 //桶序号 => 次数
+	Count   int64
+	Sum     float64
+	Max     float64
+}
+
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{Buckets: make(map[int]int64)}
+}
+
+//桶序号
+func histogramBucket(seconds float64) int {
+	if seconds <= histogramBase {
+		return 0
+	}
+	return int(math.Ceil(math.Log(seconds/histogramBase) / math.Log(histogramFactor)))
+}
+
+//桶上界
+func histogramUpperBound(bucket int) float64 {
+	return histogramBase * math.Pow(histogramFactor, float64(bucket))
+}
+
+//记录一次请求的延迟
+func (self *LatencyHistogram) Observe(seconds float64) {
+	if seconds < 0 {
+		seconds = 0
+	}
+	self.Buckets[histogramBucket(seconds)]++
+	self.Count++
+	self.Sum += seconds
+	if seconds > self.Max {
+		self.Max = seconds
+	}
+}
+
+//合并另一个直方图
+func (self *LatencyHistogram) Merge(other *LatencyHistogram) {
+	if other == nil {
+		return
+	}
+	for bucket, count := range other.Buckets {
+		self.Buckets[bucket] += count
+	}
+	self.Count += other.Count
+	self.Sum += other.Sum
+	if other.Max > self.Max {
+		self.Max = other.Max
+	}
+}
+
+//分位数,q在0到1之间,返回所在桶的上界
+func (self *LatencyHistogram) Quantile(q float64) float64 {
+	if self.Count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(self.Count)))
+	if rank < 1 {
+		rank = 1
+	}
+	maxBucket := histogramBucket(self.Max)
+	var seen int64
+	for bucket := 0; bucket <= maxBucket; bucket++ {
+		seen += self.Buckets[bucket]
+		if seen >= rank {
+			return math.Min(histogramUpperBound(bucket), self.Max)
+		}
+	}
+	return self.Max
+}
+
+//副本
+func (self *LatencyHistogram) Copy() *LatencyHistogram {
+	copied := NewLatencyHistogram()
+	copied.Merge(self)
+	return copied
+}
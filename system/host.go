@@ -128,6 +128,35 @@ func (self *HostInfoTable) InsertSortHostWeight(hostinfo HostInfo) {
 	}
 }
 
+//按照权重降序返回活跃主机的副本
+func (self *HostInfoTable) ActiveHostsByWeight() []HostInfo {
+	hosttableMutex.RLock()
+	defer hosttableMutex.RUnlock()
+	hosts := make([]HostInfo, 0, self.ActiveHostWeightList.Len())
+	for e := self.ActiveHostWeightList.Front(); e != nil; e = e.Next() {
+		hosts = append(hosts, e.Value.(HostInfo))
+	}
+	return hosts
+}
+
+//返回所有主机的副本,包含不活跃的主机
+func (self *HostInfoTable) HostsSnapshot() []HostInfo {
+	hosttableMutex.RLock()
+	defer hosttableMutex.RUnlock()
+	cacheMap := *self.HostsInfo.GetStorage().GetData()
+	hosts := make([]HostInfo, 0, len(cacheMap))
+	for _, v := range cacheMap {
+		hostInfo := *v.(*HostInfo)
+		if hostInfo.Info == nil {
+			continue
+		}
+		info := *hostInfo.Info
+		hostInfo.Info = &info
+		hosts = append(hosts, hostInfo)
+	}
+	return hosts
+}
+
 //calc host weight
 //根据服务器负载状态  计算 权重
 // cpu  0 1 2 3
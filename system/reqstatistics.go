@@ -1,15 +1,31 @@
 package system
 
 import (
+	"strconv"
 	"sync"
 
 	"ActivedRouter/tools"
 )
 
+//请求次数,状态码分类,流量和延迟
+type TrafficStatistics struct {
+	RequestCount int64             //all请求次数
+	StatusClass  map[string]int64  //按状态码分类的请求次数 1xx 2xx 3xx 4xx 5xx
+	BytesIn      int64             //客户端发送的请求体字节数
+	BytesOut     int64             //返回给客户端的响应体字节数
+	Latency      *LatencyHistogram //延迟直方图
+	//延迟分位数,单位秒,读取统计的时候计算
+	LatencyP50 float64
+	LatencyP90 float64
+	LatencyP99 float64
+}
+
 //http 反向代理请求统计
 type HttpProxyStatistics struct {
-	Timestamp    int64 //时间戳
-	RequestCount int64 //all请求次数
+	Timestamp int64 //时间戳
+	TrafficStatistics
+	Rejected map[string]int64              //超出限制被拒绝的请求次数,按原因分类
+	Backends map[string]*TrafficStatistics //按后端服务器 host:port 分类
 }
 
 //http请求分析
@@ -24,9 +40,73 @@ type SysHttpStatistics struct {
 	mutexUpdate *sync.RWMutex
 }
 
+func newTrafficStatistics() *TrafficStatistics {
+	return &TrafficStatistics{StatusClass: make(map[string]int64), Latency: NewLatencyHistogram()}
+}
+
+//记录一次请求
+func (self *TrafficStatistics) record(status int, bytesIn, bytesOut int64, latency float64) {
+	self.RequestCount++
+	self.StatusClass[strconv.Itoa(status/100)+"xx"]++
+	self.BytesIn += bytesIn
+	self.BytesOut += bytesOut
+	self.Latency.Observe(latency)
+}
+
+//合并另一个统计
+func (self *TrafficStatistics) merge(other *TrafficStatistics) {
+	self.RequestCount += other.RequestCount
+	for class, count := range other.StatusClass {
+		self.StatusClass[class] += count
+	}
+	self.BytesIn += other.BytesIn
+	self.BytesOut += other.BytesOut
+	self.Latency.Merge(other.Latency)
+}
+
+//副本,并计算延迟分位数
+func (self *TrafficStatistics) copy() *TrafficStatistics {
+	copied := newTrafficStatistics()
+	copied.merge(self)
+	copied.LatencyP50 = copied.Latency.Quantile(0.5)
+	copied.LatencyP90 = copied.Latency.Quantile(0.9)
+	copied.LatencyP99 = copied.Latency.Quantile(0.99)
+	return copied
+}
+
 //创建一个反向代理统计对象
 func newHttpProxyStatistics(timestamp, reqCount int64) *HttpProxyStatistics {
-	return &HttpProxyStatistics{Timestamp: timestamp, RequestCount: reqCount}
+	node := &HttpProxyStatistics{Timestamp: timestamp, Rejected: make(map[string]int64), Backends: make(map[string]*TrafficStatistics)}
+	node.TrafficStatistics = *newTrafficStatistics()
+	node.RequestCount = reqCount
+	return node
+}
+
+//副本
+func (self *HttpProxyStatistics) copy() *HttpProxyStatistics {
+	node := newHttpProxyStatistics(self.Timestamp, 0)
+	node.TrafficStatistics = *self.TrafficStatistics.copy()
+	for reason, count := range self.Rejected {
+		node.Rejected[reason] = count
+	}
+	for backend, traffic := range self.Backends {
+		node.Backends[backend] = traffic.copy()
+	}
+	return node
+}
+
+//合并另一个时间段的统计
+func (self *HttpProxyStatistics) merge(other *HttpProxyStatistics) {
+	self.TrafficStatistics.merge(&other.TrafficStatistics)
+	for reason, count := range other.Rejected {
+		self.Rejected[reason] += count
+	}
+	for backend, traffic := range other.Backends {
+		if _, ok := self.Backends[backend]; !ok {
+			self.Backends[backend] = newTrafficStatistics()
+		}
+		self.Backends[backend].merge(traffic)
+	}
 }
 
 //CREATE SYSHTTPSTATISTICS
@@ -36,9 +116,65 @@ func NewSysHttpStatistics() *SysHttpStatistics {
 	}
 }
 
-//获取统计列表
+//获取统计列表的副本
 func (self *SysHttpStatistics) GetStatisticsList() StatisticsMap {
-	return self.statistic
+	return self.GetStatistics("", 0, 0)
+}
+
+//按集群和时间段过滤统计列表,返回副本
+//cluster 为空返回所有集群,from to 为0表示不限制
+func (self *SysHttpStatistics) GetStatistics(cluster string, from, to int64) StatisticsMap {
+	self.mutexUpdate.RLock()
+	defer self.mutexUpdate.RUnlock()
+	statistic := make(StatisticsMap, len(self.statistic))
+	for name, list := range self.statistic {
+		if cluster != "" && name != cluster {
+			continue
+		}
+		statistic[name] = []*HttpProxyStatistics{}
+		for _, item := range list {
+			if (from > 0 && item.Timestamp < from) || (to > 0 && item.Timestamp > to) {
+				continue
+			}
+			statistic[name] = append(statistic[name], item.copy())
+		}
+	}
+	return statistic
+}
+
+//合并每个集群的统计列表,返回整个时间段的汇总,时间戳是第一个时间段的时间戳
+func SummarizeStatistics(statistic StatisticsMap) map[string]*HttpProxyStatistics {
+	summary := make(map[string]*HttpProxyStatistics, len(statistic))
+	for cluster, list := range statistic {
+		node := newHttpProxyStatistics(0, 0)
+		for i, item := range list {
+			if i == 0 {
+				node.Timestamp = item.Timestamp
+			}
+			node.merge(item)
+		}
+		summary[cluster] = node.copy()
+	}
+	return summary
+}
+
+//记录一次代理请求
+//cluster 域名  backend 后端服务器host:port,没有选中后端的时候为空
+func (self *SysHttpStatistics) UpdateRequestStatistics(cluster, backend string, status int, bytesIn, bytesOut int64, latency float64) {
+	self.mutexUpdate.Lock()
+	defer self.mutexUpdate.Unlock()
+	if _, ok := self.statistic[cluster]; !ok {
+		dataTool := tools.DateTool{}
+		self.statistic[cluster] = []*HttpProxyStatistics{newHttpProxyStatistics(dataTool.CurrentUnixTimestamp(), 0)}
+	}
+	node := self.statistic[cluster][len(self.statistic[cluster])-1]
+	node.record(status, bytesIn, bytesOut, latency)
+	if backend != "" {
+		if _, ok := node.Backends[backend]; !ok {
+			node.Backends[backend] = newTrafficStatistics()
+		}
+		node.Backends[backend].record(status, bytesIn, bytesOut, latency)
+	}
 }
 
 //更新集群请求统计
@@ -61,18 +197,7 @@ func (self *SysHttpStatistics) UpdateClusterStatistics(cluster string, updateTyp
 	}
 	//定时增加统计对象边界
 	if updateType == 1 {
-		dataTool := tools.DateTool{}
-		timestamp := dataTool.CurrentUnixTimestamp()
-		for k, _ := range self.statistic {
-			//长度为100的线性表
-			tableLen := len(self.statistic[k])
-			//移除线性表投诉
-			if tableLen > 100 {
-				self.statistic[k] = self.statistic[k][1:]
-			}
-			//追加
-			self.statistic[k] = append(self.statistic[k], newHttpProxyStatistics(timestamp, 0))
-		}
+		self.nextInterval()
 	} else {
 		//取出最后一个统计索引
 		lastIndex := len(self.statistic[cluster]) - 1
@@ -82,12 +207,48 @@ func (self *SysHttpStatistics) UpdateClusterStatistics(cluster string, updateTyp
 	self.mutexUpdate.Unlock()
 }
 
-//存储当天的统计数据到json日志 或者数据库中
-func (self *SysHttpStatistics) SaveDataLog() {
+//开始新的统计时间段,返回刚结束的时间段的副本
+func (self *SysHttpStatistics) NextInterval() map[string]*HttpProxyStatistics {
+	self.mutexUpdate.Lock()
+	defer self.mutexUpdate.Unlock()
+	return self.nextInterval()
+}
 
+func (self *SysHttpStatistics) nextInterval() map[string]*HttpProxyStatistics {
+	finished := make(map[string]*HttpProxyStatistics, len(self.statistic))
+	dataTool := tools.DateTool{}
+	timestamp := dataTool.CurrentUnixTimestamp()
+	for k, _ := range self.statistic {
+		//长度为100的线性表
+		tableLen := len(self.statistic[k])
+		finished[k] = self.statistic[k][tableLen-1].copy()
+		//移除线性表投诉
+		if tableLen > 100 {
+			self.statistic[k] = self.statistic[k][1:]
+		}
+		//追加
+		self.statistic[k] = append(self.statistic[k], newHttpProxyStatistics(timestamp, 0))
+	}
+	return finished
 }
 
-//清空当天的请求统计日志 并且清空内存
-func (self *SysHttpStatistics) ResetData() {
+//更新集群被拒绝的请求统计
+//reason 拒绝原因,例如 body_too_large timeout
+func (self *SysHttpStatistics) UpdateClusterRejected(cluster, reason string) {
+	self.mutexUpdate.Lock()
+	defer self.mutexUpdate.Unlock()
+	if _, ok := self.statistic[cluster]; !ok {
+		dataTool := tools.DateTool{}
+		self.statistic[cluster] = []*HttpProxyStatistics{newHttpProxyStatistics(dataTool.CurrentUnixTimestamp(), 0)}
+	}
+	lastIndex := len(self.statistic[cluster]) - 1
+	self.statistic[cluster][lastIndex].Rejected[reason]++
+}
 
+//清空内存中的请求统计,历史数据保存在 StatisticsStore
+func (self *SysHttpStatistics) ResetData() {
+	self.mutexUpdate.Lock()
+	defer self.mutexUpdate.Unlock()
+	self.statistic = make(StatisticsMap)
+	self.currentNode = make(map[string]*HttpProxyStatistics)
 }
@@ -0,0 +1,64 @@
+package system
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	histogram := NewLatencyHistogram()
+	for i := 1; i <= 100; i++ {
+		histogram.Observe(float64(i) / 1000)
+	}
+	//relative error of a bucket is at most 20%
+	for q, expected := range map[float64]float64{0.5: 0.05, 0.9: 0.09, 0.99: 0.099} {
+		if value := histogram.Quantile(q); value < expected || value > expected*1.2 {
+			t.Fatal("unexpected quantile", q, value)
+		}
+	}
+	if histogram.Quantile(1) != 0.1 {
+		t.Fatal("quantile above max", histogram.Quantile(1))
+	}
+	other := NewLatencyHistogram()
+	other.Observe(2)
+	histogram.Merge(other)
+	if histogram.Count != 101 || histogram.Max != 2 || math.Abs(histogram.Sum-7.05) > 1e-9 {
+		t.Fatal("unexpected merge", histogram.Count, histogram.Max, histogram.Sum)
+	}
+}
+
+func TestGetStatistics(t *testing.T) {
+	statistics := NewSysHttpStatistics()
+	statistics.UpdateRequestStatistics("www.abc.com", "127.0.0.1:8080", 200, 10, 100, 0.01)
+	statistics.UpdateRequestStatistics("www.abc.com", "127.0.0.1:8081", 502, 0, 10, 0.2)
+	statistics.UpdateRequestStatistics("www.abcd.com", "", 404, 0, 5, 0.001)
+	//older interval
+	statistics.statistic["www.abc.com"][0].Timestamp = 100
+	statistics.UpdateClusterStatistics("", 1)
+	statistics.UpdateRequestStatistics("www.abc.com", "127.0.0.1:8080", 201, 1, 2, 0.02)
+
+	data := statistics.GetStatistics("www.abc.com", 0, 0)
+	if len(data) != 1 || len(data["www.abc.com"]) != 2 {
+		t.Fatal("domain filter", data)
+	}
+	node := data["www.abc.com"][0]
+	if node.RequestCount != 2 || node.StatusClass["2xx"] != 1 || node.StatusClass["5xx"] != 1 ||
+		node.BytesIn != 10 || node.BytesOut != 110 || node.Backends["127.0.0.1:8081"].RequestCount != 1 {
+		t.Fatal("unexpected statistics", node)
+	}
+	if node.LatencyP99 != 0.2 {
+		t.Fatal("unexpected p99", node.LatencyP99)
+	}
+	//the copy doesn't change the statistics
+	node.Backends["127.0.0.1:8080"].RequestCount = 100
+	if statistics.statistic["www.abc.com"][0].Backends["127.0.0.1:8080"].RequestCount != 1 {
+		t.Fatal("statistics changed by the copy")
+	}
+	if data := statistics.GetStatistics("", 101, 0); len(data["www.abc.com"]) != 1 || data["www.abc.com"][0].RequestCount != 1 {
+		t.Fatal("time filter", data["www.abc.com"])
+	}
+	summary := SummarizeStatistics(statistics.GetStatistics("www.abc.com", 0, 0))["www.abc.com"]
+	if summary.Timestamp != 100 || summary.RequestCount != 3 || summary.Backends["127.0.0.1:8080"].RequestCount != 2 || summary.LatencyP99 != 0.2 {
+		t.Fatal("unexpected summary", summary)
+	}
+}
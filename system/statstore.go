@@ -0,0 +1,567 @@
+package system
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ActivedRouter/tools"
+)
+
+//统计数据的精度
+const (
+	ResolutionMinute = "minute"
+	ResolutionHour   = "hour"
+	ResolutionDay    = "day"
+)
+
+//统计数据的类型
+const (
+	RecordProxy = "proxy"
+	RecordHost  = "host"
+)
+
+//各精度数据的保留天数,0使用默认值
+type StatisticsRetention struct {
+	Minute int `json:"minute"`
+	Hour   int `json:"hour"`
+	Day    int `json:"day"`
+}
+
+//默认保留 7天的分钟数据 90天的小时数据 2年的天数据
+var DefaultStatisticsRetention = StatisticsRetention{Minute: 7, Hour: 90, Day: 730}
+
+//指标的汇总,可以合并
+type MetricSummary struct {
+	Count int64
+	Sum   float64
+	Min   float64
+	Max   float64
+	Avg   float64 //读取的时候计算
+}
+
+func (self *MetricSummary) observe(value float64) {
+	if self.Count == 0 || value < self.Min {
+		self.Min = value
+	}
+	if self.Count == 0 || value > self.Max {
+		self.Max = value
+	}
+	self.Count++
+	self.Sum += value
+}
+
+func (self *MetricSummary) merge(other *MetricSummary) {
+	if other.Count == 0 {
+		return
+	}
+	if self.Count == 0 || other.Min < self.Min {
+		self.Min = other.Min
+	}
+	if self.Count == 0 || other.Max > self.Max {
+		self.Max = other.Max
+	}
+	self.Count += other.Count
+	self.Sum += other.Sum
+}
+
+//主机状态统计
+type HostStatistics struct {
+	Cluster string
+	Samples int64                     //采样次数
+	Active  int64                     //活跃的采样次数
+	Metrics map[string]*MetricSummary //cpu_percent mem_used_percent load1 ...
+}
+
+//一次主机采样
+func newHostStatistics(host HostInfo) *HostStatistics {
+	stat := &HostStatistics{Cluster: host.Info.Cluster, Samples: 1, Metrics: make(map[string]*MetricSummary)}
+	if host.Status == ACTIVE {
+		stat.Active = 1
+	}
+	observe := func(name string, value float64) {
+		summary := &MetricSummary{}
+		summary.observe(value)
+		stat.Metrics[name] = summary
+	}
+	info := host.Info
+	if len(info.CpuPercent) > 0 {
+		cpuPercent := 0.0
+		for _, v := range info.CpuPercent {
+			cpuPercent += v
+		}
+		observe("cpu_percent", cpuPercent/float64(len(info.CpuPercent)))
+	}
+	if info.VM != nil {
+		observe("mem_used_percent", info.VM.UsedPercent)
+	}
+	if info.LD != nil {
+		observe("load1", info.LD.Load1)
+		observe("load5", info.LD.Load5)
+		observe("load15", info.LD.Load15)
+	}
+	if info.DISK != nil {
+		observe("disk_used_percent", info.DISK.UsedPercent)
+	}
+	if info.NC != nil {
+		observe("tcp_connections", float64(info.NC.AllConnectCount))
+	}
+	observe("weight", float64(info.Weight))
+	return stat
+}
+
+func (self *HostStatistics) merge(other *HostStatistics) {
+	self.Cluster = other.Cluster
+	self.Samples += other.Samples
+	self.Active += other.Active
+	for name, summary := range other.Metrics {
+		if _, ok := self.Metrics[name]; !ok {
+			self.Metrics[name] = &MetricSummary{}
+		}
+		self.Metrics[name].merge(summary)
+	}
+}
+
+//存储的一条统计数据
+type StatisticsRecord struct {
+	Timestamp int64
+	Kind      string               //proxy host
+	Key       string               //域名 或者 主机ip
+	Proxy     *HttpProxyStatistics `json:",omitempty"`
+	Host      *HostStatistics      `json:",omitempty"`
+}
+
+//合并同一类型同一key的数据
+func (self *StatisticsRecord) merge(other *StatisticsRecord) {
+	if other.Proxy != nil {
+		if self.Proxy == nil {
+			self.Proxy = newHttpProxyStatistics(self.Timestamp, 0)
+		}
+		self.Proxy.merge(other.Proxy)
+	}
+	if other.Host != nil {
+		if self.Host == nil {
+			self.Host = &HostStatistics{Metrics: make(map[string]*MetricSummary)}
+		}
+		self.Host.merge(other.Host)
+	}
+}
+
+//计算分位数 平均值
+func (self *StatisticsRecord) fillDerived() {
+	if self.Proxy != nil {
+		self.Proxy = self.Proxy.copy()
+	}
+	if self.Host != nil {
+		for _, summary := range self.Host.Metrics {
+			if summary.Count > 0 {
+				summary.Avg = summary.Sum / float64(summary.Count)
+			}
+		}
+	}
+}
+
+//统计数据的磁盘存储,每行一条json记录
+//分钟数据按天分文件 dir/minute/20060102.jsonl
+//小时数据按月分文件 dir/hour/200601.jsonl
+//天数据按年分文件   dir/day/2006.jsonl
+//时间使用UTC
+type StatisticsStore struct {
+	Dir       string
+	Retention StatisticsRetention
+	mutex     sync.Mutex
+}
+
+//时间段结束后等待的秒数,最后一个统计时间段写入后再汇总
+const rollupDelay = 120
+
+//汇总进度,下一个需要汇总的小时和天
+type rollupState struct {
+	Hour int64 `json:"hour"`
+	Day  int64 `json:"day"`
+}
+
+func NewStatisticsStore(dir string, retention StatisticsRetention) *StatisticsStore {
+	if retention.Minute <= 0 {
+		retention.Minute = DefaultStatisticsRetention.Minute
+	}
+	if retention.Hour <= 0 {
+		retention.Hour = DefaultStatisticsRetention.Hour
+	}
+	if retention.Day <= 0 {
+		retention.Day = DefaultStatisticsRetention.Day
+	}
+	return &StatisticsStore{Dir: dir, Retention: retention}
+}
+
+//精度对应的秒数
+func resolutionSeconds(resolution string) int64 {
+	switch resolution {
+	case ResolutionHour:
+		return 3600
+	case ResolutionDay:
+		return 86400
+	}
+	return 60
+}
+
+//文件名的时间格式
+func periodLayout(resolution string) string {
+	switch resolution {
+	case ResolutionHour:
+		return "200601"
+	case ResolutionDay:
+		return "2006"
+	}
+	return "20060102"
+}
+
+func (self *StatisticsStore) fileName(resolution string, timestamp int64) string {
+	period := time.Unix(timestamp, 0).UTC().Format(periodLayout(resolution))
+	return filepath.Join(self.Dir, resolution, period+".jsonl")
+}
+
+//追加记录
+func (self *StatisticsStore) Append(resolution string, records []*StatisticsRecord) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.append(resolution, records)
+}
+
+func (self *StatisticsStore) append(resolution string, records []*StatisticsRecord) error {
+	files := make(map[string][]interface{})
+	for _, record := range records {
+		name := self.fileName(resolution, record.Timestamp)
+		files[name] = append(files[name], record)
+	}
+	for name, list := range files {
+		if err := appendJsonLines(name, list); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//追加json行到文件
+func appendJsonLines(name string, values []interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, value := range values {
+		if err = encoder.Encode(value); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+//存储一个时间段的反向代理统计
+func (self *StatisticsStore) SaveProxyStatistics(nodes map[string]*HttpProxyStatistics) error {
+	records := make([]*StatisticsRecord, 0, len(nodes))
+	for cluster, node := range nodes {
+		records = append(records, &StatisticsRecord{Timestamp: node.Timestamp, Kind: RecordProxy, Key: cluster, Proxy: node})
+	}
+	return self.Append(ResolutionMinute, records)
+}
+
+//存储一次主机采样
+func (self *StatisticsStore) SaveHostStatistics(hosts []HostInfo, timestamp int64) error {
+	records := make([]*StatisticsRecord, 0, len(hosts))
+	for _, host := range hosts {
+		records = append(records, &StatisticsRecord{Timestamp: timestamp, Kind: RecordHost, Key: host.Info.IP, Host: newHostStatistics(host)})
+	}
+	return self.Append(ResolutionMinute, records)
+}
+
+//查询时间段内的记录,按时间排序
+//kind key 为空不过滤,from to 为0不限制
+func (self *StatisticsStore) Query(resolution, kind, key string, from, to int64) ([]*StatisticsRecord, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	records, err := self.query(resolution, kind, key, from, to)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		record.fillDerived()
+	}
+	return records, nil
+}
+
+func (self *StatisticsStore) query(resolution, kind, key string, from, to int64) ([]*StatisticsRecord, error) {
+	fileInfos, err := ioutil.ReadDir(filepath.Join(self.Dir, resolution))
+	if os.IsNotExist(err) {
+		return []*StatisticsRecord{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	layout := periodLayout(resolution)
+	var fromPeriod, toPeriod string
+	if from > 0 {
+		fromPeriod = time.Unix(from, 0).UTC().Format(layout)
+	}
+	if to > 0 {
+		toPeriod = time.Unix(to, 0).UTC().Format(layout)
+	}
+	records := []*StatisticsRecord{}
+	for _, fileInfo := range fileInfos {
+		period := strings.TrimSuffix(fileInfo.Name(), ".jsonl")
+		if fileInfo.IsDir() || len(period) != len(layout) || period == fileInfo.Name() {
+			continue
+		}
+		if (fromPeriod != "" && period < fromPeriod) || (toPeriod != "" && period > toPeriod) {
+			continue
+		}
+		file, err := os.Open(filepath.Join(self.Dir, resolution, fileInfo.Name()))
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			record := &StatisticsRecord{}
+			//跳过写了一半的行
+			if json.Unmarshal(scanner.Bytes(), record) != nil {
+				continue
+			}
+			if (kind != "" && record.Kind != kind) || (key != "" && record.Key != key) {
+				continue
+			}
+			if (from > 0 && record.Timestamp < from) || (to > 0 && record.Timestamp > to) {
+				continue
+			}
+			records = append(records, record)
+		}
+		file.Close()
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp < records[j].Timestamp
+	})
+	return records, nil
+}
+
+//把低精度的记录按时间段合并
+func rollupRecords(records []*StatisticsRecord, seconds int64) []*StatisticsRecord {
+	merged := make(map[string]*StatisticsRecord)
+	var order []string
+	for _, record := range records {
+		timestamp := record.Timestamp - record.Timestamp%seconds
+		id := record.Kind + "|" + record.Key + "|" + strconv.FormatInt(timestamp, 10)
+		item, ok := merged[id]
+		if !ok {
+			item = &StatisticsRecord{Timestamp: timestamp, Kind: record.Kind, Key: record.Key}
+			merged[id] = item
+			order = append(order, id)
+		}
+		item.merge(record)
+		if item.Proxy != nil {
+			item.Proxy.Timestamp = timestamp
+		}
+	}
+	result := make([]*StatisticsRecord, 0, len(order))
+	for _, id := range order {
+		result = append(result, merged[id])
+	}
+	return result
+}
+
+func (self *StatisticsStore) stateFile() string {
+	return filepath.Join(self.Dir, "rollup.json")
+}
+
+//汇总已经结束的小时和天,重启后从上次的进度继续
+func (self *StatisticsStore) Rollup(now time.Time) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	state := &rollupState{}
+	if bts, err := ioutil.ReadFile(self.stateFile()); err == nil {
+		json.Unmarshal(bts, state)
+	}
+	changed := false
+	for _, step := range []struct {
+		from, to string
+		next     *int64
+	}{
+		{ResolutionMinute, ResolutionHour, &state.Hour},
+		{ResolutionHour, ResolutionDay, &state.Day},
+	} {
+		seconds := resolutionSeconds(step.to)
+		current := now.Unix() - rollupDelay
+		end := current - current%seconds
+		if *step.next >= end {
+			continue
+		}
+		records, err := self.query(step.from, "", "", *step.next, end-1)
+		if err != nil {
+			return err
+		}
+		if err := self.append(step.to, rollupRecords(records, seconds)); err != nil {
+			return err
+		}
+		*step.next = end
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	bts, _ := json.Marshal(state)
+	return tools.WriteFileAtomic(self.stateFile(), bts, 0644)
+}
+
+//删除超过保留时间的文件
+func (self *StatisticsStore) Cleanup(now time.Time) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, item := range []struct {
+		dir, resolution string
+		days            int
+	}{
+		{ResolutionMinute, ResolutionMinute, self.Retention.Minute},
+		{ResolutionHour, ResolutionHour, self.Retention.Hour},
+		{ResolutionDay, ResolutionDay, self.Retention.Day},
+		{alertDir, ResolutionMinute, self.Retention.Hour},
+	} {
+		layout := periodLayout(item.resolution)
+		//文件的最后时间早于这个时间段的文件可以删除
+		expired := now.UTC().AddDate(0, 0, -item.days).Format(layout)
+		fileInfos, err := ioutil.ReadDir(filepath.Join(self.Dir, item.dir))
+		if err != nil {
+			continue
+		}
+		for _, fileInfo := range fileInfos {
+			period := strings.TrimSuffix(fileInfo.Name(), ".jsonl")
+			if len(period) == len(layout) && period < expired {
+				if err := os.Remove(filepath.Join(self.Dir, item.dir, fileInfo.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//时间段内每个key的合并数据,精度根据分钟数据的保留时间选择
+func (self *StatisticsStore) Summarize(kind string, from, to int64, now time.Time) (map[string]*StatisticsRecord, error) {
+	resolution := ResolutionMinute
+	if from < now.AddDate(0, 0, -self.Retention.Minute).Unix() {
+		resolution = ResolutionHour
+	}
+	self.mutex.Lock()
+	records, err := self.query(resolution, kind, "", from, to)
+	self.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]*StatisticsRecord)
+	for _, record := range records {
+		item, ok := result[record.Key]
+		if !ok {
+			item = &StatisticsRecord{Timestamp: from, Kind: record.Kind, Key: record.Key}
+			result[record.Key] = item
+		}
+		item.merge(record)
+	}
+	for _, record := range result {
+		if record.Proxy != nil {
+			record.Proxy.Timestamp = from
+		}
+		record.fillDerived()
+	}
+	return result, nil
+}
+
+//钩子脚本触发的报警
+type AlertRecord struct {
+	Timestamp int64
+	Host      string
+	Subject   string
+	Info      string
+}
+
+//报警按天分文件 dir/alert/20060102.jsonl,和小时数据保留相同的天数
+const alertDir = "alert"
+
+//记录一次报警
+func (self *StatisticsStore) SaveAlert(alert *AlertRecord) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	period := time.Unix(alert.Timestamp, 0).UTC().Format(periodLayout(ResolutionMinute))
+	return appendJsonLines(filepath.Join(self.Dir, alertDir, period+".jsonl"), []interface{}{alert})
+}
+
+//查询时间段内的报警,按时间排序
+func (self *StatisticsStore) QueryAlerts(from, to int64) ([]*AlertRecord, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	alerts := []*AlertRecord{}
+	layout := periodLayout(ResolutionMinute)
+	fromPeriod := time.Unix(from, 0).UTC().Format(layout)
+	toPeriod := time.Unix(to, 0).UTC().Format(layout)
+	fileInfos, err := ioutil.ReadDir(filepath.Join(self.Dir, alertDir))
+	if os.IsNotExist(err) {
+		return alerts, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, fileInfo := range fileInfos {
+		period := strings.TrimSuffix(fileInfo.Name(), ".jsonl")
+		if fileInfo.IsDir() || len(period) != len(layout) || period < fromPeriod || period > toPeriod {
+			continue
+		}
+		file, err := os.Open(filepath.Join(self.Dir, alertDir, fileInfo.Name()))
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			alert := &AlertRecord{}
+			if json.Unmarshal(scanner.Bytes(), alert) != nil {
+				continue
+			}
+			if alert.Timestamp >= from && alert.Timestamp <= to {
+				alerts = append(alerts, alert)
+			}
+		}
+		file.Close()
+	}
+	sort.SliceStable(alerts, func(i, j int) bool {
+		return alerts[i].Timestamp < alerts[j].Timestamp
+	})
+	return alerts, nil
+}
+
+//根据时间段选择精度,2天以内分钟,60天以内小时
+func AutoResolution(from, to int64) string {
+	if from <= 0 {
+		return ResolutionHour
+	}
+	if to <= 0 {
+		to = time.Now().Unix()
+	}
+	switch {
+	case to-from <= 2*86400:
+		return ResolutionMinute
+	case to-from <= 60*86400:
+		return ResolutionHour
+	}
+	return ResolutionDay
+}
@@ -0,0 +1,114 @@
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ActivedRouter/gopsutil/mem"
+)
+
+func proxyNode(timestamp int64, requests int, latency float64) *HttpProxyStatistics {
+	node := newHttpProxyStatistics(timestamp, 0)
+	for i := 0; i < requests; i++ {
+		node.record(200, 1, 10, latency)
+	}
+	return node
+}
+
+func TestStatisticsStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "statstore")
+	defer os.RemoveAll(dir)
+	store := NewStatisticsStore(dir, StatisticsRetention{Minute: 1})
+	//2026-10-18 10:00 UTC
+	base := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC).Unix()
+	for minute := int64(0); minute < 120; minute += 30 {
+		store.SaveProxyStatistics(map[string]*HttpProxyStatistics{
+			"www.abc.com":  proxyNode(base+minute*60, 2, 0.01),
+			"www.abcd.com": proxyNode(base+minute*60, 1, 0.5),
+		})
+	}
+	hosts := []HostInfo{{Status: ACTIVE, Info: &SystemInfo{IP: "10.0.0.1", Cluster: "web", VM: &mem.VirtualMemoryStat{UsedPercent: 40}}}}
+	store.SaveHostStatistics(hosts, base+60)
+	hosts[0].Info.VM.UsedPercent = 60
+	store.SaveHostStatistics(hosts, base+120)
+
+	records, err := store.Query(ResolutionMinute, RecordProxy, "www.abc.com", base, base+3599)
+	if err != nil || len(records) != 2 || records[0].Proxy.RequestCount != 2 || records[0].Proxy.LatencyP50 == 0 {
+		t.Fatal("unexpected minute records", err, records)
+	}
+
+	//10:00 and 11:00 finished
+	if err := store.Rollup(time.Unix(base+2*3600+rollupDelay, 0)); err != nil {
+		t.Fatal(err)
+	}
+	//restart,nothing is rolled up twice
+	store = NewStatisticsStore(dir, StatisticsRetention{Minute: 1})
+	store.Rollup(time.Unix(base+2*3600+rollupDelay+60, 0))
+	records, _ = store.Query(ResolutionHour, RecordProxy, "www.abc.com", 0, 0)
+	if len(records) != 2 || records[0].Timestamp != base || records[0].Proxy.RequestCount != 4 || records[1].Proxy.Timestamp != base+3600 {
+		t.Fatal("unexpected hour records", records)
+	}
+	records, _ = store.Query(ResolutionHour, RecordHost, "10.0.0.1", 0, 0)
+	if len(records) != 1 || records[0].Host.Samples != 2 || records[0].Host.Metrics["mem_used_percent"].Avg != 50 ||
+		records[0].Host.Metrics["mem_used_percent"].Max != 60 {
+		t.Fatal("unexpected host records", records)
+	}
+
+	//the day is finished
+	store.Rollup(time.Unix(base+86400+rollupDelay, 0))
+	records, _ = store.Query(ResolutionDay, RecordProxy, "www.abcd.com", 0, 0)
+	if len(records) != 1 || records[0].Proxy.RequestCount != 4 || records[0].Proxy.LatencyP99 != 0.5 {
+		t.Fatal("unexpected day records", records)
+	}
+
+	//minute data is kept for 1 day
+	store.Cleanup(time.Unix(base+3*86400, 0))
+	if _, err := os.Stat(filepath.Join(dir, ResolutionMinute, "20261018.jsonl")); !os.IsNotExist(err) {
+		t.Fatal("expired minute data kept")
+	}
+	if records, _ = store.Query(ResolutionHour, "", "", 0, 0); len(records) != 5 {
+		t.Fatal("hour data removed", len(records))
+	}
+}
+
+func TestAutoResolution(t *testing.T) {
+	if AutoResolution(1000, 1000+3600) != ResolutionMinute || AutoResolution(1000, 1000+7*86400) != ResolutionHour ||
+		AutoResolution(1000, 1000+365*86400) != ResolutionDay {
+		t.Fatal("unexpected resolution")
+	}
+}
+
+func TestSummarizeAndAlerts(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "statstore")
+	defer os.RemoveAll(dir)
+	store := NewStatisticsStore(dir, StatisticsRetention{Minute: 1})
+	base := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC).Unix()
+	store.SaveProxyStatistics(map[string]*HttpProxyStatistics{"www.abc.com": proxyNode(base, 2, 0.01)})
+	store.SaveProxyStatistics(map[string]*HttpProxyStatistics{"www.abc.com": proxyNode(base+60, 3, 0.01)})
+	store.SaveAlert(&AlertRecord{Timestamp: base + 30, Host: "10.0.0.1", Subject: "disk"})
+	store.SaveAlert(&AlertRecord{Timestamp: base + 90000, Host: "10.0.0.1", Subject: "cpu"})
+
+	summary, err := store.Summarize(RecordProxy, base, base+3599, time.Unix(base+3600, 0))
+	if err != nil || len(summary) != 1 || summary["www.abc.com"].Proxy.RequestCount != 5 {
+		t.Fatal("unexpected summary", err, summary)
+	}
+	//older than the minute data,read from the hour data
+	store.Rollup(time.Unix(base+3600+rollupDelay, 0))
+	summary, _ = store.Summarize(RecordProxy, base, base+3599, time.Unix(base+3*86400, 0))
+	if summary["www.abc.com"].Proxy.RequestCount != 5 {
+		t.Fatal("unexpected hour summary", summary)
+	}
+
+	alerts, err := store.QueryAlerts(base, base+86399)
+	if err != nil || len(alerts) != 1 || alerts[0].Subject != "disk" {
+		t.Fatal("unexpected alerts", err, alerts)
+	}
+	//alerts are kept as long as the hour data
+	store.Cleanup(time.Unix(base+3*86400, 0))
+	if alerts, _ = store.QueryAlerts(base, base+86399); len(alerts) != 1 {
+		t.Fatal("alerts removed", alerts)
+	}
+}
@@ -0,0 +1,239 @@
+package system
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+//统计的维度
+const (
+	TopKClient    = "client"
+	TopKPath      = "path"
+	TopKUserAgent = "user_agent"
+	TopKReferer   = "referer"
+)
+
+var TopKDimensions = []string{TopKClient, TopKPath, TopKUserAgent, TopKReferer}
+
+//过长的值截断,避免超长的路径或UA占用内存
+const topKMaxKeyLength = 256
+
+//热点项,真实次数在 Count-Error 到 Count 之间
+type TopKItem struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+	Error int64  `json:"error"`
+}
+
+//Space-Saving 算法,最多保留 capacity 个计数器
+//次数超过 总数/capacity 的项一定在结果中
+type SpaceSaving struct {
+	capacity int
+	items    []*TopKItem //按Count的最小堆
+	index    map[string]int
+}
+
+func NewSpaceSaving(capacity int) *SpaceSaving {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &SpaceSaving{capacity: capacity, index: make(map[string]int)}
+}
+
+//记录一次
+func (self *SpaceSaving) Observe(key string) {
+	self.add(key, 1, 0)
+}
+
+func (self *SpaceSaving) add(key string, count, errCount int64) {
+	if len(key) > topKMaxKeyLength {
+		key = key[:topKMaxKeyLength]
+	}
+	if i, ok := self.index[key]; ok {
+		self.items[i].Count += count
+		self.items[i].Error += errCount
+		self.down(i)
+		return
+	}
+	if len(self.items) < self.capacity {
+		self.items = append(self.items, &TopKItem{Key: key, Count: count, Error: errCount})
+		self.index[key] = len(self.items) - 1
+		self.up(len(self.items) - 1)
+		return
+	}
+	//替换次数最少的项,它的次数作为新项的误差
+	min := self.items[0]
+	delete(self.index, min.Key)
+	self.items[0] = &TopKItem{Key: key, Count: min.Count + count, Error: min.Count + errCount}
+	self.index[key] = 0
+	self.down(0)
+}
+
+//合并另一个统计,结果仍是近似值
+func (self *SpaceSaving) Merge(other *SpaceSaving) {
+	if other == nil {
+		return
+	}
+	for _, item := range other.items {
+		self.add(item.Key, item.Count, item.Error)
+	}
+}
+
+//次数最多的n项,n<=0时返回全部
+func (self *SpaceSaving) Top(n int) []TopKItem {
+	result := make([]TopKItem, 0, len(self.items))
+	for _, item := range self.items {
+		result = append(result, *item)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Key < result[j].Key
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+func (self *SpaceSaving) less(i, j int) bool {
+	return self.items[i].Count < self.items[j].Count
+}
+
+func (self *SpaceSaving) swap(i, j int) {
+	self.items[i], self.items[j] = self.items[j], self.items[i]
+	self.index[self.items[i].Key] = i
+	self.index[self.items[j].Key] = j
+}
+
+func (self *SpaceSaving) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if !self.less(i, parent) {
+			return
+		}
+		self.swap(i, parent)
+		i = parent
+	}
+}
+
+func (self *SpaceSaving) down(i int) {
+	for {
+		smallest := i
+		left, right := 2*i+1, 2*i+2
+		if left < len(self.items) && self.less(left, smallest) {
+			smallest = left
+		}
+		if right < len(self.items) && self.less(right, smallest) {
+			smallest = right
+		}
+		if smallest == i {
+			return
+		}
+		self.swap(i, smallest)
+		i = smallest
+	}
+}
+
+//一分钟内一个域名各维度的统计
+type topKWindow struct {
+	minute   int64
+	sketches map[string]*SpaceSaving
+}
+
+//按分钟滚动的热点统计,每个域名保留最近 windows 分钟
+//内存上限为 域名数*windows*维度数*capacity 个计数器,与请求的基数无关
+type TrafficTopK struct {
+	mutex    sync.Mutex
+	capacity int
+	windows  int
+	domains  map[string][]*topKWindow
+}
+
+func NewTrafficTopK(capacity, windows int) *TrafficTopK {
+	if windows < 1 {
+		windows = 1
+	}
+	return &TrafficTopK{capacity: capacity, windows: windows, domains: make(map[string][]*topKWindow)}
+}
+
+//记录一次请求,values 是维度 => 值
+func (self *TrafficTopK) Observe(domain string, now time.Time, values map[string]string) {
+	minute := now.Unix() / 60
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	ring, ok := self.domains[domain]
+	if !ok {
+		ring = make([]*topKWindow, self.windows)
+		self.domains[domain] = ring
+	}
+	slot := int(minute % int64(self.windows))
+	window := ring[slot]
+	if window == nil || window.minute != minute {
+		window = &topKWindow{minute: minute, sketches: make(map[string]*SpaceSaving)}
+		ring[slot] = window
+	}
+	for dimension, value := range values {
+		if value == "" {
+			continue
+		}
+		sketch, ok := window.sketches[dimension]
+		if !ok {
+			sketch = NewSpaceSaving(self.capacity)
+			window.sketches[dimension] = sketch
+		}
+		sketch.Observe(value)
+	}
+}
+
+//最近 minutes 分钟的热点,domain为空时返回所有域名
+//结果是 域名 => 维度 => 前n项
+func (self *TrafficTopK) Top(domain, dimension string, minutes, n int, now time.Time) map[string]map[string][]TopKItem {
+	if minutes < 1 || minutes > self.windows {
+		minutes = self.windows
+	}
+	last := now.Unix() / 60
+	first := last - int64(minutes) + 1
+	result := make(map[string]map[string][]TopKItem)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for name, ring := range self.domains {
+		if domain != "" && name != domain {
+			continue
+		}
+		merged := make(map[string]*SpaceSaving)
+		for _, window := range ring {
+			if window == nil || window.minute < first || window.minute > last {
+				continue
+			}
+			for dim, sketch := range window.sketches {
+				if dimension != "" && dim != dimension {
+					continue
+				}
+				if _, ok := merged[dim]; !ok {
+					merged[dim] = NewSpaceSaving(self.capacity)
+				}
+				merged[dim].Merge(sketch)
+			}
+		}
+		tops := make(map[string][]TopKItem)
+		for dim, sketch := range merged {
+			tops[dim] = sketch.Top(n)
+		}
+		result[name] = tops
+	}
+	return result
+}
+
+//删除不再代理的域名
+func (self *TrafficTopK) Retain(domains map[string]bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for name := range self.domains {
+		if !domains[name] {
+			delete(self.domains, name)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package system
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSpaceSavingHeavyHitters(t *testing.T) {
+	sketch := NewSpaceSaving(10)
+	for i := 0; i < 10000; i++ {
+		//a b c are heavy,the rest is a long tail of distinct keys
+		switch i % 10 {
+		case 0, 1, 2:
+			sketch.Observe("a")
+		case 3, 4:
+			sketch.Observe("b")
+		case 5:
+			sketch.Observe("c")
+		default:
+			sketch.Observe(fmt.Sprintf("tail-%d", i))
+		}
+	}
+	if len(sketch.items) != 10 {
+		t.Fatalf("counters %d,want 10", len(sketch.items))
+	}
+	top := sketch.Top(3)
+	for i, key := range []string{"a", "b", "c"} {
+		want := int64(1000 * (3 - i))
+		//the true count lies between Count-Error and Count
+		if top[i].Key != key || top[i].Count < want || top[i].Count-top[i].Error > want {
+			t.Fatalf("top %v", top)
+		}
+	}
+}
+
+func TestSpaceSavingMerge(t *testing.T) {
+	a, b := NewSpaceSaving(5), NewSpaceSaving(5)
+	for i := 0; i < 100; i++ {
+		a.Observe("x")
+		b.Observe("x")
+		b.Observe("y")
+	}
+	a.Merge(b)
+	top := a.Top(0)
+	if len(top) != 2 || top[0].Key != "x" || top[0].Count != 200 || top[1].Count != 100 {
+		t.Fatalf("merged %v", top)
+	}
+}
+
+func TestTrafficTopKWindows(t *testing.T) {
+	topk := NewTrafficTopK(10, 5)
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < 10; i++ {
+		//one request per minute over ten minutes,only the last five are kept
+		topk.Observe("a.com", now.Add(time.Duration(i)*time.Minute), map[string]string{
+			TopKClient: "10.0.0.1",
+			TopKPath:   fmt.Sprintf("/p%d", i%2),
+		})
+	}
+	topk.Observe("b.com", now, map[string]string{TopKClient: "10.0.0.2"})
+	last := now.Add(9 * time.Minute)
+	result := topk.Top("a.com", "", 0, 0, last)
+	if _, ok := result["b.com"]; ok {
+		t.Fatal("domain filter ignored")
+	}
+	if items := result["a.com"][TopKClient]; len(items) != 1 || items[0].Count != 5 {
+		t.Fatalf("clients %v", items)
+	}
+	if items := result["a.com"][TopKPath]; len(items) != 2 {
+		t.Fatalf("paths %v", items)
+	}
+	result = topk.Top("a.com", TopKClient, 2, 0, last)
+	if items := result["a.com"][TopKClient]; items[0].Count != 2 || len(result["a.com"]) != 1 {
+		t.Fatalf("window %v", result)
+	}
+	topk.Retain(map[string]bool{"a.com": true})
+	if _, ok := topk.Top("", "", 0, 0, last)["b.com"]; ok {
+		t.Fatal("b.com kept")
+	}
+}
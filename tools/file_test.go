@@ -0,0 +1,33 @@
+package tools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "atomic")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "http_proxy.json")
+	ioutil.WriteFile(file, []byte("old"), 0644)
+	if err := WriteFileAtomic(file, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if bts, _ := ioutil.ReadFile(file); string(bts) != "new" {
+		t.Fatal("unexpected content", string(bts))
+	}
+	//no temp file left
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 1 {
+		t.Fatal("temp file left", len(infos))
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	diff := DiffLines("a\nb\nc", "a\nc\nd")
+	if strings.Join(diff, "|") != "  a|- b|  c|+ d" {
+		t.Fatal(diff)
+	}
+}